@@ -2,12 +2,17 @@ package cluster
 
 import (
 	"bytes"
-	"cmp"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/rs/zerolog"
 	"github.com/semafind/semadb/models"
 	"github.com/semafind/semadb/utils"
 )
@@ -19,7 +24,7 @@ func (c *ClusterNode) CreateCollection(collection models.Collection) error {
 	rpcReq := RPCCreateCollectionRequest{
 		RPCRequestArgs: RPCRequestArgs{
 			Source: c.MyHostname,
-			Dest:   RendezvousHash(collection.UserId, c.Servers, 1)[0],
+			Dest:   c.placement(collection.UserId, 1)[0],
 		},
 		Collection: collection,
 	}
@@ -27,6 +32,9 @@ func (c *ClusterNode) CreateCollection(collection models.Collection) error {
 	if err := c.RPCCreateCollection(&rpcReq, &rpcResp); err != nil {
 		return fmt.Errorf("could not create collection: %w", err)
 	}
+	if len(rpcResp.Problems) > 0 {
+		return &ValidationError{Problems: rpcResp.Problems}
+	}
 	if rpcResp.AlreadyExists {
 		return ErrExists
 	}
@@ -42,7 +50,7 @@ func (c *ClusterNode) ListCollections(userId string) ([]models.Collection, error
 	rpcReq := RPCListCollectionsRequest{
 		RPCRequestArgs: RPCRequestArgs{
 			Source: c.MyHostname,
-			Dest:   RendezvousHash(userId, c.Servers, 1)[0],
+			Dest:   c.placement(userId, 1)[0],
 		},
 		UserId: userId,
 	}
@@ -59,7 +67,7 @@ func (c *ClusterNode) GetCollection(userId string, collectionId string) (models.
 	rpcReq := RPCGetCollectionRequest{
 		RPCRequestArgs: RPCRequestArgs{
 			Source: c.MyHostname,
-			Dest:   RendezvousHash(userId, c.Servers, 1)[0],
+			Dest:   c.placement(userId, 1)[0],
 		},
 		UserId:       userId,
 		CollectionId: collectionId,
@@ -77,9 +85,10 @@ func (c *ClusterNode) GetCollection(userId string, collectionId string) (models.
 }
 
 type shardInfo struct {
-	Id         string
-	Size       int64
-	PointCount int64
+	Id            string
+	Size          int64
+	PointCount    int64
+	LastWriteTime int64
 }
 
 func (c *ClusterNode) GetShardsInfo(col models.Collection) ([]shardInfo, error) {
@@ -87,7 +96,7 @@ func (c *ClusterNode) GetShardsInfo(col models.Collection) ([]shardInfo, error)
 	shards := make([]shardInfo, 0, len(col.ShardIds))
 	for _, shardId := range col.ShardIds {
 		// ---------------------------
-		targetServer := RendezvousHash(shardId, c.Servers, 1)[0]
+		targetServer := c.placement(shardId, 1)[0]
 		getInfoRequest := RPCGetShardInfoRequest{
 			RPCRequestArgs: RPCRequestArgs{
 				Source: c.MyHostname,
@@ -103,9 +112,10 @@ func (c *ClusterNode) GetShardsInfo(col models.Collection) ([]shardInfo, error)
 		}
 		// ---------------------------
 		si := shardInfo{
-			Id:         shardId,
-			Size:       getInfoResponse.Size,
-			PointCount: getInfoResponse.PointCount,
+			Id:            shardId,
+			Size:          getInfoResponse.Size,
+			PointCount:    getInfoResponse.PointCount,
+			LastWriteTime: getInfoResponse.LastWriteTime,
 		}
 		shards = append(shards, si)
 	}
@@ -115,34 +125,150 @@ func (c *ClusterNode) GetShardsInfo(col models.Collection) ([]shardInfo, error)
 
 // ---------------------------
 
-func (c *ClusterNode) DeleteCollection(col models.Collection) ([]string, error) {
+/* Deciding when to split or merge the shards of a collection needs a view of
+ * all of them at once. Unlike GetShardsInfo, a shard whose server cannot be
+ * reached does not fail the whole listing, it is reported as unavailable so
+ * the rest of the collection can still be inspected. */
+
+// ShardInfo describes a shard of a collection and the server hosting it.
+type ShardInfo struct {
+	Id       string
+	Hostname string
+	// Available is false if the hosting server could not report on the shard,
+	// the sizes are then zero and Err holds the reason
+	Available     bool
+	Err           string
+	Size          int64
+	PointCount    int64
+	LastWriteTime int64
+}
+
+// GetCollectionShardInfos returns the information of every shard of the
+// collection in the order of its shard ids.
+func (c *ClusterNode) GetCollectionShardInfos(userId, collectionId string) ([]ShardInfo, error) {
+	col, err := c.GetCollection(userId, collectionId)
+	if err != nil {
+		return nil, fmt.Errorf("could not get collection %s: %w", collectionId, err)
+	}
+	// ---------------------------
+	infos := make([]ShardInfo, len(col.ShardIds))
+	var wg sync.WaitGroup
+	for i, shardId := range col.ShardIds {
+		wg.Add(1)
+		go func(i int, sId string) {
+			defer wg.Done()
+			targetServer := c.placement(sId, 1)[0]
+			getInfoRequest := RPCGetShardInfoRequest{
+				RPCRequestArgs: RPCRequestArgs{
+					Source: c.MyHostname,
+					Dest:   targetServer,
+				},
+				Collection: col,
+				ShardId:    sId,
+			}
+			getInfoResponse := RPCGetShardInfoResponse{}
+			// Each goroutine writes to its own entry so no lock is needed
+			infos[i] = ShardInfo{Id: sId, Hostname: targetServer}
+			if err := c.RPCGetShardInfo(&getInfoRequest, &getInfoResponse); err != nil {
+				c.logger.Error().Err(err).Str("userId", userId).Str("collectionId", collectionId).Str("shardId", sId).Str("targetServer", targetServer).Msg("could not get shard info")
+				infos[i].Err = fmt.Errorf("%w: %w", ErrShardUnavailable, err).Error()
+				return
+			}
+			infos[i].Available = true
+			infos[i].Size = getInfoResponse.Size
+			infos[i].PointCount = getInfoResponse.PointCount
+			infos[i].LastWriteTime = getInfoResponse.LastWriteTime
+		}(i, shardId)
+	}
+	wg.Wait()
+	// ---------------------------
+	return infos, nil
+}
+
+// ---------------------------
+
+/* Shards are loaded on first use so the first request after a shard has been
+ * unloaded pays for opening it and reading the graph from disk. WarmShard lets
+ * us do that ahead of a known traffic spike. The shard directory is relative
+ * to the user collections directory, i.e. userId/collectionId/shardId, or the
+ * absolute directory the shard manager uses. */
+
+// WarmShard loads the shard in the given directory and the top of its graph
+// indexes into memory.
+func (c *ClusterNode) WarmShard(shardDir string) error {
+	root := filepath.Join(c.cfg.ShardManager.RootDir, "userCollections")
+	if filepath.IsAbs(shardDir) {
+		rel, err := filepath.Rel(root, shardDir)
+		if err != nil {
+			return fmt.Errorf("could not resolve shard directory %s: %w", shardDir, err)
+		}
+		shardDir = rel
+	}
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(shardDir)), "/")
+	if len(parts) != 3 || slices.Contains(parts, "..") {
+		return fmt.Errorf("invalid shard directory %s, expected userId/collectionId/shardId", shardDir)
+	}
+	userId, collectionId, shardId := parts[0], parts[1], parts[2]
+	// ---------------------------
+	col, err := c.GetCollection(userId, collectionId)
+	if err != nil {
+		return fmt.Errorf("could not get collection of shard %s: %w", shardDir, err)
+	}
+	if col.Ephemeral {
+		return fmt.Errorf("ephemeral shard %s has nothing on disk to warm", shardDir)
+	}
+	// Only shards stored on this node can be warmed, otherwise loading would
+	// create an empty shard here
+	if _, err := os.Stat(filepath.Join(root, userId, collectionId, shardId)); err != nil {
+		return fmt.Errorf("shard %s is not stored on this node: %w", shardDir, ErrNotFound)
+	}
+	loaded, err := c.shardManager.WarmShard(col, shardId)
+	if err != nil {
+		return fmt.Errorf("could not warm shard %s: %w", shardDir, err)
+	}
+	c.logger.Debug().Str("shardDir", shardDir).Int("loaded", loaded).Msg("WarmShard")
+	return nil
+}
+
+// ---------------------------
+
+// DeleteCollection deletes the collection entry and then the shards of the
+// collection on every server that holds a replica of them. It returns the ids
+// of the deleted shards and the error of each shard that could not be deleted,
+// the collection is deleted regardless.
+func (c *ClusterNode) DeleteCollection(col models.Collection) ([]string, map[string]string, error) {
 	// ---------------------------
 	// Delete the collection entry first
 	deleteColReq := RPCDeleteCollectionRequest{
 		RPCRequestArgs: RPCRequestArgs{
 			Source: c.MyHostname,
-			Dest:   RendezvousHash(col.UserId, c.Servers, 1)[0],
+			Dest:   c.placement(col.UserId, 1)[0],
 		},
 		Collection: col,
 	}
 	if err := c.RPCDeleteCollection(&deleteColReq, &RPCDeleteCollectionResponse{}); err != nil {
-		return nil, fmt.Errorf("could not delete collection: %w", err)
+		return nil, nil, fmt.Errorf("could not delete collection: %w", err)
 	}
 	// ---------------------------
-	// Delete all shards as a best effort service
-	targetServers := make([]string, 0, len(col.ShardIds))
+	// Delete all shards as a best effort service, each server deletes all the
+	// shards of the collection it has so we contact it once
+	serverShardIds := make(map[string][]string)
 	for _, shardId := range col.ShardIds {
-		targetServers = append(targetServers, RendezvousHash(shardId, c.Servers, 1)[0])
+		for _, server := range c.placement(shardId, max(int(col.Replicas), 1)) {
+			serverShardIds[server] = append(serverShardIds[server], shardId)
+		}
 	}
 	// ---------------------------
 	// Contact all shard servers
-	deletedShardIds := make([]string, 0, len(col.ShardIds))
+	// Replicas of a shard report the same id
+	deletedSet := make(map[string]struct{}, len(col.ShardIds))
+	shardErrors := make(map[string]string)
 	var wg sync.WaitGroup
 	var mu sync.Mutex
-	for _, targetServer := range targetServers {
+	for targetServer, shardIds := range serverShardIds {
 		wg.Add(1)
 		// ---------------------------
-		go func(tServer string) {
+		go func(tServer string, shardIds []string) {
 			deleteShardRequest := RPCDeleteCollectionShardsRequest{
 				RPCRequestArgs: RPCRequestArgs{
 					Source: c.MyHostname,
@@ -151,20 +277,36 @@ func (c *ClusterNode) DeleteCollection(col models.Collection) ([]string, error)
 				Collection: col,
 			}
 			deleteShardResponse := RPCDeleteCollectionShardsResponse{}
-			if err := c.RPCDeleteCollectionShards(&deleteShardRequest, &deleteShardResponse); err != nil {
+			err := c.RPCDeleteCollectionShards(&deleteShardRequest, &deleteShardResponse)
+			mu.Lock()
+			if err != nil {
 				c.logger.Error().Err(err).Str("userId", col.UserId).Str("collectionId", col.Id).Msg("Could not delete collection shards")
+				for _, sId := range shardIds {
+					shardErrors[sId] = err.Error()
+				}
 			} else {
-				mu.Lock()
-				deletedShardIds = append(deletedShardIds, deleteShardResponse.DeletedShardIds...)
-				mu.Unlock()
+				for _, sId := range deleteShardResponse.DeletedShardIds {
+					deletedSet[sId] = struct{}{}
+				}
+				for sId, sErr := range deleteShardResponse.ShardErrors {
+					shardErrors[sId] = sErr
+				}
 			}
+			mu.Unlock()
 			wg.Done()
-		}(targetServer)
+		}(targetServer, shardIds)
 		// ---------------------------
 	}
 	wg.Wait()
 	// ---------------------------
-	return deletedShardIds, nil
+	deletedShardIds := make([]string, 0, len(deletedSet))
+	for sId := range deletedSet {
+		if _, failed := shardErrors[sId]; !failed {
+			deletedShardIds = append(deletedShardIds, sId)
+		}
+	}
+	slices.Sort(deletedShardIds)
+	return deletedShardIds, shardErrors, nil
 }
 
 // ---------------------------
@@ -176,12 +318,15 @@ type FailedRange struct {
 	Err     string `json:"error"`
 }
 
-func (c *ClusterNode) InsertPoints(col models.Collection, points []models.Point) ([]FailedRange, error) {
+// InsertPoints distributes the points to the shards of the collection and
+// returns the ranges that failed together with the shard each inserted point
+// landed in.
+func (c *ClusterNode) InsertPoints(col models.Collection, points []models.Point) ([]FailedRange, map[uuid.UUID]string, error) {
 	// ---------------------------
 	// This is where shard distribution happens
 	shards, err := c.GetShardsInfo(col)
 	if err != nil {
-		return nil, fmt.Errorf("could not get shards: %w", err)
+		return nil, nil, fmt.Errorf("could not get shards: %w", err)
 	}
 	// ---------------------------
 	// Check collection quota
@@ -190,7 +335,7 @@ func (c *ClusterNode) InsertPoints(col models.Collection, points []models.Point)
 		totalPoints += shard.PointCount
 	}
 	if totalPoints+int64(len(points)) > col.UserPlan.MaxCollectionPointCount {
-		return nil, ErrQuotaReached
+		return nil, nil, ErrQuotaReached
 	}
 	// ---------------------------
 	// Sort points based on their ID. This helps with inserting in order to the B+ tree downstream.
@@ -205,7 +350,7 @@ func (c *ClusterNode) InsertPoints(col models.Collection, points []models.Point)
 		rpcRequest := RPCCreateShardRequest{
 			RPCRequestArgs: RPCRequestArgs{
 				Source: c.MyHostname,
-				Dest:   RendezvousHash(col.UserId, c.Servers, 1)[0],
+				Dest:   c.placement(col.UserId, 1)[0],
 			},
 			UserId:       col.UserId,
 			CollectionId: col.Id,
@@ -218,38 +363,63 @@ func (c *ClusterNode) InsertPoints(col models.Collection, points []models.Point)
 		return rpcResponse.ShardId, nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("could not distribute points: %w", err)
+		return nil, nil, fmt.Errorf("could not distribute points: %w", err)
 	}
 	// ---------------------------
 	// Insert points
 	failedRanges := make([]FailedRange, 0)
+	pointShards := make(map[uuid.UUID]string, len(points))
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 	for shardId, pointRange := range shardAssignments {
 		wg.Add(1)
 		go func(sId string, pRange [2]int) {
 			// ---------------------------
-			targetServer := RendezvousHash(sId, c.Servers, 1)[0]
-			shardPoints := points[pRange[0]:pRange[1]]
-			insertReq := RPCInsertPointsRequest{
-				RPCRequestArgs: RPCRequestArgs{
-					Source: c.MyHostname,
-					Dest:   targetServer,
-				},
-				Collection: col,
-				ShardId:    sId,
-				Points:     shardPoints,
-			}
-			insertResp := RPCInsertPointsResponse{}
-			if err := c.RPCInsertPoints(&insertReq, &insertResp); err != nil {
-				c.logger.Error().Err(err).Str("userId", col.UserId).Str("collectionId", col.Id).Str("shardId", sId).Msg("could not insert points")
-				mu.Lock()
-				failedRanges = append(failedRanges, FailedRange{
-					ShardId: sId,
-					Start:   pRange[0],
-					End:     pRange[1],
-					Err:     err.Error(),
+			targetServers := c.placement(sId, max(int(col.Replicas), 1))
+			/* Large inserts are sent in chunks so that neither side has to
+			 * encode or hold the entire set of points of the shard in a single
+			 * message. The chunks are inserted in order and we stop at the first
+			 * failure, reporting the rest of the range as failed. */
+			for _, chunk := range chunkRange(pRange, c.cfg.InsertChunkSize) {
+				chunkPoints := points[chunk[0]:chunk[1]]
+				// Makes retries of the chunk safe if an attempt was applied
+				idempotencyKey := uuid.NewString()
+				writeTime := time.Now().UnixNano()
+				replicaResults, err := c.writeReplicasDetailed(targetServers, c.cfg.WriteConsistency, func(server string) error {
+					insertReq := RPCInsertPointsRequest{
+						RPCRequestArgs: RPCRequestArgs{
+							Source: c.MyHostname,
+							Dest:   server,
+						},
+						Collection:     col,
+						ShardId:        sId,
+						Points:         chunkPoints,
+						IdempotencyKey: idempotencyKey,
+						WriteTime:      writeTime,
+					}
+					return c.RPCInsertPoints(&insertReq, &RPCInsertPointsResponse{})
 				})
+				if err != nil {
+					// Which replicas failed or were slow to answer
+					replicas := zerolog.Dict()
+					for server, res := range replicaResults {
+						replicas.Str(server, res.String())
+					}
+					c.logger.Error().Err(err).Str("userId", col.UserId).Str("collectionId", col.Id).Str("shardId", sId).Dict("replicas", replicas).Msg("could not insert points")
+					mu.Lock()
+					failedRanges = append(failedRanges, FailedRange{
+						ShardId: sId,
+						Start:   chunk[0],
+						End:     pRange[1],
+						Err:     err.Error(),
+					})
+					mu.Unlock()
+					break
+				}
+				mu.Lock()
+				for _, p := range chunkPoints {
+					pointShards[p.Id] = sId
+				}
 				mu.Unlock()
 			}
 			wg.Done()
@@ -259,7 +429,21 @@ func (c *ClusterNode) InsertPoints(col models.Collection, points []models.Point)
 	// Wait for all insertions to finish
 	wg.Wait()
 	// ---------------------------
-	return failedRanges, nil
+	if col.PointShardIndex && len(pointShards) > 0 {
+		ids := make([]uuid.UUID, 0, len(pointShards))
+		shardIds := make([]string, 0, len(pointShards))
+		for id, sId := range pointShards {
+			ids = append(ids, id)
+			shardIds = append(shardIds, sId)
+		}
+		// The points are inserted regardless, without an entry they are
+		// found by asking every shard.
+		if err := c.setPointShards(col, ids, shardIds); err != nil {
+			c.logger.Error().Err(err).Str("userId", col.UserId).Str("collectionId", col.Id).Msg("could not record point shards")
+		}
+	}
+	// ---------------------------
+	return failedRanges, pointShards, nil
 }
 
 // These are the parameters for the linear approximation of the inverse of the
@@ -270,7 +454,18 @@ func (c *ClusterNode) InsertPoints(col models.Collection, points []models.Point)
 const poissonApproxA = 1.42
 const poissonApproxB = 10.0
 
-func (c *ClusterNode) SearchPoints(col models.Collection, sr models.SearchRequest) ([]models.SearchResult, error) {
+// SearchPoints searches every shard of the collection in parallel and merges
+// the results. Shards that fail are left out and counted so the caller can
+// warn about possibly incomplete results, it only errors if every shard fails.
+func (c *ClusterNode) SearchPoints(col models.Collection, sr models.SearchRequest) ([]models.SearchResult, int, error) {
+	return c.SearchPointsAfter(col, sr, 0)
+}
+
+// SearchPointsAfter is like SearchPoints but only searches shard replicas that
+// have applied the writes up to minWriteTime, e.g. the last write time of the
+// client to read its own writes. Shards without such a replica count as
+// failed, see readServer.
+func (c *ClusterNode) SearchPointsAfter(col models.Collection, sr models.SearchRequest, minWriteTime int64) ([]models.SearchResult, int, error) {
 	// ---------------------------
 	/* Here we calculate the target limit for each shard. We want to reduce the
 	 * number of points discarded. For example, 5 chards with a limit of 100
@@ -308,72 +503,62 @@ func (c *ClusterNode) SearchPoints(col models.Collection, sr models.SearchReques
 	}
 	// ---------------------------
 	/* Search every shard in parallel. If a shard is unavailable, we will simply
-	 * ignore it for now to keep the search request alive. This is not a major
-	 * problem especially for approximate nearest neighbour based search
-	 * requests. */
-	results := make([]models.SearchResult, 0, len(col.ShardIds)*10)
+	 * ignore it to keep the search request alive. This is not a major problem
+	 * especially for approximate nearest neighbour based search requests. */
+	shardResults := make([][]models.SearchResult, 0, len(col.ShardIds))
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var searchErr error
-	var errOnce sync.Once
+	failedShards := 0
 	for _, shardId := range col.ShardIds {
 		wg.Add(1)
 		go func(sId string) {
 			defer wg.Done()
-			targetServer := RendezvousHash(sId, c.Servers, 1)[0]
+			searchResp := RPCSearchPointsResponse{}
+			targetServer, err := c.readServer(col, sId, minWriteTime)
 			// ---------------------------
-			searchReq := RPCSearchPointsRequest{
-				RPCRequestArgs: RPCRequestArgs{
-					Source: c.MyHostname,
-					Dest:   targetServer,
-				},
-				Collection:    col,
-				ShardId:       sId,
-				SearchRequest: sr,
+			if err == nil {
+				searchReq := RPCSearchPointsRequest{
+					RPCRequestArgs: RPCRequestArgs{
+						Source: c.MyHostname,
+						Dest:   targetServer,
+					},
+					Collection:    col,
+					ShardId:       sId,
+					SearchRequest: sr,
+				}
+				err = c.RPCSearchPoints(&searchReq, &searchResp)
 			}
-			searchResp := RPCSearchPointsResponse{}
-			if err := c.RPCSearchPoints(&searchReq, &searchResp); err != nil {
-				errOnce.Do(func() {
-					// If we encounter an error, we only want to report it once.
+			if err != nil {
+				mu.Lock()
+				// We only report the first error in case every shard fails
+				if searchErr == nil {
 					searchErr = fmt.Errorf("shard could not search points: %w", err)
-				})
+				}
+				failedShards++
+				mu.Unlock()
 				c.logger.Error().Err(err).Str("userId", col.UserId).Str("collectionId", col.Id).Str("shardId", sId).Msg("could not search points")
 			} else {
-				// Alternatively we can stream the results into a channel and
-				// loop over. This is more straightforward for now.
 				mu.Lock()
-				results = append(results, searchResp.Points...)
+				shardResults = append(shardResults, searchResp.Points)
 				mu.Unlock()
 			}
 		}(shardId)
 	}
 	// ---------------------------
 	wg.Wait()
-	if searchErr != nil {
-		return nil, searchErr
-	}
-	if len(col.ShardIds) > 1 {
-		// Merge results in a single slice. We could instead use a channel to stream
-		// and merge results on the go but that adds more complexity which could be
-		// future work.
-		if len(sr.Sort) == 0 {
-			slices.SortFunc(results, func(a, b models.SearchResult) int {
-				return cmp.Compare(b.HybridScore, a.HybridScore)
-			})
-		} else {
-			// We have to sort the results based on the sort options. This is a
-			// multi-level sort. We first sort based on the first sort option, then
-			// the second and so on.
-			utils.SortSearchResults(results, sr.Sort)
-		}
-	} // End of merge
-	// ---------------------------
-	// Take the top limit points
-	if len(results) > originalLimit {
-		results = results[:originalLimit]
+	if failedShards > 0 && failedShards == len(col.ShardIds) {
+		return nil, failedShards, searchErr
 	}
+	/* Each shard returns its results in order so we merge them into the top
+	 * limit points rather than sorting all of them, see MergeSearchResults. */
+	compare := utils.CompareHybridScore
+	if len(sr.Sort) > 0 {
+		compare = utils.CompareSearchResults(sr.Sort)
+	}
+	results := utils.MergeSearchResults(shardResults, originalLimit, compare)
 	// ---------------------------
-	return results, nil
+	return results, failedShards, nil
 }
 
 // ---------------------------
@@ -401,22 +586,26 @@ func (c *ClusterNode) UpdatePoints(col models.Collection, points []models.Point)
 		wg.Add(1)
 		go func(sId string) {
 			defer wg.Done()
-			targetServer := RendezvousHash(sId, c.Servers, 1)[0]
-			updateReq := RPCUpdatePointsRequest{
-				RPCRequestArgs: RPCRequestArgs{
-					Source: c.MyHostname,
-					Dest:   targetServer,
-				},
-				Collection: col,
-				ShardId:    sId,
-				Points:     points,
-			}
-			updateResp := RPCUpdatePointsResponse{}
-			if err := c.RPCUpdatePoints(&updateReq, &updateResp); err != nil {
+			updatedIds, err := c.writeShardReplicas(col, sId, func(server string, writeTime int64) ([]uuid.UUID, error) {
+				updateReq := RPCUpdatePointsRequest{
+					RPCRequestArgs: RPCRequestArgs{
+						Source: c.MyHostname,
+						Dest:   server,
+					},
+					Collection: col,
+					ShardId:    sId,
+					Points:     points,
+					WriteTime:  writeTime,
+				}
+				updateResp := RPCUpdatePointsResponse{}
+				err := c.RPCUpdatePoints(&updateReq, &updateResp)
+				return updateResp.UpdatedIds, err
+			})
+			if err != nil {
 				c.logger.Error().Err(err).Str("userId", col.UserId).Str("collectionId", col.Id).Str("shardId", sId).Msg("could not update points")
 			} else {
 				mu.Lock()
-				results = append(results, updateResp.UpdatedIds...)
+				results = append(results, updatedIds...)
 				successCount++
 				mu.Unlock()
 			}
@@ -433,6 +622,40 @@ func (c *ClusterNode) UpdatePoints(col models.Collection, points []models.Point)
 	return curateFailedPoints(allIds, results, successCount == len(col.ShardIds)), nil
 }
 
+// writeShardReplicas sends a write to every replica of the shard with the
+// write consistency of the cluster. All replicas record the changes at the
+// same write time so their last write times agree. It returns the ids the
+// replicas that completed in time reported, e.g. which points were updated.
+func (c *ClusterNode) writeShardReplicas(col models.Collection, shardId string, write func(server string, writeTime int64) ([]uuid.UUID, error)) ([]uuid.UUID, error) {
+	servers := c.placement(shardId, max(int(col.Replicas), 1))
+	writeTime := time.Now().UnixNano()
+	var mu sync.Mutex
+	idSet := make(map[uuid.UUID]struct{})
+	_, err := c.writeReplicasDetailed(servers, c.cfg.WriteConsistency, func(server string) error {
+		ids, err := write(server, writeTime)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		for _, id := range ids {
+			idSet[id] = struct{}{}
+		}
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Replicas still writing in the background may add to the set
+	mu.Lock()
+	defer mu.Unlock()
+	ids := make([]uuid.UUID, 0, len(idSet))
+	for id := range idSet {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
 func curateFailedPoints(allIds []uuid.UUID, successIds []uuid.UUID, isCompleteResponse bool) []FailedPoint {
 	// ---------------------------
 	slices.SortFunc(successIds, func(a, b uuid.UUID) int {
@@ -474,46 +697,206 @@ func curateFailedPoints(allIds []uuid.UUID, successIds []uuid.UUID, isCompleteRe
 func (c *ClusterNode) DeletePoints(col models.Collection, pointIds []uuid.UUID) ([]FailedPoint, error) {
 	// ---------------------------
 	// Deleting points is similar to updating points and we ask every shard to
-	// participate. This is because we don't have a table of point ids to shard
-	// ids, so we need every shard to check if it has the point.
+	// participate. This is because unless the collection has a point shard
+	// index we don't have a table of point ids to shard ids, so we need every
+	// shard to check if it has the point.
 	//
 	// The shard operation returns which ids succeeded and this function returns
 	// which ones failed to notify the client upstream. This is because it is
 	// more efficient to just let shards return what succeeded instead of a long
 	// list of points that failed.
 	// ---------------------------
+	shardPointIds := c.targetShards(col, pointIds)
 	deletedIds := make([]uuid.UUID, 0, len(pointIds))
 	successCount := 0
 	var wg sync.WaitGroup
 	var mu sync.Mutex
-	for _, shardId := range col.ShardIds {
+	for shardId, ids := range shardPointIds {
 		wg.Add(1)
-		go func(sId string) {
+		go func(sId string, ids []uuid.UUID) {
 			defer wg.Done()
-			targetServer := RendezvousHash(sId, c.Servers, 1)[0]
-			deleteReq := RPCDeletePointsRequest{
-				RPCRequestArgs: RPCRequestArgs{
-					Source: c.MyHostname,
-					Dest:   targetServer,
-				},
-				Collection: col,
-				ShardId:    sId,
-				Ids:        pointIds,
-			}
-			deleteResp := RPCDeletePointsResponse{}
-			if err := c.RPCDeletePoints(&deleteReq, &deleteResp); err != nil {
+			shardDeletedIds, err := c.writeShardReplicas(col, sId, func(server string, writeTime int64) ([]uuid.UUID, error) {
+				deleteReq := RPCDeletePointsRequest{
+					RPCRequestArgs: RPCRequestArgs{
+						Source: c.MyHostname,
+						Dest:   server,
+					},
+					Collection: col,
+					ShardId:    sId,
+					Ids:        ids,
+					WriteTime:  writeTime,
+				}
+				deleteResp := RPCDeletePointsResponse{}
+				err := c.RPCDeletePoints(&deleteReq, &deleteResp)
+				return deleteResp.DeletedIds, err
+			})
+			if err != nil {
 				c.logger.Error().Err(err).Str("userId", col.UserId).Str("collectionId", col.Id).Str("shardId", sId).Msg("could not delete points")
 			} else {
 				mu.Lock()
-				deletedIds = append(deletedIds, deleteResp.DeletedIds...)
+				deletedIds = append(deletedIds, shardDeletedIds...)
 				successCount++
 				mu.Unlock()
 			}
-		}(shardId)
+		}(shardId, ids)
 	}
 	// ---------------------------
 	wg.Wait()
 	// ---------------------------
+	if col.PointShardIndex && len(deletedIds) > 0 {
+		// A stale entry only costs a wasted request to its shard
+		if err := c.setPointShards(col, deletedIds, nil); err != nil {
+			c.logger.Error().Err(err).Str("userId", col.UserId).Str("collectionId", col.Id).Msg("could not remove point shards")
+		}
+	}
+	// ---------------------------
 	// *** Return which points were NOT deleted. ***
-	return curateFailedPoints(pointIds, deletedIds, successCount == len(col.ShardIds)), nil
+	return curateFailedPoints(pointIds, deletedIds, successCount == len(shardPointIds)), nil
+}
+
+// DeletePointsByFilter deletes the points matching the filter expression from
+// every shard of the collection, see deletefilter.go for the expression. It
+// returns the number of deleted points and the deleted ids of each shard,
+// shards that failed are left out and reported in the error.
+func (c *ClusterNode) DeletePointsByFilter(col models.Collection, filter string) (int, map[string][]uuid.UUID, error) {
+	// Reject bad filters before any shard deletes anything
+	if _, err := parseDeleteFilter(filter); err != nil {
+		return 0, nil, err
+	}
+	// ---------------------------
+	shardDeletedIds := make(map[string][]uuid.UUID, len(col.ShardIds))
+	var errs []error
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, shardId := range col.ShardIds {
+		wg.Add(1)
+		go func(sId string) {
+			defer wg.Done()
+			deletedIds, err := c.writeShardReplicas(col, sId, func(server string, writeTime int64) ([]uuid.UUID, error) {
+				deleteReq := RPCDeletePointsByFilterRequest{
+					RPCRequestArgs: RPCRequestArgs{
+						Source: c.MyHostname,
+						Dest:   server,
+					},
+					Collection: col,
+					ShardId:    sId,
+					Filter:     filter,
+					WriteTime:  writeTime,
+				}
+				deleteResp := RPCDeletePointsByFilterResponse{}
+				err := c.RPCDeletePointsByFilter(&deleteReq, &deleteResp)
+				return deleteResp.DeletedIds, err
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				c.logger.Error().Err(err).Str("userId", col.UserId).Str("collectionId", col.Id).Str("shardId", sId).Msg("could not delete points by filter")
+				errs = append(errs, fmt.Errorf("could not delete points of shard %s: %w", sId, err))
+				return
+			}
+			shardDeletedIds[sId] = deletedIds
+		}(shardId)
+	}
+	wg.Wait()
+	// ---------------------------
+	deletedIds := make([]uuid.UUID, 0)
+	for _, ids := range shardDeletedIds {
+		deletedIds = append(deletedIds, ids...)
+	}
+	if col.PointShardIndex && len(deletedIds) > 0 {
+		if err := c.setPointShards(col, deletedIds, nil); err != nil {
+			c.logger.Error().Err(err).Str("userId", col.UserId).Str("collectionId", col.Id).Msg("could not remove point shards")
+		}
+	}
+	return len(deletedIds), shardDeletedIds, errors.Join(errs...)
+}
+
+// targetShards returns which ids to send to each shard. Without a point shard
+// index every shard gets every id, with one the ids in the index are only sent
+// to their shard.
+func (c *ClusterNode) targetShards(col models.Collection, pointIds []uuid.UUID) map[string][]uuid.UUID {
+	var knownShards []string
+	if col.PointShardIndex {
+		var err error
+		if knownShards, err = c.getPointShards(col, pointIds); err != nil {
+			c.logger.Warn().Err(err).Str("userId", col.UserId).Str("collectionId", col.Id).Msg("could not get point shards, asking every shard")
+			knownShards = nil
+		}
+	}
+	unknownIds := make([]uuid.UUID, 0, len(pointIds))
+	shardPointIds := make(map[string][]uuid.UUID)
+	for i, id := range pointIds {
+		if knownShards != nil && knownShards[i] != "" {
+			shardPointIds[knownShards[i]] = append(shardPointIds[knownShards[i]], id)
+		} else {
+			unknownIds = append(unknownIds, id)
+		}
+	}
+	if len(unknownIds) > 0 {
+		for _, shardId := range col.ShardIds {
+			shardPointIds[shardId] = append(shardPointIds[shardId], unknownIds...)
+		}
+	}
+	return shardPointIds
+}
+
+// ---------------------------
+
+// GetPoint returns the point from the shard that has it, asking only its shard
+// if the collection has a point shard index with an entry for the point.
+func (c *ClusterNode) GetPoint(col models.Collection, pointId uuid.UUID, includePayload bool) (models.Point, bool, error) {
+	return c.GetPointAfter(col, pointId, includePayload, 0)
+}
+
+// GetPointAfter is like GetPoint but only reads shard replicas that have
+// applied the writes up to minWriteTime, see SearchPointsAfter.
+func (c *ClusterNode) GetPointAfter(col models.Collection, pointId uuid.UUID, includePayload bool, minWriteTime int64) (models.Point, bool, error) {
+	shardIds := make([]string, 0, len(col.ShardIds))
+	for sId := range c.targetShards(col, []uuid.UUID{pointId}) {
+		shardIds = append(shardIds, sId)
+	}
+	// ---------------------------
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var point models.Point
+	found := false
+	failedCount := 0
+	for _, shardId := range shardIds {
+		wg.Add(1)
+		go func(sId string) {
+			defer wg.Done()
+			getResp := RPCGetPointResponse{}
+			targetServer, err := c.readServer(col, sId, minWriteTime)
+			if err == nil {
+				getReq := RPCGetPointRequest{
+					RPCRequestArgs: RPCRequestArgs{
+						Source: c.MyHostname,
+						Dest:   targetServer,
+					},
+					Collection:     col,
+					ShardId:        sId,
+					Id:             pointId,
+					IncludePayload: includePayload,
+				}
+				err = c.RPCGetPoint(&getReq, &getResp)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				c.logger.Error().Err(err).Str("userId", col.UserId).Str("collectionId", col.Id).Str("shardId", sId).Msg("could not get point")
+				failedCount++
+				return
+			}
+			if !getResp.NotFound {
+				point = getResp.Point
+				found = true
+			}
+		}(shardId)
+	}
+	wg.Wait()
+	// ---------------------------
+	if !found && failedCount > 0 {
+		return point, false, ErrShardUnavailable
+	}
+	return point, found, nil
 }
@@ -0,0 +1,278 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/models"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// tempClusterNode creates a node listening on localhost:9897 that is not
+// serving RPC requests, other servers can be given to test routing.
+func tempClusterNode(t *testing.T, otherServers ...string) *ClusterNode {
+	tempDir := t.TempDir()
+	c, err := NewNode(ClusterNodeConfig{
+		RootDir:        tempDir,
+		Servers:        append([]string{"localhost:9897"}, otherServers...),
+		RpcHost:        "localhost",
+		RpcPort:        9897,
+		RpcTimeout:     1,
+		RpcRetries:     1,
+		MaxSearchLimit: 75,
+		ShardManager: ShardManagerConfig{
+			RootDir:      tempDir,
+			ShardTimeout: 30,
+		},
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func Test_SearchPointsPartialFailure(t *testing.T) {
+	// The second server does not exist so its shards cannot be searched
+	c := tempClusterNode(t, "localhost:1")
+	// ---------------------------
+	var localShard, remoteShard string
+	for i := 0; localShard == "" || remoteShard == ""; i++ {
+		shardId := fmt.Sprintf("shard%d", i)
+		if c.placement(shardId, 1)[0] == c.MyHostname {
+			localShard = shardId
+		} else {
+			remoteShard = shardId
+		}
+	}
+	col := models.Collection{
+		UserId: "alice",
+		Id:     "docs",
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorVamana,
+				VectorVamana: &models.IndexVectorVamanaParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+					SearchSize:     75,
+					DegreeBound:    64,
+					Alpha:          1.2,
+				},
+			},
+		},
+	}
+	sr := models.SearchRequest{
+		Query: models.Query{
+			Property: "vector",
+			VectorVamana: &models.SearchVectorVamanaOptions{
+				Vector: []float32{1, 2},
+				Limit:  10,
+			},
+		},
+		Limit: 10,
+	}
+	// ---------------------------
+	col.ShardIds = []string{localShard, remoteShard}
+	_, failedShards, err := c.SearchPoints(col, sr)
+	require.NoError(t, err)
+	require.Equal(t, 1, failedShards)
+	// Without any reachable shard there are no results to return
+	col.ShardIds = []string{remoteShard}
+	_, failedShards, err = c.SearchPoints(col, sr)
+	require.Error(t, err)
+	require.Equal(t, 1, failedShards)
+	require.NoError(t, c.Close())
+}
+
+func Test_PointShardIndex(t *testing.T) {
+	c := tempClusterNode(t)
+	c.cfg.MaxShardSize = 1 << 20
+	c.cfg.MaxShardPointCount = 4
+	col := models.Collection{
+		UserId:          "alice",
+		Id:              "docs",
+		UserPlan:        models.UserPlan{MaxCollections: 1, MaxCollectionPointCount: 100},
+		PointShardIndex: true,
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorVamana,
+				VectorVamana: &models.IndexVectorVamanaParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+					SearchSize:     75,
+					DegreeBound:    64,
+					Alpha:          1.2,
+				},
+			},
+		},
+	}
+	require.NoError(t, c.CreateCollection(col))
+	points := make([]models.Point, 10)
+	for i := range points {
+		data, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{float32(i), float32(i)}})
+		require.NoError(t, err)
+		points[i] = models.Point{Id: uuid.New(), Data: data}
+	}
+	failedRanges, pointShards, err := c.InsertPoints(col, points)
+	require.NoError(t, err)
+	require.Empty(t, failedRanges)
+	require.Len(t, pointShards, len(points))
+	col, err = c.GetCollection(col.UserId, col.Id)
+	require.NoError(t, err)
+	require.Len(t, col.ShardIds, 3)
+	// ---------------------------
+	ids := make([]uuid.UUID, len(points))
+	for i, p := range points {
+		ids[i] = p.Id
+	}
+	shardIds, err := c.getPointShards(col, ids)
+	require.NoError(t, err)
+	for i, id := range ids {
+		require.Equal(t, pointShards[id], shardIds[i])
+	}
+	targets := c.targetShards(col, ids[:1])
+	require.Equal(t, map[string][]uuid.UUID{pointShards[ids[0]]: ids[:1]}, targets)
+	point, found, err := c.GetPoint(col, ids[0], false)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, ids[0], point.Id)
+	// ---------------------------
+	failedPoints, err := c.DeletePoints(col, ids[:2])
+	require.NoError(t, err)
+	require.Empty(t, failedPoints)
+	shardIds, err = c.getPointShards(col, ids[:3])
+	require.NoError(t, err)
+	require.Equal(t, []string{"", "", pointShards[ids[2]]}, shardIds)
+	// Without an entry every shard is asked
+	_, found, err = c.GetPoint(col, ids[0], false)
+	require.NoError(t, err)
+	require.False(t, found)
+	// ---------------------------
+	_, _, err = c.DeleteCollection(col)
+	require.NoError(t, err)
+	shardIds, err = c.getPointShards(col, ids)
+	require.NoError(t, err)
+	for _, sId := range shardIds {
+		require.Empty(t, sId)
+	}
+	require.NoError(t, c.Close())
+}
+
+func Test_DeletePointsByFilter(t *testing.T) {
+	c := tempClusterNode(t)
+	c.cfg.MaxShardSize = 1 << 20
+	c.cfg.MaxShardPointCount = 4
+	col := models.Collection{
+		UserId:   "alice",
+		Id:       "docs",
+		UserPlan: models.UserPlan{MaxCollections: 1, MaxCollectionPointCount: 100},
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorVamana,
+				VectorVamana: &models.IndexVectorVamanaParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+					SearchSize:     75,
+					DegreeBound:    64,
+					Alpha:          1.2,
+				},
+			},
+		},
+	}
+	require.NoError(t, c.CreateCollection(col))
+	points := make([]models.Point, 10)
+	tenantIds := make(map[uuid.UUID]struct{})
+	for i := range points {
+		tenant := "acme"
+		if i%2 == 0 {
+			tenant = "globex"
+		}
+		data, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{float32(i), float32(i)}, "tenant": tenant})
+		require.NoError(t, err)
+		points[i] = models.Point{Id: uuid.New(), Data: data}
+		if tenant == "globex" {
+			tenantIds[points[i].Id] = struct{}{}
+		}
+	}
+	failedRanges, _, err := c.InsertPoints(col, points)
+	require.NoError(t, err)
+	require.Empty(t, failedRanges)
+	col, err = c.GetCollection(col.UserId, col.Id)
+	require.NoError(t, err)
+	require.Greater(t, len(col.ShardIds), 1)
+	// ---------------------------
+	_, _, err = c.DeletePointsByFilter(col, "tenant = globex")
+	require.Error(t, err)
+	count, shardDeletedIds, err := c.DeletePointsByFilter(col, `tenant == "globex"`)
+	require.NoError(t, err)
+	require.Equal(t, len(tenantIds), count)
+	require.Len(t, shardDeletedIds, len(col.ShardIds))
+	for _, ids := range shardDeletedIds {
+		for _, id := range ids {
+			require.Contains(t, tenantIds, id)
+		}
+	}
+	for _, p := range points {
+		_, found, err := c.GetPoint(col, p.Id, false)
+		require.NoError(t, err)
+		_, deleted := tenantIds[p.Id]
+		require.Equal(t, !deleted, found)
+	}
+	require.NoError(t, c.Close())
+}
+
+func Test_GetCollectionShardInfos(t *testing.T) {
+	// The second server does not exist so its shards are unavailable
+	c := tempClusterNode(t, "localhost:1")
+	// ---------------------------
+	var userId string
+	for i := 0; userId == ""; i++ {
+		if candidate := fmt.Sprintf("user%d", i); c.placement(candidate, 1)[0] == c.MyHostname {
+			userId = candidate
+		}
+	}
+	var localShard, remoteShard string
+	for i := 0; localShard == "" || remoteShard == ""; i++ {
+		shardId := fmt.Sprintf("shard%d", i)
+		if c.placement(shardId, 1)[0] == c.MyHostname {
+			localShard = shardId
+		} else {
+			remoteShard = shardId
+		}
+	}
+	col := models.Collection{
+		UserId:   userId,
+		Id:       "docs",
+		UserPlan: models.UserPlan{MaxCollections: 1, MaxCollectionPointCount: 100},
+		ShardIds: []string{localShard, remoteShard},
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorVamana,
+				VectorVamana: &models.IndexVectorVamanaParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+					SearchSize:     75,
+					DegreeBound:    64,
+					Alpha:          1.2,
+				},
+			},
+		},
+	}
+	require.NoError(t, c.CreateCollection(col))
+	// ---------------------------
+	infos, err := c.GetCollectionShardInfos(userId, "docs")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, localShard, infos[0].Id)
+	require.Equal(t, c.MyHostname, infos[0].Hostname)
+	require.True(t, infos[0].Available)
+	require.Empty(t, infos[0].Err)
+	require.EqualValues(t, 0, infos[0].PointCount)
+	require.Equal(t, remoteShard, infos[1].Id)
+	require.Equal(t, "localhost:1", infos[1].Hostname)
+	require.False(t, infos[1].Available)
+	require.NotEmpty(t, infos[1].Err)
+	// ---------------------------
+	_, err = c.GetCollectionShardInfos(userId, "missing")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, c.Close())
+}
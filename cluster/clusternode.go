@@ -2,6 +2,7 @@ package cluster
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/rpc"
@@ -37,10 +38,17 @@ type ClusterNodeConfig struct {
 	RpcPort   int    `yaml:"rpcPort"`
 	// Timeout in seconds
 	RpcTimeout int `yaml:"rpcTimeout"`
-	RpcRetries int `yaml:"rpcRetries"`
+	// Number of attempts at reaching another node, retries back off
+	// exponentially starting from the delay in milliseconds and all attempts
+	// share the rpc timeout.
+	RpcRetries    int `yaml:"rpcRetries"`
+	RpcRetryDelay int `yaml:"rpcRetryDelay"`
 	// ---------------------------
 	// Initial set of known servers
 	Servers []string `yaml:"servers"`
+	// Relative capacity of each server used to weight key placement, servers
+	// not listed default to a weight of 1. Leave empty for equal placement.
+	ServerWeights map[string]float64 `yaml:"serverWeights"`
 	// Shard manager configuration
 	ShardManager ShardManagerConfig `yaml:"shardManager"`
 	// ---------------------------
@@ -55,6 +63,22 @@ type ClusterNodeConfig struct {
 	MaxShardPointCount int64 `yaml:"maxShardPointCount"`
 	// Maximum number of points to search
 	MaxSearchLimit int `yaml:"maxSearchLimit"`
+	// Maximum number of graph nodes returned when exporting the graph of a
+	// shard, requests asking for more are capped
+	MaxExportGraphNodes int `yaml:"maxExportGraphNodes"`
+	// Maximum number of visited graph nodes returned when explaining a search,
+	// longer traces are cut
+	MaxExplainVisits int `yaml:"maxExplainVisits"`
+	// Maximum number of points sent to a shard in a single insert request, 0
+	// sends all the points of a shard at once
+	InsertChunkSize int `yaml:"insertChunkSize"`
+	// Seconds for which the result of an insert with an idempotency key is
+	// kept so a retried request returns it instead of inserting again, 0
+	// disables idempotency keys
+	IdempotencyKeyTTL int `yaml:"idempotencyKeyTTL"`
+	// Number of replicas of a shard that have to acknowledge an insert, one of
+	// one, quorum or all. Empty uses quorum.
+	WriteConsistency ConsistencyLevel `yaml:"writeConsistency"`
 }
 
 type ClusterNode struct {
@@ -64,6 +88,9 @@ type ClusterNode struct {
 	// ---------------------------
 	Servers    []string
 	MyHostname string
+	startTime  time.Time
+	// Hash function of the rendezvous hashing that places keys on servers
+	hashFn HashFn
 	// ---------------------------
 	rpcClients   map[string]*rpc.Client
 	rpcClientsMu sync.Mutex
@@ -74,6 +101,12 @@ type ClusterNode struct {
 	// ---------------------------
 	shardManager *ShardManager
 	// ---------------------------
+	// Results of streamed searches awaiting their remaining pages
+	searchStreams   map[string]*searchStream
+	searchStreamsMu sync.Mutex
+	// Shard replicas being repaired in the background, see readReplica
+	replicaRepairs sync.Map
+	// ---------------------------
 	// The done channel is used to signal goroutines to stop via the Close
 	// method. The close method then waits for them to exit.
 	doneCh      chan struct{}
@@ -96,6 +129,9 @@ func NewNode(config ClusterNodeConfig) (*ClusterNode, error) {
 		envHostname = envHostname + config.RpcDomain + ":" + strconv.Itoa(config.RpcPort)
 		log.Info().Str("hostname", envHostname).Msg("Full hostname")
 	}
+	if _, err := config.WriteConsistency.requiredAcks(1); config.WriteConsistency != "" && err != nil {
+		return nil, fmt.Errorf("invalid write consistency: %w", err)
+	}
 	// ---------------------------
 	logger := log.With().Str("hostname", envHostname).Str("component", "clusterNode").Logger()
 	// ---------------------------
@@ -109,18 +145,22 @@ func NewNode(config ClusterNodeConfig) (*ClusterNode, error) {
 		return nil, fmt.Errorf("could not open node db: %w", err)
 	}
 	// ---------------------------
-	shardManager := NewShardManager(config.ShardManager)
+	metrics := newClusterNodeMetrics()
+	shardManager := NewShardManager(config.ShardManager, metrics)
 	// ---------------------------
 	cluster := &ClusterNode{
-		logger:       logger,
-		cfg:          config,
-		Servers:      config.Servers,
-		MyHostname:   envHostname,
-		rpcClients:   make(map[string]*rpc.Client),
-		metrics:      newClusterNodeMetrics(),
-		nodedb:       nodedb,
-		shardManager: shardManager,
-		doneCh:       make(chan struct{}),
+		logger:        logger,
+		cfg:           config,
+		Servers:       config.Servers,
+		MyHostname:    envHostname,
+		startTime:     time.Now(),
+		hashFn:        DefaultHashFn,
+		rpcClients:    make(map[string]*rpc.Client),
+		metrics:       metrics,
+		nodedb:        nodedb,
+		shardManager:  shardManager,
+		searchStreams: make(map[string]*searchStream),
+		doneCh:        make(chan struct{}),
 	}
 	return cluster, nil
 }
@@ -168,6 +208,26 @@ func (c *ClusterNode) Serve() error {
 		c.bgWaitGroup.Done()
 	}()
 	// ---------------------------
+	// Purge expired idempotency keys, checking as often as they expire
+	if c.cfg.IdempotencyKeyTTL > 0 {
+		c.bgWaitGroup.Add(1)
+		go func() {
+			defer c.bgWaitGroup.Done()
+			ticker := time.NewTicker(time.Duration(c.cfg.IdempotencyKeyTTL) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-c.doneCh:
+					return
+				case now := <-ticker.C:
+					if _, err := c.purgeIdempotencyKeys(now); err != nil {
+						c.logger.Error().Err(err).Msg("Failed to purge idempotency keys")
+					}
+				}
+			}
+		}()
+	}
+	// ---------------------------
 	// Setup periodic node database backups
 	if c.cfg.BackupFrequency <= 0 {
 		return nil
@@ -204,12 +264,19 @@ func (c *ClusterNode) Close() error {
 	// Wait for goroutines to stop
 	c.bgWaitGroup.Wait()
 	// ---------------------------
+	// Close loaded shards so their databases are cleanly closed. We still
+	// close the node database if some shards fail to close.
+	shardsErr := c.shardManager.CloseAll()
+	if shardsErr != nil {
+		shardsErr = fmt.Errorf("could not close shards: %w", shardsErr)
+	}
+	// ---------------------------
 	// Close node database
 	if err := c.nodedb.Close(); err != nil {
-		return fmt.Errorf("could not close node db: %w", err)
+		return errors.Join(shardsErr, fmt.Errorf("could not close node db: %w", err))
 	}
 	// ---------------------------
-	return nil
+	return shardsErr
 }
 
 // ---------------------------
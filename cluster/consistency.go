@@ -0,0 +1,145 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/* Inserts are written to every replica of a shard in parallel rather than only
+ * to the primary, see replicas.go. The consistency level sets how many of the
+ * replicas have to acknowledge the write before it is reported as successful,
+ * the remaining writes complete in the background and replicas that miss one
+ * are repaired on a later read. Lower levels keep accepting writes while some
+ * replicas are down at the cost of durability, a write acknowledged by one
+ * replica is lost if that replica is lost before the others catch up. */
+
+type ConsistencyLevel string
+
+const (
+	ConsistencyOne    ConsistencyLevel = "one"
+	ConsistencyQuorum ConsistencyLevel = "quorum"
+	ConsistencyAll    ConsistencyLevel = "all"
+)
+
+// DefaultConsistencyLevel is used when the configuration leaves it empty.
+const DefaultConsistencyLevel = ConsistencyQuorum
+
+// requiredAcks returns the number of replicas out of n that have to
+// acknowledge a write at this level.
+func (l ConsistencyLevel) requiredAcks(n int) (int, error) {
+	switch l {
+	case ConsistencyOne:
+		return min(1, n), nil
+	case ConsistencyQuorum:
+		return n/2 + 1, nil
+	case ConsistencyAll:
+		return n, nil
+	default:
+		return 0, fmt.Errorf("unknown consistency level %q", l)
+	}
+}
+
+// ReplicaStatus is the outcome of writing to one replica.
+type ReplicaStatus string
+
+const (
+	ReplicaSuccess ReplicaStatus = "success"
+	// The replica already had the data, e.g. an insert of existing points
+	ReplicaExists  ReplicaStatus = "exists"
+	ReplicaTimeout ReplicaStatus = "timeout"
+	ReplicaFailed  ReplicaStatus = "failed"
+	// The write had not completed when the outcome was decided and carries on
+	// in the background
+	ReplicaPending ReplicaStatus = "pending"
+)
+
+// ReplicaResult records how the write to one replica went and how long it
+// took, or how long it had been running for if it is pending.
+type ReplicaResult struct {
+	Status   ReplicaStatus
+	Duration time.Duration
+	Err      error
+}
+
+func (r ReplicaResult) String() string {
+	return fmt.Sprintf("%s in %s", r.Status, r.Duration.Round(time.Millisecond))
+}
+
+// writeReplicas calls write for every server in parallel and returns once
+// enough of them succeeded for the consistency level, or once too many failed
+// to reach it. Writes still running when it returns complete in the
+// background.
+func (c *ClusterNode) writeReplicas(servers []string, level ConsistencyLevel, write func(server string) error) error {
+	_, err := c.writeReplicasDetailed(servers, level, write)
+	return err
+}
+
+// writeReplicasDetailed is writeReplicas that also reports the result of every
+// server, for example to tell which replica was slow to time out a write.
+func (c *ClusterNode) writeReplicasDetailed(servers []string, level ConsistencyLevel, write func(server string) error) (map[string]ReplicaResult, error) {
+	if level == "" {
+		level = DefaultConsistencyLevel
+	}
+	required, err := level.requiredAcks(len(servers))
+	if err != nil {
+		return nil, err
+	}
+	type serverResult struct {
+		server   string
+		duration time.Duration
+		err      error
+	}
+	// Buffered so the writes that complete after we return do not block
+	resultC := make(chan serverResult, len(servers))
+	startTime := time.Now()
+	c.bgWaitGroup.Add(len(servers))
+	for _, server := range servers {
+		go func(server string) {
+			defer c.bgWaitGroup.Done()
+			err := write(server)
+			duration := time.Since(startTime)
+			if err != nil {
+				c.logger.Error().Err(err).Str("server", server).Str("duration", duration.String()).Msg("could not write replica")
+				err = fmt.Errorf("could not write replica on %s: %w", server, err)
+			}
+			resultC <- serverResult{server: server, duration: duration, err: err}
+		}(server)
+	}
+	// ---------------------------
+	results := make(map[string]ReplicaResult, len(servers))
+	// Whatever has not reported back by the time we return is pending
+	defer func() {
+		for _, server := range servers {
+			if _, ok := results[server]; !ok {
+				results[server] = ReplicaResult{Status: ReplicaPending, Duration: time.Since(startTime)}
+			}
+		}
+	}()
+	acks, failures := 0, 0
+	var firstErr error
+	for acks < required {
+		res := <-resultC
+		if res.err == nil {
+			results[res.server] = ReplicaResult{Status: ReplicaSuccess, Duration: res.duration}
+			acks++
+			continue
+		}
+		status := ReplicaFailed
+		switch {
+		case errors.Is(res.err, ErrTimeout):
+			status = ReplicaTimeout
+		case errors.Is(res.err, ErrExists):
+			status = ReplicaExists
+		}
+		results[res.server] = ReplicaResult{Status: status, Duration: res.duration, Err: res.err}
+		failures++
+		if firstErr == nil {
+			firstErr = res.err
+		}
+		if failures > len(servers)-required {
+			return results, fmt.Errorf("%d of %d replicas acknowledged, %s needs %d: %w", acks, len(servers), level, required, firstErr)
+		}
+	}
+	return results, nil
+}
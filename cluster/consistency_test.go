@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_requiredAcks(t *testing.T) {
+	for _, tc := range []struct {
+		level ConsistencyLevel
+		n     int
+		want  int
+	}{
+		{ConsistencyOne, 3, 1},
+		{ConsistencyQuorum, 1, 1},
+		{ConsistencyQuorum, 2, 2},
+		{ConsistencyQuorum, 3, 2},
+		{ConsistencyQuorum, 4, 3},
+		{ConsistencyAll, 3, 3},
+	} {
+		got, err := tc.level.requiredAcks(tc.n)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, got, "%s of %d", tc.level, tc.n)
+	}
+	_, err := ConsistencyLevel("most").requiredAcks(3)
+	require.Error(t, err)
+}
+
+func Test_writeReplicasTimeout(t *testing.T) {
+	servers := []string{"a", "b", "c"}
+	for _, tc := range []struct {
+		level   ConsistencyLevel
+		wantErr bool
+	}{
+		{ConsistencyOne, false},
+		{ConsistencyQuorum, false},
+		{"", false},
+		{ConsistencyAll, true},
+	} {
+		t.Run(string(tc.level), func(t *testing.T) {
+			c := &ClusterNode{}
+			// Server c times out but only after the others have been written
+			release := make(chan struct{})
+			var written atomic.Int32
+			write := func(server string) error {
+				if server == "c" {
+					<-release
+					return ErrTimeout
+				}
+				written.Add(1)
+				return nil
+			}
+			if tc.level == ConsistencyAll {
+				close(release)
+			}
+			err := c.writeReplicas(servers, tc.level, write)
+			if tc.wantErr {
+				require.ErrorIs(t, err, ErrTimeout)
+			} else {
+				require.NoError(t, err)
+				close(release)
+			}
+			// The remaining writes complete in the background
+			c.bgWaitGroup.Wait()
+			require.EqualValues(t, 2, written.Load())
+		})
+	}
+}
+
+func Test_writeReplicasFailures(t *testing.T) {
+	c := &ClusterNode{}
+	errDown := errors.New("down")
+	// Two of three replicas being down fails a quorum but not a single ack
+	write := func(server string) error {
+		if server == "a" {
+			return nil
+		}
+		return errDown
+	}
+	servers := []string{"a", "b", "c"}
+	require.NoError(t, c.writeReplicas(servers, ConsistencyOne, write))
+	require.ErrorIs(t, c.writeReplicas(servers, ConsistencyQuorum, write), errDown)
+	require.ErrorIs(t, c.writeReplicas(servers, ConsistencyAll, write), errDown)
+	c.bgWaitGroup.Wait()
+}
+
+func Test_writeReplicasDetailed(t *testing.T) {
+	c := &ClusterNode{}
+	release := make(chan struct{})
+	// The successful writes wait for the failures so they are all reported
+	var failed sync.WaitGroup
+	failed.Add(2)
+	write := func(server string) error {
+		switch server {
+		case "slow":
+			<-release
+			return nil
+		case "down":
+			defer failed.Done()
+			return fmt.Errorf("rpc failed: %w", ErrTimeout)
+		case "dup":
+			defer failed.Done()
+			return ErrExists
+		}
+		failed.Wait()
+		return nil
+	}
+	// Quorum needs 4 of the 7 servers
+	servers := []string{"ok1", "ok2", "ok3", "ok4", "down", "dup", "slow"}
+	results, err := c.writeReplicasDetailed(servers, ConsistencyQuorum, write)
+	require.NoError(t, err)
+	close(release)
+	c.bgWaitGroup.Wait()
+	require.Len(t, results, len(servers))
+	require.Equal(t, ReplicaSuccess, results["ok1"].Status)
+	require.Equal(t, ReplicaSuccess, results["ok2"].Status)
+	require.Equal(t, ReplicaTimeout, results["down"].Status)
+	require.ErrorIs(t, results["down"].Err, ErrTimeout)
+	require.Equal(t, ReplicaExists, results["dup"].Status)
+	require.Equal(t, ReplicaPending, results["slow"].Status)
+	// ---------------------------
+	// Failing to reach the level still reports every server
+	results, err = c.writeReplicasDetailed([]string{"ok1", "down"}, ConsistencyAll, func(server string) error {
+		if server == "down" {
+			return ErrTimeout
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, ErrTimeout)
+	c.bgWaitGroup.Wait()
+	require.Len(t, results, 2)
+	require.Equal(t, ReplicaTimeout, results["down"].Status)
+}
@@ -0,0 +1,94 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/semafind/semadb/models"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/* Deleting by filter selects points by their data rather than their ids, for
+ * example erasing every point of a tenant. The filter is deliberately a single
+ * equality predicate of the form
+ *
+ *   property == value
+ *
+ * where property is a top level key of the point data and value is a JSON
+ * string, number, boolean or null literal. There is nothing to evaluate beyond
+ * decoding the literal, so an expression cannot do more than compare one
+ * value. A point without the property never matches. */
+
+var deleteFilterPropertyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type deleteFilter struct {
+	property string
+	// One of string, float64, bool or nil as decoded from JSON
+	value any
+}
+
+func parseDeleteFilter(expr string) (deleteFilter, error) {
+	property, literal, ok := strings.Cut(expr, "==")
+	if !ok {
+		return deleteFilter{}, fmt.Errorf("filter %q is not of the form property == value", expr)
+	}
+	property = strings.TrimSpace(property)
+	if !deleteFilterPropertyRe.MatchString(property) {
+		return deleteFilter{}, fmt.Errorf("invalid filter property %q", property)
+	}
+	var value any
+	if err := json.Unmarshal([]byte(strings.TrimSpace(literal)), &value); err != nil {
+		return deleteFilter{}, fmt.Errorf("invalid filter value: %w", err)
+	}
+	switch value.(type) {
+	case string, float64, bool, nil:
+	default:
+		return deleteFilter{}, fmt.Errorf("filter value must be a string, number, boolean or null, got %T", value)
+	}
+	return deleteFilter{property: property, value: value}, nil
+}
+
+// match reports whether the msgpack encoded point data satisfies the filter.
+// Data that cannot be decoded does not match.
+func (f deleteFilter) match(data []byte) bool {
+	var pointData models.PointAsMap
+	if err := msgpack.Unmarshal(data, &pointData); err != nil {
+		return false
+	}
+	v, ok := pointData[f.property]
+	if !ok {
+		return false
+	}
+	// Numbers decode to the smallest fitting type, JSON numbers are floats
+	switch n := v.(type) {
+	case int8:
+		v = float64(n)
+	case int16:
+		v = float64(n)
+	case int32:
+		v = float64(n)
+	case int64:
+		v = float64(n)
+	case int:
+		v = float64(n)
+	case uint8:
+		v = float64(n)
+	case uint16:
+		v = float64(n)
+	case uint32:
+		v = float64(n)
+	case uint64:
+		v = float64(n)
+	case uint:
+		v = float64(n)
+	case float32:
+		v = float64(n)
+	}
+	switch v.(type) {
+	case string, float64, bool, nil:
+		return v == f.value
+	}
+	return false
+}
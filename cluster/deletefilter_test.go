@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/semafind/semadb/models"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func Test_parseDeleteFilter(t *testing.T) {
+	for _, expr := range []string{"tenant", "== 1", "a b == 1", "tenant == alice", "tenant == [1]", "tenant == {}"} {
+		_, err := parseDeleteFilter(expr)
+		require.Error(t, err, expr)
+	}
+	f, err := parseDeleteFilter(` tenant=="a == b" `)
+	require.NoError(t, err)
+	require.Equal(t, deleteFilter{property: "tenant", value: "a == b"}, f)
+}
+
+func Test_deleteFilterMatch(t *testing.T) {
+	data, err := msgpack.Marshal(models.PointAsMap{
+		"tenant": "alice",
+		"age":    42,
+		"score":  float32(0.5),
+		"active": true,
+		"none":   nil,
+		"tags":   []string{"a"},
+	})
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		expr string
+		want bool
+	}{
+		{`tenant == "alice"`, true},
+		{`tenant == "bob"`, false},
+		{`age == 42`, true},
+		{`age == 42.0`, true},
+		{`age == "42"`, false},
+		{`score == 0.5`, true},
+		{`active == true`, true},
+		{`none == null`, true},
+		{`missing == null`, false},
+		{`tags == "a"`, false},
+	} {
+		f, err := parseDeleteFilter(tc.expr)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, f.match(data), tc.expr)
+	}
+	f, err := parseDeleteFilter(`tenant == "alice"`)
+	require.NoError(t, err)
+	require.False(t, f.match([]byte("not msgpack")))
+}
@@ -1,9 +1,42 @@
 package cluster
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/semafind/semadb/shard"
+)
 
 var ErrExists = errors.New("already exists")
 var ErrTimeout = errors.New("timeout")
 var ErrNotFound = errors.New("not found")
 var ErrShardUnavailable = errors.New("shard unavailable")
 var ErrQuotaReached = errors.New("quota reached")
+
+// shardError additionally wraps the errors of shard operations in the
+// matching cluster errors so that handlers only check for the latter. The
+// shard error is kept, errors.Is matches both.
+func shardError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, shard.ErrPointExists):
+		return fmt.Errorf("%w: %w", ErrExists, err)
+	case errors.Is(err, shard.ErrPointNotFound):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case errors.Is(err, shard.ErrShardClosed):
+		return fmt.Errorf("%w: %w", ErrShardUnavailable, err)
+	}
+	return err
+}
+
+// ValidationError lists every problem found with a request so they can all be
+// fixed at once.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "validation failed: " + strings.Join(e.Problems, "; ")
+}
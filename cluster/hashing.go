@@ -2,6 +2,7 @@ package cluster
 
 import (
 	"cmp"
+	"math"
 	"slices"
 
 	"github.com/cespare/xxhash"
@@ -12,12 +13,25 @@ type ServerScore struct {
 	Score  uint64
 }
 
+// HashFn hashes the combination of a key and a server for rendezvous hashing.
+// Changing it changes where every key is placed, so it must be the same on all
+// nodes of a cluster.
+type HashFn func(string) uint64
+
+// DefaultHashFn is the hash function used unless another one is given.
+var DefaultHashFn HashFn = xxhash.Sum64String
+
 // RendezvousHash returns a list of servers sorted by their score for the given key.
 func RendezvousHash(key string, servers []string, topK int) []string {
+	return RendezvousHashWith(key, servers, topK, DefaultHashFn)
+}
+
+// RendezvousHashWith is RendezvousHash using the given hash function.
+func RendezvousHashWith(key string, servers []string, topK int, hashFn HashFn) []string {
 	scores := make([]ServerScore, len(servers))
 	for i, server := range servers {
 		// combinedKey := append(key, []byte(server)...)
-		hash := xxhash.Sum64String(key + server)
+		hash := hashFn(key + server)
 		scores[i] = ServerScore{server, hash}
 	}
 	// Sort by score
@@ -35,3 +49,72 @@ func RendezvousHash(key string, servers []string, topK int) []string {
 	}
 	return res
 }
+
+// WeightedRendezvousHash returns a list of servers sorted by their weighted
+// score for the given key. Each server receives a share of the keys
+// proportional to its weight, servers without a positive weight default to 1.
+func WeightedRendezvousHash(key string, servers []string, weights map[string]float64, topK int) []string {
+	return WeightedRendezvousHashWith(key, servers, weights, topK, DefaultHashFn)
+}
+
+// WeightedRendezvousHashWith is WeightedRendezvousHash using the given hash
+// function.
+func WeightedRendezvousHashWith(key string, servers []string, weights map[string]float64, topK int, hashFn HashFn) []string {
+	type weightedScore struct {
+		Server string
+		Score  float64
+	}
+	scores := make([]weightedScore, len(servers))
+	for i, server := range servers {
+		weight, ok := weights[server]
+		if !ok || weight <= 0 {
+			weight = 1
+		}
+		// ---------------------------
+		// Map the hash onto the open interval (0, 1) using the top 53 bits so
+		// the conversion to float64 is exact. The score -w / ln(u) then picks
+		// each server with probability w / sum(w).
+		hash := hashFn(key + server)
+		u := (float64(hash>>11) + 0.5) / (1 << 53)
+		scores[i] = weightedScore{server, -weight / math.Log(u)}
+	}
+	// Sort by score, highest first
+	slices.SortFunc(scores, func(a, b weightedScore) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+	// Convert back to string slice
+	resSize := min(topK, len(servers))
+	res := make([]string, resSize)
+	for i := 0; i < resSize; i++ {
+		res[i] = scores[i].Server
+	}
+	return res
+}
+
+// placement returns the servers responsible for the given key. If server
+// weights are configured, the weighted variant is used so that larger nodes
+// receive more keys, otherwise the plain rendezvous hash keeps the existing
+// placement intact.
+func (c *ClusterNode) placement(key string, topK int) []string {
+	if len(c.cfg.ServerWeights) == 0 {
+		return RendezvousHashWith(key, c.Servers, topK, c.hashFn)
+	}
+	return WeightedRendezvousHashWith(key, c.Servers, c.cfg.ServerWeights, topK, c.hashFn)
+}
+
+// PlacementDisruption returns the fraction of the keys whose first server
+// differs between the two server lists. Rendezvous hashing only moves the keys
+// of a removed server or the share an added server takes over, so adding or
+// removing one of N servers should disrupt around 1/N of the keys.
+func PlacementDisruption(keys []string, before, after []string, hashFn HashFn) float64 {
+	if len(keys) == 0 {
+		return 0
+	}
+	moved := 0
+	for _, key := range keys {
+		if RendezvousHashWith(key, before, 1, hashFn)[0] != RendezvousHashWith(key, after, 1, hashFn)[0] {
+			moved++
+		}
+	}
+	return float64(moved) / float64(len(keys))
+}
@@ -0,0 +1,71 @@
+package cluster
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WeightedRendezvousHash(t *testing.T) {
+	servers := []string{"serverA", "serverB", "serverC"}
+	weights := map[string]float64{"serverA": 1, "serverB": 2, "serverC": 5}
+	totalWeight := 8.0
+	numKeys := 1000
+	counts := make(map[string]int)
+	for i := 0; i < numKeys; i++ {
+		res := WeightedRendezvousHash(fmt.Sprintf("user%d", i), servers, weights, 1)
+		require.Len(t, res, 1)
+		counts[res[0]]++
+	}
+	for _, server := range servers {
+		expected := weights[server] / totalWeight
+		actual := float64(counts[server]) / float64(numKeys)
+		require.InDelta(t, expected, actual, 0.05, "server %s", server)
+	}
+}
+
+func Test_WeightedRendezvousHash_Defaults(t *testing.T) {
+	servers := []string{"serverA", "serverB", "serverC"}
+	// Missing weights default to 1 and every server is returned once
+	res := WeightedRendezvousHash("user", servers, nil, 5)
+	require.ElementsMatch(t, servers, res)
+	// The same key always maps to the same server
+	first := WeightedRendezvousHash("user", servers, map[string]float64{"serverA": 3}, 1)
+	second := WeightedRendezvousHash("user", servers, map[string]float64{"serverA": 3}, 1)
+	require.Equal(t, first, second)
+}
+
+func Test_RendezvousHashWith(t *testing.T) {
+	servers := []string{"serverA", "serverB", "serverC"}
+	// A deterministic hash that scores servers by their last byte
+	lastByte := func(s string) uint64 { return uint64(s[len(s)-1]) }
+	require.Equal(t, []string{"serverA", "serverB"}, RendezvousHashWith("key", servers, 2, lastByte))
+	// The default hash gives a stable placement regardless of server order
+	first := RendezvousHash("user", servers, 3)
+	second := RendezvousHash("user", []string{"serverC", "serverA", "serverB"}, 3)
+	require.Equal(t, first, second)
+	require.Equal(t, first, RendezvousHashWith("user", servers, 3, DefaultHashFn))
+}
+
+func Test_PlacementDisruption(t *testing.T) {
+	keys := make([]string, 2000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user%d", i)
+	}
+	servers := []string{"serverA", "serverB", "serverC", "serverD"}
+	require.Equal(t, 0.0, PlacementDisruption(keys, servers, servers, DefaultHashFn))
+	// Adding a fifth server moves about 1/5 of the keys, only to the new server
+	added := append(slices.Clone(servers), "serverE")
+	require.InDelta(t, 1.0/5, PlacementDisruption(keys, servers, added, DefaultHashFn), 0.03)
+	for _, key := range keys {
+		before := RendezvousHash(key, servers, 1)[0]
+		after := RendezvousHash(key, added, 1)[0]
+		if before != after {
+			require.Equal(t, "serverE", after)
+		}
+	}
+	// Removing a server only moves its own keys, about 1/4 of them
+	require.InDelta(t, 1.0/4, PlacementDisruption(keys, servers, servers[1:], DefaultHashFn), 0.03)
+}
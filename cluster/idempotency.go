@@ -0,0 +1,104 @@
+package cluster
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/semafind/semadb/diskstore"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/* An insert that times out or loses its connection may still have been
+ * applied by the remote node, retrying it would then fail because the points
+ * already exist. Requests carrying an idempotency key record the result of the
+ * first successful attempt in the node database so a replay returns the same
+ * result without inserting again. Failed attempts are not recorded and can be
+ * retried as usual. Keys expire after the configured ttl, expired keys are
+ * ignored on lookup and purged periodically. */
+
+var IDEMPOTENCYBUCKETKEY = "idempotencyKeys"
+
+type idempotencyRecord struct {
+	Count int
+	// Unix time in seconds after which the record is ignored
+	ExpiresAt int64
+}
+
+func idempotencyKey(userId, collectionId, shardId, key string) []byte {
+	return []byte(userId + DBDELIMITER + collectionId + DBDELIMITER + shardId + DBDELIMITER + key)
+}
+
+// idempotentResult returns the recorded result of the key if it has not yet
+// expired.
+func (c *ClusterNode) idempotentResult(key []byte) (record idempotencyRecord, found bool, err error) {
+	err = c.nodedb.Read(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get(IDEMPOTENCYBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get idempotency bucket: %w", err)
+		}
+		value := b.Get(key)
+		if value == nil {
+			return nil
+		}
+		if err := msgpack.Unmarshal(value, &record); err != nil {
+			return fmt.Errorf("could not unmarshal idempotency record: %w", err)
+		}
+		found = record.ExpiresAt > time.Now().Unix()
+		return nil
+	})
+	return
+}
+
+func (c *ClusterNode) recordIdempotentResult(key []byte, count int) error {
+	record := idempotencyRecord{
+		Count:     count,
+		ExpiresAt: time.Now().Unix() + int64(c.cfg.IdempotencyKeyTTL),
+	}
+	value, err := msgpack.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("could not marshal idempotency record: %w", err)
+	}
+	return c.nodedb.Write(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get(IDEMPOTENCYBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get write idempotency bucket: %w", err)
+		}
+		return b.Put(key, value)
+	})
+}
+
+// purgeIdempotencyKeys deletes the records that expired before now and returns
+// how many were deleted.
+func (c *ClusterNode) purgeIdempotencyKeys(now time.Time) (int, error) {
+	purged := 0
+	err := c.nodedb.Write(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get(IDEMPOTENCYBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get write idempotency bucket: %w", err)
+		}
+		// Deleting whilst iterating is not safe so we collect the keys first
+		expired := make([][]byte, 0)
+		err = b.ForEach(func(k, v []byte) error {
+			var record idempotencyRecord
+			if err := msgpack.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("could not unmarshal idempotency record: %w", err)
+			}
+			if record.ExpiresAt <= now.Unix() {
+				expired = append(expired, slices.Clone(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return fmt.Errorf("could not delete idempotency key: %w", err)
+			}
+		}
+		purged = len(expired)
+		return nil
+	})
+	return purged, err
+}
@@ -1,6 +1,10 @@
 package cluster
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 type clusterNodeMetrics struct {
 	// ---------------------------
@@ -11,6 +15,11 @@ type clusterNodeMetrics struct {
 	pointUpdateCount prometheus.Counter
 	pointDeleteCount prometheus.Counter
 	pointSearchCount prometheus.Counter
+	// ---------------------------
+	shardSearchDuration *prometheus.HistogramVec
+	shardGraphHops      *prometheus.HistogramVec
+	shardInsertCount    *prometheus.CounterVec
+	shardOpenCount      prometheus.Counter
 }
 
 func newClusterNodeMetrics() *clusterNodeMetrics {
@@ -54,6 +63,35 @@ func newClusterNodeMetrics() *clusterNodeMetrics {
 				Help: "Total number of points searched.",
 			},
 		),
+		shardSearchDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "cluster_node_shard_search_duration_seconds",
+				Help:    "Shard search latencies in seconds.",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"collection"},
+		),
+		shardGraphHops: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "cluster_node_shard_graph_hops",
+				Help:    "Number of graph nodes visited per shard search.",
+				Buckets: prometheus.ExponentialBuckets(16, 2, 12),
+			},
+			[]string{"collection"},
+		),
+		shardInsertCount: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "cluster_node_shard_insert_count",
+				Help: "Total number of points inserted into shards.",
+			},
+			[]string{"collection"},
+		),
+		shardOpenCount: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "cluster_node_shard_open_count",
+				Help: "Total number of shards opened from disk.",
+			},
+		),
 	}
 }
 
@@ -64,4 +102,28 @@ func (c *ClusterNode) RegisterMetrics(reg *prometheus.Registry) {
 	reg.MustRegister(c.metrics.pointUpdateCount)
 	reg.MustRegister(c.metrics.pointDeleteCount)
 	reg.MustRegister(c.metrics.pointSearchCount)
+	reg.MustRegister(c.metrics.shardSearchDuration)
+	reg.MustRegister(c.metrics.shardGraphHops)
+	reg.MustRegister(c.metrics.shardInsertCount)
+	reg.MustRegister(c.metrics.shardOpenCount)
+}
+
+// ---------------------------
+
+// shardMetricsRecorder records the metrics of the shards of a collection
+type shardMetricsRecorder struct {
+	metrics      *clusterNodeMetrics
+	collectionId string
+}
+
+func (r shardMetricsRecorder) ObserveSearchLatency(latency time.Duration) {
+	r.metrics.shardSearchDuration.WithLabelValues(r.collectionId).Observe(latency.Seconds())
+}
+
+func (r shardMetricsRecorder) ObserveGraphHops(hops int) {
+	r.metrics.shardGraphHops.WithLabelValues(r.collectionId).Observe(float64(hops))
+}
+
+func (r shardMetricsRecorder) IncInsert(count int) {
+	r.metrics.shardInsertCount.WithLabelValues(r.collectionId).Add(float64(count))
 }
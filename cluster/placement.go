@@ -50,3 +50,16 @@ func distributePoints(shards []shardInfo, points []models.Point, maxShardSize, m
 	// ---------------------------
 	return shardAssignments, nil
 }
+
+// chunkRange splits the range of points into consecutive chunks of at most
+// chunkSize points. A chunk size of 0 or less gives the whole range.
+func chunkRange(pRange [2]int, chunkSize int) [][2]int {
+	if chunkSize <= 0 || pRange[1]-pRange[0] <= chunkSize {
+		return [][2]int{pRange}
+	}
+	chunks := make([][2]int, 0, (pRange[1]-pRange[0]+chunkSize-1)/chunkSize)
+	for start := pRange[0]; start < pRange[1]; start += chunkSize {
+		chunks = append(chunks, [2]int{start, min(start+chunkSize, pRange[1])})
+	}
+	return chunks
+}
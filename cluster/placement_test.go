@@ -71,3 +71,10 @@ func Test_distributePoints(t *testing.T) {
 		})
 	}
 }
+
+func Test_chunkRange(t *testing.T) {
+	require.Equal(t, [][2]int{{3, 10}}, chunkRange([2]int{3, 10}, 0))
+	require.Equal(t, [][2]int{{3, 10}}, chunkRange([2]int{3, 10}, 7))
+	require.Equal(t, [][2]int{{3, 6}, {6, 9}, {9, 10}}, chunkRange([2]int{3, 10}, 3))
+	require.Equal(t, [][2]int{{0, 2}, {2, 4}}, chunkRange([2]int{0, 4}, 2))
+}
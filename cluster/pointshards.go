@@ -0,0 +1,167 @@
+package cluster
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+)
+
+/* Points are distributed to shards on insert and nothing records where they
+ * went, so getting or deleting a point asks every shard of the collection.
+ * Collections created with a point shard index record the shard of every
+ * inserted point in the node database that holds the collection entry, which
+ * lets those operations contact only the shard of the point. This costs an
+ * extra write per insert and delete, hence it is optional. Points without an
+ * entry, e.g. inserted before a failed index write, fall back to asking every
+ * shard so the index is only ever an optimisation. */
+
+var POINTSHARDSBUCKETKEY = "pointShards"
+
+func pointShardPrefix(userId, collectionId string) []byte {
+	return []byte(userId + DBDELIMITER + collectionId + DBDELIMITER)
+}
+
+func pointShardKey(userId, collectionId string, id uuid.UUID) []byte {
+	return append(pointShardPrefix(userId, collectionId), id[:]...)
+}
+
+// ---------------------------
+
+type RPCSetPointShardsRequest struct {
+	RPCRequestArgs
+	UserId       string
+	CollectionId string
+	Ids          []uuid.UUID
+	// The shard of each id, if empty the ids are removed from the index
+	ShardIds []string
+}
+
+type RPCSetPointShardsResponse struct{}
+
+func (c *ClusterNode) RPCSetPointShards(args *RPCSetPointShardsRequest, reply *RPCSetPointShardsResponse) error {
+	c.logger.Debug().Str("userId", args.UserId).Str("collectionId", args.CollectionId).Int("count", len(args.Ids)).Msg("RPCSetPointShards")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCSetPointShards", args, reply)
+	}
+	if len(args.ShardIds) != 0 && len(args.ShardIds) != len(args.Ids) {
+		return fmt.Errorf("got %d shard ids for %d point ids", len(args.ShardIds), len(args.Ids))
+	}
+	return c.nodedb.Write(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get(POINTSHARDSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get write point shards bucket: %w", err)
+		}
+		for i, id := range args.Ids {
+			key := pointShardKey(args.UserId, args.CollectionId, id)
+			if len(args.ShardIds) == 0 {
+				err = b.Delete(key)
+			} else {
+				err = b.Put(key, []byte(args.ShardIds[i]))
+			}
+			if err != nil {
+				return fmt.Errorf("could not set point shard: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// ---------------------------
+
+type RPCGetPointShardsRequest struct {
+	RPCRequestArgs
+	UserId       string
+	CollectionId string
+	Ids          []uuid.UUID
+}
+
+type RPCGetPointShardsResponse struct {
+	// The shard of each id, empty if the id is not in the index
+	ShardIds []string
+}
+
+func (c *ClusterNode) RPCGetPointShards(args *RPCGetPointShardsRequest, reply *RPCGetPointShardsResponse) error {
+	c.logger.Debug().Str("userId", args.UserId).Str("collectionId", args.CollectionId).Int("count", len(args.Ids)).Msg("RPCGetPointShards")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCGetPointShards", args, reply)
+	}
+	return c.nodedb.Read(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get(POINTSHARDSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get point shards bucket: %w", err)
+		}
+		reply.ShardIds = make([]string, len(args.Ids))
+		for i, id := range args.Ids {
+			reply.ShardIds[i] = string(b.Get(pointShardKey(args.UserId, args.CollectionId, id)))
+		}
+		return nil
+	})
+}
+
+// ---------------------------
+
+// setPointShards records the shards of the ids in the index of the collection,
+// without shard ids the ids are removed.
+func (c *ClusterNode) setPointShards(col models.Collection, ids []uuid.UUID, shardIds []string) error {
+	req := RPCSetPointShardsRequest{
+		RPCRequestArgs: RPCRequestArgs{
+			Source: c.MyHostname,
+			Dest:   c.placement(col.UserId, 1)[0],
+		},
+		UserId:       col.UserId,
+		CollectionId: col.Id,
+		Ids:          ids,
+		ShardIds:     shardIds,
+	}
+	if err := c.RPCSetPointShards(&req, &RPCSetPointShardsResponse{}); err != nil {
+		return fmt.Errorf("could not set point shards: %w", err)
+	}
+	return nil
+}
+
+// getPointShards returns the shard of each id as recorded in the index of the
+// collection, empty for ids that are not in the index.
+func (c *ClusterNode) getPointShards(col models.Collection, ids []uuid.UUID) ([]string, error) {
+	req := RPCGetPointShardsRequest{
+		RPCRequestArgs: RPCRequestArgs{
+			Source: c.MyHostname,
+			Dest:   c.placement(col.UserId, 1)[0],
+		},
+		UserId:       col.UserId,
+		CollectionId: col.Id,
+		Ids:          ids,
+	}
+	resp := RPCGetPointShardsResponse{}
+	if err := c.RPCGetPointShards(&req, &resp); err != nil {
+		return nil, fmt.Errorf("could not get point shards: %w", err)
+	}
+	return resp.ShardIds, nil
+}
+
+// ---------------------------
+
+// deletePointShardPrefix removes the index entries of the collection, it must
+// be called in a write transaction of the node database.
+func deletePointShardPrefix(bm diskstore.BucketManager, userId, collectionId string) error {
+	b, err := bm.Get(POINTSHARDSBUCKETKEY)
+	if err != nil {
+		return fmt.Errorf("could not get write point shards bucket: %w", err)
+	}
+	// Deleting whilst iterating is not safe so we collect the keys first
+	keys := make([][]byte, 0)
+	err = b.PrefixScan(pointShardPrefix(userId, collectionId), func(k, v []byte) error {
+		keys = append(keys, append([]byte(nil), k...))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not scan point shards: %w", err)
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return fmt.Errorf("could not delete point shard: %w", err)
+		}
+	}
+	return nil
+}
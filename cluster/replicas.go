@@ -0,0 +1,174 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard"
+)
+
+/* A shard may be replicated on multiple servers to scale reads with one server,
+ * the first in the rendezvous order, owning the writes. Replicas catch up with
+ * the primary through its change feed and so are eventually consistent. Each
+ * replica reports the time of the last write it has applied which lets us
+ * measure how far behind the primary it is and pick a replica that is fresh
+ * enough for a read, e.g. one that has seen the writes of the client. */
+
+type shardReplica struct {
+	Server        string
+	LastWriteTime int64
+}
+
+// replicaLag returns how far behind the primary a replica is based on the last
+// applied write of each.
+func replicaLag(primary, replica shardReplica) time.Duration {
+	return time.Duration(max(primary.LastWriteTime-replica.LastWriteTime, 0))
+}
+
+// selectReplica picks the freshest replica that has applied writes up to at
+// least minWriteTime. A minWriteTime of 0 accepts any replica. Equally fresh
+// replicas are picked in the given order.
+func selectReplica(replicas []shardReplica, minWriteTime int64) (shardReplica, error) {
+	var selected shardReplica
+	found := false
+	for _, r := range replicas {
+		if r.LastWriteTime < minWriteTime {
+			continue
+		}
+		if !found || r.LastWriteTime > selected.LastWriteTime {
+			selected = r
+			found = true
+		}
+	}
+	if !found {
+		return shardReplica{}, fmt.Errorf("no replica has caught up to %d: %w", minWriteTime, ErrShardUnavailable)
+	}
+	return selected, nil
+}
+
+// getShardReplicas asks the servers responsible for a shard for their last
+// applied write. Unreachable servers are left out.
+func (c *ClusterNode) getShardReplicas(col models.Collection, shardId string, replicaCount int) []shardReplica {
+	servers := c.placement(shardId, replicaCount)
+	replicas := make([]shardReplica, 0, len(servers))
+	for _, server := range servers {
+		getInfoRequest := RPCGetShardInfoRequest{
+			RPCRequestArgs: RPCRequestArgs{
+				Source: c.MyHostname,
+				Dest:   server,
+			},
+			Collection: col,
+			ShardId:    shardId,
+		}
+		getInfoResponse := RPCGetShardInfoResponse{}
+		if err := c.RPCGetShardInfo(&getInfoRequest, &getInfoResponse); err != nil {
+			c.logger.Warn().Err(err).Str("shardId", shardId).Str("server", server).Msg("could not get replica info")
+			continue
+		}
+		replicas = append(replicas, shardReplica{Server: server, LastWriteTime: getInfoResponse.LastWriteTime})
+	}
+	return replicas
+}
+
+// readServer returns the server to read a shard from. A shard without replicas
+// is read from its only server unless the read asks for a minimum write time,
+// otherwise the freshest replica that has applied writes up to minWriteTime is
+// picked and the replicas behind it are repaired, see readReplica.
+func (c *ClusterNode) readServer(col models.Collection, shardId string, minWriteTime int64) (string, error) {
+	if col.Replicas <= 1 && minWriteTime == 0 {
+		return c.placement(shardId, 1)[0], nil
+	}
+	selected, err := c.readReplica(col, shardId, max(int(col.Replicas), 1), minWriteTime)
+	if err != nil {
+		return "", err
+	}
+	return selected.Server, nil
+}
+
+// ---------------------------
+
+/* Reading through the replicas also repairs them, the freshest replica is
+ * returned for the read and any replica that is behind it is brought up to date
+ * in the background by copying over the changes it has missed. This way
+ * replicas converge even if they missed changes from the primary, e.g. while
+ * they were restarting. */
+
+// Number of changes copied at a time when repairing a stale replica
+const repairBatchSize = 1000
+
+// readReplica picks a replica to read from like selectReplica and repairs the
+// replicas that are behind it in the background.
+func (c *ClusterNode) readReplica(col models.Collection, shardId string, replicaCount int, minWriteTime int64) (shardReplica, error) {
+	replicas := c.getShardReplicas(col, shardId, replicaCount)
+	selected, err := selectReplica(replicas, minWriteTime)
+	if err != nil {
+		return shardReplica{}, err
+	}
+	for _, r := range replicas {
+		if r.LastWriteTime >= selected.LastWriteTime {
+			continue
+		}
+		select {
+		case <-c.doneCh:
+			// The node is shutting down, the repair can happen on a later read
+			return selected, nil
+		default:
+		}
+		// Concurrent reads of the same shard start one repair per replica
+		repairKey := col.UserId + "/" + col.Id + "/" + shardId + "/" + r.Server
+		if _, running := c.replicaRepairs.LoadOrStore(repairKey, struct{}{}); running {
+			continue
+		}
+		c.bgWaitGroup.Add(1)
+		go func(stale shardReplica) {
+			defer c.bgWaitGroup.Done()
+			defer c.replicaRepairs.Delete(repairKey)
+			if err := c.repairReplica(col, shardId, selected, stale); err != nil {
+				c.logger.Error().Err(err).Str("shardId", shardId).Str("server", stale.Server).Msg("could not repair replica")
+			}
+		}(r)
+	}
+	return selected, nil
+}
+
+// repairReplica copies the changes applied to the source replica after the last
+// write of the stale replica onto the stale replica.
+func (c *ClusterNode) repairReplica(col models.Collection, shardId string, source, stale shardReplica) error {
+	c.logger.Debug().Str("shardId", shardId).Str("source", source.Server).Str("stale", stale.Server).Dur("lag", replicaLag(source, stale)).Msg("repairReplica")
+	// Changes at the same timestamp as the last write may be copied again
+	// which is fine because applying a change twice has the same outcome.
+	cursor := shard.ChangeCursor{Timestamp: stale.LastWriteTime}
+	for {
+		getChangesRequest := RPCGetPointChangesRequest{
+			RPCRequestArgs: RPCRequestArgs{
+				Source: c.MyHostname,
+				Dest:   source.Server,
+			},
+			Collection: col,
+			ShardId:    shardId,
+			Cursor:     cursor,
+			Limit:      repairBatchSize,
+		}
+		getChangesResponse := RPCGetPointChangesResponse{}
+		if err := c.RPCGetPointChanges(&getChangesRequest, &getChangesResponse); err != nil {
+			return fmt.Errorf("could not get changes from %s: %w", source.Server, err)
+		}
+		if len(getChangesResponse.Changes) == 0 {
+			return nil
+		}
+		applyRequest := RPCApplyPointChangesRequest{
+			RPCRequestArgs: RPCRequestArgs{
+				Source: c.MyHostname,
+				Dest:   stale.Server,
+			},
+			Collection: col,
+			ShardId:    shardId,
+			Changes:    getChangesResponse.Changes,
+		}
+		if err := c.RPCApplyPointChanges(&applyRequest, &RPCApplyPointChangesResponse{}); err != nil {
+			return fmt.Errorf("could not apply changes to %s: %w", stale.Server, err)
+		}
+		cursor = getChangesResponse.NextCursor
+	}
+}
@@ -0,0 +1,283 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func Test_replicaLag(t *testing.T) {
+	primary := shardReplica{Server: "primary", LastWriteTime: int64(10 * time.Second)}
+	lagging := shardReplica{Server: "lagging", LastWriteTime: int64(7 * time.Second)}
+	require.Equal(t, 3*time.Second, replicaLag(primary, lagging))
+	require.Equal(t, time.Duration(0), replicaLag(primary, primary))
+	// A replica can't be ahead of the primary
+	require.Equal(t, time.Duration(0), replicaLag(lagging, primary))
+}
+
+func Test_selectReplica(t *testing.T) {
+	primary := shardReplica{Server: "primary", LastWriteTime: 100}
+	fresh := shardReplica{Server: "fresh", LastWriteTime: 90}
+	lagging := shardReplica{Server: "lagging", LastWriteTime: 50}
+	replicas := []shardReplica{lagging, fresh}
+	// Without a requirement the freshest replica is preferred
+	r, err := selectReplica(replicas, 0)
+	require.NoError(t, err)
+	require.Equal(t, "fresh", r.Server)
+	// Read your writes up to 60 must skip the lagging replica
+	r, err = selectReplica([]shardReplica{lagging, lagging, fresh}, 60)
+	require.NoError(t, err)
+	require.Equal(t, "fresh", r.Server)
+	// No replica has seen write 95 so only the primary qualifies
+	_, err = selectReplica(replicas, 95)
+	require.ErrorIs(t, err, ErrShardUnavailable)
+	r, err = selectReplica(append(replicas, primary), 95)
+	require.NoError(t, err)
+	require.Equal(t, "primary", r.Server)
+}
+
+// freePort returns a port that is free to listen on so that parallel test runs
+// do not collide on fixed ports.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// servedClusterNode creates a node that serves RPC requests on the given port
+// so that other nodes can reach it.
+func servedClusterNode(t *testing.T, port int, servers []string) *ClusterNode {
+	tempDir := t.TempDir()
+	c, err := NewNode(ClusterNodeConfig{
+		RootDir:        tempDir,
+		Servers:        servers,
+		RpcHost:        "localhost",
+		RpcPort:        port,
+		RpcTimeout:     5,
+		RpcRetries:     3,
+		RpcRetryDelay:  50,
+		MaxSearchLimit: 75,
+		ShardManager: ShardManagerConfig{
+			RootDir:      tempDir,
+			ShardTimeout: 30,
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.Serve())
+	return c
+}
+
+func Test_readReplicaRepairs(t *testing.T) {
+	portA, portB := freePort(t), freePort(t)
+	servers := []string{fmt.Sprintf("localhost:%d", portA), fmt.Sprintf("localhost:%d", portB)}
+	nodeA := servedClusterNode(t, portA, servers)
+	nodeB := servedClusterNode(t, portB, servers)
+	col := models.Collection{
+		UserId: "alice",
+		Id:     "docs",
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorFlat,
+				VectorFlat: &models.IndexVectorFlatParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+				},
+			},
+		},
+	}
+	// ---------------------------
+	// Only the replica on node A receives the points so node B is stale
+	points := make([]models.Point, 10)
+	for i := range points {
+		data, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{float32(i), 1}})
+		require.NoError(t, err)
+		points[i] = models.Point{Id: uuid.New(), Data: data}
+	}
+	err := nodeA.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+		return s.InsertPoints(context.Background(), points)
+	})
+	require.NoError(t, err)
+	pointCount := func(c *ClusterNode) uint64 {
+		var count uint64
+		err := c.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+			si, err := s.Info(false, false)
+			count = si.PointCount
+			return err
+		})
+		require.NoError(t, err)
+		return count
+	}
+	require.EqualValues(t, 0, pointCount(nodeB))
+	// ---------------------------
+	// Either node can read through the replicas, the newest one is picked and
+	// the stale one catches up in the background.
+	selected, err := nodeB.readReplica(col, "shard0", 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, servers[0], selected.Server)
+	require.Eventually(t, func() bool {
+		return pointCount(nodeB) == 10
+	}, 5*time.Second, 50*time.Millisecond)
+	// ---------------------------
+	// Once repaired both replicas have the same last write time
+	replicas := nodeA.getShardReplicas(col, "shard0", 2)
+	require.Len(t, replicas, 2)
+	require.Equal(t, replicas[0].LastWriteTime, replicas[1].LastWriteTime)
+	require.NoError(t, nodeA.Close())
+	require.NoError(t, nodeB.Close())
+}
+
+func Test_SearchPointsAfter(t *testing.T) {
+	portA, portB := freePort(t), freePort(t)
+	servers := []string{fmt.Sprintf("localhost:%d", portA), fmt.Sprintf("localhost:%d", portB)}
+	nodeA := servedClusterNode(t, portA, servers)
+	nodeB := servedClusterNode(t, portB, servers)
+	col := models.Collection{
+		UserId:   "alice",
+		Id:       "docs",
+		Replicas: 2,
+		ShardIds: []string{"shard0"},
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorFlat,
+				VectorFlat: &models.IndexVectorFlatParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+				},
+			},
+		},
+	}
+	// ---------------------------
+	// Only the replica on node A has the points, node B is lagging behind
+	points := make([]models.Point, 10)
+	for i := range points {
+		data, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{float32(i), 1}})
+		require.NoError(t, err)
+		points[i] = models.Point{Id: uuid.New(), Data: data}
+	}
+	var lastWriteTime int64
+	err := nodeA.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+		if err := s.InsertPoints(context.Background(), points); err != nil {
+			return err
+		}
+		si, err := s.Info(false, false)
+		lastWriteTime = si.LastWriteTime
+		return err
+	})
+	require.NoError(t, err)
+	// ---------------------------
+	// Reading its own writes from node B must be routed to node A
+	server, err := nodeB.readServer(col, "shard0", lastWriteTime)
+	require.NoError(t, err)
+	require.Equal(t, servers[0], server)
+	sr := models.SearchRequest{
+		Query: models.Query{
+			Property: "vector",
+			VectorFlat: &models.SearchVectorFlatOptions{
+				Vector:   []float32{0, 1},
+				Operator: "near",
+				Limit:    5,
+			},
+		},
+		Limit: 5,
+	}
+	results, failedShards, err := nodeB.SearchPointsAfter(col, sr, lastWriteTime)
+	require.NoError(t, err)
+	require.Zero(t, failedShards)
+	require.Len(t, results, 5)
+	require.Equal(t, points[0].Id, results[0].Point.Id)
+	_, found, err := nodeB.GetPointAfter(col, points[1].Id, false, lastWriteTime)
+	require.NoError(t, err)
+	require.True(t, found)
+	// No replica has seen a later write
+	_, failedShards, err = nodeB.SearchPointsAfter(col, sr, lastWriteTime+1)
+	require.ErrorIs(t, err, ErrShardUnavailable)
+	require.Equal(t, 1, failedShards)
+	// ---------------------------
+	// Searching through the replicas also repaired the lagging one
+	require.Eventually(t, func() bool {
+		var count uint64
+		err := nodeB.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+			si, err := s.Info(false, false)
+			count = si.PointCount
+			return err
+		})
+		return err == nil && count == 10
+	}, 5*time.Second, 50*time.Millisecond)
+	require.NoError(t, nodeA.Close())
+	require.NoError(t, nodeB.Close())
+}
+
+func Test_replicatedWrites(t *testing.T) {
+	portA, portB := freePort(t), freePort(t)
+	servers := []string{fmt.Sprintf("localhost:%d", portA), fmt.Sprintf("localhost:%d", portB)}
+	nodeA := servedClusterNode(t, portA, servers)
+	nodeB := servedClusterNode(t, portB, servers)
+	col := models.Collection{
+		UserId:   "alice",
+		Id:       "docs",
+		Replicas: 2,
+		ShardIds: []string{"shard0"},
+		UserPlan: models.UserPlan{MaxPointSize: 1000},
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorFlat,
+				VectorFlat: &models.IndexVectorFlatParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+				},
+			},
+		},
+	}
+	// ---------------------------
+	// Both replicas start with the same points
+	points := make([]models.Point, 10)
+	for i := range points {
+		data, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{float32(i), 1}, "size": i})
+		require.NoError(t, err)
+		points[i] = models.Point{Id: uuid.New(), Data: data}
+	}
+	ctx := shard.WithWriteTime(context.Background(), time.Now().UnixNano())
+	for _, c := range []*ClusterNode{nodeA, nodeB} {
+		err := c.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+			return s.InsertPoints(ctx, points)
+		})
+		require.NoError(t, err)
+	}
+	// ---------------------------
+	// Updates and deletes reach every replica with the same write time
+	data, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{5, 5}})
+	require.NoError(t, err)
+	failed, err := nodeA.UpdatePoints(col, []models.Point{{Id: points[0].Id, Data: data}})
+	require.NoError(t, err)
+	require.Empty(t, failed)
+	failed, err = nodeB.DeletePoints(col, []uuid.UUID{points[1].Id})
+	require.NoError(t, err)
+	require.Empty(t, failed)
+	deletedCount, _, err := nodeA.DeletePointsByFilter(col, "size == 2")
+	require.NoError(t, err)
+	require.Equal(t, 1, deletedCount)
+	require.Eventually(t, func() bool {
+		replicas := nodeA.getShardReplicas(col, "shard0", 2)
+		return len(replicas) == 2 && replicas[0].LastWriteTime == replicas[1].LastWriteTime
+	}, 5*time.Second, 50*time.Millisecond)
+	for _, c := range []*ClusterNode{nodeA, nodeB} {
+		err := c.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+			si, err := s.Info(false, false)
+			require.NoError(t, err)
+			require.EqualValues(t, 8, si.PointCount)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, nodeA.Close())
+	require.NoError(t, nodeB.Close())
+}
@@ -1,6 +1,7 @@
 package cluster
 
 import (
+	"context"
 	"fmt"
 	"net/rpc"
 	"time"
@@ -39,6 +40,22 @@ func (args RPCRequestArgs) Destination() string {
 	return args.Dest
 }
 
+// requestContext returns the context for handling a request on this node. The
+// remote caller gives up waiting after the rpc timeout so there is no point in
+// carrying on beyond it.
+func (c *ClusterNode) requestContext() (context.Context, context.CancelFunc) {
+	if c.cfg.RpcTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(c.cfg.RpcTimeout)*time.Second)
+}
+
+// retryDelay returns how long to wait before the given retry attempt, the delay
+// doubles with every attempt starting from the configured base delay.
+func (c *ClusterNode) retryDelay(attempt int) time.Duration {
+	return time.Duration(c.cfg.RpcRetryDelay) * time.Millisecond << attempt
+}
+
 func (c *ClusterNode) internalRoute(remoteFn string, args Destinationer, reply any) error {
 	destination := args.Destination()
 	c.logger.Debug().Str("destination", destination).Msg(remoteFn + ": routing")
@@ -49,15 +66,38 @@ func (c *ClusterNode) internalRoute(remoteFn string, args Destinationer, reply a
 		c.metrics.rpcRequestCount.WithLabelValues(remoteFn).Inc()
 	}()
 	// ---------------------------
-	for i := 0; i < c.cfg.RpcRetries; i++ {
+	/* All attempts share a single deadline of the rpc timeout because the remote
+	 * node stops handling the request after that long anyway, see
+	 * requestContext. We only retry when the request could not have reached the
+	 * remote node, i.e. dialing failed or the connection was shut down. A timed
+	 * out request may still be applied remotely and errors returned by the
+	 * remote function are final, so neither is retried. */
+	var deadline <-chan time.Time
+	if c.cfg.RpcTimeout > 0 {
+		timeout := time.NewTimer(time.Duration(c.cfg.RpcTimeout) * time.Second)
+		defer timeout.Stop()
+		deadline = timeout.C
+	}
+	attempts := max(c.cfg.RpcRetries, 1)
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			delay := time.NewTimer(c.retryDelay(i - 1))
+			select {
+			case <-delay.C:
+			case <-deadline:
+				delay.Stop()
+				return fmt.Errorf(remoteFn+" timed out after %d attempts: %w", i, ErrTimeout)
+			}
+		}
 		client, err := c.rpcClient(destination)
 		if err != nil {
-			return fmt.Errorf("failed to get client: %v", err)
+			lastErr = fmt.Errorf("failed to get client: %w", err)
+			c.logger.Debug().Err(err).Str("destination", destination).Int("attempt", i+1).Msg(remoteFn + ": dial failed")
+			continue
 		}
 		// Make request with timeout
 		rpcCall := client.Go(remoteFn, args, reply, nil)
-		timeout := time.NewTimer(time.Duration(c.cfg.RpcTimeout) * time.Second)
-		defer timeout.Stop()
 		select {
 		case <-rpcCall.Done:
 			if rpcCall.Error != nil {
@@ -68,6 +108,7 @@ func (c *ClusterNode) internalRoute(remoteFn string, args Destinationer, reply a
 					delete(c.rpcClients, destination)
 					c.rpcClientsMu.Unlock()
 					c.logger.Debug().Str("destination", destination).Msg("Removed dead client")
+					lastErr = fmt.Errorf("failed to call %v: %w", remoteFn, rpcCall.Error)
 					continue
 				}
 				// The method's return value, if non-nil, is passed back as a string that the client sees as if created by errors.New
@@ -84,9 +125,9 @@ func (c *ClusterNode) internalRoute(remoteFn string, args Destinationer, reply a
 				return fmt.Errorf("failed to call %v: %w", remoteFn, finalErr)
 			}
 			return nil
-		case <-timeout.C:
+		case <-deadline:
 			return fmt.Errorf(remoteFn+" timed out: %w", ErrTimeout)
 		}
 	}
-	return nil
+	return lastErr
 }
@@ -0,0 +1,41 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_InternalRouteRetries(t *testing.T) {
+	c := tempClusterNode(t, "localhost:1")
+	c.cfg.RpcRetries = 3
+	c.cfg.RpcRetryDelay = 10
+	args := RPCPingRequest{
+		RPCRequestArgs: RPCRequestArgs{
+			Source: c.MyHostname,
+			Dest:   "localhost:1",
+		},
+	}
+	// Dialing fails on every attempt and the delays between them add up
+	start := time.Now()
+	err := c.internalRoute("ClusterNode.RPCPing", args, &RPCPingResponse{})
+	require.ErrorContains(t, err, "failed to get client")
+	require.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+	// ---------------------------
+	// Backing off cannot exceed the rpc timeout shared by the attempts
+	c.cfg.RpcRetries = 100
+	c.cfg.RpcRetryDelay = 200
+	start = time.Now()
+	err = c.internalRoute("ClusterNode.RPCPing", args, &RPCPingResponse{})
+	require.ErrorIs(t, err, ErrTimeout)
+	require.Less(t, time.Since(start), 2*time.Second)
+	require.NoError(t, c.Close())
+}
+
+func Test_RetryDelay(t *testing.T) {
+	c := &ClusterNode{cfg: ClusterNodeConfig{RpcRetryDelay: 100}}
+	require.Equal(t, 100*time.Millisecond, c.retryDelay(0))
+	require.Equal(t, 200*time.Millisecond, c.retryDelay(1))
+	require.Equal(t, 800*time.Millisecond, c.retryDelay(3))
+}
@@ -1,7 +1,10 @@
 package cluster
 
 import (
+	"errors"
 	"fmt"
+	"runtime"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/semafind/semadb/diskstore"
@@ -12,23 +15,38 @@ import (
 
 // ---------------------------
 
-// type rpcPingRequest struct {
-// 	rpcRequestArgs
-// 	Message string
-// }
+type RPCPingRequest struct {
+	RPCRequestArgs
+}
 
-// type rpcPingResponse struct {
-// 	Message string
-// }
+/* The ping response is used by health checks so fields should only be added,
+ * not changed or removed. */
+type RPCPingResponse struct {
+	Hostname     string
+	Uptime       time.Duration
+	LoadedShards int
+	// Go runtime memory statistics in bytes
+	HeapAlloc uint64
+	Sys       uint64
+	NumGC     uint32
+}
 
-// func (c *ClusterNode) rpcPing(args *rpcPingRequest, reply *rpcPingResponse) error {
-// 	c.logger.Debug().Interface("args", args).Msg("Ping")
-// 	if args.Dest != c.MyHostname {
-// 		return c.internalRoute("ClusterNode.Ping", args, reply)
-// 	}
-// 	reply.Message = fmt.Sprintf("Pong from semadb %v, message: %v", c.MyHostname, args.Message)
-// 	return nil
-// }
+func (c *ClusterNode) RPCPing(args *RPCPingRequest, reply *RPCPingResponse) error {
+	c.logger.Debug().Str("dest", args.Dest).Msg("RPCPing")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCPing", args, reply)
+	}
+	// ---------------------------
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	reply.Hostname = c.MyHostname
+	reply.Uptime = time.Since(c.startTime)
+	reply.LoadedShards = c.shardManager.loadedShardCount()
+	reply.HeapAlloc = memStats.HeapAlloc
+	reply.Sys = memStats.Sys
+	reply.NumGC = memStats.NumGC
+	return nil
+}
 
 // ---------------------------
 
@@ -40,6 +58,8 @@ type RPCCreateCollectionRequest struct {
 type RPCCreateCollectionResponse struct {
 	AlreadyExists bool
 	QuotaReached  bool
+	// Set if the collection is invalid, nothing is stored then
+	Problems []string
 }
 
 func (c *ClusterNode) RPCCreateCollection(args *RPCCreateCollectionRequest, reply *RPCCreateCollectionResponse) error {
@@ -48,6 +68,14 @@ func (c *ClusterNode) RPCCreateCollection(args *RPCCreateCollectionRequest, repl
 		return c.internalRoute("ClusterNode.RPCCreateCollection", args, reply)
 	}
 	// ---------------------------
+	/* The http layer validates the collection too but other callers may not,
+	 * an invalid schema would only surface when points are inserted so we
+	 * reject it here before anything is stored. */
+	if problems := validateCollection(args.Collection); len(problems) > 0 {
+		reply.Problems = problems
+		return nil
+	}
+	// ---------------------------
 	// Marshal collection
 	colBytes, err := msgpack.Marshal(args.Collection)
 	if err != nil {
@@ -115,6 +143,10 @@ func (c *ClusterNode) RPCDeleteCollection(args *RPCDeleteCollectionRequest, repl
 		if err := b.Delete([]byte(args.Collection.UserId + DBDELIMITER + args.Collection.Id)); err != nil {
 			return fmt.Errorf("could not delete collection: %w", err)
 		}
+		// ---------------------------
+		if args.Collection.PointShardIndex {
+			return deletePointShardPrefix(bm, args.Collection.UserId, args.Collection.Id)
+		}
 		return nil
 	})
 	return err
@@ -259,8 +291,9 @@ type RPCGetShardInfoRequest struct {
 }
 
 type RPCGetShardInfoResponse struct {
-	PointCount int64
-	Size       int64
+	PointCount    int64
+	Size          int64
+	LastWriteTime int64
 }
 
 func (c *ClusterNode) RPCGetShardInfo(args *RPCGetShardInfoRequest, reply *RPCGetShardInfoResponse) error {
@@ -270,9 +303,10 @@ func (c *ClusterNode) RPCGetShardInfo(args *RPCGetShardInfoRequest, reply *RPCGe
 	}
 	// ---------------------------
 	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
-		si, err := s.Info()
+		si, err := s.Info(false, false)
 		reply.PointCount = int64(si.PointCount)
 		reply.Size = si.Size
+		reply.LastWriteTime = si.LastWriteTime
 		return err
 	})
 }
@@ -286,6 +320,8 @@ type RPCDeleteCollectionShardsRequest struct {
 
 type RPCDeleteCollectionShardsResponse struct {
 	DeletedShardIds []string
+	// The error of each shard that could not be deleted
+	ShardErrors map[string]string
 }
 
 func (c *ClusterNode) RPCDeleteCollectionShards(args *RPCDeleteCollectionShardsRequest, reply *RPCDeleteCollectionShardsResponse) error {
@@ -293,8 +329,9 @@ func (c *ClusterNode) RPCDeleteCollectionShards(args *RPCDeleteCollectionShardsR
 	if args.Dest != c.MyHostname {
 		return c.internalRoute("ClusterNode.RPCDeleteCollectionShards", args, reply)
 	}
-	deletedShardIds, err := c.shardManager.DeleteCollectionShards(args.Collection)
+	deletedShardIds, shardErrors, err := c.shardManager.DeleteCollectionShards(args.Collection)
 	reply.DeletedShardIds = deletedShardIds
+	reply.ShardErrors = shardErrors
 	return err
 }
 
@@ -305,6 +342,13 @@ type RPCInsertPointsRequest struct {
 	Collection models.Collection
 	ShardId    string
 	Points     []models.Point
+	// Optional, a request replayed with the same key returns the result of
+	// the first successful attempt instead of inserting again
+	IdempotencyKey string
+	// Unix nano time chosen by the coordinator to record the changes at, so
+	// every replica records the same time for the write. Zero uses the clock
+	// of the replica.
+	WriteTime int64
 }
 
 // This response is not really used, but we need to return something otherwise
@@ -320,14 +364,38 @@ func (c *ClusterNode) RPCInsertPoints(args *RPCInsertPointsRequest, reply *RPCIn
 		return c.internalRoute("ClusterNode.RPCInsertPoints", args, reply)
 	}
 	// ---------------------------
-	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
-		err := s.InsertPoints(args.Points)
+	var idemKey []byte
+	if args.IdempotencyKey != "" && c.cfg.IdempotencyKeyTTL > 0 {
+		idemKey = idempotencyKey(args.Collection.UserId, args.Collection.Id, args.ShardId, args.IdempotencyKey)
+		record, found, err := c.idempotentResult(idemKey)
+		if err != nil {
+			return fmt.Errorf("could not check idempotency key: %w", err)
+		}
+		if found {
+			reply.Count = record.Count
+			return nil
+		}
+	}
+	// ---------------------------
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	ctx = shard.WithWriteTime(ctx, args.WriteTime)
+	err := c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		err := s.InsertPoints(ctx, args.Points)
 		if err == nil {
 			reply.Count = len(args.Points)
 			c.metrics.pointInsertCount.Add(float64(len(args.Points)))
 		}
 		return err
 	})
+	if err != nil || idemKey == nil {
+		return err
+	}
+	if err := c.recordIdempotentResult(idemKey, reply.Count); err != nil {
+		// The points are inserted so we only lose the protection of a replay
+		c.logger.Error().Err(err).Str("idempotencyKey", args.IdempotencyKey).Msg("could not record idempotency key")
+	}
+	return nil
 }
 
 // ---------------------------
@@ -337,6 +405,8 @@ type RPCUpdatePointsRequest struct {
 	Collection models.Collection
 	ShardId    string
 	Points     []models.Point
+	// See RPCInsertPointsRequest
+	WriteTime int64
 }
 
 type RPCUpdatePointsResponse struct {
@@ -349,8 +419,44 @@ func (c *ClusterNode) RPCUpdatePoints(args *RPCUpdatePointsRequest, reply *RPCUp
 		return c.internalRoute("ClusterNode.RPCUpdatePoints", args, reply)
 	}
 	// ---------------------------
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	ctx = shard.WithWriteTime(ctx, args.WriteTime)
+	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		updatedIds, err := s.UpdatePoints(ctx, args.Points)
+		reply.UpdatedIds = updatedIds
+		if err == nil {
+			c.metrics.pointUpdateCount.Add(float64(len(updatedIds)))
+		}
+		return err
+	})
+}
+
+// ---------------------------
+
+// Metadata updates cannot change vectors, see shard.UpdateMetadata.
+type RPCUpdateMetadataRequest struct {
+	RPCRequestArgs
+	Collection models.Collection
+	ShardId    string
+	// Msgpack encoded properties to merge into the data of each point
+	Updates map[uuid.UUID][]byte
+}
+
+type RPCUpdateMetadataResponse struct {
+	UpdatedIds []uuid.UUID
+}
+
+func (c *ClusterNode) RPCUpdateMetadata(args *RPCUpdateMetadataRequest, reply *RPCUpdateMetadataResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Int("count", len(args.Updates)).Msg("RPCUpdateMetadata")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCUpdateMetadata", args, reply)
+	}
+	// ---------------------------
+	ctx, cancel := c.requestContext()
+	defer cancel()
 	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
-		updatedIds, err := s.UpdatePoints(args.Points)
+		updatedIds, err := s.UpdateMetadata(ctx, args.Updates)
 		reply.UpdatedIds = updatedIds
 		if err == nil {
 			c.metrics.pointUpdateCount.Add(float64(len(updatedIds)))
@@ -366,6 +472,8 @@ type RPCDeletePointsRequest struct {
 	Collection models.Collection
 	ShardId    string
 	Ids        []uuid.UUID
+	// See RPCInsertPointsRequest
+	WriteTime int64
 }
 
 type RPCDeletePointsResponse struct {
@@ -382,8 +490,11 @@ func (c *ClusterNode) RPCDeletePoints(args *RPCDeletePointsRequest, reply *RPCDe
 	for _, id := range args.Ids {
 		deleteSet[id] = struct{}{}
 	}
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	ctx = shard.WithWriteTime(ctx, args.WriteTime)
 	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
-		delIds, err := s.DeletePoints(deleteSet)
+		delIds, err := s.DeletePoints(ctx, deleteSet)
 		reply.DeletedIds = delIds
 		if err == nil {
 			c.metrics.pointDeleteCount.Add(float64(len(delIds)))
@@ -394,6 +505,229 @@ func (c *ClusterNode) RPCDeletePoints(args *RPCDeletePointsRequest, reply *RPCDe
 
 // ---------------------------
 
+// The filter is an expression of the form property == value, see
+// deletefilter.go.
+type RPCDeletePointsByFilterRequest struct {
+	RPCRequestArgs
+	Collection models.Collection
+	ShardId    string
+	Filter     string
+	// See RPCInsertPointsRequest
+	WriteTime int64
+}
+
+type RPCDeletePointsByFilterResponse struct {
+	DeletedIds []uuid.UUID
+}
+
+func (c *ClusterNode) RPCDeletePointsByFilter(args *RPCDeletePointsByFilterRequest, reply *RPCDeletePointsByFilterResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Str("filter", args.Filter).Msg("RPCDeletePointsByFilter")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCDeletePointsByFilter", args, reply)
+	}
+	// ---------------------------
+	filter, err := parseDeleteFilter(args.Filter)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	ctx = shard.WithWriteTime(ctx, args.WriteTime)
+	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		delIds, err := s.DeletePointsByFilter(ctx, filter.match)
+		reply.DeletedIds = delIds
+		if err == nil {
+			c.metrics.pointDeleteCount.Add(float64(len(delIds)))
+		}
+		return err
+	})
+}
+
+// ---------------------------
+
+type RPCGetPointRequest struct {
+	RPCRequestArgs
+	Collection models.Collection
+	ShardId    string
+	Id         uuid.UUID
+	// Payloads can be large so they are only returned if asked for
+	IncludePayload bool
+}
+
+type RPCGetPointResponse struct {
+	Point    models.Point
+	NotFound bool
+}
+
+func (c *ClusterNode) RPCGetPoint(args *RPCGetPointRequest, reply *RPCGetPointResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Str("pointId", args.Id.String()).Msg("RPCGetPoint")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCGetPoint", args, reply)
+	}
+	// ---------------------------
+	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		point, found, err := s.GetPoint(args.Id)
+		if err != nil {
+			return err
+		}
+		if found && args.IncludePayload {
+			if point.Payload, err = s.GetPayload(args.Id); err != nil {
+				return err
+			}
+		}
+		reply.Point = point
+		reply.NotFound = !found
+		return nil
+	})
+}
+
+// ---------------------------
+
+type RPCGetPointChangesRequest struct {
+	RPCRequestArgs
+	Collection models.Collection
+	ShardId    string
+	// Changes strictly after the cursor are returned, use the NextCursor of the
+	// response to continue streaming large change sets.
+	Cursor shard.ChangeCursor
+	Limit  int
+}
+
+type RPCGetPointChangesResponse struct {
+	Changes    []shard.PointChange
+	NextCursor shard.ChangeCursor
+}
+
+func (c *ClusterNode) RPCGetPointChanges(args *RPCGetPointChangesRequest, reply *RPCGetPointChangesResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Msg("RPCGetPointChanges")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCGetPointChanges", args, reply)
+	}
+	// ---------------------------
+	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		changes, next, err := s.ChangesAfter(args.Cursor, args.Limit)
+		reply.Changes = changes
+		reply.NextCursor = next
+		return err
+	})
+}
+
+// Used by replicas to apply the changes pulled from the primary shard
+type RPCApplyPointChangesRequest struct {
+	RPCRequestArgs
+	Collection models.Collection
+	ShardId    string
+	Changes    []shard.PointChange
+}
+
+type RPCApplyPointChangesResponse struct{}
+
+func (c *ClusterNode) RPCApplyPointChanges(args *RPCApplyPointChangesRequest, reply *RPCApplyPointChangesResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Int("count", len(args.Changes)).Msg("RPCApplyPointChanges")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCApplyPointChanges", args, reply)
+	}
+	// ---------------------------
+	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		return s.ApplyChanges(args.Changes)
+	})
+}
+
+// ---------------------------
+
+// Used when maxExportGraphNodes is not configured
+const defaultMaxExportGraphNodes = 10000
+
+// Used to visualise the graph of a vector index, the number of nodes is capped
+// by the maxExportGraphNodes configuration.
+type RPCExportGraphRequest struct {
+	RPCRequestArgs
+	Collection models.Collection
+	ShardId    string
+	Property   string
+	// Zero or a larger value than the configured maximum uses the maximum
+	MaxNodes     int
+	WithPointIds bool
+}
+
+type RPCExportGraphResponse struct {
+	Nodes []shard.GraphNode
+}
+
+func (c *ClusterNode) RPCExportGraph(args *RPCExportGraphRequest, reply *RPCExportGraphResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Str("property", args.Property).Msg("RPCExportGraph")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCExportGraph", args, reply)
+	}
+	// ---------------------------
+	limit := c.cfg.MaxExportGraphNodes
+	if limit <= 0 {
+		limit = defaultMaxExportGraphNodes
+	}
+	maxNodes := args.MaxNodes
+	if maxNodes <= 0 || maxNodes > limit {
+		maxNodes = limit
+	}
+	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		nodes, err := s.ExportGraph(args.Property, maxNodes, args.WithPointIds)
+		reply.Nodes = nodes
+		return err
+	})
+}
+
+/* Re-embedding is driven by the client in two steps since the rpc calls
+ * cannot stream. The client asks for the next batch of points, computes the
+ * new vectors and sends them back. The shard keeps track of the progress so
+ * the client only needs to loop until an empty batch is returned. */
+type RPCReEmbedBatchRequest struct {
+	RPCRequestArgs
+	Collection models.Collection
+	ShardId    string
+	Property   string
+	BatchSize  int
+}
+
+type RPCReEmbedBatchResponse struct {
+	Points []models.Point
+}
+
+func (c *ClusterNode) RPCReEmbedBatch(args *RPCReEmbedBatchRequest, reply *RPCReEmbedBatchResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Str("property", args.Property).Msg("RPCReEmbedBatch")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCReEmbedBatch", args, reply)
+	}
+	// ---------------------------
+	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		points, err := s.ReEmbedBatch(args.Property, args.BatchSize)
+		reply.Points = points
+		return err
+	})
+}
+
+type RPCApplyReEmbedRequest struct {
+	RPCRequestArgs
+	Collection models.Collection
+	ShardId    string
+	Property   string
+	PointIds   []uuid.UUID
+	Vectors    [][]float32
+}
+
+type RPCApplyReEmbedResponse struct{}
+
+func (c *ClusterNode) RPCApplyReEmbed(args *RPCApplyReEmbedRequest, reply *RPCApplyReEmbedResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Int("count", len(args.PointIds)).Msg("RPCApplyReEmbed")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCApplyReEmbed", args, reply)
+	}
+	// ---------------------------
+	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		return s.ApplyReEmbed(args.Property, args.PointIds, args.Vectors)
+	})
+}
+
+// ---------------------------
+
 type RPCSearchPointsRequest struct {
 	RPCRequestArgs
 	Collection    models.Collection
@@ -403,6 +737,11 @@ type RPCSearchPointsRequest struct {
 
 type RPCSearchPointsResponse struct {
 	Points []models.SearchResult
+	// Number of matching points in the shard before offset and limit, useful
+	// for pagination. This is an approximate count, vector searches only
+	// consider as many candidates as their limit which can be raised along
+	// with the search size of the vector query.
+	CandidateCount int
 }
 
 func (c *ClusterNode) RPCSearchPoints(args *RPCSearchPointsRequest, reply *RPCSearchPointsResponse) error {
@@ -411,9 +750,12 @@ func (c *ClusterNode) RPCSearchPoints(args *RPCSearchPointsRequest, reply *RPCSe
 		return c.internalRoute("ClusterNode.RPCSearchPoints", args, reply)
 	}
 	// ---------------------------
+	ctx, cancel := c.requestContext()
+	defer cancel()
 	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
-		points, err := s.SearchPoints(args.SearchRequest)
+		points, candidateCount, err := s.SearchPointsWithCount(ctx, args.SearchRequest)
 		reply.Points = points
+		reply.CandidateCount = candidateCount
 		if err == nil {
 			c.metrics.pointSearchCount.Add(float64(len(points)))
 		}
@@ -422,3 +764,213 @@ func (c *ClusterNode) RPCSearchPoints(args *RPCSearchPointsRequest, reply *RPCSe
 }
 
 // ---------------------------
+
+type RPCSearchByIdRequest struct {
+	RPCRequestArgs
+	Collection models.Collection
+	ShardId    string
+	Id         uuid.UUID
+	Limit      int
+}
+
+type RPCSearchByIdResponse struct {
+	// The points most like the query point, excluding the query point
+	Points []models.SearchResult
+	// The query point is not in the shard
+	NotFound bool
+}
+
+func (c *ClusterNode) RPCSearchById(args *RPCSearchByIdRequest, reply *RPCSearchByIdResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Str("pointId", args.Id.String()).Msg("RPCSearchById")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCSearchById", args, reply)
+	}
+	// ---------------------------
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		points, err := s.SearchByPointId(ctx, args.Id, args.Limit)
+		if errors.Is(err, shard.ErrPointNotFound) {
+			reply.NotFound = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		reply.Points = points
+		c.metrics.pointSearchCount.Add(float64(len(points)))
+		return nil
+	})
+}
+
+// ---------------------------
+
+const defaultScanPointsLimit = 100
+const maxScanPointsLimit = 10000
+
+/* Scanning pages through every point of a shard without a query, e.g. for
+ * auditing or exporting. The client passes the next id of the previous page to
+ * continue, see shard.ScanPoints for the ordering guarantees. */
+type RPCScanPointsRequest struct {
+	RPCRequestArgs
+	Collection models.Collection
+	ShardId    string
+	// Points strictly after this id are returned, uuid.Nil starts the scan
+	AfterId uuid.UUID
+	// Zero uses the default, larger values than the maximum are capped
+	Limit          int
+	IncludePayload bool
+}
+
+type RPCScanPointsResponse struct {
+	Points []models.Point
+	// The after id of the next page, uuid.Nil once the scan is done
+	NextId uuid.UUID
+}
+
+func (c *ClusterNode) RPCScanPoints(args *RPCScanPointsRequest, reply *RPCScanPointsResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Str("afterId", args.AfterId.String()).Msg("RPCScanPoints")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCScanPoints", args, reply)
+	}
+	// ---------------------------
+	limit := args.Limit
+	if limit <= 0 {
+		limit = defaultScanPointsLimit
+	}
+	limit = min(limit, maxScanPointsLimit)
+	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		points, more, err := s.ScanPoints(args.AfterId, limit, args.IncludePayload)
+		if err != nil {
+			return err
+		}
+		reply.Points = points
+		if more {
+			reply.NextId = points[len(points)-1].Id
+		}
+		return nil
+	})
+}
+
+// ---------------------------
+
+// Checks which of the points are stored in the shard without reading them,
+// e.g. to plan upserts on the client side. Expired points count as stored
+// until they are purged since inserting them again fails, see shard.Exists.
+type RPCPointsExistRequest struct {
+	RPCRequestArgs
+	Collection models.Collection
+	ShardId    string
+	Ids        []uuid.UUID
+}
+
+type RPCPointsExistResponse struct {
+	// In the same order as the requested ids
+	Exists []bool
+}
+
+func (c *ClusterNode) RPCPointsExist(args *RPCPointsExistRequest, reply *RPCPointsExistResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Int("count", len(args.Ids)).Msg("RPCPointsExist")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCPointsExist", args, reply)
+	}
+	// ---------------------------
+	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		reply.Exists = make([]bool, len(args.Ids))
+		for i, id := range args.Ids {
+			exists, err := s.Exists(id)
+			if err != nil {
+				return err
+			}
+			reply.Exists[i] = exists
+		}
+		return nil
+	})
+}
+
+// ---------------------------
+
+// Used when maxExplainVisits is not configured
+const defaultMaxExplainVisits = 1000
+
+// Used to debug the results of a search, the number of visits in the trace is
+// capped by the maxExplainVisits configuration.
+type RPCSearchPointsExplainRequest struct {
+	RPCRequestArgs
+	Collection models.Collection
+	ShardId    string
+	Vector     []float32
+	Limit      int
+}
+
+type RPCSearchPointsExplainResponse struct {
+	Points  []models.SearchResult
+	Explain shard.SearchExplain
+	// The visits of the trace were cut at the configured maximum, hops still
+	// counts all of them
+	Truncated bool
+}
+
+func (c *ClusterNode) RPCSearchPointsExplain(args *RPCSearchPointsExplainRequest, reply *RPCSearchPointsExplainResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Int("limit", args.Limit).Msg("RPCSearchPointsExplain")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCSearchPointsExplain", args, reply)
+	}
+	// ---------------------------
+	maxVisits := c.cfg.MaxExplainVisits
+	if maxVisits <= 0 {
+		maxVisits = defaultMaxExplainVisits
+	}
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		points, explain, err := s.SearchPointsExplain(ctx, args.Vector, args.Limit)
+		if err != nil {
+			return err
+		}
+		if len(explain.Visits) > maxVisits {
+			explain.Visits = explain.Visits[:maxVisits]
+			reply.Truncated = true
+		}
+		reply.Points = points
+		reply.Explain = explain
+		c.metrics.pointSearchCount.Add(float64(len(points)))
+		return nil
+	})
+}
+
+// ---------------------------
+
+type RPCSearchPointsBatchRequest struct {
+	RPCRequestArgs
+	Collection     models.Collection
+	ShardId        string
+	SearchRequests []models.SearchRequest
+}
+
+type RPCSearchPointsBatchResponse struct {
+	// The results of each search in the order of the requests
+	Points [][]models.SearchResult
+}
+
+func (c *ClusterNode) RPCSearchPointsBatch(args *RPCSearchPointsBatchRequest, reply *RPCSearchPointsBatchResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Int("count", len(args.SearchRequests)).Msg("RPCSearchPointsBatch")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCSearchPointsBatch", args, reply)
+	}
+	// ---------------------------
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	return c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+		batchPoints, err := s.SearchPointsBatch(ctx, args.SearchRequests)
+		reply.Points = batchPoints
+		if err == nil {
+			for _, points := range batchPoints {
+				c.metrics.pointSearchCount.Add(float64(len(points)))
+			}
+		}
+		return err
+	})
+}
+
+// ---------------------------
@@ -0,0 +1,352 @@
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func Test_RPCPing(t *testing.T) {
+	c := tempClusterNode(t, "localhost:1")
+	args := RPCPingRequest{
+		RPCRequestArgs: RPCRequestArgs{
+			Source: c.MyHostname,
+			Dest:   c.MyHostname,
+		},
+	}
+	var reply RPCPingResponse
+	require.NoError(t, c.RPCPing(&args, &reply))
+	require.Equal(t, c.MyHostname, reply.Hostname)
+	require.Greater(t, reply.Uptime, time.Duration(0))
+	require.Equal(t, 0, reply.LoadedShards)
+	require.Greater(t, reply.HeapAlloc, uint64(0))
+	// ---------------------------
+	// Pinging an unreachable node is routed and fails
+	args.Dest = "localhost:1"
+	require.Error(t, c.RPCPing(&args, &RPCPingResponse{}))
+	require.NoError(t, c.Close())
+}
+
+func Test_RPCExportGraph(t *testing.T) {
+	c := tempClusterNode(t)
+	c.cfg.MaxExportGraphNodes = 5
+	col := models.Collection{
+		UserId: "alice",
+		Id:     "docs",
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorVamana,
+				VectorVamana: &models.IndexVectorVamanaParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+					SearchSize:     75,
+					DegreeBound:    64,
+					Alpha:          1.2,
+				},
+			},
+		},
+	}
+	pointIds := make(map[uuid.UUID]struct{})
+	points := make([]models.Point, 20)
+	for i := range points {
+		data, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{float32(i), 1}})
+		require.NoError(t, err)
+		points[i] = models.Point{Id: uuid.New(), Data: data}
+		pointIds[points[i].Id] = struct{}{}
+	}
+	err := c.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+		return s.InsertPoints(context.Background(), points)
+	})
+	require.NoError(t, err)
+	// ---------------------------
+	// Asking for more nodes than configured is capped
+	args := RPCExportGraphRequest{
+		RPCRequestArgs: RPCRequestArgs{
+			Source: c.MyHostname,
+			Dest:   c.MyHostname,
+		},
+		Collection:   col,
+		ShardId:      "shard0",
+		Property:     "vector",
+		MaxNodes:     100,
+		WithPointIds: true,
+	}
+	var reply RPCExportGraphResponse
+	require.NoError(t, c.RPCExportGraph(&args, &reply))
+	require.Len(t, reply.Nodes, 5)
+	// The start node comes first and is not a point
+	require.EqualValues(t, 1, reply.Nodes[0].NodeId)
+	require.Equal(t, uuid.Nil, reply.Nodes[0].PointId)
+	require.NotEmpty(t, reply.Nodes[0].Edges)
+	for i, node := range reply.Nodes[1:] {
+		require.Contains(t, pointIds, node.PointId)
+		// The smallest node ids are exported in order
+		require.Less(t, reply.Nodes[i].NodeId, node.NodeId)
+	}
+	require.EqualValues(t, 5, reply.Nodes[4].NodeId)
+	// An unset maximum falls back to the default
+	c.cfg.MaxExportGraphNodes = 0
+	args.MaxNodes = 0
+	reply = RPCExportGraphResponse{}
+	require.NoError(t, c.RPCExportGraph(&args, &reply))
+	require.Len(t, reply.Nodes, 21)
+	// ---------------------------
+	args.Property = "missing"
+	require.Error(t, c.RPCExportGraph(&args, &RPCExportGraphResponse{}))
+	require.NoError(t, c.Close())
+}
+
+func Test_RPCSearchPointsExplain(t *testing.T) {
+	c := tempClusterNode(t)
+	c.cfg.MaxExplainVisits = 3
+	col := models.Collection{
+		UserId: "alice",
+		Id:     "docs",
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorVamana,
+				VectorVamana: &models.IndexVectorVamanaParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+					SearchSize:     75,
+					DegreeBound:    64,
+					Alpha:          1.2,
+				},
+			},
+		},
+	}
+	points := make([]models.Point, 20)
+	for i := range points {
+		data, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{float32(i), 1}})
+		require.NoError(t, err)
+		points[i] = models.Point{Id: uuid.New(), Data: data}
+	}
+	err := c.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+		return s.InsertPoints(context.Background(), points)
+	})
+	require.NoError(t, err)
+	// ---------------------------
+	args := RPCSearchPointsExplainRequest{
+		RPCRequestArgs: RPCRequestArgs{
+			Source: c.MyHostname,
+			Dest:   c.MyHostname,
+		},
+		Collection: col,
+		ShardId:    "shard0",
+		Vector:     []float32{5, 1},
+		Limit:      2,
+	}
+	var reply RPCSearchPointsExplainResponse
+	require.NoError(t, c.RPCSearchPointsExplain(&args, &reply))
+	require.Len(t, reply.Points, 2)
+	require.Equal(t, points[5].Id, reply.Points[0].Point.Id)
+	// The trace is cut but the hops are not
+	require.True(t, reply.Truncated)
+	require.Len(t, reply.Explain.Visits, 3)
+	require.Greater(t, reply.Explain.Hops, 3)
+	// Without a configured maximum the default keeps the whole trace
+	c.cfg.MaxExplainVisits = 0
+	reply = RPCSearchPointsExplainResponse{}
+	require.NoError(t, c.RPCSearchPointsExplain(&args, &reply))
+	require.False(t, reply.Truncated)
+	require.Greater(t, len(reply.Explain.Visits), 3)
+	require.NoError(t, c.Close())
+}
+
+func Test_RPCScanPoints(t *testing.T) {
+	c := tempClusterNode(t)
+	col := models.Collection{
+		UserId: "alice",
+		Id:     "docs",
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorVamana,
+				VectorVamana: &models.IndexVectorVamanaParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+					SearchSize:     75,
+					DegreeBound:    64,
+					Alpha:          1.2,
+				},
+			},
+		},
+	}
+	pointIds := make(map[uuid.UUID]struct{})
+	points := make([]models.Point, 15)
+	for i := range points {
+		data, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{float32(i), 1}})
+		require.NoError(t, err)
+		points[i] = models.Point{Id: uuid.New(), Data: data}
+		pointIds[points[i].Id] = struct{}{}
+	}
+	err := c.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+		return s.InsertPoints(context.Background(), points)
+	})
+	require.NoError(t, err)
+	// ---------------------------
+	args := RPCScanPointsRequest{
+		RPCRequestArgs: RPCRequestArgs{
+			Source: c.MyHostname,
+			Dest:   c.MyHostname,
+		},
+		Collection: col,
+		ShardId:    "shard0",
+		Limit:      10,
+	}
+	seen := make(map[uuid.UUID]struct{})
+	pages := 0
+	for {
+		var reply RPCScanPointsResponse
+		require.NoError(t, c.RPCScanPoints(&args, &reply))
+		pages++
+		for _, p := range reply.Points {
+			require.Contains(t, pointIds, p.Id)
+			seen[p.Id] = struct{}{}
+		}
+		if reply.NextId == uuid.Nil {
+			break
+		}
+		args.AfterId = reply.NextId
+	}
+	require.Equal(t, 2, pages)
+	require.Len(t, seen, len(points))
+	require.NoError(t, c.Close())
+}
+
+func Test_RPCPointsExist(t *testing.T) {
+	c := tempClusterNode(t)
+	col := models.Collection{
+		UserId: "alice",
+		Id:     "docs",
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorVamana,
+				VectorVamana: &models.IndexVectorVamanaParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+					SearchSize:     75,
+					DegreeBound:    64,
+					Alpha:          1.2,
+				},
+			},
+		},
+	}
+	data, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{1, 2}})
+	require.NoError(t, err)
+	point := models.Point{Id: uuid.New(), Data: data}
+	err = c.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+		return s.InsertPoints(context.Background(), []models.Point{point})
+	})
+	require.NoError(t, err)
+	// ---------------------------
+	args := RPCPointsExistRequest{
+		RPCRequestArgs: RPCRequestArgs{
+			Source: c.MyHostname,
+			Dest:   c.MyHostname,
+		},
+		Collection: col,
+		ShardId:    "shard0",
+		Ids:        []uuid.UUID{uuid.New(), point.Id},
+	}
+	var reply RPCPointsExistResponse
+	require.NoError(t, c.RPCPointsExist(&args, &reply))
+	require.Equal(t, []bool{false, true}, reply.Exists)
+	require.NoError(t, c.Close())
+}
+
+func Test_RPCInsertPointsIdempotent(t *testing.T) {
+	c := tempClusterNode(t)
+	c.cfg.IdempotencyKeyTTL = 60
+	col := models.Collection{
+		UserId: "alice",
+		Id:     "docs",
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorFlat,
+				VectorFlat: &models.IndexVectorFlatParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+				},
+			},
+		},
+	}
+	points := make([]models.Point, 10)
+	for i := range points {
+		data, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{float32(i), 1}})
+		require.NoError(t, err)
+		points[i] = models.Point{Id: uuid.New(), Data: data}
+	}
+	args := RPCInsertPointsRequest{
+		RPCRequestArgs: RPCRequestArgs{
+			Source: c.MyHostname,
+			Dest:   c.MyHostname,
+		},
+		Collection:     col,
+		ShardId:        "shard0",
+		Points:         points,
+		IdempotencyKey: "request1",
+	}
+	var reply RPCInsertPointsResponse
+	require.NoError(t, c.RPCInsertPoints(&args, &reply))
+	require.Equal(t, 10, reply.Count)
+	// ---------------------------
+	// A replay returns the first result without inserting again
+	reply = RPCInsertPointsResponse{}
+	require.NoError(t, c.RPCInsertPoints(&args, &reply))
+	require.Equal(t, 10, reply.Count)
+	err := c.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+		si, err := s.Info(false, false)
+		require.EqualValues(t, 10, si.PointCount)
+		return err
+	})
+	require.NoError(t, err)
+	// A different key is a true duplicate
+	args.IdempotencyKey = "request2"
+	require.Error(t, c.RPCInsertPoints(&args, &RPCInsertPointsResponse{}))
+	// ---------------------------
+	// Once expired the key no longer protects the request
+	purged, err := c.purgeIdempotencyKeys(time.Now().Add(2 * time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+	args.IdempotencyKey = "request1"
+	require.Error(t, c.RPCInsertPoints(&args, &RPCInsertPointsResponse{}))
+	require.NoError(t, c.Close())
+}
+
+func Test_RPCCreateCollectionValidation(t *testing.T) {
+	c := tempClusterNode(t)
+	col := models.Collection{
+		UserId:   "alice",
+		UserPlan: models.UserPlan{MaxCollections: 1},
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorVamana,
+				VectorVamana: &models.IndexVectorVamanaParameters{
+					DistanceMetric: "chebyshev",
+					SearchSize:     75,
+				},
+			},
+		},
+	}
+	err := c.CreateCollection(col)
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	require.Equal(t, []string{
+		"collection id is empty",
+		"degree bound of property vector must be positive, got 0",
+		"alpha of property vector must be positive, got 0.000000",
+		"vector size of property vector must be positive",
+		`unknown distance metric "chebyshev" for property vector`,
+	}, validationErr.Problems)
+	// Nothing was stored
+	cols, err := c.ListCollections(col.UserId)
+	require.NoError(t, err)
+	require.Empty(t, cols)
+	require.NoError(t, c.Close())
+}
@@ -0,0 +1,147 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard"
+)
+
+/* The rpc calls cannot stream so a search with a large limit and big points
+ * sends every result in a single response that both ends have to hold while it
+ * is encoded. A streamed search instead returns the results in pages. The first
+ * call runs the search and keeps the results on the shard server, the client
+ * then fetches the remaining pages one call at a time and can start processing
+ * the top results before the tail is encoded. The results are still computed
+ * in full on the shard server, streaming only spreads out their transfer. Pages
+ * are addressed by their position so a retried call returns the same page. */
+
+// How long the results of a streamed search are kept after the last page was
+// fetched, a client that stops early leaves them behind until then.
+const searchStreamTTL = time.Minute
+
+const defaultSearchStreamPageSize = 10
+
+type searchStream struct {
+	results []models.SearchResult
+	expires time.Time
+}
+
+type RPCSearchPointsStreamRequest struct {
+	RPCRequestArgs
+	Collection    models.Collection
+	ShardId       string
+	SearchRequest models.SearchRequest
+	// Empty starts a new search, otherwise continues the given stream
+	StreamId string
+	// Position of the first result of the page in the stream
+	Cursor   int
+	PageSize int
+}
+
+type RPCSearchPointsStreamResponse struct {
+	Points []models.SearchResult
+	// See RPCSearchPointsResponse, only set on the first page
+	CandidateCount int
+	// Identifies the stream for the next page, empty after the last page
+	StreamId string
+}
+
+func (c *ClusterNode) RPCSearchPointsStream(args *RPCSearchPointsStreamRequest, reply *RPCSearchPointsStreamResponse) error {
+	c.logger.Debug().Str("userId", args.Collection.UserId).Str("collectionId", args.Collection.Id).Str("shardId", args.ShardId).Str("streamId", args.StreamId).Int("cursor", args.Cursor).Msg("RPCSearchPointsStream")
+	if args.Dest != c.MyHostname {
+		return c.internalRoute("ClusterNode.RPCSearchPointsStream", args, reply)
+	}
+	// ---------------------------
+	pageSize := args.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultSearchStreamPageSize
+	}
+	streamId := args.StreamId
+	var results []models.SearchResult
+	if streamId == "" {
+		ctx, cancel := c.requestContext()
+		defer cancel()
+		err := c.shardManager.DoWithShard(args.Collection, args.ShardId, func(s *shard.Shard) error {
+			var err error
+			results, reply.CandidateCount, err = s.SearchPointsWithCount(ctx, args.SearchRequest)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		c.metrics.pointSearchCount.Add(float64(len(results)))
+		if len(results) <= pageSize {
+			reply.Points = results
+			return nil
+		}
+		streamId = uuid.NewString()
+	}
+	// ---------------------------
+	now := time.Now()
+	c.searchStreamsMu.Lock()
+	defer c.searchStreamsMu.Unlock()
+	for id, stream := range c.searchStreams {
+		if now.After(stream.expires) {
+			delete(c.searchStreams, id)
+		}
+	}
+	if results == nil {
+		stream, ok := c.searchStreams[streamId]
+		if !ok {
+			return fmt.Errorf("search stream %s: %w", streamId, ErrNotFound)
+		}
+		results = stream.results
+	}
+	start := min(args.Cursor, len(results))
+	end := min(start+pageSize, len(results))
+	reply.Points = results[start:end]
+	if end < len(results) {
+		c.searchStreams[streamId] = &searchStream{results: results, expires: now.Add(searchStreamTTL)}
+		reply.StreamId = streamId
+	} else {
+		delete(c.searchStreams, streamId)
+	}
+	return nil
+}
+
+// ---------------------------
+
+// SearchShardStream searches a single shard and calls f with each result in
+// order as the pages of the streamed search arrive. It stops early if f
+// returns an error, which it returns. It returns the candidate count of the
+// search, see RPCSearchPointsResponse.
+func (c *ClusterNode) SearchShardStream(col models.Collection, shardId string, sr models.SearchRequest, pageSize int, f func(models.SearchResult) error) (int, error) {
+	req := RPCSearchPointsStreamRequest{
+		RPCRequestArgs: RPCRequestArgs{
+			Source: c.MyHostname,
+			Dest:   c.placement(shardId, 1)[0],
+		},
+		Collection:    col,
+		ShardId:       shardId,
+		SearchRequest: sr,
+		PageSize:      pageSize,
+	}
+	candidateCount := 0
+	for {
+		resp := RPCSearchPointsStreamResponse{}
+		if err := c.RPCSearchPointsStream(&req, &resp); err != nil {
+			return 0, fmt.Errorf("could not search shard %s: %w", shardId, err)
+		}
+		if req.StreamId == "" {
+			candidateCount = resp.CandidateCount
+		}
+		for _, r := range resp.Points {
+			if err := f(r); err != nil {
+				return candidateCount, err
+			}
+		}
+		if resp.StreamId == "" {
+			return candidateCount, nil
+		}
+		req.StreamId = resp.StreamId
+		req.Cursor += len(resp.Points)
+	}
+}
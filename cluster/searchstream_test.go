@@ -0,0 +1,81 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func Test_SearchShardStream(t *testing.T) {
+	c := tempClusterNode(t)
+	col := models.Collection{
+		UserId: "alice",
+		Id:     "docs",
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorVamana,
+				VectorVamana: &models.IndexVectorVamanaParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+					SearchSize:     75,
+					DegreeBound:    64,
+					Alpha:          1.2,
+				},
+			},
+		},
+	}
+	points := make([]models.Point, 30)
+	for i := range points {
+		data, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{float32(i), float32(i)}})
+		require.NoError(t, err)
+		points[i] = models.Point{Id: uuid.New(), Data: data}
+	}
+	err := c.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+		return s.InsertPoints(context.Background(), points)
+	})
+	require.NoError(t, err)
+	sr := models.SearchRequest{
+		Query: models.Query{
+			Property: "vector",
+			VectorVamana: &models.SearchVectorVamanaOptions{
+				Vector: []float32{0, 0},
+				Limit:  25,
+			},
+		},
+		Limit: 25,
+	}
+	// ---------------------------
+	batchReq := RPCSearchPointsRequest{
+		RPCRequestArgs: RPCRequestArgs{Source: c.MyHostname, Dest: c.MyHostname},
+		Collection:     col,
+		ShardId:        "shard0",
+		SearchRequest:  sr,
+	}
+	batchResp := RPCSearchPointsResponse{}
+	require.NoError(t, c.RPCSearchPoints(&batchReq, &batchResp))
+	streamed := make([]models.SearchResult, 0)
+	candidateCount, err := c.SearchShardStream(col, "shard0", sr, 10, func(r models.SearchResult) error {
+		streamed = append(streamed, r)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, batchResp.CandidateCount, candidateCount)
+	require.Equal(t, batchResp.Points, streamed)
+	// The finished stream is not kept around
+	require.Empty(t, c.searchStreams)
+	// ---------------------------
+	// Stopping early leaves the stream to expire
+	errStop := errors.New("stop")
+	_, err = c.SearchShardStream(col, "shard0", sr, 10, func(r models.SearchResult) error {
+		return errStop
+	})
+	require.ErrorIs(t, err, errStop)
+	require.Len(t, c.searchStreams, 1)
+	require.NoError(t, c.Close())
+}
@@ -1,6 +1,8 @@
 package cluster
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -20,6 +22,12 @@ type loadedShard struct {
 	shard    *shard.Shard
 	doneCh   chan bool
 	mu       sync.RWMutex // This locks stops the cleanup goroutine from unloading the shard while it is being used
+	// Asks the cleanup goroutine to unload the shard straight away
+	evictCh chan struct{}
+	// Last time the shard was loaded and whether it has been chosen for
+	// eviction, both guarded by the store lock of the shard manager
+	lastAccess time.Time
+	evicted    bool
 }
 
 type ShardManagerConfig struct {
@@ -29,6 +37,33 @@ type ShardManagerConfig struct {
 	ShardTimeout int `yaml:"shardTimeout"`
 	// Cache size in bytes, set to -1 for unlimited, 0 for no shared caching
 	MaxCacheSize int64 `yaml:"maxCacheSize"`
+	// Hex encoded 16, 24 or 32 byte keys to encrypt the shards of collections
+	// at rest, keyed by userId/collectionId. Collections without a key are not
+	// encrypted.
+	EncryptionKeys map[string]string `yaml:"encryptionKeys"`
+	// Shards are vacuumed when they are unloaded if the fraction of their
+	// database file in use falls below this threshold, 0 disables vacuuming.
+	VacuumThreshold float64 `yaml:"vacuumThreshold"`
+	// Seeds the start vectors of the graph indexes of new shards so that
+	// integration tests are reproducible, 0 uses random start vectors.
+	StartSeed int64 `yaml:"startSeed"`
+	// Maximum number of shards kept loaded, the least recently used shard is
+	// unloaded when loading another one exceeds it, 0 for no limit.
+	MaxLoadedShards int `yaml:"maxLoadedShards"`
+	// Number of distinct searches each shard caches the results of until its
+	// next write, 0 disables the result cache.
+	ResultCacheSize int `yaml:"resultCacheSize"`
+	// Skips the fsync after every shard write. Inserts get faster but a power
+	// loss may lose recent writes or corrupt shards, only for benchmarks.
+	NoSync bool `yaml:"noSync"`
+}
+
+// shardLoad is an open of a shard in progress that concurrent loads of the
+// same shard wait for.
+type shardLoad struct {
+	done chan struct{}
+	ls   *loadedShard
+	err  error
 }
 
 type ShardManager struct {
@@ -36,21 +71,34 @@ type ShardManager struct {
 	cfg    ShardManagerConfig
 	// ---------------------------
 	shardStore map[string]*loadedShard
-	shardLock  sync.Mutex
+	// Shards that are being opened, keyed by shard directory like shardStore
+	loading   map[string]*shardLoad
+	shardLock sync.Mutex
 	// Shared cache for all the shards loaded by this shard manager
 	cacheManager *cache.Manager
+	// Loaded shards report their search and insert metrics here
+	metrics *clusterNodeMetrics
 }
 
-func NewShardManager(config ShardManagerConfig) *ShardManager {
+func NewShardManager(config ShardManagerConfig, metrics *clusterNodeMetrics) *ShardManager {
 	logger := log.With().Str("component", "shardManager").Logger()
 	return &ShardManager{
 		logger:       logger,
 		cfg:          config,
 		shardStore:   make(map[string]*loadedShard),
+		loading:      make(map[string]*shardLoad),
 		cacheManager: cache.NewManager(config.MaxCacheSize),
+		metrics:      metrics,
 	}
 }
 
+// loadedShardCount returns the number of shards currently loaded in memory.
+func (sm *ShardManager) loadedShardCount() int {
+	sm.shardLock.Lock()
+	defer sm.shardLock.Unlock()
+	return len(sm.shardStore)
+}
+
 // Load a shard into memory. If the shard is already loaded, the shard is
 // returned from the local cache. The shard is unloaded after a timeout if it is
 // not used.
@@ -58,7 +106,6 @@ func (sm *ShardManager) loadShard(collection models.Collection, shardId string)
 	shardDir := filepath.Join(sm.cfg.RootDir, "userCollections", collection.UserId, collection.Id, shardId)
 	sm.logger.Debug().Str("shardDir", shardDir).Msg("LoadShard")
 	sm.shardLock.Lock()
-	defer sm.shardLock.Unlock()
 	if ls, ok := sm.shardStore[shardDir]; ok {
 		// We reset the timer here so that the shard is not unloaded prematurely
 		sm.logger.Debug().Str("shardDir", shardDir).Msg("Returning cached shard")
@@ -69,33 +116,147 @@ func (sm *ShardManager) loadShard(collection models.Collection, shardId string)
 		case ls.doneCh <- false:
 		default:
 		}
+		ls.lastAccess = time.Now()
+		sm.shardLock.Unlock()
 		return ls, nil
 	}
+	/* Opening a shard can take a while, e.g. waiting for the file lock of the
+	 * database, so we do not hold the store lock while opening. Concurrent
+	 * loads of the same shard wait for the first one instead of each opening
+	 * the file and loads of other shards carry on. */
+	if load, ok := sm.loading[shardDir]; ok {
+		sm.shardLock.Unlock()
+		sm.logger.Debug().Str("shardDir", shardDir).Msg("Waiting for shard to open")
+		<-load.done
+		return load.ls, load.err
+	}
+	load := &shardLoad{done: make(chan struct{})}
+	sm.loading[shardDir] = load
+	sm.shardLock.Unlock()
+	// ---------------------------
+	load.ls, load.err = sm.openShard(collection, shardDir)
+	sm.shardLock.Lock()
+	delete(sm.loading, shardDir)
+	if load.err == nil {
+		load.ls.lastAccess = time.Now()
+		sm.shardStore[shardDir] = load.ls
+		sm.evictShards(load.ls)
+	}
+	sm.shardLock.Unlock()
+	close(load.done)
+	if load.err != nil {
+		return nil, load.err
+	}
 	// ---------------------------
-	// Check shard directory exists, create if it doesn't
-	if err := os.MkdirAll(shardDir, 0755); err != nil {
-		return nil, fmt.Errorf("could not create shard directory: %w", err)
+	// Setup cleanup goroutine, in memory shards have nothing to back up
+	backupFrequency, backupCount := collection.UserPlan.ShardBackupFrequency, collection.UserPlan.ShardBackupCount
+	if collection.Ephemeral {
+		backupFrequency, backupCount = 0, 0
+	}
+	/* The timeout is read from the collection every time the shard is loaded
+	 * so a changed timeout applies from the next load. */
+	timeout := sm.cfg.ShardTimeout
+	if collection.ShardTimeout > 0 {
+		timeout = collection.ShardTimeout
+	}
+	go sm.cleanupRoutine(load.ls, time.Duration(timeout)*time.Second, backupFrequency, backupCount)
+	return load.ls, nil
+}
+
+// openShard opens the shard in the given directory, see loadShard.
+func (sm *ShardManager) openShard(collection models.Collection, shardDir string) (*loadedShard, error) {
+	// An empty file name opens the shard in memory
+	dbFile := ""
+	if !collection.Ephemeral {
+		// Check shard directory exists, create if it doesn't
+		if err := os.MkdirAll(shardDir, 0755); err != nil {
+			return nil, fmt.Errorf("could not create shard directory: %w", err)
+		}
+		dbFile = filepath.Join(shardDir, "sharddb.bbolt")
 	}
 	// Open shard
-	shard, err := shard.NewShard(filepath.Join(shardDir, "sharddb.bbolt"), collection, sm.cacheManager)
+	var openedShard *shard.Shard
+	var err error
+	recorder := shardMetricsRecorder{metrics: sm.metrics, collectionId: collection.Id}
+	opts := []shard.ShardOption{shard.WithMetricsRecorder(recorder)}
+	if sm.cfg.StartSeed != 0 {
+		opts = append(opts, shard.WithStartSeed(sm.cfg.StartSeed))
+	}
+	if sm.cfg.ResultCacheSize > 0 {
+		opts = append(opts, shard.WithResultCache(sm.cfg.ResultCacheSize))
+	}
+	if sm.cfg.NoSync {
+		opts = append(opts, shard.WithNoSync())
+	}
+	if hexKey, ok := sm.cfg.EncryptionKeys[collection.UserId+"/"+collection.Id]; ok {
+		key, decodeErr := hex.DecodeString(hexKey)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("could not decode encryption key: %w", decodeErr)
+		}
+		openedShard, err = shard.NewEncryptedShard(dbFile, collection, sm.cacheManager, key, opts...)
+	} else {
+		openedShard, err = shard.NewShard(dbFile, collection, sm.cacheManager, opts...)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("could not open shard: %w", err)
 	}
-	ls := &loadedShard{
+	sm.metrics.shardOpenCount.Inc()
+	return &loadedShard{
 		shardDir: shardDir,
-		shard:    shard,
+		shard:    openedShard,
 		doneCh:   make(chan bool),
+		evictCh:  make(chan struct{}, 1),
+	}, nil
+}
+
+/* Shards are normally unloaded once they have not been used for the shard
+ * timeout, but a burst of requests across many collections would keep all of
+ * their shards open until then. With a maximum, loading a shard over it evicts
+ * the least recently used ones. Eviction only signals the cleanup goroutine of
+ * the shard which then unloads it like a timeout does, so there is a single
+ * place that closes shards. The evicted shard stays in the store until it has
+ * been closed, so loading it again in the meantime does not open the database
+ * file twice, and ongoing operations on it finish before it closes. */
+
+// evictShards picks the least recently used shards other than the given one to
+// unload until at most the maximum number of shards remain. The caller must
+// hold the store lock.
+func (sm *ShardManager) evictShards(keep *loadedShard) {
+	if sm.cfg.MaxLoadedShards <= 0 {
+		return
+	}
+	loaded := 0
+	for _, ls := range sm.shardStore {
+		if !ls.evicted {
+			loaded++
+		}
+	}
+	for ; loaded > sm.cfg.MaxLoadedShards; loaded-- {
+		var oldest *loadedShard
+		for _, ls := range sm.shardStore {
+			if ls == keep || ls.evicted {
+				continue
+			}
+			if oldest == nil || ls.lastAccess.Before(oldest.lastAccess) {
+				oldest = ls
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		sm.logger.Debug().Str("shardDir", oldest.shardDir).Msg("Evicting least recently used shard")
+		oldest.evicted = true
+		// The channel is buffered because the cleanup goroutine may not have
+		// started yet or may be unloading the shard already
+		select {
+		case oldest.evictCh <- struct{}{}:
+		default:
+		}
 	}
-	sm.shardStore[shardDir] = ls
-	// ---------------------------
-	// Setup cleanup goroutine
-	go sm.cleanupRoutine(ls, collection.UserPlan.ShardBackupFrequency, collection.UserPlan.ShardBackupCount)
-	return ls, nil
 }
 
-func (sm *ShardManager) cleanupRoutine(ls *loadedShard, backupFrequency, backupCount int) {
+func (sm *ShardManager) cleanupRoutine(ls *loadedShard, timeoutDuration time.Duration, backupFrequency, backupCount int) {
 	shardDir := ls.shardDir
-	timeoutDuration := time.Duration(sm.cfg.ShardTimeout) * time.Second
 	timer := time.NewTimer(timeoutDuration)
 	defer sm.logger.Debug().Str("shardDir", shardDir).Msg("Stopping shard cleanup goroutine")
 	for {
@@ -114,42 +275,82 @@ func (sm *ShardManager) cleanupRoutine(ls *loadedShard, backupFrequency, backupC
 			}
 		case <-timer.C:
 			sm.logger.Debug().Str("shardDir", shardDir).Msg("Unloading shard")
-			ls.mu.Lock()
-			defer ls.mu.Unlock() // we commit to exiting the cleanup goroutine here
-			if ls.shard == nil {
-				sm.logger.Debug().Str("shardDir", shardDir).Msg("Shard already unloaded")
-				return
-			}
-			// ---------------------------
-			// We probably should find a better place to backup the shard. The
-			// original idea is that the when the shard is being unloaded it is
-			// no longer busy and we can backup its content. But if a shard is
-			// always busy then we never get a chance to backup its content. We
-			// could backup the shard when it is being loaded, but that would be
-			// a waste of resources if the shard is not used. Perhaps a
-			// heuristic could be used in DoWithShard operation to determine a
-			// backup is needed along side this one.
-			if backupFrequency > 0 && backupCount > 0 {
-				if err := ls.shard.Backup(backupFrequency, backupCount); err != nil {
-					sm.logger.Error().Err(err).Str("shardDir", shardDir).Msg("Failed to backup shard")
-				}
-			}
-			// ---------------------------
-			// Time to say goodbye to the shard
-			if err := ls.shard.Close(); err != nil {
-				sm.logger.Error().Err(err).Str("shardDir", shardDir).Msg("Failed to close shard")
-			}
-			// We set the shard to nil so that other goroutines know it
-			// is closed in case they are waiting on the lock
-			sm.logger.Debug().Str("shardDir", shardDir).Msg("Removing loaded shard")
-			ls.shard = nil
-			sm.shardLock.Lock()
-			delete(sm.shardStore, shardDir)
-			sm.shardLock.Unlock()
-			// ---------------------------
+			sm.unloadShard(ls, backupFrequency, backupCount)
 			return
+		case <-ls.evictCh:
+			sm.logger.Debug().Str("shardDir", shardDir).Msg("Unloading evicted shard")
+			sm.unloadShard(ls, backupFrequency, backupCount)
+			return
+		}
+	}
+}
+
+// unloadShard closes the shard once ongoing operations are done and removes it
+// from the store, backing it up and vacuuming it first if configured.
+func (sm *ShardManager) unloadShard(ls *loadedShard, backupFrequency, backupCount int) {
+	shardDir := ls.shardDir
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.shard == nil {
+		sm.logger.Debug().Str("shardDir", shardDir).Msg("Shard already unloaded")
+		return
+	}
+	// ---------------------------
+	// Vacuuming here cannot race operations on the shard because we
+	// hold the exclusive lock.
+	if sm.cfg.VacuumThreshold > 0 {
+		sm.vacuumShard(ls)
+	}
+	// ---------------------------
+	// We probably should find a better place to backup the shard. The
+	// original idea is that the when the shard is being unloaded it is
+	// no longer busy and we can backup its content. But if a shard is
+	// always busy then we never get a chance to backup its content. We
+	// could backup the shard when it is being loaded, but that would be
+	// a waste of resources if the shard is not used. Perhaps a
+	// heuristic could be used in DoWithShard operation to determine a
+	// backup is needed along side this one.
+	if backupFrequency > 0 && backupCount > 0 {
+		if err := ls.shard.Backup(backupFrequency, backupCount); err != nil {
+			sm.logger.Error().Err(err).Str("shardDir", shardDir).Msg("Failed to backup shard")
 		}
 	}
+	// ---------------------------
+	// Time to say goodbye to the shard
+	if err := ls.shard.Close(); err != nil {
+		sm.logger.Error().Err(err).Str("shardDir", shardDir).Msg("Failed to close shard")
+	}
+	// We set the shard to nil so that other goroutines know it
+	// is closed in case they are waiting on the lock
+	sm.logger.Debug().Str("shardDir", shardDir).Msg("Removing loaded shard")
+	ls.shard = nil
+	sm.shardLock.Lock()
+	// The shard may have been deleted and loaded again while we were closing it
+	if sm.shardStore[shardDir] == ls {
+		delete(sm.shardStore, shardDir)
+	}
+	sm.shardLock.Unlock()
+}
+
+// vacuumShard reclaims the free space of the shard database if enough of it is
+// unused. The caller must hold the lock of the loaded shard.
+func (sm *ShardManager) vacuumShard(ls *loadedShard) {
+	si, err := ls.shard.Info(false, false)
+	if err != nil {
+		sm.logger.Error().Err(err).Str("shardDir", ls.shardDir).Msg("Failed to get shard info for vacuum")
+		return
+	}
+	if si.Size == 0 {
+		return
+	}
+	inUse := float64(si.Size-si.FreeSize) / float64(si.Size)
+	if inUse >= sm.cfg.VacuumThreshold {
+		return
+	}
+	sm.logger.Debug().Str("shardDir", ls.shardDir).Float64("inUse", inUse).Msg("Vacuuming shard")
+	if err := ls.shard.Vacuum(); err != nil {
+		sm.logger.Error().Err(err).Str("shardDir", ls.shardDir).Msg("Failed to vacuum shard")
+	}
 }
 
 // DoWithShard executes a function with a shard. The shard is loaded if it is
@@ -161,40 +362,134 @@ func (sm *ShardManager) DoWithShard(collection models.Collection, shardId string
 		return fmt.Errorf("could not load shard: %w", err)
 	}
 	ls.mu.RLock()
-	defer ls.mu.RUnlock()
 	// This nil check is necessary because the shard may have been unloaded
 	// while we were waiting for lock.
 	if ls.shard == nil {
-		return fmt.Errorf("shard %s is already closed", shardId)
+		ls.mu.RUnlock()
+		// An evicted shard is removed from the store once it is closed, so
+		// loading it again opens it afresh
+		sm.shardLock.Lock()
+		evicted := ls.evicted
+		sm.shardLock.Unlock()
+		if !evicted {
+			return fmt.Errorf("shard %s is already closed: %w", shardId, shard.ErrShardClosed)
+		}
+		if ls, err = sm.loadShard(collection, shardId); err != nil {
+			return fmt.Errorf("could not load shard: %w", err)
+		}
+		ls.mu.RLock()
+		if ls.shard == nil {
+			ls.mu.RUnlock()
+			return fmt.Errorf("shard %s is already closed: %w", shardId, shard.ErrShardClosed)
+		}
+	}
+	defer ls.mu.RUnlock()
+	return shardError(f(ls.shard))
+}
+
+// WarmShard loads the shard if needed, which also resets its unload timer, and
+// pulls the top of its graph indexes into memory. It returns the number of
+// graph nodes loaded.
+func (sm *ShardManager) WarmShard(collection models.Collection, shardId string) (int, error) {
+	var loaded int
+	err := sm.DoWithShard(collection, shardId, func(s *shard.Shard) error {
+		var err error
+		loaded, err = s.Warm()
+		return err
+	})
+	return loaded, err
+}
+
+// lockWithoutLoads takes the store lock once no shard under dir is being
+// opened, so the caller sees every such shard in the store.
+func (sm *ShardManager) lockWithoutLoads(dir string) {
+	for {
+		sm.shardLock.Lock()
+		var pending *shardLoad
+		for shardDir, load := range sm.loading {
+			if strings.HasPrefix(shardDir, dir+string(filepath.Separator)) {
+				pending = load
+				break
+			}
+		}
+		if pending == nil {
+			return
+		}
+		sm.shardLock.Unlock()
+		<-pending.done
 	}
-	return f(ls.shard)
 }
 
-func (sm *ShardManager) DeleteCollectionShards(collection models.Collection) ([]string, error) {
+// CloseAll closes every loaded shard, for example when the node is shutting
+// down. It waits for ongoing operations on the shards to finish.
+func (sm *ShardManager) CloseAll() error {
+	/* We take a snapshot instead of holding the store lock throughout because
+	 * the cleanup goroutines take the store lock while holding the lock of
+	 * their shard when they unload it. */
+	sm.lockWithoutLoads(sm.cfg.RootDir)
+	loaded := make([]*loadedShard, 0, len(sm.shardStore))
+	for _, ls := range sm.shardStore {
+		loaded = append(loaded, ls)
+	}
+	sm.shardLock.Unlock()
+	// ---------------------------
+	var errs []error
+	for _, ls := range loaded {
+		ls.mu.Lock()
+		if ls.shard != nil {
+			// Stop the cleanup goroutine, if it has already started unloading
+			// it will see the nil shard reference.
+			select {
+			case ls.doneCh <- true:
+			default:
+			}
+			if err := ls.shard.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("could not close shard %s: %w", ls.shardDir, err))
+			}
+			ls.shard = nil
+		}
+		ls.mu.Unlock()
+	}
+	// ---------------------------
+	sm.shardLock.Lock()
+	for _, ls := range loaded {
+		if sm.shardStore[ls.shardDir] == ls {
+			delete(sm.shardStore, ls.shardDir)
+		}
+	}
+	sm.shardLock.Unlock()
+	return errors.Join(errs...)
+}
+
+// DeleteCollectionShards unloads and deletes the shards of the collection on
+// this server. It returns the ids of the deleted shards and the error of each
+// shard that could not be deleted.
+func (sm *ShardManager) DeleteCollectionShards(collection models.Collection) ([]string, map[string]string, error) {
 	// ---------------------------
 	// We can't let shards be loaded while we are deleting them, this blocks
 	// other shard loading too. In the future we can make this more efficient by
 	// having a lock per collection. We don't expect too many delete collection
 	// requests and this function in general should be fast.
-	sm.shardLock.Lock()
+	collectionDir := filepath.Join(sm.cfg.RootDir, "userCollections", collection.UserId, collection.Id)
+	sm.lockWithoutLoads(collectionDir)
 	defer sm.shardLock.Unlock()
 	// ---------------------------
 	// Shard deletion is a best effort service, we don't return an error if
 	// something goes wrong with the deletion of a shard. This is because the
 	// deletion of the collection makes these shards inaccessible anyway. It is
 	// a cleanup problem if a shard is not deleted.
-	collectionDir := filepath.Join(sm.cfg.RootDir, "userCollections", collection.UserId, collection.Id)
 	// List all shards in the collection directory if it exists
 	if _, err := os.Stat(collectionDir); os.IsNotExist(err) {
 		log.Debug().Str("collectionDir", collectionDir).Msg("Collection directory does not exist, skipping shard deletion")
-		return nil, nil
+		return nil, nil, nil
 	}
 	shardDirs, err := os.ReadDir(collectionDir)
 	if err != nil {
-		return nil, fmt.Errorf("could not list shards: %w", err)
+		return nil, nil, fmt.Errorf("could not list shards: %w", err)
 	}
 	// Delete all shards
 	deletedShardIds := make([]string, 0, len(shardDirs))
+	shardErrors := make(map[string]string)
 	for _, shardDirEntry := range shardDirs {
 		if !shardDirEntry.IsDir() {
 			continue
@@ -226,7 +521,10 @@ func (sm *ShardManager) DeleteCollectionShards(collection models.Collection) ([]
 		if err := os.RemoveAll(shardDir); err != nil {
 			sm.logger.Error().Err(err).Str("shardDir", shardDir).Msg("Failed to delete shard")
 			// Again, not much we can do here, because the shard can no longer
-			// be used. We assume the collection entry is deleted.
+			// be used. We assume the collection entry is deleted and report the
+			// shard so it can be cleaned up.
+			shardErrors[shardDirEntry.Name()] = err.Error()
+			continue
 		}
 		sm.logger.Debug().Str("shardDir", shardDir).Msg("Deleted shard")
 		deletedShardIds = append(deletedShardIds, shardDirEntry.Name())
@@ -243,5 +541,5 @@ func (sm *ShardManager) DeleteCollectionShards(collection models.Collection) ([]
 		sm.logger.Error().Err(err).Str("userDir", userDir).Msg("Failed to delete user directory")
 	}
 	// ---------------------------
-	return deletedShardIds, nil
+	return deletedShardIds, shardErrors, nil
 }
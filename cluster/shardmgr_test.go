@@ -0,0 +1,232 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func Test_CloseAll(t *testing.T) {
+	c := tempClusterNode(t)
+	col := models.Collection{UserId: "alice", Id: "docs"}
+	for _, shardId := range []string{"shardA", "shardB"} {
+		err := c.shardManager.DoWithShard(col, shardId, func(s *shard.Shard) error {
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, c.shardManager.loadedShardCount())
+	// ---------------------------
+	require.NoError(t, c.Close())
+	require.Equal(t, 0, c.shardManager.loadedShardCount())
+	// The shard files are released and can be opened straight away
+	dbFile := filepath.Join(c.cfg.ShardManager.RootDir, "userCollections", "alice", "docs", "shardA", "sharddb.bbolt")
+	s, err := shard.NewShard(dbFile, col, nil, shard.WithTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+}
+
+func Test_DoWithShardErrors(t *testing.T) {
+	c := tempClusterNode(t)
+	col := models.Collection{UserId: "alice", Id: "docs"}
+	err := c.shardManager.DoWithShard(col, "shardA", func(s *shard.Shard) error {
+		return fmt.Errorf("could not insert points: %w", shard.ErrPointExists)
+	})
+	require.ErrorIs(t, err, ErrExists)
+	require.ErrorIs(t, err, shard.ErrPointExists)
+	err = c.shardManager.DoWithShard(col, "shardA", func(s *shard.Shard) error {
+		return shard.ErrPointNotFound
+	})
+	require.ErrorIs(t, err, ErrNotFound)
+	err = c.shardManager.DoWithShard(col, "shardA", func(s *shard.Shard) error {
+		return shard.ErrShardClosed
+	})
+	require.ErrorIs(t, err, ErrShardUnavailable)
+	// Other errors are passed through as is
+	otherErr := errors.New("other")
+	err = c.shardManager.DoWithShard(col, "shardA", func(s *shard.Shard) error {
+		return otherErr
+	})
+	require.Equal(t, otherErr, err)
+	require.NoError(t, c.Close())
+}
+
+func Test_DeleteCollectionShards(t *testing.T) {
+	c := tempClusterNode(t)
+	col := models.Collection{UserId: "alice", Id: "docs"}
+	for _, shardId := range []string{"shardA", "shardB"} {
+		err := c.shardManager.DoWithShard(col, shardId, func(s *shard.Shard) error {
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	// Only one of the shards is loaded when deleting
+	require.NoError(t, c.shardManager.CloseAll())
+	err := c.shardManager.DoWithShard(col, "shardA", func(s *shard.Shard) error {
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, c.shardManager.loadedShardCount())
+	// ---------------------------
+	deleted, shardErrors, err := c.shardManager.DeleteCollectionShards(col)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"shardA", "shardB"}, deleted)
+	require.Empty(t, shardErrors)
+	require.Equal(t, 0, c.shardManager.loadedShardCount())
+	require.NoDirExists(t, filepath.Join(c.cfg.ShardManager.RootDir, "userCollections", "alice"))
+	// Deleting again finds nothing
+	deleted, _, err = c.shardManager.DeleteCollectionShards(col)
+	require.NoError(t, err)
+	require.Empty(t, deleted)
+	require.NoError(t, c.Close())
+}
+
+func Test_WarmShard(t *testing.T) {
+	c := tempClusterNode(t)
+	col := models.Collection{
+		UserId:   "alice",
+		Id:       "docs",
+		UserPlan: models.UserPlan{MaxCollections: 1},
+		IndexSchema: models.IndexSchema{
+			"vector": {
+				Type: models.IndexTypeVectorVamana,
+				VectorVamana: &models.IndexVectorVamanaParameters{
+					VectorSize:     2,
+					DistanceMetric: models.DistanceEuclidean,
+					SearchSize:     75,
+					DegreeBound:    64,
+					Alpha:          1.2,
+				},
+			},
+		},
+	}
+	require.NoError(t, c.CreateCollection(col))
+	points := make([]models.Point, 20)
+	for i := range points {
+		data, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{float32(i), 1}})
+		require.NoError(t, err)
+		points[i] = models.Point{Id: uuid.New(), Data: data}
+	}
+	err := c.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+		return s.InsertPoints(context.Background(), points)
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.shardManager.CloseAll())
+	require.Equal(t, 0, c.shardManager.loadedShardCount())
+	// ---------------------------
+	require.NoError(t, c.WarmShard("alice/docs/shard0"))
+	require.Equal(t, 1, c.shardManager.loadedShardCount())
+	shardDir := filepath.Join(c.cfg.ShardManager.RootDir, "userCollections", "alice", "docs", "shard0")
+	require.NoError(t, c.WarmShard(shardDir))
+	require.Equal(t, 1, c.shardManager.loadedShardCount())
+	// ---------------------------
+	require.ErrorIs(t, c.WarmShard("alice/docs/shard1"), ErrNotFound)
+	require.ErrorIs(t, c.WarmShard("alice/missing/shard0"), ErrNotFound)
+	require.Error(t, c.WarmShard("alice/docs"))
+	require.Error(t, c.WarmShard("alice/../../shard0"))
+	require.NoError(t, c.Close())
+}
+
+func Test_CollectionShardTimeout(t *testing.T) {
+	c := tempClusterNode(t)
+	// The node default is 30 seconds
+	hot := models.Collection{UserId: "alice", Id: "hot"}
+	cold := models.Collection{UserId: "alice", Id: "cold", ShardTimeout: 1}
+	for _, col := range []models.Collection{hot, cold} {
+		err := c.shardManager.DoWithShard(col, "shard0", func(s *shard.Shard) error {
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, c.shardManager.loadedShardCount())
+	require.Eventually(t, func() bool {
+		return c.shardManager.loadedShardCount() == 1
+	}, 3*time.Second, 100*time.Millisecond)
+	coldDir := filepath.Join(c.cfg.ShardManager.RootDir, "userCollections", "alice", "cold", "shard0")
+	c.shardManager.shardLock.Lock()
+	require.NotContains(t, c.shardManager.shardStore, coldDir)
+	c.shardManager.shardLock.Unlock()
+	require.NoError(t, c.Close())
+}
+
+func Test_LoadShardSingleFlight(t *testing.T) {
+	c := tempClusterNode(t)
+	col := models.Collection{UserId: "alice", Id: "docs"}
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	loaded := make([]*loadedShard, 50)
+	errs := make([]error, 50)
+	for i := range loaded {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			loaded[i], errs[i] = c.shardManager.loadShard(col, "shard0")
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	for i := range loaded {
+		require.NoError(t, errs[i])
+		require.Same(t, loaded[0], loaded[i])
+	}
+	require.Equal(t, 1.0, testutil.ToFloat64(c.metrics.shardOpenCount))
+	require.Equal(t, 1, c.shardManager.loadedShardCount())
+	require.NoError(t, c.Close())
+}
+
+func Test_MaxLoadedShards(t *testing.T) {
+	c := tempClusterNode(t)
+	c.shardManager.cfg.MaxLoadedShards = 2
+	col := models.Collection{UserId: "alice", Id: "docs"}
+	shardDir := func(shardId string) string {
+		return filepath.Join(c.cfg.ShardManager.RootDir, "userCollections", "alice", "docs", shardId)
+	}
+	use := func(shardId string) {
+		err := c.shardManager.DoWithShard(col, shardId, func(s *shard.Shard) error {
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	use("shardA")
+	use("shardB")
+	// Using shardA makes shardB the least recently used
+	use("shardA")
+	use("shardC")
+	require.Eventually(t, func() bool {
+		return c.shardManager.loadedShardCount() == 2
+	}, 3*time.Second, 10*time.Millisecond)
+	c.shardManager.shardLock.Lock()
+	require.Contains(t, c.shardManager.shardStore, shardDir("shardA"))
+	require.NotContains(t, c.shardManager.shardStore, shardDir("shardB"))
+	require.Contains(t, c.shardManager.shardStore, shardDir("shardC"))
+	c.shardManager.shardLock.Unlock()
+	// ---------------------------
+	// An evicted shard opens again and data survives the eviction
+	points := randPoints(1)
+	err := c.shardManager.DoWithShard(col, "shardB", func(s *shard.Shard) error {
+		return s.InsertPoints(context.Background(), points)
+	})
+	require.NoError(t, err)
+	for _, shardId := range []string{"shardA", "shardC"} {
+		use(shardId)
+	}
+	err = c.shardManager.DoWithShard(col, "shardB", func(s *shard.Shard) error {
+		exists, err := s.Exists(points[0].Id)
+		require.True(t, exists)
+		return err
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+}
@@ -0,0 +1,64 @@
+package cluster
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/semafind/semadb/distance"
+	"github.com/semafind/semadb/models"
+)
+
+/* validateCollection returns every problem with the collection rather than the
+ * first one. The http layer binds the same constraints but other callers may
+ * not, and a collection with for example a zero vector size is stored happily
+ * only to break every insert and search into its shards later on. */
+func validateCollection(col models.Collection) []string {
+	problems := make([]string, 0)
+	if col.UserId == "" {
+		problems = append(problems, "user id is empty")
+	}
+	if col.Id == "" {
+		problems = append(problems, "collection id is empty")
+	}
+	// Sorted so the problems are listed in the same order every time
+	properties := make([]string, 0, len(col.IndexSchema))
+	for property := range col.IndexSchema {
+		properties = append(properties, property)
+	}
+	slices.Sort(properties)
+	for _, property := range properties {
+		params := col.IndexSchema[property]
+		var vectorSize uint
+		var distanceMetric string
+		switch {
+		case params.Type == models.IndexTypeVectorFlat && params.VectorFlat != nil:
+			vectorSize, distanceMetric = params.VectorFlat.VectorSize, params.VectorFlat.DistanceMetric
+		case params.Type == models.IndexTypeVectorVamana && params.VectorVamana != nil:
+			vv := params.VectorVamana
+			vectorSize, distanceMetric = vv.VectorSize, vv.DistanceMetric
+			if vv.DegreeBound <= 0 {
+				problems = append(problems, fmt.Sprintf("degree bound of property %s must be positive, got %d", property, vv.DegreeBound))
+			}
+			if vv.SearchSize <= 0 {
+				problems = append(problems, fmt.Sprintf("search size of property %s must be positive, got %d", property, vv.SearchSize))
+			}
+			if vv.Alpha <= 0 {
+				problems = append(problems, fmt.Sprintf("alpha of property %s must be positive, got %f", property, vv.Alpha))
+			}
+		default:
+			continue
+		}
+		if vectorSize == 0 {
+			problems = append(problems, fmt.Sprintf("vector size of property %s must be positive", property))
+		}
+		// Custom metrics are known once registered with the distance package
+		if !distance.IsKnownMetric(distanceMetric) {
+			problems = append(problems, fmt.Sprintf("unknown distance metric %q for property %s", distanceMetric, property))
+		}
+	}
+	// The schema checks combinations of the parameters and stops at the first
+	if err := col.IndexSchema.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
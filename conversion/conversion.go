@@ -2,7 +2,9 @@ package conversion
 
 import (
 	"encoding/binary"
+	"fmt"
 	"math"
+	"slices"
 	"unsafe"
 
 	"github.com/rs/zerolog/log"
@@ -122,3 +124,66 @@ func BytesToEdgeList(b []byte) []uint64 {
 	}
 	return edges
 }
+
+/* Delta encoded edge lists sort the node ids and store the first id followed
+ * by the gaps between consecutive ids as uvarints. Node ids are handed out
+ * densely, so in a graph of a million nodes most gaps of a node with 64 edges
+ * fit in 2 or 3 bytes instead of 8. The order of the edges is not kept, the
+ * graph does not depend on it. A delta encoded list ends in a trailer byte that
+ * holds the number of trailing bytes, 1 or 2 with a padding byte, chosen so its
+ * length is never a multiple of 8. That tells it apart from a plain list
+ * without knowing which encoding wrote it. */
+
+func EdgeListToDeltaBytes(edges []uint64) []byte {
+	sorted := slices.Clone(edges)
+	slices.Sort(sorted)
+	b := make([]byte, 0, len(sorted)*3+2)
+	var prev uint64
+	for _, e := range sorted {
+		b = binary.AppendUvarint(b, e-prev)
+		prev = e
+	}
+	if (len(b)+1)%8 == 0 {
+		return append(b, 0, 2)
+	}
+	return append(b, 1)
+}
+
+// DecodeEdgeList decodes edges written by either EdgeListToBytes or
+// EdgeListToDeltaBytes.
+func DecodeEdgeList(b []byte) ([]uint64, error) {
+	if IsDeltaEdgeList(b) {
+		return DeltaBytesToEdgeList(b)
+	}
+	return BytesToEdgeList(b), nil
+}
+
+// IsDeltaEdgeList reports whether the bytes were written by
+// EdgeListToDeltaBytes rather than EdgeListToBytes.
+func IsDeltaEdgeList(b []byte) bool {
+	return len(b)%8 != 0
+}
+
+func DeltaBytesToEdgeList(b []byte) ([]uint64, error) {
+	if !IsDeltaEdgeList(b) {
+		return nil, fmt.Errorf("not a delta encoded edge list of %d bytes", len(b))
+	}
+	trailer := int(b[len(b)-1])
+	if trailer != 1 && trailer != 2 {
+		return nil, fmt.Errorf("invalid delta encoded edge list trailer %d", trailer)
+	}
+	b = b[:len(b)-trailer]
+	// Most gaps take two or three bytes
+	edges := make([]uint64, 0, len(b)/2)
+	var prev uint64
+	for len(b) > 0 {
+		gap, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid delta encoded edge list gap")
+		}
+		prev += gap
+		edges = append(edges, prev)
+		b = b[n:]
+	}
+	return edges, nil
+}
@@ -2,7 +2,9 @@ package conversion
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
+	"slices"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -88,3 +90,67 @@ func Test_EdgeListToBytes(t *testing.T) {
 		require.Equal(t, randEdges, BytesToEdgeList(b))
 	}
 }
+
+func Test_EdgeListToDeltaBytes(t *testing.T) {
+	edgeLists := [][]uint64{
+		{},
+		{0},
+		{1, 1, 1},
+		{math.MaxUint64, 0, 1 << 40},
+	}
+	// Sizes around multiples of 8 bytes exercise the padding of the trailer
+	for size := 0; size < 80; size++ {
+		randEdges := make([]uint64, size)
+		for j := range randEdges {
+			randEdges[j] = uint64(rand.Intn(1_000_000))
+		}
+		edgeLists = append(edgeLists, randEdges)
+	}
+	for _, edges := range edgeLists {
+		b := EdgeListToDeltaBytes(edges)
+		require.True(t, IsDeltaEdgeList(b))
+		require.False(t, IsDeltaEdgeList(EdgeListToBytes(edges)))
+		decoded, err := DecodeEdgeList(b)
+		require.NoError(t, err)
+		require.Len(t, decoded, len(edges))
+		sorted := slices.Clone(edges)
+		slices.Sort(sorted)
+		require.Equal(t, sorted, decoded)
+		// Plain lists still decode
+		decoded, err = DecodeEdgeList(EdgeListToBytes(edges))
+		require.NoError(t, err)
+		require.Equal(t, edges, decoded)
+	}
+	// ---------------------------
+	_, err := DeltaBytesToEdgeList([]byte{0x80, 1})
+	require.Error(t, err)
+	_, err = DeltaBytesToEdgeList([]byte{5, 3})
+	require.Error(t, err)
+}
+
+// Compares decoding the edges of a node with 64 edges in a graph of a million
+// nodes, bytes/edge reports the storage of each encoding.
+func Benchmark_DecodeEdgeList(b *testing.B) {
+	edges := make([]uint64, 64)
+	for i := range edges {
+		edges[i] = uint64(rand.Intn(1_000_000))
+	}
+	encodings := []struct {
+		name   string
+		encode func([]uint64) []byte
+	}{
+		{"plain", EdgeListToBytes},
+		{"delta", EdgeListToDeltaBytes},
+	}
+	for _, enc := range encodings {
+		encoded := enc.encode(edges)
+		b.Run(enc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodeEdgeList(encoded); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(encoded))/float64(len(edges)), "bytes/edge")
+		})
+	}
+}
@@ -2,7 +2,11 @@ package diskstore
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
 	"sync"
 
 	"go.etcd.io/bbolt"
@@ -127,33 +131,80 @@ func (bm *bboltBucketManager) Delete(bucketName string) error {
 
 type bboltDiskStore struct {
 	bboltDB *bbolt.DB
+	opts    Options
+	// Vacuum swaps the underlying database, this lock stops it from doing so
+	// while other operations are using it.
+	mu sync.RWMutex
+	// Set by Close so that closing again does not sync a closed file, and by
+	// Vacuum if it cannot reopen the database after closing it
+	closed bool
 }
 
-func (ds bboltDiskStore) Path() string {
+func (ds *bboltDiskStore) Path() string {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
 	return ds.bboltDB.Path()
 }
 
-func (ds bboltDiskStore) Read(f func(BucketManager) error) error {
-	return ds.bboltDB.View(func(tx *bbolt.Tx) error {
+func (ds *bboltDiskStore) Read(f func(BucketManager) error) error {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return closedError(ds.bboltDB.View(func(tx *bbolt.Tx) error {
 		bm := &bboltBucketManager{tx: tx, isReadOnly: true}
 		return f(bm)
-	})
+	}))
 }
 
-func (ds bboltDiskStore) Write(f func(BucketManager) error) error {
-	return ds.bboltDB.Update(func(tx *bbolt.Tx) error {
+func (ds *bboltDiskStore) Write(f func(BucketManager) error) error {
+	if ds.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return closedError(ds.bboltDB.Update(func(tx *bbolt.Tx) error {
 		bm := &bboltBucketManager{tx: tx}
 		return f(bm)
-	})
+	}))
 }
 
-func (ds bboltDiskStore) BackupToFile(path string) error {
-	return ds.bboltDB.View(func(tx *bbolt.Tx) error {
+// closedError replaces the bbolt error of a closed database with ErrClosed.
+func closedError(err error) error {
+	if err == bbolt.ErrDatabaseNotOpen {
+		return ErrClosed
+	}
+	return err
+}
+
+/* Backups run in a single read transaction which sees a consistent snapshot of
+ * the database. A read transaction does not block writers in bbolt, writes
+ * proceed concurrently with two caveats. The pages freed by writes cannot be
+ * reused until the backup finishes, so a long backup under heavy writes grows
+ * the file which a later Vacuum can reclaim. A write that grows the file beyond
+ * its memory map has to wait for the backup to finish before remapping, see
+ * Options.InitialMmapSize to avoid this. The read lock only excludes Vacuum
+ * and Close which replace or release the database. */
+
+func (ds *bboltDiskStore) BackupToFile(path string) error {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return closedError(ds.bboltDB.View(func(tx *bbolt.Tx) error {
 		return tx.CopyFile(path, 0644)
-	})
+	}))
 }
 
-func (ds bboltDiskStore) SizeInBytes() (int64, error) {
+func (ds *bboltDiskStore) BackupTo(w io.Writer) (n int64, err error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	err = closedError(ds.bboltDB.View(func(tx *bbolt.Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	}))
+	return
+}
+
+func (ds *bboltDiskStore) SizeInBytes() (int64, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
 	var size int64
 	err := ds.bboltDB.View(func(tx *bbolt.Tx) error {
 		size = tx.Size()
@@ -162,6 +213,91 @@ func (ds bboltDiskStore) SizeInBytes() (int64, error) {
 	return size, err
 }
 
-func (ds bboltDiskStore) Close() error {
+func (ds *bboltDiskStore) FreeSizeInBytes() (int64, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	// Pending pages are freed by past transactions but may still be in use by
+	// open read transactions, they become free once those finish.
+	stats := ds.bboltDB.Stats()
+	pageSize := int64(ds.bboltDB.Info().PageSize)
+	return int64(stats.FreePageN+stats.PendingPageN) * pageSize, nil
+}
+
+// Compaction copies the buckets in transactions of at most this many bytes
+const vacuumTxMaxSize = 64 * 1024 * 1024
+
+func (ds *bboltDiskStore) Vacuum() error {
+	if ds.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.closed {
+		return ErrClosed
+	}
+	// ---------------------------
+	/* bbolt never shrinks the database file, pages freed by deletions are
+	 * only reused by later writes. So we copy the live data into a new file
+	 * and swap it with the old one. */
+	path := ds.bboltDB.Path()
+	vacuumPath := path + ".vacuum"
+	// A vacuum interrupted by a crash leaves its copy behind, compacting into
+	// it would bring back whatever it holds
+	if err := os.Remove(vacuumPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not remove stale vacuum db: %w", err)
+	}
+	dst, err := openBBolt(vacuumPath, DefaultOptions)
+	if err != nil {
+		return fmt.Errorf("could not open vacuum db: %w", err)
+	}
+	if err := bbolt.Compact(dst, ds.bboltDB, vacuumTxMaxSize); err != nil {
+		dst.Close()
+		os.Remove(vacuumPath)
+		return fmt.Errorf("could not compact db: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(vacuumPath)
+		return fmt.Errorf("could not close vacuum db: %w", err)
+	}
+	// ---------------------------
+	if err := ds.bboltDB.Close(); err != nil {
+		ds.closed = true
+		os.Remove(vacuumPath)
+		return fmt.Errorf("could not close db: %w", err)
+	}
+	/* If the swap fails we reopen whichever file is at the original path.
+	 * The rename is atomic so that is either the old or the compacted db. */
+	renameErr := os.Rename(vacuumPath, path)
+	if renameErr != nil {
+		os.Remove(vacuumPath)
+	}
+	bboltDB, err := openBBolt(path, ds.opts)
+	if err != nil {
+		// The store is left with the closed db, later calls fail with ErrClosed
+		ds.closed = true
+		return fmt.Errorf("%w: could not reopen db: %w", ErrClosed, err)
+	}
+	ds.bboltDB = bboltDB
+	if renameErr != nil {
+		return fmt.Errorf("could not replace db with vacuumed db: %w", renameErr)
+	}
+	return nil
+}
+
+func (ds *bboltDiskStore) Close() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.closed {
+		return nil
+	}
+	// Commits without fsync are flushed so a clean shutdown stays durable
+	if ds.opts.NoSync && !ds.opts.ReadOnly {
+		if err := ds.bboltDB.Sync(); err != nil {
+			ds.closed = true
+			ds.bboltDB.Close()
+			return fmt.Errorf("could not sync db: %w", err)
+		}
+	}
+	ds.closed = true
 	return ds.bboltDB.Close()
 }
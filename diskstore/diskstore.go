@@ -3,6 +3,7 @@ package diskstore
 import (
 	"errors"
 	"fmt"
+	"io"
 	"time"
 
 	"go.etcd.io/bbolt"
@@ -76,20 +77,81 @@ type DiskStore interface {
 	Read(f func(BucketManager) error) error
 	Write(f func(BucketManager) error) error
 	BackupToFile(path string) error
+	// Streams a consistent copy of the store to the writer, e.g. straight to
+	// object storage, and returns the number of bytes written.
+	BackupTo(w io.Writer) (int64, error)
 	SizeInBytes() (int64, error)
+	// The number of bytes held by free pages which are reused by later writes
+	// or reclaimed with Vacuum.
+	FreeSizeInBytes() (int64, error)
+	// Rewrites the store to reclaim the space of deleted data.
+	Vacuum() error
 	Close() error
 }
 
+var ErrReadOnly = errors.New("disk store is read-only")
+var ErrInMemory = errors.New("not supported by in-memory store")
+var ErrClosed = errors.New("disk store is closed")
+
+// Options control how a disk store file is opened.
+type Options struct {
+	// How long to wait for the lock on the file held by another process, 0
+	// waits indefinitely.
+	Timeout time.Duration
+	// Opens the file with a shared lock so multiple processes can read it at
+	// the same time, writes return ErrReadOnly.
+	ReadOnly bool
+	// Skips writing the freelist to disk which speeds up writes at the cost
+	// of rebuilding it on the next open.
+	NoFreelistSync bool
+	// Initial size in bytes of the memory map of the file. A write that grows
+	// the file beyond the memory map waits for every open read transaction,
+	// including a running backup, before remapping. Setting it larger than
+	// the file is expected to grow avoids such stalls, 0 uses the default.
+	InitialMmapSize int
+	// Skips the fsync after every write transaction so that commits only
+	// reach the operating system page cache. Writes get much faster but a
+	// power loss or kernel crash may lose recent commits or corrupt the file,
+	// a process crash alone loses nothing. Only meant for benchmarks and data
+	// that can be rebuilt. The file is synced once when the store is closed.
+	NoSync bool
+}
+
+var DefaultOptions = Options{
+	Timeout: 1 * time.Minute,
+}
+
 // A disk storage layer that can be used to store things in memory. Leave path
 // empty to use memory.
 func Open(path string) (DiskStore, error) {
+	return OpenWithOptions(path, DefaultOptions)
+}
+
+// OpenWithOptions is like Open but with the given options, the in memory store
+// ignores them.
+func OpenWithOptions(path string, opts Options) (DiskStore, error) {
 	if path == "" {
 		return newMemDiskStore(), nil
 	}
 	// ---------------------------
-	bboltDB, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: 1 * time.Minute})
+	bboltDB, err := openBBolt(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &bboltDiskStore{bboltDB: bboltDB, opts: opts}, nil
+}
+
+func openBBolt(path string, opts Options) (*bbolt.DB, error) {
+	bboltOpts := &bbolt.Options{
+		Timeout:         opts.Timeout,
+		ReadOnly:        opts.ReadOnly,
+		NoFreelistSync:  opts.NoFreelistSync,
+		InitialMmapSize: opts.InitialMmapSize,
+		NoSync:          opts.NoSync,
+	}
+	bboltDB, err := bbolt.Open(path, 0644, bboltOpts)
 	if err != nil {
 		return nil, fmt.Errorf("could not open db %s: %w", path, err)
 	}
-	return bboltDiskStore{bboltDB: bboltDB}, nil
+	return bboltDB, nil
 }
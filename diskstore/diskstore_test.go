@@ -1,10 +1,14 @@
 package diskstore_test
 
 import (
+	"bytes"
 	"fmt"
+	"io/fs"
+	"os"
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/semafind/semadb/diskstore"
 	"github.com/stretchr/testify/assert"
@@ -321,6 +325,34 @@ func Test_Persistence(t *testing.T) {
 	require.NoError(t, ds.Close())
 }
 
+func Test_NoSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	opts := diskstore.DefaultOptions
+	opts.NoSync = true
+	ds, err := diskstore.OpenWithOptions(path, opts)
+	require.NoError(t, err)
+	err = ds.Write(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get("bucket")
+		require.NoError(t, err)
+		return b.Put([]byte("wizard"), []byte("gandalf"))
+	})
+	require.NoError(t, err)
+	// Closing syncs the commits that skipped fsync
+	require.NoError(t, ds.Close())
+	require.NoError(t, ds.Close())
+	// ---------------------------
+	ds, err = diskstore.Open(path)
+	require.NoError(t, err)
+	err = ds.Read(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get("bucket")
+		require.NoError(t, err)
+		require.Equal(t, []byte("gandalf"), b.Get([]byte("wizard")))
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, ds.Close())
+}
+
 func Test_Backup(t *testing.T) {
 	ds := tempDiskStore(t, "", false)
 	err := ds.Write(func(bm diskstore.BucketManager) error {
@@ -334,6 +366,7 @@ func Test_Backup(t *testing.T) {
 	err = ds.BackupToFile(backupFilePath)
 	require.NoError(t, err)
 	require.NoError(t, ds.Close())
+	require.ErrorIs(t, ds.BackupToFile(filepath.Join(t.TempDir(), "closed.db")), diskstore.ErrClosed)
 	// ---------------------------
 	ds, err = diskstore.Open(backupFilePath)
 	require.NoError(t, err)
@@ -347,6 +380,87 @@ func Test_Backup(t *testing.T) {
 	require.NoError(t, ds.Close())
 }
 
+func Test_Vacuum(t *testing.T) {
+	for _, inMemory := range []bool{true, false} {
+		t.Run(fmt.Sprintf("inMemory=%v", inMemory), func(t *testing.T) {
+			ds := tempDiskStore(t, "", inMemory)
+			value := make([]byte, 1024)
+			err := ds.Write(func(bm diskstore.BucketManager) error {
+				b, err := bm.Get("bucket")
+				require.NoError(t, err)
+				for i := 0; i < 1000; i++ {
+					if err := b.Put([]byte(fmt.Sprintf("key%d", i)), value); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			require.NoError(t, err)
+			err = ds.Write(func(bm diskstore.BucketManager) error {
+				b, err := bm.Get("bucket")
+				require.NoError(t, err)
+				for i := 1; i < 1000; i++ {
+					if err := b.Delete([]byte(fmt.Sprintf("key%d", i))); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			require.NoError(t, err)
+			// ---------------------------
+			size, err := ds.SizeInBytes()
+			require.NoError(t, err)
+			require.NoError(t, ds.Vacuum())
+			vacuumSize, err := ds.SizeInBytes()
+			require.NoError(t, err)
+			freeSize, err := ds.FreeSizeInBytes()
+			require.NoError(t, err)
+			if !inMemory {
+				require.Less(t, vacuumSize, size)
+				require.Less(t, freeSize, vacuumSize)
+			}
+			err = ds.Read(func(bm diskstore.BucketManager) error {
+				b, err := bm.Get("bucket")
+				require.NoError(t, err)
+				require.Equal(t, value, b.Get([]byte("key0")))
+				require.Nil(t, b.Get([]byte("key1")))
+				return nil
+			})
+			require.NoError(t, err)
+			require.NoError(t, ds.Close())
+			// A closed store, e.g. one that failed to reopen, is not vacuumed
+			if !inMemory {
+				require.ErrorIs(t, ds.Vacuum(), diskstore.ErrClosed)
+				require.NoError(t, ds.Close())
+			}
+		})
+	}
+}
+
+func Test_VacuumStaleFile(t *testing.T) {
+	ds := tempDiskStore(t, "", false)
+	err := ds.Write(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get("bucket")
+		require.NoError(t, err)
+		return b.Put([]byte("wizard"), []byte("gandalf"))
+	})
+	require.NoError(t, err)
+	// A previous vacuum crashed and left its copy behind
+	vacuumPath := ds.Path() + ".vacuum"
+	require.NoError(t, os.WriteFile(vacuumPath, []byte("not a database"), 0644))
+	require.NoError(t, ds.Vacuum())
+	_, err = os.Stat(vacuumPath)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	err = ds.Read(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get("bucket")
+		require.NoError(t, err)
+		require.Equal(t, []byte("gandalf"), b.Get([]byte("wizard")))
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, ds.Close())
+}
+
 func Test_ForEach(t *testing.T) {
 	for _, inMemory := range []bool{true, false} {
 		t.Run(fmt.Sprintf("inMemory=%v", inMemory), func(t *testing.T) {
@@ -469,3 +583,110 @@ func Test_RangeScan(t *testing.T) {
 		})
 	}
 }
+
+func Test_ReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	ds := tempDiskStore(t, path, false)
+	err := ds.Write(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get("bucket")
+		require.NoError(t, err)
+		return b.Put([]byte("wizard"), []byte("gandalf"))
+	})
+	require.NoError(t, err)
+	// ---------------------------
+	// The file is locked by the open store so we give up quickly
+	_, err = diskstore.OpenWithOptions(path, diskstore.Options{Timeout: 50 * time.Millisecond})
+	require.Error(t, err)
+	require.NoError(t, ds.Close())
+	// ---------------------------
+	// Multiple read-only stores can share the same file
+	readOnlyOpts := diskstore.Options{Timeout: time.Second, ReadOnly: true}
+	dsA, err := diskstore.OpenWithOptions(path, readOnlyOpts)
+	require.NoError(t, err)
+	dsB, err := diskstore.OpenWithOptions(path, readOnlyOpts)
+	require.NoError(t, err)
+	err = dsB.Read(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get("bucket")
+		require.NoError(t, err)
+		require.Equal(t, []byte("gandalf"), b.Get([]byte("wizard")))
+		return nil
+	})
+	require.NoError(t, err)
+	err = dsA.Write(func(bm diskstore.BucketManager) error {
+		return nil
+	})
+	require.ErrorIs(t, err, diskstore.ErrReadOnly)
+	require.ErrorIs(t, dsA.Vacuum(), diskstore.ErrReadOnly)
+	require.NoError(t, dsA.Close())
+	require.NoError(t, dsB.Close())
+}
+
+// blockingWriter runs a function on the first write and waits for it, which
+// lets a test act whilst a backup is in progress.
+type blockingWriter struct {
+	bytes.Buffer
+	once sync.Once
+	fn   func()
+}
+
+func (bw *blockingWriter) Write(p []byte) (int, error) {
+	bw.once.Do(bw.fn)
+	return bw.Buffer.Write(p)
+}
+
+func Test_BackupTo(t *testing.T) {
+	// The memory map is large enough that the write below does not need to
+	// remap, which would wait for the backup to finish.
+	opts := diskstore.DefaultOptions
+	opts.InitialMmapSize = 1 << 24
+	ds, err := diskstore.OpenWithOptions(filepath.Join(t.TempDir(), "test.db"), opts)
+	require.NoError(t, err)
+	put := func(key, value string) error {
+		return ds.Write(func(bm diskstore.BucketManager) error {
+			b, err := bm.Get("bucket")
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(key), []byte(value))
+		})
+	}
+	require.NoError(t, put("wizard", "gandalf"))
+	// ---------------------------
+	// A write during the backup completes without waiting for the backup and
+	// is not part of it because the backup reads a snapshot.
+	var writeErr error
+	bw := &blockingWriter{fn: func() {
+		done := make(chan error)
+		go func() { done <- put("hobbit", "frodo") }()
+		select {
+		case writeErr = <-done:
+		case <-time.After(5 * time.Second):
+			writeErr = fmt.Errorf("write blocked by backup")
+		}
+	}}
+	n, err := ds.BackupTo(bw)
+	require.NoError(t, err)
+	require.NoError(t, writeErr)
+	require.EqualValues(t, bw.Len(), n)
+	require.NoError(t, ds.Close())
+	// ---------------------------
+	backupFilePath := filepath.Join(t.TempDir(), "backup.db")
+	require.NoError(t, os.WriteFile(backupFilePath, bw.Bytes(), 0644))
+	ds, err = diskstore.Open(backupFilePath)
+	require.NoError(t, err)
+	err = ds.Read(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get("bucket")
+		require.NoError(t, err)
+		require.Equal(t, []byte("gandalf"), b.Get([]byte("wizard")))
+		require.Nil(t, b.Get([]byte("hobbit")))
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, ds.Close())
+}
+
+func Test_BackupToInMemory(t *testing.T) {
+	ds := tempDiskStore(t, "", true)
+	_, err := ds.BackupTo(&bytes.Buffer{})
+	require.ErrorIs(t, err, diskstore.ErrInMemory)
+}
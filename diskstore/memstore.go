@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"cmp"
 	"fmt"
+	"io"
 	"slices"
 	"sync"
 )
@@ -145,7 +146,8 @@ type memDiskStore struct {
 	buckets map[string]map[string][]byte
 	// This lock is used to give a consistent view of the store such that Write
 	// does not interleave with any Read.
-	mu sync.RWMutex
+	mu     sync.RWMutex
+	closed bool
 }
 
 func newMemDiskStore() *memDiskStore {
@@ -161,6 +163,9 @@ func (ds *memDiskStore) Path() string {
 func (ds *memDiskStore) Read(f func(BucketManager) error) error {
 	ds.mu.RLock()
 	defer ds.mu.RUnlock()
+	if ds.closed {
+		return ErrClosed
+	}
 	bm := &memBucketManager{
 		buckets:    ds.buckets,
 		isReadOnly: true,
@@ -171,6 +176,9 @@ func (ds *memDiskStore) Read(f func(BucketManager) error) error {
 func (ds *memDiskStore) Write(f func(BucketManager) error) error {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
+	if ds.closed {
+		return ErrClosed
+	}
 	bm := &memBucketManager{
 		buckets:    ds.buckets,
 		isReadOnly: false,
@@ -179,14 +187,30 @@ func (ds *memDiskStore) Write(f func(BucketManager) error) error {
 }
 
 func (ds *memDiskStore) BackupToFile(path string) error {
-	return fmt.Errorf("not supported")
+	return ErrInMemory
+}
+
+func (ds *memDiskStore) BackupTo(w io.Writer) (int64, error) {
+	return 0, ErrInMemory
 }
 
 func (ds *memDiskStore) SizeInBytes() (int64, error) {
 	return 0, nil
 }
 
+func (ds *memDiskStore) FreeSizeInBytes() (int64, error) {
+	return 0, nil
+}
+
+func (ds *memDiskStore) Vacuum() error {
+	// Deleted keys are removed from the maps so there is nothing to reclaim
+	return nil
+}
+
 func (ds *memDiskStore) Close() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
 	clear(ds.buckets)
+	ds.closed = true
 	return nil
 }
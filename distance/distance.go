@@ -20,10 +20,46 @@ func dotProductDistance(x, y []float32) float32 {
 	return -dotProductImpl(x, y)
 }
 
+// Cosine distance assumes unit vectors, which reduces it to one minus the dot
+// product. No norms are computed during comparisons, vectors that are not
+// normalised should be normalised once up front, e.g. with the autoNormalize
+// index option.
 func cosineDistance(x, y []float32) float32 {
 	return 1 - dotProductImpl(x, y)
 }
 
+// Computes the sum of absolute differences, also known as the L1 distance. It is
+// more robust to outliers in individual dimensions than euclidean distance,
+// which often suits sparse count vectors.
+func manhattanDistance(x, y []float32) float32 {
+	var sum float32
+	for i := range x {
+		diff := x[i] - y[i]
+		if diff < 0 {
+			diff = -diff
+		}
+		sum += diff
+	}
+	return sum
+}
+
+// Normalize scales the vector in place to unit length so that cosine distance,
+// which assumes unit vectors, ranks it correctly. A zero vector has no
+// direction and is left unchanged.
+func Normalize(v []float32) {
+	var sum float32
+	for _, x := range v {
+		sum += x * x
+	}
+	if sum == 0 {
+		return
+	}
+	norm := 1 / float32(math.Sqrt(float64(sum)))
+	for i := range v {
+		v[i] *= norm
+	}
+}
+
 const degToRad = math.Pi / 180
 
 // Earth radius in meters
@@ -42,6 +78,10 @@ func haversineDistance(x, y []float32) float32 {
 	return float32(earthRadius * c)
 }
 
+// Counts the number of bits that differ between two binary vectors. The vectors
+// are packed 64 dimensions per word, the binary quantizer produces them from
+// float32 values where 0.0 and 1.0 are the expected inputs as anything above
+// 0.5 is set.
 func hammingDistance(x, y []uint64) float32 {
 	dist := 0
 	for i := range x {
@@ -53,6 +93,9 @@ func hammingDistance(x, y []uint64) float32 {
 	return float32(dist)
 }
 
+// Computes one minus the ratio of set bits in common to set bits in either
+// vector, treating each binary vector as a set. It uses the same packed 0/1
+// encoding as hammingDistance and two empty sets have a distance of 0.
 func jaccardDistance(x, y []uint64) float32 {
 	intersection := 0
 	union := 0
@@ -66,20 +109,16 @@ func jaccardDistance(x, y []uint64) float32 {
 	return 1 - float32(intersection)/float32(union)
 }
 
-// Returns floating distance function by name.
+// Returns floating distance function by name from the registry, see
+// registry.go.
 func GetFloatDistanceFn(name string) (FloatDistFunc, error) {
-	switch name {
-	case models.DistanceEuclidean:
-		return euclideanDistance, nil
-	case models.DistanceDot:
-		return dotProductDistance, nil
-	case models.DistanceCosine:
-		return cosineDistance, nil
-	case models.DistanceHaversine:
-		return haversineDistance, nil
-	default:
+	floatDistancesMu.RLock()
+	defer floatDistancesMu.RUnlock()
+	fn, ok := floatDistances[name]
+	if !ok {
 		return nil, fmt.Errorf("unknown float32 distance function: %s", name)
 	}
+	return fn, nil
 }
 
 func GetBitDistanceFn(name string) (BitDistFunc, error) {
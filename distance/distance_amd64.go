@@ -5,6 +5,7 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"github.com/semafind/semadb/distance/asm"
+	"github.com/semafind/semadb/models"
 	"golang.org/x/sys/cpu"
 )
 
@@ -21,6 +22,10 @@ func init() {
 		log.Info().Str("GOARCH", runtime.GOARCH).Msg("Using ASM support for dot and euclidean distance")
 		dotProductImpl = asm.Dot
 		euclideanDistance = asm.SquaredEuclideanDistance
+		// The registry may already hold the pure Go version, see registry.go
+		floatDistancesMu.Lock()
+		floatDistances[models.DistanceEuclidean] = euclideanDistance
+		floatDistancesMu.Unlock()
 	} else {
 		log.Warn().Str("GOARCH", runtime.GOARCH).Msg("No ASM support for dot and euclidean distance")
 	}
@@ -43,6 +43,7 @@ func TestHammingDistance(t *testing.T) {
 	y := []uint64{0b1101, 0b0}
 	dist := hammingDistance(x, y)
 	require.Equal(t, float32(2), dist)
+	require.Equal(t, float32(0), hammingDistance(x, x))
 }
 
 func TestJaccardDistance(t *testing.T) {
@@ -50,12 +51,20 @@ func TestJaccardDistance(t *testing.T) {
 	y := []uint64{0b1101, 0b0}
 	dist := jaccardDistance(x, y)
 	require.Equal(t, float32(0.5), dist)
+	require.Equal(t, float32(0), jaccardDistance(x, x))
 	x = []uint64{0b0, 0b0}
 	y = []uint64{0b0, 0b0}
 	dist = jaccardDistance(x, y)
 	require.Equal(t, float32(0.0), dist)
 }
 
+func TestManhattanDistance(t *testing.T) {
+	x := []float32{1, -2, 3}
+	y := []float32{4, 5, -6}
+	require.Equal(t, float32(19), manhattanDistance(x, y))
+	require.Equal(t, float32(0), manhattanDistance(x, x))
+}
+
 func TestHaversineDistance(t *testing.T) {
 	// Airport example from
 	// https://scikit-learn.org/stable/modules/generated/sklearn.metrics.pairwise.haversine_distances.html
@@ -65,3 +74,48 @@ func TestHaversineDistance(t *testing.T) {
 	dist /= 1000 // in km
 	require.InDelta(t, 11099.54, dist, 0.01)
 }
+
+func TestNormalize(t *testing.T) {
+	v := []float32{3, 4}
+	Normalize(v)
+	require.InDelta(t, 0.6, v[0], 1e-6)
+	require.InDelta(t, 0.8, v[1], 1e-6)
+	require.InDelta(t, 0, cosineDistance(v, v), 1e-6)
+	// Zero vectors have no direction and stay as they are
+	zero := []float32{0, 0}
+	Normalize(zero)
+	require.Equal(t, []float32{0, 0}, zero)
+}
+
+func TestRegister(t *testing.T) {
+	chebyshev := func(x, y []float32) float32 {
+		var maxDiff float32
+		for i := range x {
+			maxDiff = max(maxDiff, x[i]-y[i], y[i]-x[i])
+		}
+		return maxDiff
+	}
+	require.False(t, IsKnownMetric("test-chebyshev"))
+	require.NoError(t, Register("test-chebyshev", chebyshev))
+	require.True(t, IsKnownMetric("test-chebyshev"))
+	fn, err := GetFloatDistanceFn("test-chebyshev")
+	require.NoError(t, err)
+	require.Equal(t, float32(9), fn([]float32{1, -2, 3}, []float32{4, 5, -6}))
+	// ---------------------------
+	require.Error(t, Register("test-chebyshev", chebyshev))
+	require.Error(t, Register("euclidean", chebyshev))
+	require.Error(t, Register("hamming", chebyshev))
+	require.Error(t, Register("", chebyshev))
+	require.Error(t, Register("test-nil", nil))
+	// ---------------------------
+	for _, name := range []string{"euclidean", "cosine", "dot", "haversine", "manhattan", "hamming", "jaccard"} {
+		require.True(t, IsKnownMetric(name), name)
+	}
+	_, err = GetFloatDistanceFn("unknown")
+	require.Error(t, err)
+	// The registered euclidean distance is the implementation in use
+	fn, err = GetFloatDistanceFn("euclidean")
+	require.NoError(t, err)
+	x, y := []float32{1, 2, 3, 4, 5, 6, 7, 8}, []float32{8, 7, 6, 5, 4, 3, 2, 1}
+	require.Equal(t, euclideanDistance(x, y), fn(x, y))
+}
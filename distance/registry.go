@@ -0,0 +1,70 @@
+package distance
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/semafind/semadb/models"
+)
+
+/* The registry maps distance metric names to float distance functions so that
+ * applications embedding semadb can add their own metrics, e.g. a Mahalanobis
+ * distance with a fixed covariance, without changing this package. Register
+ * custom metrics at startup on every server before any shard using them is
+ * opened, a collection cannot be created with a metric that is not registered
+ * on the server handling the request. Custom metrics cannot be used with the
+ * product quantizer, and graph indexes prune with alpha on them as is since
+ * only euclidean distances are known to be squared.
+ *
+ * The bit distances of binary quantized vectors are not part of the registry
+ * because their functions take packed bits rather than floats. */
+
+var floatDistancesMu sync.RWMutex
+var floatDistances = make(map[string]FloatDistFunc)
+
+func init() {
+	floatDistancesMu.Lock()
+	defer floatDistancesMu.Unlock()
+	/* On amd64 the init function of distance_amd64.go may replace the
+	 * euclidean implementation. If it runs after this one it updates the
+	 * registry itself, otherwise we pick up the replaced one here. */
+	floatDistances[models.DistanceEuclidean] = euclideanDistance
+	floatDistances[models.DistanceDot] = dotProductDistance
+	floatDistances[models.DistanceCosine] = cosineDistance
+	floatDistances[models.DistanceHaversine] = haversineDistance
+	floatDistances[models.DistanceManhattan] = manhattanDistance
+}
+
+// Register adds a float distance function under the given metric name. The
+// function must return smaller values for closer vectors. Names that are
+// already registered, including the built-in metrics, cannot be replaced.
+func Register(name string, fn FloatDistFunc) error {
+	if name == "" {
+		return fmt.Errorf("distance metric name is empty")
+	}
+	if fn == nil {
+		return fmt.Errorf("distance function of metric %s is nil", name)
+	}
+	if _, err := GetBitDistanceFn(name); err == nil {
+		return fmt.Errorf("distance metric %s is a bit distance", name)
+	}
+	floatDistancesMu.Lock()
+	defer floatDistancesMu.Unlock()
+	if _, ok := floatDistances[name]; ok {
+		return fmt.Errorf("distance metric %s is already registered", name)
+	}
+	floatDistances[name] = fn
+	return nil
+}
+
+// IsKnownMetric reports whether the metric is a registered float distance or
+// a bit distance.
+func IsKnownMetric(name string) bool {
+	if _, err := GetBitDistanceFn(name); err == nil {
+		return true
+	}
+	floatDistancesMu.RLock()
+	defer floatDistancesMu.RUnlock()
+	_, ok := floatDistances[name]
+	return ok
+}
@@ -81,10 +81,16 @@ func (sdbh *SemaDBHandlers) CreateCollection(c *gin.Context) {
 				},
 			},
 		},
+		MaxMetadataBytes: models.DefaultMaxMetadataBytes,
 	}
 	log.Debug().Interface("collection", vamanaCollection).Msg("CreateCollection")
 	// ---------------------------
 	err := sdbh.clusterNode.CreateCollection(vamanaCollection)
+	var validationErr *cluster.ValidationError
+	if errors.As(err, &validationErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "problems": validationErr.Problems})
+		return
+	}
 	switch err {
 	case nil:
 		c.JSON(http.StatusOK, gin.H{"message": "collection created"})
@@ -212,7 +218,7 @@ func (sdbh *SemaDBHandlers) DeleteCollection(c *gin.Context) {
 	// ---------------------------
 	collection := c.MustGet("collection").(models.Collection)
 	// ---------------------------
-	deletedShardIds, err := sdbh.clusterNode.DeleteCollection(collection)
+	deletedShardIds, _, err := sdbh.clusterNode.DeleteCollection(collection)
 	if err != nil {
 		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -286,7 +292,7 @@ func (sdbh *SemaDBHandlers) InsertPoints(c *gin.Context) {
 	}
 	// ---------------------------
 	// Insert points returns a range of errors for failed shards
-	failedRanges, err := sdbh.clusterNode.InsertPoints(collection, points)
+	failedRanges, _, err := sdbh.clusterNode.InsertPoints(collection, points)
 	if errors.Is(err, cluster.ErrQuotaReached) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "quota reached"})
 		return
@@ -469,7 +475,7 @@ func (sdbh *SemaDBHandlers) SearchPoints(c *gin.Context) {
 		Select: []string{"metadata"},
 		Limit:  req.Limit,
 	}
-	points, err := sdbh.clusterNode.SearchPoints(collection, sr)
+	points, _, err := sdbh.clusterNode.SearchPoints(collection, sr)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -48,8 +48,13 @@ func SetupV2Handlers(clusterNode *cluster.ClusterNode, rgroup *gin.RouterGroup)
 // ---------------------------
 
 type CreateCollectionRequest struct {
-	Id          string             `json:"id" binding:"required,alphanum,min=3,max=24"`
-	IndexSchema models.IndexSchema `json:"indexSchema" binding:"required,dive"`
+	Id              string             `json:"id" binding:"required,alphanum,min=3,max=24"`
+	IndexSchema     models.IndexSchema `json:"indexSchema" binding:"required,dive"`
+	Ephemeral       bool               `json:"ephemeral"`
+	ShardTimeout    int                `json:"shardTimeout" binding:"min=0,max=86400"`
+	PointShardIndex bool               `json:"pointShardIndex"`
+	// Nil uses the default, zero is unlimited
+	MaxMetadataBytes *int `json:"maxMetadataBytes" binding:"omitempty,min=0"`
 }
 
 func (sdbh *SemaDBHandlers) CreateCollection(c *gin.Context) {
@@ -64,19 +69,32 @@ func (sdbh *SemaDBHandlers) CreateCollection(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	maxMetadataBytes := models.DefaultMaxMetadataBytes
+	if req.MaxMetadataBytes != nil {
+		maxMetadataBytes = *req.MaxMetadataBytes
+	}
 	// ---------------------------
 	vamanaCollection := models.Collection{
-		UserId:      appHeaders.UserId,
-		Id:          req.Id,
-		Replicas:    1,
-		Timestamp:   time.Now().Unix(),
-		CreatedAt:   time.Now().Unix(),
-		UserPlan:    c.MustGet("userPlan").(models.UserPlan),
-		IndexSchema: req.IndexSchema,
+		UserId:           appHeaders.UserId,
+		Id:               req.Id,
+		Replicas:         1,
+		Timestamp:        time.Now().Unix(),
+		CreatedAt:        time.Now().Unix(),
+		UserPlan:         c.MustGet("userPlan").(models.UserPlan),
+		IndexSchema:      req.IndexSchema,
+		Ephemeral:        req.Ephemeral,
+		ShardTimeout:     req.ShardTimeout,
+		PointShardIndex:  req.PointShardIndex,
+		MaxMetadataBytes: maxMetadataBytes,
 	}
 	log.Debug().Interface("collection", vamanaCollection).Msg("CreateCollection")
 	// ---------------------------
 	err := sdbh.clusterNode.CreateCollection(vamanaCollection)
+	var validationErr *cluster.ValidationError
+	if errors.As(err, &validationErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "problems": validationErr.Problems})
+		return
+	}
 	switch err {
 	case nil:
 		c.JSON(http.StatusOK, gin.H{"message": "collection created"})
@@ -200,7 +218,7 @@ func (sdbh *SemaDBHandlers) DeleteCollection(c *gin.Context) {
 	// ---------------------------
 	collection := c.MustGet("collection").(models.Collection)
 	// ---------------------------
-	deletedShardIds, err := sdbh.clusterNode.DeleteCollection(collection)
+	deletedShardIds, _, err := sdbh.clusterNode.DeleteCollection(collection)
 	if err != nil {
 		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -266,7 +284,7 @@ func (sdbh *SemaDBHandlers) InsertPoints(c *gin.Context) {
 	}
 	// ---------------------------
 	// Insert points returns a range of errors for failed shards
-	failedRanges, err := sdbh.clusterNode.InsertPoints(collection, points)
+	failedRanges, _, err := sdbh.clusterNode.InsertPoints(collection, points)
 	if errors.Is(err, cluster.ErrQuotaReached) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "quota reached"})
 		return
@@ -397,6 +415,9 @@ func (sdbh *SemaDBHandlers) DeletePoints(c *gin.Context) {
 
 type SearchPointsResponse struct {
 	Points []models.PointAsMap `json:"points"`
+	// Number of shards that could not be searched, the points are from the
+	// remaining shards.
+	FailedShards int `json:"failedShards,omitempty"`
 }
 
 func (sdbh *SemaDBHandlers) SearchPoints(c *gin.Context) {
@@ -420,7 +441,7 @@ func (sdbh *SemaDBHandlers) SearchPoints(c *gin.Context) {
 		return
 	}
 	// ---------------------------
-	points, err := sdbh.clusterNode.SearchPoints(collection, req)
+	points, failedShards, err := sdbh.clusterNode.SearchPoints(collection, req)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -450,7 +471,7 @@ func (sdbh *SemaDBHandlers) SearchPoints(c *gin.Context) {
 		pointData["_hybridScore"] = sp.HybridScore
 		results[i] = pointData
 	}
-	resp := SearchPointsResponse{Points: results}
+	resp := SearchPointsResponse{Points: results, FailedShards: failedShards}
 	c.JSON(http.StatusOK, resp)
 	// ---------------------------
 }
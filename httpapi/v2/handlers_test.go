@@ -132,7 +132,7 @@ func setupClusterNode(t *testing.T, nodeS clusterNodeState) *cluster.ClusterNode
 				Data: pointDataBytes,
 			}
 		}
-		failedRanges, err := cnode.InsertPoints(colState.Collection, points)
+		failedRanges, _, err := cnode.InsertPoints(colState.Collection, points)
 		require.NoError(t, err)
 		require.Len(t, failedRanges, 0)
 	}
@@ -38,7 +38,10 @@ func main() {
 			if !ok {
 				return nil
 			}
-			edges := conversion.BytesToEdgeList(v)
+			edges, err := conversion.DecodeEdgeList(v)
+			if err != nil {
+				return fmt.Errorf("could not decode edges of node %d: %w", nodeId, err)
+			}
 			// Print as nodeid, edge1, edge2, ...
 			fmt.Printf("%d", nodeId)
 			for _, edge := range edges {
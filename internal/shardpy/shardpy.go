@@ -3,6 +3,7 @@ package main
 
 import (
 	"C"
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -135,7 +136,7 @@ func fit(X []float32) {
 				Data: pointDataBytes,
 			}
 		}
-		if err := globalShard.InsertPoints(points); err != nil {
+		if err := globalShard.InsertPoints(context.Background(), points); err != nil {
 			log.Fatal(err)
 		}
 	}
@@ -183,7 +184,7 @@ func query(x []float32, k int, out []uint32) {
 		},
 		Select: []string{"xid"},
 	}
-	res, err := globalShard.SearchPoints(sr)
+	res, err := globalShard.SearchPoints(context.Background(), sr)
 	if err != nil {
 		log.Fatal(err)
 	}
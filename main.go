@@ -91,6 +91,8 @@ func main() {
 	}
 	cancel()
 	// ---------------------------
-	clusterNode.Close()
+	if err := clusterNode.Close(); err != nil {
+		log.Error().Err(err).Msg("Failed to close cluster node")
+	}
 	// ---------------------------
 }
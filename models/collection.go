@@ -10,4 +10,21 @@ type Collection struct {
 	// Active user plan, dynamically assigned
 	UserPlan    UserPlan
 	IndexSchema IndexSchema
+	// Ephemeral collections keep their shards in memory only, the points are
+	// lost when a shard is unloaded or the node restarts.
+	Ephemeral bool
+	// Seconds a shard of the collection stays loaded after its last use, zero
+	// uses the shard timeout of the shard manager.
+	ShardTimeout int
+	// Records the shard of every point in the node database so getting and
+	// deleting points only contact the shard of the point, at the cost of an
+	// extra write per insert and delete.
+	PointShardIndex bool
+	// Maximum encoded size in bytes of the data of a point other than its
+	// vectors plus its payload, zero means unlimited.
+	MaxMetadataBytes int
 }
+
+// DefaultMaxMetadataBytes is the metadata limit of new collections that do not
+// set one.
+const DefaultMaxMetadataBytes = 1 << 20
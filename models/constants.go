@@ -11,6 +11,7 @@ const (
 	DistanceHamming   = "hamming"
 	DistanceJaccard   = "jaccard"
 	DistanceHaversine = "haversine"
+	DistanceManhattan = "manhattan"
 )
 
 // ---------------------------
@@ -46,6 +47,7 @@ const (
 	QuantizerNone    = "none"
 	QuantizerBinary  = "binary"
 	QuantizerProduct = "product"
+	QuantizerFloat16 = "float16"
 )
 
 // ---------------------------
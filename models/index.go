@@ -18,6 +18,9 @@ func (s IndexSchema) Validate() error {
 			if v.VectorFlat.DistanceMetric == DistanceHaversine && v.VectorFlat.VectorSize != 2 {
 				return fmt.Errorf("haversine distance metric requires vector size 2 for property %s, got %d", k, v.VectorFlat.VectorSize)
 			}
+			if err := validateVectorFormat(v.VectorFlat.DistanceMetric, v.VectorFlat.VectorSize, v.VectorFlat.Quantizer); err != nil {
+				return fmt.Errorf("invalid vectorFlat parameters for property %s: %w", k, err)
+			}
 		case IndexTypeVectorVamana:
 			if v.VectorVamana == nil {
 				return fmt.Errorf("vectorVamana parameters not provided for property %s", k)
@@ -25,6 +28,9 @@ func (s IndexSchema) Validate() error {
 			if v.VectorVamana.DistanceMetric == DistanceHaversine && v.VectorVamana.VectorSize != 2 {
 				return fmt.Errorf("haversine distance metric requires vector size 2 for property %s, got %d", k, v.VectorVamana.VectorSize)
 			}
+			if err := validateVectorFormat(v.VectorVamana.DistanceMetric, v.VectorVamana.VectorSize, v.VectorVamana.Quantizer); err != nil {
+				return fmt.Errorf("invalid vectorVamana parameters for property %s: %w", k, err)
+			}
 		case IndexTypeText:
 			if v.Text == nil {
 				return fmt.Errorf("text parameters not provided for property %s", k)
@@ -47,6 +53,44 @@ func (s IndexSchema) Validate() error {
 	return nil
 }
 
+/* validateVectorFormat checks the distance metric and quantizer combination of
+ * a vector index. Not every combination makes sense, for example hamming and
+ * jaccard distances are computed on binarised vectors so they already imply a
+ * binary quantizer and product quantization can only approximate metrics that
+ * decompose over subvectors. Without this check such collections would be
+ * created and then fail or silently ignore the quantizer when points arrive. */
+func validateVectorFormat(distanceMetric string, vectorSize uint, quantizer *Quantizer) error {
+	if quantizer == nil || quantizer.Type == QuantizerNone {
+		return nil
+	}
+	switch distanceMetric {
+	case DistanceHamming, DistanceJaccard:
+		return fmt.Errorf("%s distance operates on binary vectors and does not support a %s quantizer, valid quantizers are: %s", distanceMetric, quantizer.Type, QuantizerNone)
+	case DistanceHaversine:
+		return fmt.Errorf("haversine distance does not support a %s quantizer, valid quantizers are: %s", quantizer.Type, QuantizerNone)
+	}
+	switch quantizer.Type {
+	case QuantizerBinary:
+		if quantizer.Binary == nil {
+			return fmt.Errorf("binary quantizer parameters not provided")
+		}
+	case QuantizerProduct:
+		if quantizer.Product == nil {
+			return fmt.Errorf("product quantizer parameters not provided")
+		}
+		if distanceMetric != DistanceEuclidean && distanceMetric != DistanceCosine && distanceMetric != DistanceDot {
+			return fmt.Errorf("product quantizer does not support %s distance, valid distances are: %s, %s, %s", distanceMetric, DistanceEuclidean, DistanceCosine, DistanceDot)
+		}
+		if quantizer.Product.NumSubVectors <= 0 || vectorSize%uint(quantizer.Product.NumSubVectors) != 0 {
+			return fmt.Errorf("product quantizer requires vector size %d to be divisible by number of subvectors %d", vectorSize, quantizer.Product.NumSubVectors)
+		}
+	case QuantizerFloat16:
+	default:
+		return fmt.Errorf("unknown quantizer type %s, valid types are: %s, %s, %s, %s", quantizer.Type, QuantizerNone, QuantizerBinary, QuantizerProduct, QuantizerFloat16)
+	}
+	return nil
+}
+
 type IndexSchemaValue struct {
 	Type         string                       `json:"type" binding:"required,oneof=vectorFlat vectorVamana text string integer float stringArray"`
 	VectorFlat   *IndexVectorFlatParameters   `json:"vectorFlat,omitempty"`
@@ -190,19 +234,43 @@ func (s IndexSchema) CheckCompatibleMap(m PointAsMap) error {
 	return nil
 }
 
+// The distance metric of vector indexes is not bound to the built-in names
+// because custom metrics can be registered with the distance package, the
+// cluster rejects collections with unknown metrics.
 type IndexVectorFlatParameters struct {
 	VectorSize     uint       `json:"vectorSize" binding:"required,min=1,max=4096"`
-	DistanceMetric string     `json:"distanceMetric" binding:"required,oneof=euclidean cosine dot hamming jaccard haversine"`
+	DistanceMetric string     `json:"distanceMetric" binding:"required"`
 	Quantizer      *Quantizer `json:"quantizer,omitempty"`
 }
 
 type IndexVectorVamanaParameters struct {
 	VectorSize     uint       `json:"vectorSize" binding:"required,min=1,max=4096"`
-	DistanceMetric string     `json:"distanceMetric" binding:"required,oneof=euclidean cosine dot hamming jaccard haversine"`
+	DistanceMetric string     `json:"distanceMetric" binding:"required"`
 	SearchSize     int        `json:"searchSize" binding:"min=25,max=75"`
 	DegreeBound    int        `json:"degreeBound" binding:"min=32,max=64"`
 	Alpha          float32    `json:"alpha" binding:"min=1.1,max=1.5"`
 	Quantizer      *Quantizer `json:"quantizer,omitempty"`
+	// Search size of the greedy search that finds the neighbours of inserted
+	// points, zero uses the search size. A larger value builds a better graph
+	// and so raises the recall of every query at the cost of slower inserts,
+	// whereas the search size only trades recall for speed per query.
+	ConstructionSearchSize int `json:"constructionSearchSize,omitempty" binding:"omitempty,min=25,max=200"`
+	// Optional upper bound on the number of hops the greedy search takes from
+	// the start node to any node. Extra edges are added by the graph repair and
+	// rebuild maintenance, not by inserts, to bring nodes within reach. Zero
+	// disables the bound.
+	MaxHops int `json:"maxHops,omitempty" binding:"min=0,max=100"`
+	// Normalise inserted and query vectors to unit length, only applies to
+	// cosine distance which otherwise expects normalised vectors.
+	AutoNormalize bool `json:"autoNormalize,omitempty"`
+	// Store the edges of the graph delta encoded which takes roughly a third of
+	// the space at the cost of decoding them when nodes are loaded. It suits
+	// read heavy collections whose graph does not fit the page cache.
+	CompressEdges bool `json:"compressEdges,omitempty"`
+	// Seeds the random start vector of the graph so tests can reproduce it,
+	// zero picks a random one. It is set when opening a shard and is never
+	// stored or sent.
+	StartSeed int64 `json:"-" msgpack:"-"`
 }
 
 type IndexTextParameters struct {
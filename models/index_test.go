@@ -107,3 +107,60 @@ func TestIndexSchema_CheckCompatibleMap(t *testing.T) {
 	err := schema.CheckCompatibleMap(m)
 	require.NoError(t, err)
 }
+
+func TestIndexSchema_Validate_VectorFormat(t *testing.T) {
+	binary := &models.Quantizer{
+		Type:   models.QuantizerBinary,
+		Binary: &models.BinaryQuantizerParamaters{DistanceMetric: models.DistanceHamming},
+	}
+	product := &models.Quantizer{
+		Type:    models.QuantizerProduct,
+		Product: &models.ProductQuantizerParameters{NumCentroids: 256, NumSubVectors: 4, TriggerThreshold: 1000},
+	}
+	tests := []struct {
+		metric     string
+		vectorSize uint
+		quantizer  *models.Quantizer
+		valid      bool
+	}{
+		{models.DistanceEuclidean, 8, nil, true},
+		{models.DistanceHamming, 8, &models.Quantizer{Type: models.QuantizerNone}, true},
+		{models.DistanceCosine, 8, binary, true},
+		{models.DistanceDot, 8, product, true},
+		{models.DistanceEuclidean, 8, product, true},
+		// Invalid combinations
+		{models.DistanceHamming, 8, binary, false},
+		{models.DistanceJaccard, 8, product, false},
+		{models.DistanceHaversine, 2, binary, false},
+		{models.DistanceEuclidean, 6, product, false},
+		{models.DistanceEuclidean, 8, &models.Quantizer{Type: models.QuantizerProduct}, false},
+		{models.DistanceEuclidean, 8, &models.Quantizer{Type: models.QuantizerBinary}, false},
+		{models.DistanceEuclidean, 8, &models.Quantizer{Type: "gibberish"}, false},
+	}
+	for _, tt := range tests {
+		schema := models.IndexSchema{
+			"flat": models.IndexSchemaValue{
+				Type: models.IndexTypeVectorFlat,
+				VectorFlat: &models.IndexVectorFlatParameters{
+					DistanceMetric: tt.metric,
+					VectorSize:     tt.vectorSize,
+					Quantizer:      tt.quantizer,
+				},
+			},
+			"vamana": models.IndexSchemaValue{
+				Type: models.IndexTypeVectorVamana,
+				VectorVamana: &models.IndexVectorVamanaParameters{
+					DistanceMetric: tt.metric,
+					VectorSize:     tt.vectorSize,
+					Quantizer:      tt.quantizer,
+				},
+			},
+		}
+		err := schema.Validate()
+		if tt.valid {
+			require.NoError(t, err, "%s %v", tt.metric, tt.quantizer)
+		} else {
+			require.Error(t, err, "%s %v", tt.metric, tt.quantizer)
+		}
+	}
+}
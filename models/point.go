@@ -39,6 +39,12 @@ func (p PointAsMap) ExtractIdField(createNew bool) (uuid.UUID, error) {
 type Point struct {
 	Id   uuid.UUID
 	Data []byte
+	// Optional opaque payload that is stored alongside the point but never
+	// indexed, it is only returned when explicitly requested.
+	Payload []byte `msgpack:",omitempty"`
+	// Optional unix time in seconds after which the point is no longer
+	// returned by searches, zero means the point never expires.
+	ExpiresAt int64 `msgpack:",omitempty"`
 }
 
 func (p *Point) GetField(name string) (any, error) {
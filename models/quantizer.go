@@ -1,7 +1,7 @@
 package models
 
 type Quantizer struct {
-	Type    string                      `json:"type" binding:"required,oneof=none binary product"`
+	Type    string                      `json:"type" binding:"required,oneof=none binary product float16"`
 	Binary  *BinaryQuantizerParamaters  `json:"binary,omitempty"`
 	Product *ProductQuantizerParameters `json:"product,omitempty"`
 }
@@ -29,4 +29,9 @@ type ProductQuantizerParameters struct {
 	// Number of points to use to train the quantizer, it will automatically trigger training
 	// when this number of points is reached.
 	TriggerThreshold int `json:"triggerThreshold" binding:"required,min=1000,max=10000"`
+	// Retrain the quantizer once the average quantization error of the points
+	// inserted since the last training exceeds this multiple of the training
+	// error, 0 disables retraining. For example 1.5 retrains when new points
+	// are quantized 50% worse than the points the codebook was trained on.
+	RetrainDriftThreshold float32 `json:"retrainDriftThreshold,omitempty" binding:"omitempty,min=1"`
 }
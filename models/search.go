@@ -1,6 +1,13 @@
 package models
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrDimMismatch is returned when a vector does not have the size of the
+// index of its property.
+var ErrDimMismatch = errors.New("vector length mismatch")
 
 /* The search query design is based on the following key steps:
  *
@@ -18,6 +25,9 @@ type SearchRequest struct {
 	Sort   []SortOption `json:"sort" binding:"max=10,dive"`
 	Offset int          `json:"offset" binding:"min=0"`
 	Limit  int          `json:"limit" binding:"required,min=1,max=100"`
+	// Whether to return the payloads of the points, they are left out by
+	// default as they can be large.
+	IncludePayload bool `json:"includePayload"`
 }
 
 // ---------------------------
@@ -35,6 +45,11 @@ type Query struct {
 	Or           []Query                    `json:"_or" binding:"dive"`
 }
 
+// Bit distances work on binarised vectors so they are already exact
+func isBitDistance(metric string) bool {
+	return metric == DistanceHamming || metric == DistanceJaccard
+}
+
 func (q Query) Validate(schema IndexSchema) error {
 	// Handle recursive case
 	switch q.Property {
@@ -65,18 +80,28 @@ func (q Query) Validate(schema IndexSchema) error {
 			return fmt.Errorf("vectorFlat query options not provided for property %s", q.Property)
 		}
 		if len(q.VectorFlat.Vector) != int(value.VectorFlat.VectorSize) {
-			return fmt.Errorf("vectorFlat query vector length mismatch for property %s, expected %d got %d", q.Property, value.VectorFlat.VectorSize, len(q.VectorFlat.Vector))
+			return fmt.Errorf("vectorFlat query %w for property %s, expected %d got %d", ErrDimMismatch, q.Property, value.VectorFlat.VectorSize, len(q.VectorFlat.Vector))
+		}
+		if q.VectorFlat.Rerank != nil && isBitDistance(value.VectorFlat.DistanceMetric) {
+			return fmt.Errorf("rerank is not supported for %s distance of property %s", value.VectorFlat.DistanceMetric, q.Property)
 		}
 	case IndexTypeVectorVamana:
 		if q.VectorVamana == nil {
 			return fmt.Errorf("vectorVamana query options not provided for property %s", q.Property)
 		}
 		if len(q.VectorVamana.Vector) != int(value.VectorVamana.VectorSize) {
-			return fmt.Errorf("vectorVamana query vector length mismatch for property %s, expected %d got %d", q.Property, value.VectorVamana.VectorSize, len(q.VectorVamana.Vector))
+			return fmt.Errorf("vectorVamana query %w for property %s, expected %d got %d", ErrDimMismatch, q.Property, value.VectorVamana.VectorSize, len(q.VectorVamana.Vector))
 		}
-		if q.VectorVamana.SearchSize < q.VectorVamana.Limit {
+		searchSize := q.VectorVamana.SearchSize
+		if searchSize == 0 {
+			searchSize = value.VectorVamana.SearchSize
+		}
+		if searchSize < q.VectorVamana.Limit {
 			return fmt.Errorf("searchSize must be greater than or equal to limit for property %s", q.Property)
 		}
+		if q.VectorVamana.Rerank != nil && isBitDistance(value.VectorVamana.DistanceMetric) {
+			return fmt.Errorf("rerank is not supported for %s distance of property %s", value.VectorVamana.DistanceMetric, q.Property)
+		}
 	case IndexTypeText:
 		if q.Text == nil {
 			return fmt.Errorf("text query options not provided for property %s", q.Property)
@@ -128,12 +153,51 @@ type SortOption struct {
 }
 
 type SearchVectorVamanaOptions struct {
-	Vector     []float32 `json:"vector" binding:"required,max=4096"`
-	Operator   string    `json:"operator" binding:"required,oneof=near"`
-	SearchSize int       `json:"searchSize" binding:"required,min=25,max=75"`
-	Limit      int       `json:"limit" binding:"required,min=1,max=75"`
-	Filter     *Query    `json:"filter"`
-	Weight     *float32  `json:"weight"`
+	Vector   []float32 `json:"vector" binding:"required,max=4096"`
+	Operator string    `json:"operator" binding:"required,oneof=near"`
+	// Zero uses the searchSize of the index parameters
+	SearchSize int      `json:"searchSize" binding:"omitempty,min=25,max=75"`
+	Limit      int      `json:"limit" binding:"required,min=1,max=75"`
+	Filter     *Query   `json:"filter"`
+	Weight     *float32 `json:"weight"`
+	// If set, the graph search falls back to an exact search when it looks
+	// like the approximate search has poor recall.
+	ExactFallback *SearchVectorVamanaExactFallbackOptions `json:"exactFallback"`
+	// If set, the results are re-ranked to be diverse rather than just the
+	// nearest ones.
+	Diversify *SearchVectorVamanaDiversifyOptions `json:"diversify"`
+	// If set, more candidates are fetched and re-ranked using exact
+	// distances, useful when the index is quantized.
+	Rerank *SearchVectorRerankOptions `json:"rerank"`
+	// If greater than one, the neighbours of the closest unvisited nodes are
+	// loaded concurrently with this many workers, which helps searches on
+	// indexes not yet in the cache. Zero or one searches sequentially.
+	PrefetchWorkers int `json:"prefetchWorkers" binding:"omitempty,min=0,max=16"`
+}
+
+// The criteria under which an approximate search is deemed to have poor
+// recall. Any criteria that is met triggers the exact search.
+type SearchVectorVamanaExactFallbackOptions struct {
+	// Fall back if the graph search visited fewer nodes than this, 0 defaults
+	// to the limit of the search.
+	MinVisited int `json:"minVisited" binding:"min=0"`
+	// Fall back if the graph search returned fewer results than the limit.
+	OnShortResults bool `json:"onShortResults"`
+}
+
+// Maximal Marginal Relevance re-ranking of the search candidates.
+type SearchVectorVamanaDiversifyOptions struct {
+	// Trades off relevance against diversity, 1 is plain nearest neighbour
+	// search and 0 ranks purely on dissimilarity to the already selected
+	// results.
+	Lambda float32 `json:"lambda" binding:"min=0,max=1"`
+}
+
+// Exact re-ranking of the candidates of a vector search.
+type SearchVectorRerankOptions struct {
+	// Number of candidates fetched per result, e.g. a factor of 4 with a limit
+	// of 10 re-ranks the 40 nearest candidates.
+	Factor int `json:"factor" binding:"required,min=1,max=10"`
 }
 
 type SearchVectorFlatOptions struct {
@@ -142,6 +206,9 @@ type SearchVectorFlatOptions struct {
 	Limit    int       `json:"limit" binding:"required,min=1,max=75"`
 	Filter   *Query    `json:"filter"`
 	Weight   *float32  `json:"weight"`
+	// If set, more candidates are fetched and re-ranked using exact
+	// distances, useful when the index is quantized.
+	Rerank *SearchVectorRerankOptions `json:"rerank"`
 }
 
 type SearchTextOptions struct {
@@ -12,4 +12,9 @@ type UserPlan struct {
 	ShardBackupFrequency int `yaml:"shardBackupFrequency"`
 	// The maximum number of shard backups to keep
 	ShardBackupCount int `yaml:"shardBackupCount"`
+	// Fraction of search queries to record for query pattern analysis, 0
+	// disables the query log and 1 records every query
+	QueryStatsSampleRate float64 `yaml:"queryStatsSampleRate"`
+	// How long in seconds to keep recorded queries, 0 keeps them indefinitely
+	QueryStatsRetention int `yaml:"queryStatsRetention"`
 }
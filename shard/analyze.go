@@ -0,0 +1,236 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard/index"
+	"github.com/semafind/semadb/shard/index/vamana"
+)
+
+/* Analyze is diagnostic tooling to monitor the health of the graph indexes
+ * over time, e.g. in a staging environment. The structural statistics are
+ * always computed, the recall only if ground truth is given for the sample
+ * queries. The recall is measured on the graph index of the collection so it
+ * requires the schema to have exactly one. */
+
+type AnalyzeReport struct {
+	vamana.GraphStats
+	// Average number of outgoing edges of a node
+	AverageDegree float64
+	// Number of sample queries the recall is measured on, zero if no ground
+	// truth was given
+	QueryCount int
+	// Fraction of the ground truth points returned when searching for as many
+	// points as the ground truth of each query has, i.e. recall@k
+	Recall float64
+}
+
+// vamanaProperty returns the property of the only graph index in the schema.
+func vamanaProperty(schema models.IndexSchema) (string, *models.IndexVectorVamanaParameters, error) {
+	found := ""
+	var params *models.IndexVectorVamanaParameters
+	for property, p := range schema {
+		if p.Type != models.IndexTypeVectorVamana {
+			continue
+		}
+		if found != "" {
+			return "", nil, fmt.Errorf("multiple graph indexes %s and %s", found, property)
+		}
+		found, params = property, p.VectorVamana
+	}
+	if found == "" {
+		return "", nil, fmt.Errorf("no graph index found")
+	}
+	return found, params, nil
+}
+
+// Analyze reports structural statistics of the graph indexes and, if ground
+// truth ids are given for the sample queries, the recall of searching them.
+func (s *Shard) Analyze(ctx context.Context, sampleQueries [][]float32, groundTruth [][]uuid.UUID) (AnalyzeReport, error) {
+	var report AnalyzeReport
+	if len(groundTruth) > 0 && len(groundTruth) != len(sampleQueries) {
+		return report, fmt.Errorf("got %d ground truths for %d sample queries", len(groundTruth), len(sampleQueries))
+	}
+	// ---------------------------
+	cacheTx := s.cacheManager.NewTransaction()
+	err := s.db.Read(func(bm diskstore.BucketManager) error {
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+		var err error
+		report.GraphStats, err = im.GraphStats()
+		return err
+	})
+	cacheTx.Commit(err != nil)
+	if err != nil {
+		return report, fmt.Errorf("could not compute graph stats: %w", err)
+	}
+	if report.NodeCount > 0 {
+		report.AverageDegree = float64(report.EdgeCount) / float64(report.NodeCount)
+	}
+	if len(groundTruth) == 0 {
+		return report, nil
+	}
+	// ---------------------------
+	property, params, err := vamanaProperty(s.collection.IndexSchema)
+	if err != nil {
+		return report, fmt.Errorf("could not measure recall: %w", err)
+	}
+	found, total := 0, 0
+	for i, query := range sampleQueries {
+		k := len(groundTruth[i])
+		if k == 0 {
+			continue
+		}
+		sr := models.SearchRequest{
+			Query: models.Query{
+				Property: property,
+				VectorVamana: &models.SearchVectorVamanaOptions{
+					Vector:     query,
+					Operator:   "near",
+					SearchSize: max(params.SearchSize, k),
+					Limit:      k,
+				},
+			},
+			Limit: k,
+		}
+		results, err := s.SearchPoints(ctx, sr)
+		if err != nil {
+			return report, fmt.Errorf("could not search sample query %d: %w", i, err)
+		}
+		want := make(map[uuid.UUID]struct{}, k)
+		for _, id := range groundTruth[i] {
+			want[id] = struct{}{}
+		}
+		for _, r := range results {
+			if _, ok := want[r.Point.Id]; ok {
+				found++
+			}
+		}
+		total += k
+		report.QueryCount++
+	}
+	if total > 0 {
+		report.Recall = float64(found) / float64(total)
+	}
+	s.logger.Debug().Int("queryCount", report.QueryCount).Float64("recall", report.Recall).Msg("Analyze")
+	return report, nil
+}
+
+// ---------------------------
+
+/* The search sizes a collection accepts are bounded, see the binding of
+ * IndexVectorVamanaParameters.SearchSize, so calibration only probes those. */
+const (
+	minCalibrateSearchSize = 25
+	maxCalibrateSearchSize = 75
+)
+
+// CalibrateSearchSize returns the smallest search size of the graph index for
+// which searching the sample queries reaches the target recall@k against the
+// ground truth. The probe searches share a single read transaction. Recall
+// grows with the search size in practice but not strictly, so the binary
+// search may settle on a slightly larger size than necessary.
+func (s *Shard) CalibrateSearchSize(ctx context.Context, sampleQueries [][]float32, groundTruth [][]uuid.UUID, targetRecall float64) (int, error) {
+	if len(sampleQueries) == 0 || len(groundTruth) != len(sampleQueries) {
+		return 0, fmt.Errorf("got %d ground truths for %d sample queries", len(groundTruth), len(sampleQueries))
+	}
+	if targetRecall <= 0 || targetRecall > 1 {
+		return 0, fmt.Errorf("target recall must be in (0, 1], got %f", targetRecall)
+	}
+	property, _, err := vamanaProperty(s.collection.IndexSchema)
+	if err != nil {
+		return 0, fmt.Errorf("could not calibrate search size: %w", err)
+	}
+	lo := minCalibrateSearchSize
+	for _, gt := range groundTruth {
+		lo = max(lo, len(gt))
+	}
+	if lo > maxCalibrateSearchSize {
+		return 0, fmt.Errorf("ground truth of more than %d points is not supported", maxCalibrateSearchSize)
+	}
+	// ---------------------------
+	searchSize := 0
+	cacheTx := s.cacheManager.NewTransaction()
+	err = s.db.Read(func(bm diskstore.BucketManager) error {
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		// Searches return node ids so we compare against those
+		truth := make([]map[uint64]struct{}, len(groundTruth))
+		for i, gt := range groundTruth {
+			truth[i] = make(map[uint64]struct{}, len(gt))
+			for _, id := range gt {
+				nodeId, err := GetPointNodeIdByUUID(bPoints, id)
+				if err != nil {
+					return fmt.Errorf("could not get ground truth point %s: %w", id, err)
+				}
+				truth[i][nodeId] = struct{}{}
+			}
+		}
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+		recallAt := func(size int) (float64, error) {
+			found, total := 0, 0
+			for i, query := range sampleQueries {
+				k := len(truth[i])
+				if k == 0 {
+					continue
+				}
+				q := models.Query{
+					Property: property,
+					VectorVamana: &models.SearchVectorVamanaOptions{
+						Vector:     query,
+						Operator:   "near",
+						SearchSize: size,
+						Limit:      k,
+					},
+				}
+				_, results, err := im.Search(ctx, q)
+				if err != nil {
+					return 0, fmt.Errorf("could not search sample query %d: %w", i, err)
+				}
+				for _, r := range results {
+					if _, ok := truth[i][r.NodeId]; ok {
+						found++
+					}
+				}
+				total += k
+			}
+			if total == 0 {
+				return 0, fmt.Errorf("no ground truth given")
+			}
+			return float64(found) / float64(total), nil
+		}
+		// ---------------------------
+		hi := maxCalibrateSearchSize
+		recall, err := recallAt(hi)
+		if err != nil {
+			return err
+		}
+		if recall < targetRecall {
+			return fmt.Errorf("recall %f at the largest search size %d is below the target %f", recall, hi, targetRecall)
+		}
+		for lo < hi {
+			mid := (lo + hi) / 2
+			if recall, err = recallAt(mid); err != nil {
+				return err
+			}
+			if recall >= targetRecall {
+				hi = mid
+			} else {
+				lo = mid + 1
+			}
+		}
+		searchSize = hi
+		return nil
+	})
+	cacheTx.Commit(err != nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not calibrate search size: %w", err)
+	}
+	s.logger.Debug().Int("searchSize", searchSize).Float64("targetRecall", targetRecall).Msg("CalibrateSearchSize")
+	return searchSize, nil
+}
@@ -0,0 +1,151 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+)
+
+/* A bulk load keeps a single write transaction open across many inserts so an
+ * initial data load pays for committing and syncing the database once instead
+ * of once per batch. The price is durability: nothing of the bulk load is on
+ * disk until End returns, a crash or any failed insert during the bulk load
+ * discards the whole bulk load, i.e. it is all or nothing for the session.
+ *
+ * Whilst the bulk load is open other writes to the shard wait for it to end
+ * because the database allows one write transaction at a time. Searches carry
+ * on but see the shard as it was before the bulk load and use a cold index
+ * cache. */
+
+// ErrBulkLoadClosed is returned when using a bulk load that has ended or
+// failed.
+var ErrBulkLoadClosed = errors.New("bulk load closed")
+
+type bulkLoadRequest struct {
+	ctx    context.Context
+	points []models.Point
+	// Asks to end the bulk load, it is rolled back if ctx is done
+	end  bool
+	errC chan error
+}
+
+// BulkLoad is an open bulk load of a shard. It is not safe for concurrent use,
+// the inserts of a bulk load are sent one after the other.
+type BulkLoad struct {
+	shard    *Shard
+	requests chan bulkLoadRequest
+	// Result of the write transaction, sent once it is over
+	doneC    chan error
+	inserted int
+	// Set once the write transaction is over
+	closed bool
+}
+
+// BeginBulkLoad opens a write transaction that the inserts of the returned
+// bulk load share until End or Abort is called.
+func (s *Shard) BeginBulkLoad() (*BulkLoad, error) {
+	if s.readOnly {
+		return nil, fmt.Errorf("could not begin bulk load: %w", diskstore.ErrReadOnly)
+	}
+	b := &BulkLoad{
+		shard:    s,
+		requests: make(chan bulkLoadRequest),
+		doneC:    make(chan error, 1),
+	}
+	go func() {
+		cacheTx := s.cacheManager.NewTransaction()
+		err := s.db.Write(func(bm diskstore.BucketManager) error {
+			for req := range b.requests {
+				if req.end {
+					return req.ctx.Err()
+				}
+				_, err := s.insertPointsTx(req.ctx, bm, cacheTx, req.points, false)
+				req.errC <- err
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		cacheTx.Commit(err != nil)
+		b.doneC <- err
+		close(b.doneC)
+	}()
+	return b, nil
+}
+
+// InsertPoints inserts the points as part of the bulk load. If it fails the
+// bulk load is rolled back and can no longer be used.
+func (b *BulkLoad) InsertPoints(ctx context.Context, points []models.Point) error {
+	if b.closed {
+		return fmt.Errorf("could not insert points: %w", ErrBulkLoadClosed)
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("could not insert points: %w", err)
+	}
+	if err := b.shard.validateInsert(points); err != nil {
+		return err
+	}
+	// ---------------------------
+	req := bulkLoadRequest{ctx: ctx, points: points, errC: make(chan error, 1)}
+	if err := b.send(req); err != nil {
+		return fmt.Errorf("could not insert points: %w", err)
+	}
+	if err := <-req.errC; err != nil {
+		// The transaction has already rolled back
+		close(b.requests)
+		<-b.doneC
+		b.closed = true
+		return fmt.Errorf("could not insert points: %w", err)
+	}
+	b.inserted += len(points)
+	return nil
+}
+
+// send hands the request to the write transaction. It fails if the transaction
+// is already over, e.g. the shard was closed so the transaction never started.
+func (b *BulkLoad) send(req bulkLoadRequest) error {
+	select {
+	case b.requests <- req:
+		return nil
+	case err := <-b.doneC:
+		b.closed = true
+		if err == nil {
+			err = ErrBulkLoadClosed
+		}
+		return err
+	}
+}
+
+func (b *BulkLoad) finish(ctx context.Context) error {
+	if b.closed {
+		return ErrBulkLoadClosed
+	}
+	if err := b.send(bulkLoadRequest{ctx: ctx, end: true}); err != nil {
+		return err
+	}
+	close(b.requests)
+	b.closed = true
+	return <-b.doneC
+}
+
+// End commits the bulk load, after which its points are on disk and visible.
+// It returns the number of points inserted.
+func (b *BulkLoad) End() (int, error) {
+	if err := b.finish(context.Background()); err != nil {
+		return 0, fmt.Errorf("could not end bulk load: %w", err)
+	}
+	b.shard.metrics.IncInsert(b.inserted)
+	b.shard.logger.Debug().Int("inserted", b.inserted).Msg("EndBulkLoad")
+	return b.inserted, nil
+}
+
+// Abort rolls back the bulk load, none of its points are kept.
+func (b *BulkLoad) Abort() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = b.finish(ctx)
+}
@@ -0,0 +1,299 @@
+package shard
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+)
+
+/* The change feed records the last operation applied to every point so
+ * downstream systems can incrementally sync a shard. Only the latest change of
+ * a point is kept, if a point is inserted and then updated, the feed reports a
+ * single update. Deleted points remain in the feed as tombstones so that
+ * consumers can learn about deletions too.
+ *
+ * Storage map:
+ * changes:
+ * - t<unix_nano><point_uuid>: operation
+ * - p<point_uuid>: unix_nano of the latest change
+ * - lastWrite: unix_nano of the last applied write, for replicas this is the
+ *   timestamp of the last change applied from the primary
+ *
+ * The timestamps are big endian so the t keys are ordered by time and then by
+ * point id which gives a stable order to page through. */
+
+const CHANGESBUCKETKEY = "changes"
+
+var LASTWRITEKEY = []byte("lastWrite")
+
+// Used to stop the range scan early once enough changes are collected
+var errChangeLimitReached = errors.New("change limit reached")
+
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+type PointChange struct {
+	// The data of the point is empty for deletions
+	Point     models.Point
+	Operation string
+	// Unix nano timestamp of when the change was written
+	Timestamp int64
+}
+
+// A change cursor points to a position in the change feed. Changes strictly
+// after the cursor are returned.
+type ChangeCursor struct {
+	Timestamp int64
+	Id        uuid.UUID
+}
+
+func changeTimeKey(timestamp int64, id uuid.UUID) []byte {
+	key := make([]byte, 25)
+	key[0] = 't'
+	binary.BigEndian.PutUint64(key[1:], uint64(timestamp))
+	copy(key[9:], id[:])
+	return key
+}
+
+func changePointKey(id uuid.UUID) []byte {
+	key := make([]byte, 17)
+	key[0] = 'p'
+	copy(key[1:], id[:])
+	return key
+}
+
+func recordChanges(bucket diskstore.Bucket, operation string, timestamp int64, ids ...uuid.UUID) error {
+	for _, id := range ids {
+		pKey := changePointKey(id)
+		// Remove the previous change of this point, only the latest is kept
+		if prev := bucket.Get(pKey); prev != nil {
+			prevTimestamp := int64(binary.BigEndian.Uint64(prev))
+			if err := bucket.Delete(changeTimeKey(prevTimestamp, id)); err != nil {
+				return fmt.Errorf("could not delete previous change of %s: %w", id, err)
+			}
+		}
+		if err := bucket.Put(changeTimeKey(timestamp, id), []byte(operation)); err != nil {
+			return fmt.Errorf("could not record change of %s: %w", id, err)
+		}
+		tsBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(tsBytes, uint64(timestamp))
+		if err := bucket.Put(pKey, tsBytes); err != nil {
+			return fmt.Errorf("could not record change timestamp of %s: %w", id, err)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return setLastWriteTime(bucket, timestamp)
+}
+
+func setLastWriteTime(bucket diskstore.Bucket, timestamp int64) error {
+	// Writes stamped by different coordinators may arrive out of order
+	if getLastWriteTime(bucket) >= timestamp {
+		return nil
+	}
+	tsBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(tsBytes, uint64(timestamp))
+	if err := bucket.Put(LASTWRITEKEY, tsBytes); err != nil {
+		return fmt.Errorf("could not set last write time: %w", err)
+	}
+	return nil
+}
+
+func getLastWriteTime(bucket diskstore.ReadOnlyBucket) int64 {
+	tsBytes := bucket.Get(LASTWRITEKEY)
+	if tsBytes == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(tsBytes))
+}
+
+// ---------------------------
+
+// ChangedSince returns the latest change of every point that was inserted,
+// updated or deleted strictly after t, ordered by time.
+func (s *Shard) ChangedSince(t time.Time) ([]PointChange, error) {
+	changes, _, err := s.ChangesAfter(ChangeCursor{Timestamp: t.UnixNano(), Id: uuid.Max}, 0)
+	return changes, err
+}
+
+// ChangesAfter returns up to limit changes after the cursor along with the
+// cursor to continue from. A limit of 0 returns all remaining changes. The
+// returned cursor points to the last change returned, or is the given cursor if
+// there are no more changes.
+func (s *Shard) ChangesAfter(cursor ChangeCursor, limit int) (changes []PointChange, next ChangeCursor, err error) {
+	next = cursor
+	changes = make([]PointChange, 0)
+	err = s.db.Read(func(bm diskstore.BucketManager) error {
+		bChanges, err := bm.Get(CHANGESBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get changes bucket: %w", err)
+		}
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		bPayloads, err := bm.Get(PAYLOADSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get payloads bucket: %w", err)
+		}
+		start := changeTimeKey(cursor.Timestamp, cursor.Id)
+		err = bChanges.RangeScan(start, []byte{'u'}, false, func(k, v []byte) error {
+			if limit > 0 && len(changes) >= limit {
+				return errChangeLimitReached
+			}
+			pc := PointChange{
+				Operation: string(v),
+				Timestamp: int64(binary.BigEndian.Uint64(k[1:9])),
+			}
+			pc.Point.Id = uuid.UUID(k[9:25])
+			if pc.Operation != ChangeDelete {
+				sp, err := GetPointByUUID(bPoints, pc.Point.Id)
+				if err != nil {
+					return fmt.Errorf("could not get changed point %s: %w", pc.Point.Id, err)
+				}
+				pc.Point.Data = bytes.Clone(sp.Data)
+				pc.Point.ExpiresAt = sp.ExpiresAt
+				pc.Point.Payload = getPayload(bPayloads, pc.Point.Id)
+			}
+			changes = append(changes, pc)
+			next = ChangeCursor{Timestamp: pc.Timestamp, Id: pc.Point.Id}
+			return nil
+		})
+		if err == errChangeLimitReached {
+			return nil
+		}
+		return err
+	})
+	return
+}
+
+// ---------------------------
+
+/* ApplyChanges brings a replica shard up to date using the change feed of the
+ * primary, e.g. the output of ChangesAfter. Inserted and updated points are
+ * written as they are on the primary and deleted points are removed. All of it
+ * happens in a single write transaction so a failure leaves the replica as it
+ * was. The changes are recorded with the timestamps of the primary, so the
+ * last write time of the replica reflects how far it has caught up with the
+ * primary rather than when the changes were applied locally. */
+func (s *Shard) ApplyChanges(changes []PointChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	if s.readOnly {
+		return fmt.Errorf("could not apply changes: %w", diskstore.ErrReadOnly)
+	}
+	// ---------------------------
+	// Only the latest change of every point matters
+	latest := make(map[uuid.UUID]PointChange, len(changes))
+	for _, c := range changes {
+		if prev, ok := latest[c.Point.Id]; !ok || c.Timestamp >= prev.Timestamp {
+			latest[c.Point.Id] = c
+		}
+	}
+	deleteSet := make(map[uuid.UUID]struct{})
+	upserts := make([]models.Point, 0, len(latest))
+	lastTimestamp := int64(0)
+	for id, c := range latest {
+		if c.Operation == ChangeDelete {
+			deleteSet[id] = struct{}{}
+		} else {
+			upserts = append(upserts, c.Point)
+		}
+		lastTimestamp = max(lastTimestamp, c.Timestamp)
+	}
+	if err := s.validateInsert(upserts); err != nil {
+		return fmt.Errorf("could not apply changes: %w", err)
+	}
+	// In timestamp order so the last write time ends at the latest change
+	ordered := make([]PointChange, 0, len(latest))
+	for _, c := range latest {
+		ordered = append(ordered, c)
+	}
+	slices.SortFunc(ordered, func(a, b PointChange) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	})
+	// ---------------------------
+	/* Upserting replaces the data of points that exist entirely, unlike
+	 * updates which merge. The upserts come first so that new points do not
+	 * take the node ids freed by the deletes within the same transaction. */
+	ctx := WithWriteTime(context.Background(), lastTimestamp)
+	cacheTx := s.cacheManager.NewTransaction()
+	err := s.db.Write(func(bm diskstore.BucketManager) error {
+		bPayloads, err := bm.Get(PAYLOADSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get payloads bucket: %w", err)
+		}
+		// The primary may no longer have the payload of an upserted point
+		for _, point := range upserts {
+			if len(point.Payload) == 0 {
+				if err := deletePayloads(bPayloads, point.Id); err != nil {
+					return err
+				}
+			}
+		}
+		if len(upserts) > 0 {
+			if _, err := s.insertPointsTx(ctx, bm, cacheTx, upserts, true); err != nil {
+				return fmt.Errorf("could not upsert changed points: %w", err)
+			}
+		}
+		if len(deleteSet) > 0 {
+			_, err := s.deletePointsTx(ctx, bm, cacheTx, func(diskstore.ReadOnlyBucket) (map[uuid.UUID]struct{}, error) {
+				return deleteSet, nil
+			})
+			if err != nil {
+				return fmt.Errorf("could not delete changed points: %w", err)
+			}
+		}
+		// ---------------------------
+		bChanges, err := bm.Get(CHANGESBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get changes bucket: %w", err)
+		}
+		for _, c := range ordered {
+			if err := recordChanges(bChanges, c.Operation, c.Timestamp, c.Point.Id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		cacheTx.Commit(true)
+		return fmt.Errorf("could not apply changes: %w", err)
+	}
+	cacheTx.Commit(false)
+	return nil
+}
+
+// ---------------------------
+
+type writeTimeKey struct{}
+
+// WithWriteTime returns a context whose writes record their changes at the
+// given time in unix nanoseconds instead of the local clock, so that every
+// copy of a shard records the same time for the same write.
+func WithWriteTime(ctx context.Context, timestamp int64) context.Context {
+	return context.WithValue(ctx, writeTimeKey{}, timestamp)
+}
+
+// writeTime returns the time to record the changes of a write made with the
+// context at.
+func writeTime(ctx context.Context) int64 {
+	if timestamp, ok := ctx.Value(writeTimeKey{}).(int64); ok && timestamp > 0 {
+		return timestamp
+	}
+	return time.Now().UnixNano()
+}
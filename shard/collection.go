@@ -0,0 +1,87 @@
+package shard
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/* A shard keeps a copy of the collection it was created for so that the shard
+ * file describes itself, for example a backup can be opened and inspected
+ * without the node database that normally holds the collection. The copy is
+ * written once when the shard is first opened. The shard ids are left out
+ * because they change as the collection grows and mean nothing to a single
+ * shard.
+ *
+ * Storage map:
+ * internal:
+ * - collection: msgpack encoded collection */
+
+var COLLECTIONKEY = []byte("collection")
+
+// persistCollection stores the collection in the shard unless one is stored
+// already.
+func persistCollection(db diskstore.DiskStore, collection models.Collection) error {
+	return db.Write(func(bm diskstore.BucketManager) error {
+		bInternal, err := bm.Get(INTERNALBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get internal bucket: %w", err)
+		}
+		if bInternal.Get(COLLECTIONKEY) != nil {
+			return nil
+		}
+		collection.ShardIds = nil
+		value, err := msgpack.Marshal(collection)
+		if err != nil {
+			return fmt.Errorf("could not encode collection: %w", err)
+		}
+		if err := bInternal.Put(COLLECTIONKEY, value); err != nil {
+			return fmt.Errorf("could not store collection: %w", err)
+		}
+		return nil
+	})
+}
+
+// readCollection returns the collection stored in the shard.
+func readCollection(db diskstore.DiskStore) (collection models.Collection, err error) {
+	err = db.Read(func(bm diskstore.BucketManager) error {
+		bInternal, err := bm.Get(INTERNALBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get internal bucket: %w", err)
+		}
+		value := bInternal.Get(COLLECTIONKEY)
+		if value == nil {
+			return fmt.Errorf("shard does not store its collection")
+		}
+		if err := msgpack.Unmarshal(value, &collection); err != nil {
+			return fmt.Errorf("could not decode collection: %w", err)
+		}
+		return nil
+	})
+	return
+}
+
+// OpenShard opens an existing shard standalone using the collection stored in
+// the shard file. The shard gets its own cache and encrypted shards are not
+// supported.
+func OpenShard(dbFile string, opts ...ShardOption) (*Shard, error) {
+	// Opening the db would otherwise create an empty shard
+	if _, err := os.Stat(dbFile); err != nil {
+		return nil, fmt.Errorf("could not find shard db: %w", err)
+	}
+	db, err := diskstore.OpenWithOptions(dbFile, applyShardOptions(opts).db)
+	if err != nil {
+		return nil, fmt.Errorf("could not open shard db: %w", err)
+	}
+	collection, err := readCollection(db)
+	if closeErr := db.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("could not close shard db: %w", closeErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newShard(dbFile, collection, nil, nil, opts)
+}
@@ -0,0 +1,62 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard/index/vamana"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/* Search cursors page through the results of a single graph search, each page
+ * continues the walk of the previous one instead of searching again with a
+ * larger limit. The cursor is opaque to clients and holds the search request
+ * along with the state of the walk, which refers to node ids of this shard so
+ * it cannot be used with another shard. */
+
+type searchCursor struct {
+	Request models.SearchRequest
+	State   vamana.SearchCursor
+}
+
+// SearchPointsWithCursor is like SearchPoints but also returns a cursor to fetch
+// the next results with SearchPointsFrom. Only vamana vector queries without a
+// filter, sort or offset can be paged this way.
+func (s *Shard) SearchPointsWithCursor(ctx context.Context, searchRequest models.SearchRequest) ([]models.SearchResult, []byte, error) {
+	if searchRequest.Query.VectorVamana == nil {
+		return nil, nil, fmt.Errorf("search cursors require a vectorVamana query")
+	}
+	if searchRequest.Query.VectorVamana.Filter != nil || len(searchRequest.Sort) > 0 || searchRequest.Offset > 0 {
+		return nil, nil, fmt.Errorf("search cursors do not support filter, sort or offset")
+	}
+	return s.searchWithCursor(ctx, searchCursor{Request: searchRequest})
+}
+
+// SearchPointsFrom returns the next k results of the search the cursor was
+// created for and the cursor to continue after them. Points that have been
+// deleted since the previous page are skipped.
+func (s *Shard) SearchPointsFrom(ctx context.Context, cursor []byte, k int) ([]models.SearchResult, []byte, error) {
+	var sc searchCursor
+	if err := msgpack.Unmarshal(cursor, &sc); err != nil {
+		return nil, nil, fmt.Errorf("could not decode search cursor: %w", err)
+	}
+	if sc.Request.Query.VectorVamana == nil {
+		return nil, nil, fmt.Errorf("invalid search cursor")
+	}
+	sc.Request.Limit = k
+	sc.Request.Query.VectorVamana.Limit = k
+	return s.searchWithCursor(ctx, sc)
+}
+
+func (s *Shard) searchWithCursor(ctx context.Context, sc searchCursor) ([]models.SearchResult, []byte, error) {
+	results, _, err := s.searchPoints(vamana.WithSearchCursor(ctx, &sc.State), sc.Request, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	next, err := msgpack.Marshal(sc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not encode search cursor: %w", err)
+	}
+	return results, next, nil
+}
@@ -0,0 +1,285 @@
+package shard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+)
+
+/* Incremental backups store only the key value pairs that changed since a
+ * previous backup instead of copying the whole database file. A shard that
+ * receives few writes between backups therefore produces a small delta. The
+ * previous backup must be a full database file, e.g. one taken with Backup or
+ * one restored with RestoreFromDeltas. Applying a delta to it brings it up to
+ * date for the next incremental backup.
+ *
+ * Delta file format, integers are unsigned varints:
+ * - magic: "SEMADBDELTA" followed by a version byte, currently 1
+ * - records, each starting with an op byte:
+ *   - 'p' put: bucket name length, bucket name, key length, key, value
+ *     length, value
+ *   - 'd' delete: bucket name length, bucket name, key length, key
+ * - 'e' end of the delta, a file without it is truncated and rejected */
+
+var deltaMagic = []byte("SEMADBDELTA")
+
+const deltaVersion = 1
+
+const (
+	deltaOpPut    = 'p'
+	deltaOpDelete = 'd'
+	deltaOpEnd    = 'e'
+)
+
+// deltaBuckets lists every bucket that makes up the shard, the index buckets
+// follow the naming of the index manager.
+func deltaBuckets(schema models.IndexSchema) []string {
+	buckets := []string{POINTSBUCKETKEY, INTERNALBUCKETKEY, CHANGESBUCKETKEY, PAYLOADSBUCKETKEY, QUERYSTATSBUCKETKEY}
+	for property, params := range schema {
+		buckets = append(buckets, fmt.Sprintf("index/%s/%s", params.Type, property))
+	}
+	return buckets
+}
+
+type deltaWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func (dw *deltaWriter) writeBytes(b []byte) error {
+	dw.buf = binary.AppendUvarint(dw.buf[:0], uint64(len(b)))
+	if _, err := dw.w.Write(dw.buf); err != nil {
+		return err
+	}
+	_, err := dw.w.Write(b)
+	return err
+}
+
+func (dw *deltaWriter) writeRecord(op byte, bucket string, key, value []byte) error {
+	if err := dw.w.WriteByte(op); err != nil {
+		return err
+	}
+	if err := dw.writeBytes([]byte(bucket)); err != nil {
+		return err
+	}
+	if err := dw.writeBytes(key); err != nil {
+		return err
+	}
+	if op == deltaOpPut {
+		return dw.writeBytes(value)
+	}
+	return nil
+}
+
+// BackupIncremental writes the changes of the shard since the previous backup
+// to a delta file at outPath. Encrypted shards are not supported because the
+// delta would hold the decrypted values.
+func (s *Shard) BackupIncremental(prevBackupPath, outPath string) error {
+	if s.vc != nil {
+		return fmt.Errorf("incremental backup of encrypted shards is not supported")
+	}
+	if _, err := os.Stat(prevBackupPath); err != nil {
+		return fmt.Errorf("could not find previous backup: %w", err)
+	}
+	prevDb, err := diskstore.OpenWithOptions(prevBackupPath, diskstore.Options{Timeout: diskstore.DefaultOptions.Timeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("could not open previous backup: %w", err)
+	}
+	defer prevDb.Close()
+	// ---------------------------
+	f, err := os.Create(outPath)
+	if err != nil {
+		return fmt.Errorf("could not create delta file: %w", err)
+	}
+	defer f.Close()
+	dw := &deltaWriter{w: bufio.NewWriter(f)}
+	if _, err := dw.w.Write(deltaMagic); err != nil {
+		return fmt.Errorf("could not write delta header: %w", err)
+	}
+	if err := dw.w.WriteByte(deltaVersion); err != nil {
+		return fmt.Errorf("could not write delta header: %w", err)
+	}
+	// ---------------------------
+	puts, deletes := 0, 0
+	err = s.db.Read(func(bm diskstore.BucketManager) error {
+		return prevDb.Read(func(prevBm diskstore.BucketManager) error {
+			for _, bucketName := range deltaBuckets(s.collection.IndexSchema) {
+				bucket, err := bm.Get(bucketName)
+				if err != nil {
+					return fmt.Errorf("could not get bucket %s: %w", bucketName, err)
+				}
+				prevBucket, err := prevBm.Get(bucketName)
+				if err != nil {
+					return fmt.Errorf("could not get previous bucket %s: %w", bucketName, err)
+				}
+				// ---------------------------
+				err = bucket.ForEach(func(k, v []byte) error {
+					if prev := prevBucket.Get(k); prev != nil && bytes.Equal(prev, v) {
+						return nil
+					}
+					puts++
+					return dw.writeRecord(deltaOpPut, bucketName, k, v)
+				})
+				if err != nil {
+					return fmt.Errorf("could not write changed keys of %s: %w", bucketName, err)
+				}
+				err = prevBucket.ForEach(func(k, v []byte) error {
+					if bucket.Get(k) != nil {
+						return nil
+					}
+					deletes++
+					return dw.writeRecord(deltaOpDelete, bucketName, k, nil)
+				})
+				if err != nil {
+					return fmt.Errorf("could not write deleted keys of %s: %w", bucketName, err)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("could not compute delta: %w", err)
+	}
+	// ---------------------------
+	if err := dw.w.WriteByte(deltaOpEnd); err != nil {
+		return fmt.Errorf("could not write delta end: %w", err)
+	}
+	if err := dw.w.Flush(); err != nil {
+		return fmt.Errorf("could not flush delta file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("could not sync delta file: %w", err)
+	}
+	s.logger.Debug().Str("outPath", outPath).Int("puts", puts).Int("deletes", deletes).Msg("BackupIncremental")
+	return nil
+}
+
+// ---------------------------
+
+type deltaRecord struct {
+	op     byte
+	bucket string
+	key    []byte
+	value  []byte
+}
+
+// readDeltaBytes reads a length prefixed field, the length is checked against
+// the size of the delta file before allocating so a corrupt length fails
+// rather than exhausting memory.
+func readDeltaBytes(r *bufio.Reader, maxSize int64) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(maxSize) {
+		return nil, fmt.Errorf("field of %d bytes exceeds delta file size %d", n, maxSize)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readDelta reads all records of a delta file, it fails if the file is not a
+// complete delta.
+func readDelta(path string) ([]deltaRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open delta file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("could not stat delta file: %w", err)
+	}
+	fileSize := info.Size()
+	r := bufio.NewReader(f)
+	header := make([]byte, len(deltaMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.Equal(header[:len(deltaMagic)], deltaMagic) {
+		return nil, fmt.Errorf("%s is not a delta file", path)
+	}
+	if header[len(deltaMagic)] != deltaVersion {
+		return nil, fmt.Errorf("unsupported delta version %d", header[len(deltaMagic)])
+	}
+	// ---------------------------
+	records := make([]deltaRecord, 0)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("could not read delta record: %w", err)
+		}
+		if op == deltaOpEnd {
+			return records, nil
+		}
+		if op != deltaOpPut && op != deltaOpDelete {
+			return nil, fmt.Errorf("unknown delta op %q", op)
+		}
+		record := deltaRecord{op: op}
+		bucket, err := readDeltaBytes(r, fileSize)
+		if err == nil {
+			record.bucket = string(bucket)
+			record.key, err = readDeltaBytes(r, fileSize)
+		}
+		if err == nil && op == deltaOpPut {
+			record.value, err = readDeltaBytes(r, fileSize)
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("could not read delta record: %w", err)
+		}
+		records = append(records, record)
+	}
+}
+
+// RestoreFromDeltas applies the delta files in order to the full backup at
+// base, which then holds the shard as of the last delta. Each delta is applied
+// in a single transaction so a failing delta leaves the base as of the
+// previous one.
+func RestoreFromDeltas(base string, deltas []string) error {
+	if _, err := os.Stat(base); err != nil {
+		return fmt.Errorf("could not find base backup: %w", err)
+	}
+	db, err := diskstore.Open(base)
+	if err != nil {
+		return fmt.Errorf("could not open base backup: %w", err)
+	}
+	defer db.Close()
+	// ---------------------------
+	for _, delta := range deltas {
+		records, err := readDelta(delta)
+		if err != nil {
+			return fmt.Errorf("could not read delta %s: %w", delta, err)
+		}
+		err = db.Write(func(bm diskstore.BucketManager) error {
+			for _, record := range records {
+				bucket, err := bm.Get(record.bucket)
+				if err != nil {
+					return fmt.Errorf("could not get bucket %s: %w", record.bucket, err)
+				}
+				if record.op == deltaOpPut {
+					err = bucket.Put(record.key, record.value)
+				} else {
+					err = bucket.Delete(record.key)
+				}
+				if err != nil {
+					return fmt.Errorf("could not apply delta record to %s: %w", record.bucket, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not apply delta %s: %w", delta, err)
+		}
+	}
+	return nil
+}
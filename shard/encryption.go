@@ -0,0 +1,370 @@
+package shard
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+)
+
+/* Encryption at rest protects the point data, payloads and vectors of a shard
+ * with a key supplied by the operator for the collection. We wrap the disk
+ * store so that the values of the point data keys n<node_id>d, of the payloads
+ * bucket and of the vector index buckets are sealed with AES-GCM when written
+ * and opened when read, which keeps it transparent to the rest of the shard
+ * including search. The vector index buckets hold the vectors, quantised codes
+ * and graph edges of the vector properties.
+ *
+ * Keys are never encrypted because the buckets are scanned in key order. So
+ * the point ids, node ids, counters and the start point stay plaintext, and so
+ * do the keys of the text, string and number indexes, which are built from the
+ * indexed property values. Properties indexed that way are therefore readable
+ * from the shard file, only leave properties unindexed when they must not be.
+ *
+ * A value that fails to decrypt fails the whole transaction rather than being
+ * reported as missing, a failed read could otherwise lead a write to replace
+ * the value.
+ *
+ * A known value sealed with the key is kept in the internal bucket to reject
+ * the wrong key, or no key, when the shard is opened.
+ *
+ * Storage map:
+ * internal:
+ * - encryptionCheck: sealed check value */
+
+var ENCRYPTIONCHECKKEY = []byte("encryptionCheck")
+var encryptionCheckValue = []byte("semadb")
+
+var ErrEncryptionKey = errors.New("invalid encryption key")
+
+/* A cipher seals with its first AEAD and opens with any of them, this lets
+ * values sealed with the old key be read while a key rotation is under way. */
+type valueCipher struct {
+	aeads []cipher.AEAD
+}
+
+// newValueCipher creates an AES-GCM cipher, the key must be 16, 24 or 32 bytes
+// long to select AES-128, AES-192 or AES-256.
+func newValueCipher(key []byte) (*valueCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create block cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("could not create gcm: %w", err)
+	}
+	return &valueCipher{aeads: []cipher.AEAD{aead}}, nil
+}
+
+// seal encrypts the value with a random nonce which is prepended to the
+// ciphertext.
+func (vc *valueCipher) seal(value []byte) ([]byte, error) {
+	aead := vc.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, value, nil), nil
+}
+
+func (vc *valueCipher) open(sealed []byte) ([]byte, error) {
+	for _, aead := range vc.aeads {
+		if len(sealed) < aead.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		if value, err := aead.Open(nil, nonce, ciphertext, nil); err == nil {
+			return value, nil
+		}
+	}
+	return nil, fmt.Errorf("could not open sealed value: %w", ErrEncryptionKey)
+}
+
+// ---------------------------
+
+// isPointDataKey matches the n<node_id>d keys of the points bucket
+func isPointDataKey(k []byte) bool {
+	return len(k) == 10 && k[0] == 'n' && k[9] == 'd'
+}
+
+func encryptedKeys(bucketName string) func(k []byte) bool {
+	switch {
+	case bucketName == POINTSBUCKETKEY:
+		return isPointDataKey
+	case bucketName == PAYLOADSBUCKETKEY,
+		strings.HasPrefix(bucketName, "index/"+models.IndexTypeVectorVamana+"/"),
+		strings.HasPrefix(bucketName, "index/"+models.IndexTypeVectorFlat+"/"):
+		return func(k []byte) bool { return true }
+	}
+	return nil
+}
+
+// encryptedBuckets lists the buckets of the shard that have encrypted values,
+// the index buckets follow the naming of the index manager.
+func encryptedBuckets(schema models.IndexSchema) []string {
+	buckets := []string{POINTSBUCKETKEY, PAYLOADSBUCKETKEY}
+	for property, params := range schema {
+		bucketName := fmt.Sprintf("index/%s/%s", params.Type, property)
+		if encryptedKeys(bucketName) != nil {
+			buckets = append(buckets, bucketName)
+		}
+	}
+	return buckets
+}
+
+// txError keeps the first decryption error of a transaction, bucket reads
+// cannot return errors so the transaction fails once it is over.
+type txError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (te *txError) set(err error) {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	if te.err == nil {
+		te.err = err
+	}
+}
+
+// check returns the error of the transaction function or else the first
+// decryption error.
+func (te *txError) check(err error) error {
+	if err != nil {
+		return err
+	}
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	return te.err
+}
+
+type encryptedStore struct {
+	diskstore.DiskStore
+	// Swapped during key rotation
+	cipher atomic.Pointer[valueCipher]
+}
+
+func newEncryptedStore(db diskstore.DiskStore, vc *valueCipher) *encryptedStore {
+	es := &encryptedStore{DiskStore: db}
+	es.cipher.Store(vc)
+	return es
+}
+
+func (es *encryptedStore) Read(f func(diskstore.BucketManager) error) error {
+	vc := es.cipher.Load()
+	return es.DiskStore.Read(func(bm diskstore.BucketManager) error {
+		txErr := &txError{}
+		return txErr.check(f(encryptedBucketManager{BucketManager: bm, cipher: vc, txErr: txErr}))
+	})
+}
+
+func (es *encryptedStore) Write(f func(diskstore.BucketManager) error) error {
+	vc := es.cipher.Load()
+	return es.DiskStore.Write(func(bm diskstore.BucketManager) error {
+		// A decryption error rolls back the transaction
+		txErr := &txError{}
+		return txErr.check(f(encryptedBucketManager{BucketManager: bm, cipher: vc, txErr: txErr}))
+	})
+}
+
+type encryptedBucketManager struct {
+	diskstore.BucketManager
+	cipher *valueCipher
+	txErr  *txError
+}
+
+func (ebm encryptedBucketManager) Get(bucketName string) (diskstore.Bucket, error) {
+	bucket, err := ebm.BucketManager.Get(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	if isEncrypted := encryptedKeys(bucketName); isEncrypted != nil {
+		return encryptedBucket{Bucket: bucket, cipher: ebm.cipher, isEncrypted: isEncrypted, txErr: ebm.txErr}, nil
+	}
+	return bucket, nil
+}
+
+type encryptedBucket struct {
+	diskstore.Bucket
+	cipher      *valueCipher
+	isEncrypted func(k []byte) bool
+	txErr       *txError
+}
+
+func (eb encryptedBucket) Get(k []byte) []byte {
+	v := eb.Bucket.Get(k)
+	if v == nil || !eb.isEncrypted(k) {
+		return v
+	}
+	value, err := eb.cipher.open(v)
+	if err != nil {
+		// The key is checked when the shard is opened so this is corruption
+		eb.txErr.set(fmt.Errorf("could not decrypt value of key %x: %w", k, err))
+		return nil
+	}
+	return value
+}
+
+func (eb encryptedBucket) Put(k, v []byte) error {
+	if !eb.isEncrypted(k) {
+		return eb.Bucket.Put(k, v)
+	}
+	sealed, err := eb.cipher.seal(v)
+	if err != nil {
+		return err
+	}
+	return eb.Bucket.Put(k, sealed)
+}
+
+func (eb encryptedBucket) decryptFn(f func(k, v []byte) error) func(k, v []byte) error {
+	return func(k, v []byte) error {
+		if v == nil || !eb.isEncrypted(k) {
+			return f(k, v)
+		}
+		value, err := eb.cipher.open(v)
+		if err != nil {
+			return err
+		}
+		return f(k, value)
+	}
+}
+
+func (eb encryptedBucket) ForEach(f func(k, v []byte) error) error {
+	return eb.Bucket.ForEach(eb.decryptFn(f))
+}
+
+func (eb encryptedBucket) PrefixScan(prefix []byte, f func(k, v []byte) error) error {
+	return eb.Bucket.PrefixScan(prefix, eb.decryptFn(f))
+}
+
+func (eb encryptedBucket) RangeScan(start, end []byte, inclusive bool, f func(k, v []byte) error) error {
+	return eb.Bucket.RangeScan(start, end, inclusive, eb.decryptFn(f))
+}
+
+// ---------------------------
+
+// checkEncryptionKey makes sure the shard is opened with the key it was
+// encrypted with, a new shard adopts the given key.
+func checkEncryptionKey(db diskstore.DiskStore, vc *valueCipher) error {
+	var sealedCheck []byte
+	err := db.Read(func(bm diskstore.BucketManager) error {
+		bInternal, err := bm.Get(INTERNALBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get internal bucket: %w", err)
+		}
+		sealedCheck = bytes.Clone(bInternal.Get(ENCRYPTIONCHECKKEY))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	switch {
+	case sealedCheck == nil && vc == nil:
+		return nil
+	case sealedCheck != nil && vc == nil:
+		return fmt.Errorf("shard is encrypted but no key was given: %w", ErrEncryptionKey)
+	case sealedCheck != nil:
+		check, err := vc.open(sealedCheck)
+		if err != nil || !bytes.Equal(check, encryptionCheckValue) {
+			return fmt.Errorf("shard is encrypted with a different key: %w", ErrEncryptionKey)
+		}
+		return nil
+	}
+	// ---------------------------
+	return db.Write(func(bm diskstore.BucketManager) error {
+		bInternal, err := bm.Get(INTERNALBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get internal bucket: %w", err)
+		}
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		count, err := countPoints(bPoints)
+		if err != nil {
+			return fmt.Errorf("could not count points: %w", err)
+		}
+		if count > 0 {
+			return fmt.Errorf("cannot encrypt shard with %d existing plaintext points: %w", count, ErrEncryptionKey)
+		}
+		sealed, err := vc.seal(encryptionCheckValue)
+		if err != nil {
+			return err
+		}
+		return bInternal.Put(ENCRYPTIONCHECKKEY, sealed)
+	})
+}
+
+/* RotateEncryptionKey re-encrypts the point data, payloads and vectors of the
+ * shard with the new key in a single transaction. While it runs, values sealed with
+ * either key can be read so the shard keeps serving. */
+func (s *Shard) RotateEncryptionKey(newKey []byte) error {
+	es, ok := unversioned(s.db).(*encryptedStore)
+	if !ok {
+		return fmt.Errorf("shard is not encrypted: %w", ErrEncryptionKey)
+	}
+	newCipher, err := newValueCipher(newKey)
+	if err != nil {
+		return err
+	}
+	oldCipher := es.cipher.Load()
+	es.cipher.Store(&valueCipher{aeads: append(slices.Clone(newCipher.aeads), oldCipher.aeads...)})
+	// ---------------------------
+	// We write through the plain store so values are moved as they are stored
+	err = es.DiskStore.Write(func(bm diskstore.BucketManager) error {
+		for _, bucketName := range encryptedBuckets(s.collection.IndexSchema) {
+			bucket, err := bm.Get(bucketName)
+			if err != nil {
+				return fmt.Errorf("could not get bucket %s: %w", bucketName, err)
+			}
+			isEncrypted := encryptedKeys(bucketName)
+			// Buckets can't be modified while iterating so we collect first
+			rotated := make(map[string][]byte)
+			err = bucket.ForEach(func(k, v []byte) error {
+				if !isEncrypted(k) {
+					return nil
+				}
+				value, err := oldCipher.open(v)
+				if err != nil {
+					return err
+				}
+				rotated[string(k)], err = newCipher.seal(value)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("could not re-encrypt bucket %s: %w", bucketName, err)
+			}
+			for k, v := range rotated {
+				if err := bucket.Put([]byte(k), v); err != nil {
+					return fmt.Errorf("could not put re-encrypted value: %w", err)
+				}
+			}
+		}
+		// ---------------------------
+		bInternal, err := bm.Get(INTERNALBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get internal bucket: %w", err)
+		}
+		sealed, err := newCipher.seal(encryptionCheckValue)
+		if err != nil {
+			return err
+		}
+		return bInternal.Put(ENCRYPTIONCHECKKEY, sealed)
+	})
+	if err != nil {
+		es.cipher.Store(oldCipher)
+		return fmt.Errorf("could not rotate encryption key: %w", err)
+	}
+	es.cipher.Store(newCipher)
+	return nil
+}
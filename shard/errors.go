@@ -0,0 +1,35 @@
+package shard
+
+import (
+	"errors"
+
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+)
+
+/* Shard operations wrap these errors so that callers, such as the cluster RPC
+ * handlers, can tell common failures apart with errors.Is rather than by
+ * matching messages. */
+
+// ErrPointExists is returned when inserting a point whose id is already in
+// the shard.
+var ErrPointExists = errors.New("point already exists")
+
+// ErrPointNotFound is returned when an operation needs a point that is not in
+// the shard.
+var ErrPointNotFound = errors.New("point not found")
+
+// ErrPointDoesNotExist is the former name of ErrPointNotFound.
+//
+// Deprecated: Use ErrPointNotFound instead.
+var ErrPointDoesNotExist = ErrPointNotFound
+
+// ErrDimMismatch is returned when a point or query vector does not have the
+// size of the index of its property. It is the error of the query validation
+// in models so that both are matched.
+var ErrDimMismatch = models.ErrDimMismatch
+
+// ErrShardClosed is returned by operations on a closed shard. It is the error
+// of the underlying store so it is also matched when the store is used
+// directly.
+var ErrShardClosed = diskstore.ErrClosed
@@ -0,0 +1,48 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard/index/vamana"
+)
+
+// SearchExplain is the path a search took through the graph index.
+type SearchExplain struct {
+	// Graph nodes in the order the search visited them with their distance to
+	// the query
+	Visits []vamana.SearchVisit
+	// Number of nodes visited
+	Hops int
+}
+
+// SearchPointsExplain searches the graph index of the collection for the k
+// points closest to the query like SearchPoints and also returns the path the
+// search took, e.g. to debug recall after changing the graph parameters. The
+// schema must have exactly one graph index.
+func (s *Shard) SearchPointsExplain(ctx context.Context, query []float32, k int) ([]models.SearchResult, SearchExplain, error) {
+	property, params, err := vamanaProperty(s.collection.IndexSchema)
+	if err != nil {
+		return nil, SearchExplain{}, fmt.Errorf("could not explain search: %w", err)
+	}
+	sr := models.SearchRequest{
+		Query: models.Query{
+			Property: property,
+			VectorVamana: &models.SearchVectorVamanaOptions{
+				Vector:     query,
+				Operator:   "near",
+				SearchSize: max(params.SearchSize, k),
+				Limit:      k,
+			},
+		},
+		Limit: k,
+	}
+	ctx, trace := vamana.WithSearchTrace(ctx)
+	results, err := s.SearchPoints(ctx, sr)
+	if err != nil {
+		return nil, SearchExplain{}, fmt.Errorf("could not explain search: %w", err)
+	}
+	visits := trace.Visits()
+	return results, SearchExplain{Visits: visits, Hops: len(visits)}, nil
+}
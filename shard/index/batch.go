@@ -0,0 +1,49 @@
+package index
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard/cache"
+	"github.com/semafind/semadb/shard/index/vamana"
+)
+
+// PrepareSearchBatch preprocesses the top level vamana queries of a batch of
+// searches together. The returned context carries the prepared queries and
+// should be passed to Search, queries that were not prepared are handled as
+// usual.
+func (im indexManager) PrepareSearchBatch(ctx context.Context, queries []models.Query) (context.Context, error) {
+	vectors := make(map[string][][]float32)
+	for _, q := range queries {
+		if q.VectorVamana != nil {
+			vectors[q.Property] = append(vectors[q.Property], q.VectorVamana.Vector)
+		}
+	}
+	// ---------------------------
+	for property, propVectors := range vectors {
+		iparams, ok := im.indexSchema[property]
+		if !ok || iparams.VectorVamana == nil {
+			return ctx, fmt.Errorf("property %s is not a vamana index", property)
+		}
+		bucketName := fmt.Sprintf("index/%s/%s", iparams.Type, property)
+		bucket, err := im.bm.Get(bucketName)
+		if err != nil {
+			return ctx, fmt.Errorf("could not read bucket %s: %w", bucketName, err)
+		}
+		cacheName := im.cacheRoot + "/" + bucketName
+		newVamanaFn := func() (cache.Cachable, error) {
+			return vamana.NewIndexVamana(cacheName, *iparams.VectorVamana, bucket)
+		}
+		err = im.cx.With(cacheName, true, newVamanaFn, func(cached cache.Cachable) error {
+			vamanaIndex := cached.(*vamana.IndexVamana)
+			vamanaIndex.UpdateBucket(bucket)
+			ctx = vamanaIndex.PrepareQueries(ctx, propVectors)
+			return nil
+		})
+		if err != nil {
+			return ctx, fmt.Errorf("could not prepare queries of %s: %w", bucketName, err)
+		}
+	}
+	return ctx, nil
+}
@@ -0,0 +1,173 @@
+package index
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard/cache"
+	"github.com/semafind/semadb/shard/index/vamana"
+)
+
+// withVamanaIndexes runs the given function on every graph index in the
+// schema, other indexes have no graph to traverse.
+func (im indexManager) withVamanaIndexes(readOnly bool, f func(property string, index *vamana.IndexVamana) error) error {
+	for property, params := range im.indexSchema {
+		if params.Type != models.IndexTypeVectorVamana {
+			continue
+		}
+		bucketName := fmt.Sprintf("index/%s/%s", params.Type, property)
+		bucket, err := im.bm.Get(bucketName)
+		if err != nil {
+			return fmt.Errorf("could not get bucket %s: %w", bucketName, err)
+		}
+		cacheName := im.cacheRoot + "/" + bucketName
+		newFn := func() (cache.Cachable, error) {
+			return vamana.NewIndexVamana(cacheName, *params.VectorVamana, bucket)
+		}
+		err = im.cx.With(cacheName, readOnly, newFn, func(cached cache.Cachable) error {
+			index := cached.(*vamana.IndexVamana)
+			index.UpdateBucket(bucket)
+			return f(property, index)
+		})
+		if err != nil {
+			return fmt.Errorf("could not check graph of %s: %w", property, err)
+		}
+	}
+	return nil
+}
+
+// CheckConnectivity sums the number of nodes reachable from the start node and
+// the total number of nodes over the graph indexes.
+func (im indexManager) CheckConnectivity() (reachable, total int, err error) {
+	err = im.withVamanaIndexes(true, func(property string, index *vamana.IndexVamana) error {
+		r, t, err := index.CheckConnectivity()
+		reachable += r
+		total += t
+		return err
+	})
+	return
+}
+
+// RepairConnectivity re-links unreachable nodes of the graph indexes and
+// returns the total number of nodes re-linked.
+func (im indexManager) RepairConnectivity() (int, error) {
+	repaired := 0
+	err := im.withVamanaIndexes(false, func(property string, index *vamana.IndexVamana) error {
+		n, err := index.Repair()
+		repaired += n
+		return err
+	})
+	return repaired, err
+}
+
+// RebuildGraphs discards the edges of the graph indexes and links their points
+// again, it returns the total number of points linked.
+func (im indexManager) RebuildGraphs(ctx context.Context) (int, error) {
+	linked := 0
+	err := im.withVamanaIndexes(false, func(property string, index *vamana.IndexVamana) error {
+		n, err := index.Rebuild(ctx)
+		linked += n
+		return err
+	})
+	return linked, err
+}
+
+// DegreeHistogram sums the out-degree histograms of the graph indexes, the
+// result is as long as the largest degree bound plus one.
+func (im indexManager) DegreeHistogram() ([]int, error) {
+	var histogram []int
+	err := im.withVamanaIndexes(true, func(property string, index *vamana.IndexVamana) error {
+		h, err := index.DegreeHistogram()
+		if len(h) > len(histogram) {
+			histogram = append(histogram, make([]int, len(h)-len(histogram))...)
+		}
+		for degree, count := range h {
+			histogram[degree] += count
+		}
+		return err
+	})
+	return histogram, err
+}
+
+// GraphStats sums the graph statistics of the graph indexes.
+func (im indexManager) GraphStats() (vamana.GraphStats, error) {
+	var stats vamana.GraphStats
+	err := im.withVamanaIndexes(true, func(property string, index *vamana.IndexVamana) error {
+		s, err := index.GraphStats()
+		stats.NodeCount += s.NodeCount
+		stats.EdgeCount += s.EdgeCount
+		stats.SelfLoops += s.SelfLoops
+		stats.DuplicateEdges += s.DuplicateEdges
+		return err
+	})
+	return stats, err
+}
+
+// SetStartVector moves the start node of the graph index of the property to
+// the given vector.
+func (im indexManager) SetStartVector(property string, vector []float32) error {
+	found := false
+	err := im.withVamanaIndexes(false, func(p string, index *vamana.IndexVamana) error {
+		if p != property {
+			return nil
+		}
+		found = true
+		return index.SetStartVector(vector)
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("no graph index for property %s", property)
+	}
+	return err
+}
+
+// DeleteImpact reports the nodes of the graph indexes whose edges would be
+// pruned and the nodes that would be left without inbound edges if the given
+// nodes were deleted. Nothing is modified.
+func (im indexManager) DeleteImpact(deleteSet map[uint64]struct{}) (toPrune, orphaned map[uint64]struct{}, err error) {
+	toPrune = make(map[uint64]struct{})
+	orphaned = make(map[uint64]struct{})
+	err = im.withVamanaIndexes(true, func(property string, index *vamana.IndexVamana) error {
+		p, o, err := index.EdgeScan(deleteSet)
+		for _, id := range p {
+			toPrune[id] = struct{}{}
+		}
+		for _, id := range o {
+			orphaned[id] = struct{}{}
+		}
+		return err
+	})
+	return
+}
+
+// ExportEdges returns the edges of up to maxNodes nodes of the graph index of
+// the property.
+func (im indexManager) ExportEdges(property string, maxNodes int) ([]vamana.NodeEdges, error) {
+	var nodes []vamana.NodeEdges
+	found := false
+	err := im.withVamanaIndexes(true, func(p string, index *vamana.IndexVamana) error {
+		if p != property {
+			return nil
+		}
+		found = true
+		var err error
+		nodes, err = index.ExportEdges(maxNodes)
+		return err
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("no graph index for property %s", property)
+	}
+	return nodes, err
+}
+
+// Warm loads the top of every graph index and returns the number of nodes it
+// loaded.
+func (im indexManager) Warm() (int, error) {
+	total := 0
+	err := im.withVamanaIndexes(true, func(property string, index *vamana.IndexVamana) error {
+		n, err := index.Warm()
+		total += n
+		return err
+	})
+	return total, err
+}
@@ -73,6 +73,19 @@ func (inf IndexFlat) InsertUpdateDelete(ctx context.Context, points <-chan vaman
 	return errC
 }
 
+// TrainQuantizer retrains the quantizer of the vector store from a sample of
+// the stored vectors, it errors if the vector store cannot be trained.
+func (inf IndexFlat) TrainQuantizer(sampleSize int) error {
+	tvs, ok := inf.vecStore.(vectorstore.TrainableVectorStore)
+	if !ok {
+		return fmt.Errorf("vector store does not support training")
+	}
+	if err := tvs.Train(sampleSize); err != nil {
+		return fmt.Errorf("could not train vector store: %w", err)
+	}
+	return inf.vecStore.Flush()
+}
+
 func (inf IndexFlat) Search(ctx context.Context, options models.SearchVectorFlatOptions, filter *roaring64.Bitmap) (*roaring64.Bitmap, []models.SearchResult, error) {
 	distFn := inf.vecStore.DistanceFromFloat(options.Vector)
 	// ---------------------------
@@ -258,7 +258,7 @@ func (index *indexText) processAnalysedDoc(ad analysedDocument) error {
 }
 
 func (index *indexText) parallelAnalyse(ctx context.Context, in <-chan Document) (<-chan analysedDocument, <-chan error) {
-	numWorkers := runtime.NumCPU() - 1
+	numWorkers := max(runtime.NumCPU()-1, 1)
 	outs := make([]<-chan analysedDocument, numWorkers)
 	errCs := make([]<-chan error, numWorkers)
 	for i := 0; i < numWorkers; i++ {
@@ -0,0 +1,64 @@
+package index
+
+import (
+	"fmt"
+
+	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard/cache"
+	"github.com/semafind/semadb/shard/index/flat"
+	"github.com/semafind/semadb/shard/index/vamana"
+)
+
+// Only the product quantizer learns a codebook that is worth retraining.
+func isTrainableQuantizer(q *models.Quantizer) bool {
+	return q != nil && q.Type == models.QuantizerProduct
+}
+
+// TrainQuantizers retrains the quantizers of every vector index that uses
+// one. Indexes without a trainable quantizer are skipped. It returns the
+// number of indexes trained.
+func (im indexManager) TrainQuantizers(sampleSize int) (int, error) {
+	trained := 0
+	for property, params := range im.indexSchema {
+		var trainable bool
+		switch params.Type {
+		case models.IndexTypeVectorVamana:
+			trainable = isTrainableQuantizer(params.VectorVamana.Quantizer)
+		case models.IndexTypeVectorFlat:
+			trainable = isTrainableQuantizer(params.VectorFlat.Quantizer)
+		}
+		if !trainable {
+			continue
+		}
+		// ---------------------------
+		bucketName := fmt.Sprintf("index/%s/%s", params.Type, property)
+		bucket, err := im.bm.Get(bucketName)
+		if err != nil {
+			return trained, fmt.Errorf("could not get write bucket %s: %w", bucketName, err)
+		}
+		cacheName := im.cacheRoot + "/" + bucketName
+		newFn := func() (cache.Cachable, error) {
+			if params.Type == models.IndexTypeVectorVamana {
+				return vamana.NewIndexVamana(cacheName, *params.VectorVamana, bucket)
+			}
+			return flat.NewIndexFlat(*params.VectorFlat, bucket)
+		}
+		// ---------------------------
+		err = im.cx.With(cacheName, false, newFn, func(cached cache.Cachable) error {
+			switch index := cached.(type) {
+			case *vamana.IndexVamana:
+				index.UpdateBucket(bucket)
+				return index.TrainQuantizer(sampleSize)
+			case flat.IndexFlat:
+				index.UpdateBucket(bucket)
+				return index.TrainQuantizer(sampleSize)
+			}
+			return fmt.Errorf("unexpected cached index type %T", cached)
+		})
+		if err != nil {
+			return trained, fmt.Errorf("could not train quantizer of %s: %w", property, err)
+		}
+		trained++
+	}
+	return trained, nil
+}
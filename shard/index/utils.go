@@ -3,6 +3,7 @@ package index
 import (
 	"bytes"
 	"fmt"
+	"reflect"
 
 	"github.com/vmihailenco/msgpack/v5"
 )
@@ -50,6 +51,11 @@ func getOperation(dec *msgpack.Decoder, propertyName string, prevData, currentDa
 	case prevProp == nil && currentProp != nil:
 		// Insert
 		op = opInsert
+	case prevProp != nil && currentProp != nil && reflect.DeepEqual(prevProp, currentProp):
+		// Unchanged, e.g. an update of other properties of the point. Skipping
+		// matters most for graph indexes which would otherwise re-insert the
+		// node and prune the edges of its neighbours for nothing.
+		op = opSkip
 	case prevProp != nil && currentProp != nil:
 		// Update
 		op = opUpdate
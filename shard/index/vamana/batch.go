@@ -0,0 +1,54 @@
+package vamana
+
+import (
+	"context"
+
+	"github.com/semafind/semadb/shard/vectorstore"
+)
+
+/* A batch of searches can prepare the distance functions of all its queries
+ * together, which lets the vector store amortise per query preprocessing such
+ * as building quantizer lookup tables. The prepared functions travel with the
+ * context of the searches and are looked up by index and query vector. The
+ * vector is identified by its backing array so a copy of the search options
+ * still finds its prepared function. */
+
+type preparedQueryKey struct {
+	index  *IndexVamana
+	vector *float32
+}
+
+type preparedQueriesCtxKey struct{}
+
+// PrepareQueries computes the distance functions of the given query vectors in
+// a batch and returns a context carrying them for subsequent searches.
+func (v *IndexVamana) PrepareQueries(ctx context.Context, vectors [][]float32) context.Context {
+	prepared, _ := ctx.Value(preparedQueriesCtxKey{}).(map[preparedQueryKey]vectorstore.PointIdDistFn)
+	merged := make(map[preparedQueryKey]vectorstore.PointIdDistFn, len(prepared)+len(vectors))
+	for k, distFn := range prepared {
+		merged[k] = distFn
+	}
+	normalized := make([][]float32, len(vectors))
+	for i, vector := range vectors {
+		normalized[i] = v.normalizedVector(vector)
+	}
+	distFns := vectorstore.DistancesFromFloats(v.vecStore, normalized)
+	for i, vector := range vectors {
+		if len(vector) > 0 {
+			merged[preparedQueryKey{index: v, vector: &vector[0]}] = distFns[i]
+		}
+	}
+	return context.WithValue(ctx, preparedQueriesCtxKey{}, merged)
+}
+
+// queryDistFn returns the prepared distance function of the query if there is
+// one, otherwise it computes it.
+func (v *IndexVamana) queryDistFn(ctx context.Context, vector []float32) vectorstore.PointIdDistFn {
+	if len(vector) > 0 {
+		prepared, _ := ctx.Value(preparedQueriesCtxKey{}).(map[preparedQueryKey]vectorstore.PointIdDistFn)
+		if distFn, ok := prepared[preparedQueryKey{index: v, vector: &vector[0]}]; ok {
+			return distFn
+		}
+	}
+	return v.vecStore.DistanceFromFloat(v.normalizedVector(vector))
+}
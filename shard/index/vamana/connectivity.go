@@ -0,0 +1,287 @@
+package vamana
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/semafind/semadb/shard/cache"
+	"github.com/semafind/semadb/shard/vectorstore"
+	"github.com/semafind/semadb/utils"
+)
+
+/* Deletes and interrupted writes can leave nodes without any path from the
+ * start node. The greedy search never visits such nodes so they silently go
+ * missing from search results. The following report how much of the graph is
+ * reachable and re-link the nodes that are not by inserting them again, which
+ * gives them fresh edges and the inbound edges of their new neighbours. */
+
+// CheckConnectivity returns the number of nodes reachable from the start node
+// and the total number of nodes, neither count includes the start node.
+func (v *IndexVamana) CheckConnectivity() (reachable, total int, err error) {
+	hops, err := v.hopsFromStart()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not traverse graph: %w", err)
+	}
+	err = v.nodeStore.ForEach(func(id uint64, node *graphNode) error {
+		if id == STARTID {
+			return nil
+		}
+		total++
+		if _, ok := hops[id]; ok {
+			reachable++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not count nodes: %w", err)
+	}
+	return reachable, total, nil
+}
+
+// Repair re-links the nodes that are not reachable from the start node and
+// returns how many were re-linked.
+func (v *IndexVamana) Repair() (int, error) {
+	hops, err := v.hopsFromStart()
+	if err != nil {
+		return 0, fmt.Errorf("could not traverse graph: %w", err)
+	}
+	var orphanIds []uint64
+	err = v.nodeStore.ForEach(func(id uint64, node *graphNode) error {
+		if _, ok := hops[id]; !ok {
+			orphanIds = append(orphanIds, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not collect orphaned nodes: %w", err)
+	}
+	if len(orphanIds) == 0 && v.parameters.MaxHops == 0 {
+		return 0, nil
+	}
+	// ---------------------------
+	// Sorting keeps the repair deterministic for a given graph
+	slices.Sort(orphanIds)
+	for _, id := range orphanIds {
+		point, err := v.vecStore.Get(id)
+		if err != nil {
+			return 0, fmt.Errorf("could not get orphaned point %d: %w", id, err)
+		}
+		if err := v.linkNode(context.Background(), point, v.vecStore.DistanceFromPoint(point)); err != nil {
+			return 0, fmt.Errorf("could not re-link orphaned point %d: %w", id, err)
+		}
+	}
+	v.logger.Debug().Int("orphanCount", len(orphanIds)).Msg("IndexVamana- Repair")
+	if v.parameters.MaxHops > 0 {
+		addedEdges, err := v.enforceMaxHops(context.Background())
+		if err != nil {
+			return 0, fmt.Errorf("could not enforce max hops: %w", err)
+		}
+		v.logger.Debug().Int("addedEdges", addedEdges).Msg("IndexVamana- MaxHops")
+	}
+	if err := v.flush(); err != nil {
+		return 0, err
+	}
+	return len(orphanIds), nil
+}
+
+/* Rebuilding discards every edge and links the points again from their stored
+ * vectors, like inserting them into an empty index, for example after changing
+ * the insert parameters or when the edges are too damaged for a repair. The
+ * start node keeps its vector, which may have been placed deliberately, but
+ * loses its edges too. Points whose edges were cleared have no inbound edges
+ * until they are linked again, so like updated points they can be linked by
+ * parallel workers. */
+
+// Rebuild discards the graph edges and links every point again, it returns the
+// number of points linked.
+func (v *IndexVamana) Rebuild(ctx context.Context) (int, error) {
+	points := make([]vectorstore.VectorStorePoint, 0)
+	pointIds := make(map[uint64]struct{})
+	err := v.vecStore.ForEach(func(point vectorstore.VectorStorePoint) error {
+		pointIds[point.Id()] = struct{}{}
+		if point.Id() != STARTID {
+			points = append(points, point)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not collect points: %w", err)
+	}
+	if _, ok := pointIds[STARTID]; !ok {
+		return 0, fmt.Errorf("start point %d is missing", STARTID)
+	}
+	// ---------------------------
+	// Nodes without a vector cannot be linked again and are dropped
+	var staleIds []uint64
+	err = v.nodeStore.ForEach(func(id uint64, node *graphNode) error {
+		if _, ok := pointIds[id]; !ok {
+			staleIds = append(staleIds, id)
+			return nil
+		}
+		node.edgesMu.Lock()
+		node.ClearNeighbours()
+		node.edgesMu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not clear edges: %w", err)
+	}
+	if err := v.nodeStore.Delete(staleIds...); err != nil {
+		return 0, fmt.Errorf("could not delete stale nodes: %w", err)
+	}
+	if _, err := v.nodeStore.Get(STARTID); errors.Is(err, cache.ErrNotFound) {
+		v.nodeStore.Put(STARTID, v.newNode(STARTID))
+	} else if err != nil {
+		return 0, fmt.Errorf("could not get start node: %w", err)
+	}
+	// ---------------------------
+	pointQ := utils.ProduceWithContext(ctx, points)
+	errCs := make([]<-chan error, max(min(v.insertParameters(ctx).Workers, len(points)), 1))
+	for i := range errCs {
+		errCs[i] = utils.SinkWithContext(ctx, pointQ, func(point vectorstore.VectorStorePoint) error {
+			return v.linkNode(ctx, point, v.vecStore.DistanceFromPoint(point))
+		})
+	}
+	if err := <-utils.MergeErrorsWithContext(ctx, errCs...); err != nil {
+		return 0, fmt.Errorf("could not link points: %w", err)
+	}
+	if v.parameters.MaxHops > 0 {
+		addedEdges, err := v.enforceMaxHops(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("could not enforce max hops: %w", err)
+		}
+		v.logger.Debug().Int("addedEdges", addedEdges).Msg("IndexVamana- MaxHops")
+	}
+	v.logger.Debug().Int("pointCount", len(points)).Int("staleCount", len(staleIds)).Msg("IndexVamana- Rebuild")
+	if err := v.flush(); err != nil {
+		return 0, err
+	}
+	return len(points), nil
+}
+
+// DegreeHistogram counts the nodes by their number of outgoing edges, the
+// count at index i is the number of nodes with i edges. The start node is not
+// included.
+func (v *IndexVamana) DegreeHistogram() ([]int, error) {
+	histogram := make([]int, v.parameters.DegreeBound+1)
+	err := v.nodeStore.ForEach(func(id uint64, node *graphNode) error {
+		if id == STARTID {
+			return nil
+		}
+		node.edgesMu.RLock()
+		degree := len(node.edges)
+		node.edgesMu.RUnlock()
+		// The degree bound is only exceeded by a corrupt graph, such nodes
+		// are counted in the last bucket.
+		degree = min(degree, len(histogram)-1)
+		histogram[degree]++
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not count node degrees: %w", err)
+	}
+	return histogram, nil
+}
+
+// GraphStats summarises the edges of the graph, self loops and duplicate
+// edges are never created by a healthy index so non-zero counts point to a
+// bug.
+type GraphStats struct {
+	NodeCount      int
+	EdgeCount      int
+	SelfLoops      int
+	DuplicateEdges int
+}
+
+// GraphStats counts the nodes and edges of the graph, the start node and its
+// edges are not included.
+func (v *IndexVamana) GraphStats() (GraphStats, error) {
+	var stats GraphStats
+	seen := make(map[uint64]struct{}, v.parameters.DegreeBound)
+	err := v.nodeStore.ForEach(func(id uint64, node *graphNode) error {
+		if id == STARTID {
+			return nil
+		}
+		stats.NodeCount++
+		clear(seen)
+		node.edgesMu.RLock()
+		defer node.edgesMu.RUnlock()
+		stats.EdgeCount += len(node.edges)
+		for _, edgeId := range node.edges {
+			if edgeId == id {
+				stats.SelfLoops++
+			}
+			if _, ok := seen[edgeId]; ok {
+				stats.DuplicateEdges++
+			}
+			seen[edgeId] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("could not count graph edges: %w", err)
+	}
+	return stats, nil
+}
+
+// NodeEdges holds the outgoing edges of a graph node.
+type NodeEdges struct {
+	NodeId uint64
+	Edges  []uint64
+}
+
+type exportElem struct {
+	id   uint64
+	node *graphNode
+}
+
+// exportHeap is a max heap on node ids so that the largest of the smallest ids
+// seen so far is the one to evict.
+type exportHeap []exportElem
+
+func (h exportHeap) Len() int           { return len(h) }
+func (h exportHeap) Less(i, j int) bool { return h[i].id > h[j].id }
+func (h exportHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *exportHeap) Push(x any)        { *h = append(*h, x.(exportElem)) }
+func (h *exportHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// ExportEdges returns the edges of up to maxNodes nodes in node id order,
+// including the start node, for example to visualise the graph. Only the
+// smallest maxNodes ids are kept whilst scanning and only their edges copied.
+func (v *IndexVamana) ExportEdges(maxNodes int) ([]NodeEdges, error) {
+	if maxNodes <= 0 {
+		return []NodeEdges{}, nil
+	}
+	h := exportHeap{}
+	err := v.nodeStore.ForEach(func(id uint64, node *graphNode) error {
+		if h.Len() < maxNodes {
+			heap.Push(&h, exportElem{id: id, node: node})
+		} else if id < h[0].id {
+			h[0] = exportElem{id: id, node: node}
+			heap.Fix(&h, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read graph edges: %w", err)
+	}
+	nodes := make([]NodeEdges, len(h))
+	for i, elem := range h {
+		elem.node.edgesMu.RLock()
+		nodes[i] = NodeEdges{NodeId: elem.id, Edges: slices.Clone(elem.node.edges)}
+		elem.node.edgesMu.RUnlock()
+	}
+	slices.SortFunc(nodes, func(a, b NodeEdges) int {
+		return cmp.Compare(a.NodeId, b.NodeId)
+	})
+	return nodes, nil
+}
@@ -0,0 +1,104 @@
+package vamana
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/semafind/semadb/shard/vectorstore"
+)
+
+/* A search cursor lets a client page through the results of a graph search,
+ * e.g. for load more buttons, without running the whole search again. The
+ * cursor records the nodes returned so far and the nodes the walk has seen but
+ * not returned, the frontier. The next page continues the walk from the
+ * frontier while the returned nodes are never added again. Like hop counting,
+ * the cursor travels with the search context and is updated in place. Points
+ * may be deleted between pages so nodes of the frontier that no longer exist
+ * are skipped. */
+
+type SearchCursor struct {
+	// Nodes already returned, they are left out of later pages
+	Returned []uint64
+	// Nodes seen but not returned, the next page continues from them
+	Frontier []uint64
+}
+
+type searchCursorKey struct{}
+
+// WithSearchCursor returns a context that makes vamana searches continue from
+// the cursor, a zero cursor starts a new search. The cursor is updated to
+// continue after the results of the search.
+func WithSearchCursor(ctx context.Context, cursor *SearchCursor) context.Context {
+	return context.WithValue(ctx, searchCursorKey{}, cursor)
+}
+
+func searchCursorFrom(ctx context.Context) *SearchCursor {
+	cursor, _ := ctx.Value(searchCursorKey{}).(*SearchCursor)
+	return cursor
+}
+
+// resumeSearch continues the greedy search from the frontier of the cursor.
+func (v *IndexVamana) resumeSearch(ctx context.Context, distFn vectorstore.PointIdDistFn, searchSize int, cursor *SearchCursor) (DistSet, DistSet, error) {
+	searchSet := NewDistSet(searchSize, v.maxNodeId.Load(), distFn)
+	defer searchSet.Release()
+	visitedSet := NewDistSet(searchSize*2, 0, distFn)
+	// ---------------------------
+	// Marking the returned nodes as seen keeps them out of the search set, the
+	// start node is not a result either.
+	searchSet.set.CheckAndVisit(STARTID)
+	for _, id := range cursor.Returned {
+		searchSet.set.CheckAndVisit(id)
+	}
+	frontier := make([]uint64, 0, len(cursor.Frontier))
+	for _, id := range cursor.Frontier {
+		if v.vecStore.Exists(id) {
+			frontier = append(frontier, id)
+		}
+	}
+	points, err := v.vecStore.GetMany(frontier...)
+	if err != nil {
+		return searchSet, visitedSet, fmt.Errorf("failed to get frontier points: %w", err)
+	}
+	searchSet.AddWithLimit(points...)
+	// ---------------------------
+	if err := v.walk(ctx, &searchSet, &visitedSet, searchSize, nil, &searchSet); err != nil {
+		return searchSet, visitedSet, err
+	}
+	visitedSet.Sort()
+	return searchSet, visitedSet, nil
+}
+
+// advance moves the cursor past the given results, the frontier becomes the
+// nodes of the search that were not returned.
+func (cursor *SearchCursor) advance(results []uint64, sets ...DistSet) {
+	returned := make(map[uint64]struct{}, len(cursor.Returned)+len(results))
+	for _, id := range cursor.Returned {
+		returned[id] = struct{}{}
+	}
+	for _, id := range results {
+		if _, ok := returned[id]; !ok {
+			returned[id] = struct{}{}
+			cursor.Returned = append(cursor.Returned, id)
+		}
+	}
+	// ---------------------------
+	seen := make(map[uint64]struct{})
+	frontier := make([]uint64, 0)
+	for _, set := range sets {
+		for _, elem := range set.items {
+			id := elem.Point.Id()
+			if id == STARTID {
+				continue
+			}
+			if _, ok := returned[id]; ok {
+				continue
+			}
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+			frontier = append(frontier, id)
+		}
+	}
+	cursor.Frontier = frontier
+}
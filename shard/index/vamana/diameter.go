@@ -0,0 +1,182 @@
+package vamana
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/semafind/semadb/shard/vectorstore"
+)
+
+/* Bounding the number of hops from the start node gives a more predictable
+ * search latency because the greedy search reaches any part of the graph in a
+ * limited number of steps. Robust prune favours short edges, so on clustered
+ * data some nodes can end up many hops away from the start node.
+ *
+ * What matters for latency is the path the greedy search takes rather than the
+ * shortest path in the graph, so we search for the vector of every node and
+ * count the hops to it along the nodes that search visited. A node that is too
+ * far gets an extra long range edge from the closest visited node that is
+ * within the bound. Like any other edge it goes through robust prune so the
+ * degree bound holds, if the prune drops it the next closest is tried. This
+ * costs a search per node which is too much to pay on every write, and later
+ * prunes may drop an edge a far node relied on, so the bound is enforced by the
+ * explicit maintenance calls Repair and Rebuild rather than on insert. */
+
+// visitedDepths returns the number of hops from the start node to the nodes a
+// search visited and their neighbours, only following the edges of visited
+// nodes. It is the length of the path along which the search can reach them.
+func (v *IndexVamana) visitedDepths(visitedSet DistSet) (map[uint64]int, error) {
+	visited := make(map[uint64]struct{}, len(visitedSet.items))
+	for _, elem := range visitedSet.items {
+		visited[elem.Point.Id()] = struct{}{}
+	}
+	depths := map[uint64]int{STARTID: 0}
+	queue := []uint64{STARTID}
+	for len(queue) > 0 {
+		nodeId := queue[0]
+		queue = queue[1:]
+		if _, ok := visited[nodeId]; !ok {
+			continue
+		}
+		node, err := v.nodeStore.Get(nodeId)
+		if err != nil {
+			return nil, fmt.Errorf("could not get node %d: %w", nodeId, err)
+		}
+		node.edgesMu.RLock()
+		for _, neighbourId := range node.edges {
+			if _, ok := depths[neighbourId]; !ok {
+				depths[neighbourId] = depths[nodeId] + 1
+				queue = append(queue, neighbourId)
+			}
+		}
+		node.edgesMu.RUnlock()
+	}
+	return depths, nil
+}
+
+// connectWithinMaxHops adds an edge to the point from the closest visited node
+// that was reached within fewer than MaxHops hops and keeps the edge after
+// pruning. Nodes below the degree bound are tried first because they take the
+// edge without pruning others, which could push other nodes out of reach. It
+// reports whether such a node was found.
+func (v *IndexVamana) connectWithinMaxHops(point vectorstore.VectorStorePoint, visitedSet DistSet, depths map[uint64]int) (bool, error) {
+	for _, prune := range []bool{false, true} {
+		// The visited set is sorted by distance to the point
+		for _, elem := range visitedSet.items {
+			id := elem.Point.Id()
+			if d, ok := depths[id]; !ok || d >= v.parameters.MaxHops || id == point.Id() {
+				continue
+			}
+			node, err := v.nodeStore.Get(id)
+			if err != nil {
+				return false, fmt.Errorf("could not get node %d: %w", id, err)
+			}
+			node.edgesMu.RLock()
+			full := len(node.edges) >= v.parameters.DegreeBound
+			node.edgesMu.RUnlock()
+			if full != prune {
+				continue
+			}
+			kept, err := v.addEdge(node, elem.Point, point)
+			if err != nil {
+				return false, err
+			}
+			if kept {
+				return true, nil
+			}
+		}
+	}
+	// Every candidate pruned the edge, a later repair may succeed
+	return false, nil
+}
+
+// Edges added for one node change the searches of others, so enforceMaxHops
+// repeats until a pass adds no edges or it runs out of passes
+const maxHopsPasses = 5
+
+// enforceMaxHops connects every node that the greedy search for its own vector
+// reaches in more than MaxHops hops from the start node. It is a maintenance
+// pass that searches for every node of the graph, see Repair.
+func (v *IndexVamana) enforceMaxHops(ctx context.Context) (int, error) {
+	var nodeIds []uint64
+	err := v.nodeStore.ForEach(func(id uint64, node *graphNode) error {
+		if id != STARTID {
+			nodeIds = append(nodeIds, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not collect nodes: %w", err)
+	}
+	// ---------------------------
+	addedEdges := 0
+	searchSize := v.insertParameters(ctx).SearchSize
+	for pass := 0; pass < maxHopsPasses; pass++ {
+		passEdges := 0
+		for _, id := range nodeIds {
+			if err := ctx.Err(); err != nil {
+				return addedEdges, err
+			}
+			point, err := v.vecStore.Get(id)
+			if err != nil {
+				return addedEdges, fmt.Errorf("could not get point %d: %w", id, err)
+			}
+			_, visitedSet, err := v.greedySearch(ctx, v.vecStore.DistanceFromPoint(point), 1, searchSize, nil)
+			if err != nil {
+				return addedEdges, fmt.Errorf("could not search for point %d: %w", id, err)
+			}
+			depths, err := v.visitedDepths(visitedSet)
+			if err != nil {
+				return addedEdges, err
+			}
+			if d, ok := depths[id]; ok && d <= v.parameters.MaxHops {
+				continue
+			}
+			ok, err := v.connectWithinMaxHops(point, visitedSet, depths)
+			if err != nil {
+				return addedEdges, err
+			}
+			if ok {
+				passEdges++
+			}
+		}
+		addedEdges += passEdges
+		if passEdges == 0 {
+			break
+		}
+	}
+	return addedEdges, nil
+}
+
+// hopsFromStart computes the number of hops from the start node to every
+// reachable node.
+func (v *IndexVamana) hopsFromStart() (map[uint64]int, error) {
+	hops := map[uint64]int{STARTID: 0}
+	if err := v.relaxHops(hops, STARTID); err != nil {
+		return nil, err
+	}
+	return hops, nil
+}
+
+// relaxHops propagates the hop count of the given node to the nodes reachable
+// from it, updating those that are now fewer hops away from the start.
+func (v *IndexVamana) relaxHops(hops map[uint64]int, fromId uint64) error {
+	queue := []uint64{fromId}
+	for len(queue) > 0 {
+		nodeId := queue[0]
+		queue = queue[1:]
+		node, err := v.nodeStore.Get(nodeId)
+		if err != nil {
+			return fmt.Errorf("could not get node %d: %w", nodeId, err)
+		}
+		node.edgesMu.RLock()
+		for _, neighbourId := range node.edges {
+			if h, ok := hops[neighbourId]; !ok || h > hops[nodeId]+1 {
+				hops[neighbourId] = hops[nodeId] + 1
+				queue = append(queue, neighbourId)
+			}
+		}
+		node.edgesMu.RUnlock()
+	}
+	return nil
+}
@@ -162,8 +162,11 @@ func (ds *DistSet) Len() int {
 
 // ---------------------------
 
-// Add points while respecting the capacity of the array, used in greedy search
-func (ds *DistSet) AddWithLimit(points ...vectorstore.VectorStorePoint) {
+// Add points while respecting the capacity of the array, used in greedy search.
+// It returns the lowest index a point was inserted at, or the length of the set
+// if none was, so the elements before it are unchanged.
+func (ds *DistSet) AddWithLimit(points ...vectorstore.VectorStorePoint) int {
+	lowest := len(ds.items)
 	for _, p := range points {
 		// ---------------------------
 		// First check if we've seen this point before. We we have than it has
@@ -193,10 +196,13 @@ func (ds *DistSet) AddWithLimit(points ...vectorstore.VectorStorePoint) {
 			ds.items[len(ds.items)-1] = newElem
 		}
 		// Insert new element into the array in sorted order.
-		for i := len(ds.items) - 1; i > 0 && ds.items[i].Distance < ds.items[i-1].Distance; i-- {
+		i := len(ds.items) - 1
+		for ; i > 0 && ds.items[i].Distance < ds.items[i-1].Distance; i-- {
 			ds.items[i], ds.items[i-1] = ds.items[i-1], ds.items[i]
 		}
+		lowest = min(lowest, i)
 	}
+	return lowest
 }
 
 // Add entries and only computes distance if the point is never seen before
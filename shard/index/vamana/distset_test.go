@@ -67,8 +67,17 @@ func TestDistSet_Add_Duplicate(t *testing.T) {
 
 func TestDistSet_AddWithLimit(t *testing.T) {
 	ds := setupDistSet(2, 0, 0.5, 1.0, 0.1, 1.2)
-	ds.AddWithLimit(pointsFromIds(0, 1, 2)...)
+	require.Equal(t, 0, ds.AddWithLimit(pointsFromIds(0, 1, 2)...))
 	checkOrder(t, ds, 2, 0)
-	ds.AddWithLimit(pointsFromIds(3, 3)...)
+	// Nothing is inserted so the whole set is unchanged
+	require.Equal(t, 2, ds.AddWithLimit(pointsFromIds(3, 3)...))
 	checkOrder(t, ds, 2, 0)
 }
+
+func TestDistSet_AddWithLimit_Inserted(t *testing.T) {
+	ds := setupDistSet(3, 0, 0.1, 0.5, 0.9, 0.3, 0.7)
+	require.Equal(t, 0, ds.AddWithLimit(pointsFromIds(0, 1, 2)...))
+	// 0.7 replaces 0.9 at the end, 0.3 then lands in the middle
+	require.Equal(t, 1, ds.AddWithLimit(pointsFromIds(4, 3)...))
+	checkOrder(t, ds, 0, 3, 1)
+}
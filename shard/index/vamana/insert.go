@@ -3,32 +3,105 @@ package vamana
 import (
 	"context"
 	"fmt"
+	"runtime"
+	"slices"
 
+	"github.com/semafind/semadb/shard/vectorstore"
 	"github.com/semafind/semadb/utils"
 )
 
+/* Graph parameters are set per collection but can be overridden for the
+ * inserts of a single request, e.g. to compare different alphas without
+ * recreating the collection. The override only applies to the edges of the
+ * inserted nodes, the existing neighbours that receive back edges keep pruning
+ * with the collection parameters. A graph built with mixed parameters can have
+ * a different recall than one built with either, so measure before adopting
+ * an override as the new default. */
+
+// InsertParameters override the graph parameters of the collection for the
+// nodes inserted with a context from WithInsertParameters. Zero values keep
+// the collection parameter.
+type InsertParameters struct {
+	Alpha float32
+	// Capped at the degree bound of the collection since the rest of the index
+	// assumes no node has more edges
+	DegreeBound int
+	SearchSize  int
+	// Number of goroutines inserting the points of a write, one inserts them
+	// sequentially. The default leaves one core for the rest of the write.
+	Workers int
+}
+
+type insertParametersKey struct{}
+
+// WithInsertParameters returns a context whose inserts into graph indexes use
+// the given parameters.
+func WithInsertParameters(ctx context.Context, params InsertParameters) context.Context {
+	return context.WithValue(ctx, insertParametersKey{}, params)
+}
+
+// insertParameters resolves the parameters for inserting a node with the
+// given context against the collection parameters.
+func (v *IndexVamana) insertParameters(ctx context.Context) InsertParameters {
+	params := InsertParameters{
+		Alpha:       v.parameters.Alpha,
+		DegreeBound: v.parameters.DegreeBound,
+		SearchSize:  v.parameters.SearchSize,
+		// We leave 1 core for the main thread but need at least one worker on
+		// single core machines, otherwise nothing drains the insert queue.
+		Workers: max(runtime.NumCPU()-1, 1),
+	}
+	if v.parameters.ConstructionSearchSize > 0 {
+		params.SearchSize = v.parameters.ConstructionSearchSize
+	}
+	override, ok := ctx.Value(insertParametersKey{}).(InsertParameters)
+	if !ok {
+		return params
+	}
+	if override.Alpha > 0 {
+		params.Alpha = override.Alpha
+	}
+	if override.DegreeBound > 0 {
+		params.DegreeBound = min(override.DegreeBound, v.parameters.DegreeBound)
+	}
+	if override.SearchSize > 0 {
+		params.SearchSize = override.SearchSize
+	}
+	if override.Workers > 0 {
+		params.Workers = override.Workers
+	}
+	return params
+}
+
 func (v *IndexVamana) insertWorker(ctx context.Context, jobQueue <-chan IndexVectorChange) <-chan error {
 	return utils.SinkWithContext(ctx, jobQueue, func(change IndexVectorChange) error {
-		return v.insertSinglePoint(change)
+		return v.insertSinglePoint(ctx, change)
 	})
 }
 
-func (v *IndexVamana) insertSinglePoint(change IndexVectorChange) error {
-	vecA, err := v.vecStore.Set(change.Id, change.Vector)
+func (v *IndexVamana) insertSinglePoint(ctx context.Context, change IndexVectorChange) error {
+	vector := v.normalizedVector(change.Vector)
+	vecA, err := v.vecStore.Set(change.Id, vector)
 	if err != nil {
 		return fmt.Errorf("could not set point: %w", err)
 	}
-	// ---------------------------
-	_, visitedSet, err := v.greedySearch(change.Vector, 1, v.parameters.SearchSize, nil)
+	return v.linkNode(ctx, vecA, v.vecStore.DistanceFromFloat(vector))
+}
+
+// linkNode creates the node of a point already in the vector store and
+// connects it to the graph, replacing any existing edges of the node.
+func (v *IndexVamana) linkNode(ctx context.Context, vecA vectorstore.VectorStorePoint, distFn vectorstore.PointIdDistFn) error {
+	params := v.insertParameters(ctx)
+	_, visitedSet, err := v.greedySearch(ctx, distFn, 1, params.SearchSize, nil)
 	if err != nil {
 		return fmt.Errorf("could not greedy search: %w", err)
 	}
 	// ---------------------------
 	// We don't need to lock the point here because it does not yet have inbound
 	// edges that other goroutines might use to visit this node.
-	nodeA := &graphNode{Id: change.Id}
-	v.robustPrune(nodeA, visitedSet)
-	v.nodeStore.Put(change.Id, nodeA)
+	nodeA := v.newNode(vecA.Id())
+	v.robustPruneWith(nodeA, visitedSet, params.Alpha, params.DegreeBound)
+	v.nodeStore.Put(nodeA.Id, nodeA)
 	// ---------------------------
 	// Add the bi-directional edges, suppose A is being added and has A -> B and
 	// A -> C. Then we attempt to add edges from B and C back to A.
@@ -40,29 +113,38 @@ func (v *IndexVamana) insertSinglePoint(change IndexVectorChange) error {
 		if err != nil {
 			return fmt.Errorf("could not get neighbour point: %w", err)
 		}
-		// ---------------------------
-		// While we are adding the bi-directional edges, we need exclusive
-		// access to ensure other goroutines don't modify the edges while we
-		// are dealing with them. That is what the locks are for.
-		nodeB.edgesMu.Lock()
-		if len(nodeB.edges)+1 > v.parameters.DegreeBound {
-			// We need to prune the neighbour as well to keep the degree bound
-			distFn := v.vecStore.DistanceFromPoint(nB)
-			candidateSet := NewDistSet(len(nodeB.edges)+1, 0, distFn)
-			if err := nodeB.LoadNeighbours(v.vecStore); err != nil {
-				nodeB.edgesMu.Unlock()
-				return fmt.Errorf("could not load nodeB neighbours adding bi-directional edges: %w", err)
-			}
-			candidateSet.Add(nodeB.neighbours...)
-			candidateSet.Add(vecA) // Here we are asking B or C to add A
-			candidateSet.Sort()
-			v.robustPrune(nodeB, candidateSet)
-		} else {
-			// ---------------------------
-			// Add the edge
-			nodeB.AddNeighbour(vecA)
+		if _, err := v.addEdge(nodeB, nB, vecA); err != nil {
+			return err
 		}
-		nodeB.edgesMu.Unlock()
 	}
 	return nil
 }
+
+// addEdge adds an edge from the node to the point, the node is pruned if it
+// would exceed the degree bound in which case the new edge may not be kept.
+// It reports whether the node has the edge afterwards.
+func (v *IndexVamana) addEdge(nodeB *graphNode, pointB, vecA vectorstore.VectorStorePoint) (bool, error) {
+	// While we are adding the bi-directional edges, we need exclusive
+	// access to ensure other goroutines don't modify the edges while we
+	// are dealing with them. That is what the locks are for.
+	nodeB.edgesMu.Lock()
+	defer nodeB.edgesMu.Unlock()
+	if len(nodeB.edges)+1 > v.parameters.DegreeBound {
+		// We need to prune the neighbour as well to keep the degree bound
+		distFn := v.vecStore.DistanceFromPoint(pointB)
+		candidateSet := NewDistSet(len(nodeB.edges)+1, 0, distFn)
+		if err := nodeB.LoadNeighbours(v.vecStore); err != nil {
+			return false, fmt.Errorf("could not load nodeB neighbours adding bi-directional edges: %w", err)
+		}
+		candidateSet.Add(nodeB.neighbours...)
+		candidateSet.Add(vecA) // Here we are asking B or C to add A
+		candidateSet.Sort()
+		v.robustPrune(nodeB, candidateSet)
+		return slices.Contains(nodeB.edges, vecA.Id()), nil
+	}
+	// ---------------------------
+	// Add the edge, a re-linked node such as the moved start node may already
+	// have it
+	nodeB.AddNeighbourIfNotExists(vecA)
+	return true, nil
+}
@@ -0,0 +1,62 @@
+package vamana
+
+import "math"
+
+/* Plain nearest neighbour results can be redundant, for example if the
+ * collection has many near duplicates they will all crowd the top results.
+ * Maximal Marginal Relevance (MMR) re-ranks the search candidates by greedily
+ * picking at each step the candidate that balances being close to the query
+ * against being far from the results picked so far:
+ *
+ *   argmax lambda * -dist(query, c) + (1 - lambda) * min_s dist(c, s)
+ *
+ * The candidates are the search set of the graph search so the search size
+ * controls how large the pool to diversify from is. */
+func (v *IndexVamana) diversify(candidates []DistSetElem, k int, lambda float32) []DistSetElem {
+	pool := make([]DistSetElem, 0, len(candidates))
+	for _, elem := range candidates {
+		if elem.Point.Id() != STARTID {
+			pool = append(pool, elem)
+		}
+	}
+	if len(pool) <= 1 || lambda >= 1 {
+		return pool[:min(len(pool), k)]
+	}
+	// ---------------------------
+	// The distance of each candidate to the closest selected result so far
+	minSelectedDist := make([]float32, len(pool))
+	for i := range minSelectedDist {
+		minSelectedDist[i] = math.MaxFloat32
+	}
+	picked := make([]bool, len(pool))
+	selected := make([]DistSetElem, 0, min(len(pool), k))
+	// ---------------------------
+	for len(selected) < cap(selected) {
+		bestIdx := -1
+		var bestScore float32
+		for i, elem := range pool {
+			if picked[i] {
+				continue
+			}
+			score := -lambda * elem.Distance
+			// The first pick has nothing to be dissimilar to, it is the closest
+			if len(selected) > 0 {
+				score += (1 - lambda) * minSelectedDist[i]
+			}
+			if bestIdx == -1 || score > bestScore {
+				bestIdx = i
+				bestScore = score
+			}
+		}
+		picked[bestIdx] = true
+		selected = append(selected, pool[bestIdx])
+		// ---------------------------
+		distFn := v.vecStore.DistanceFromPoint(pool[bestIdx].Point)
+		for i, elem := range pool {
+			if !picked[i] {
+				minSelectedDist[i] = min(minSelectedDist[i], distFn(elem.Point))
+			}
+		}
+	}
+	return selected
+}
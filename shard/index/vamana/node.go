@@ -16,6 +16,8 @@ type graphNode struct {
 	edges   []uint64
 	isDirty bool
 	edgesMu sync.RWMutex
+	// Write the edges delta encoded, see conversion.EdgeListToDeltaBytes
+	compressEdges bool
 	// ---------------------------
 	// We keep a cache of the neighbours to avoid repeated lookups. This speeds
 	// up performance significantly if items are cached and accessed multiple
@@ -25,6 +27,11 @@ type graphNode struct {
 	isNeighLoaded atomic.Bool
 }
 
+// newNode creates a node without edges in the edge encoding of the index.
+func (v *IndexVamana) newNode(id uint64) *graphNode {
+	return &graphNode{Id: id, compressEdges: v.parameters.CompressEdges}
+}
+
 // ---------------------------
 /* These functions assume a lock is held. We don't lock and unlock in each
  * function because the operations usually add multiple edges over iterations,
@@ -112,15 +119,24 @@ func (g *graphNode) CheckAndClearDirty() bool {
 func (g *graphNode) ReadFrom(id uint64, bucket diskstore.Bucket) (node *graphNode, err error) {
 	node = &graphNode{Id: id}
 	edgeBytes := bucket.Get(conversion.NodeKey(id, 'e'))
-	if edgeBytes != nil {
-		node.edges = conversion.BytesToEdgeList(edgeBytes)
-	} else {
+	if edgeBytes == nil {
 		err = cache.ErrNotFound
+		return
+	}
+	// The node is written back in the encoding it was read with
+	node.compressEdges = conversion.IsDeltaEdgeList(edgeBytes)
+	if node.edges, err = conversion.DecodeEdgeList(edgeBytes); err != nil {
+		err = fmt.Errorf("could not decode edges of node %d: %w", id, err)
 	}
 	return
 }
 func (g *graphNode) WriteTo(id uint64, bucket diskstore.Bucket) error {
-	edgeBytes := conversion.EdgeListToBytes(g.edges)
+	var edgeBytes []byte
+	if g.compressEdges {
+		edgeBytes = conversion.EdgeListToDeltaBytes(g.edges)
+	} else {
+		edgeBytes = conversion.EdgeListToBytes(g.edges)
+	}
 	if err := bucket.Put(conversion.NodeKey(id, 'e'), edgeBytes); err != nil {
 		return fmt.Errorf("could not write edges: %w", err)
 	}
@@ -1,14 +1,19 @@
 package vamana
 
 import (
+	"context"
 	"fmt"
+	"sync"
 
 	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard/vectorstore"
 )
 
-func (v *IndexVamana) greedySearch(query []float32, k int, searchSize int, filter *roaring64.Bitmap) (DistSet, DistSet, error) {
+// greedySearch searches the graph for the k closest points according to the
+// distance function of the query, see queryDistFn.
+func (v *IndexVamana) greedySearch(ctx context.Context, distFn vectorstore.PointIdDistFn, k int, searchSize int, filter *roaring64.Bitmap) (DistSet, DistSet, error) {
 	// ---------------------------
-	distFn := v.vecStore.DistanceFromFloat(query)
 	// Initialise distance set
 	searchSet := NewDistSet(searchSize, v.maxNodeId.Load(), distFn)
 	/* The faster visited set based on bitmaps is only used for the search and we
@@ -60,6 +65,21 @@ func (v *IndexVamana) greedySearch(query []float32, k int, searchSize int, filte
 	}
 	searchSet.AddWithLimit(sn)
 	// ---------------------------
+	if err := v.walk(ctx, &searchSet, &visitedSet, searchSize, filter, resultSet); err != nil {
+		return searchSet, visitedSet, err
+	}
+	// ---------------------------
+	visitedSet.Sort()
+	return *resultSet, visitedSet, nil
+}
+
+// walk visits the unvisited nodes of the search set in order of distance,
+// adding their neighbours, until the closest searchSize nodes are all visited.
+// Visited nodes are added to the visited set and the nodes in the filter to the
+// result set.
+func (v *IndexVamana) walk(ctx context.Context, searchSet, visitedSet *DistSet, searchSize int, filter *roaring64.Bitmap, resultSet *DistSet) error {
+	prefetchWorkers := prefetchWorkersFrom(ctx)
+	trace, _ := ctx.Value(searchTraceKey{}).(*SearchTrace)
 	/* This loop looks to curate the closest nodes to the query vector along the
 	 * way. The loop terminates when we visited all the nodes in our search list. */
 	for i := 0; i < min(len(searchSet.items), searchSize); {
@@ -68,18 +88,27 @@ func (v *IndexVamana) greedySearch(query []float32, k int, searchSize int, filte
 			i++
 			continue
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		/* We know this is the first and only time we are visiting this node so
 		 * we bypass duplicate check and add it straight to the visited set. */
 		visitedSet.AddAlreadyUnique(distElem)
 		searchSet.items[i].visited = true
+		if trace != nil {
+			trace.add(SearchVisit{NodeId: distElem.Point.Id(), Distance: distElem.Distance})
+		}
+		if prefetchWorkers > 1 {
+			v.prefetchNeighbours(searchSet.items[i:min(len(searchSet.items), searchSize)], prefetchWorkers)
+		}
 		// ---------------------------
 		// Get the node and its neighbours
 		node, err := v.nodeStore.Get(distElem.Point.Id())
 		if err != nil {
-			return searchSet, visitedSet, fmt.Errorf("failed to get node for neighbours: %w", err)
+			return fmt.Errorf("failed to get node for neighbours: %w", err)
 		}
 		if err := node.LoadNeighbours(v.vecStore); err != nil {
-			return searchSet, visitedSet, fmt.Errorf("failed to load node neighbours: %w", err)
+			return fmt.Errorf("failed to load node neighbours: %w", err)
 		}
 		/* We have to lock the point here because while we are calculating the
 		 * distance of its neighbours (edges in the graph) we can't have another
@@ -87,23 +116,132 @@ func (v *IndexVamana) greedySearch(query []float32, k int, searchSize int, filte
 		 * calculated, they may change so the search we are doing is not
 		 * deterministic. With approximate search this is not a major problem. */
 		node.edgesMu.RLock()
-		searchSet.AddWithLimit(node.neighbours...)
+		inserted := searchSet.AddWithLimit(node.neighbours...)
 		node.edgesMu.RUnlock()
 		// ---------------------------
 		if filter != nil && filter.Contains(node.Id) {
 			resultSet.AddWithLimit(distElem.Point)
 		}
 		// ---------------------------
-		i = 0
+		/* Every node before i is visited and the neighbours only change the
+		 * set from the lowest insertion onwards, so the closest unvisited node
+		 * is at or after whichever comes first. Restarting from the beginning
+		 * would rescan the visited prefix after every expansion. */
+		i = min(i, inserted)
 	}
-	// ---------------------------
-	visitedSet.Sort()
-	return *resultSet, visitedSet, nil
+	return nil
+}
+
+type prefetchWorkersKey struct{}
+
+// withPrefetchWorkers returns a context whose searches load the neighbours of
+// upcoming nodes concurrently using the given number of workers.
+func withPrefetchWorkers(ctx context.Context, workers int) context.Context {
+	return context.WithValue(ctx, prefetchWorkersKey{}, workers)
+}
+
+func prefetchWorkersFrom(ctx context.Context) int {
+	workers, _ := ctx.Value(prefetchWorkersKey{}).(int)
+	return workers
+}
+
+/* Loading the neighbours of a node is the main cost of a search on a cold
+ * index because the vectors are read and decoded from the bucket. Whilst the
+ * walk visits the closest node, we load the neighbours of the node and of the
+ * next closest unvisited ones, which are likely to be visited soon, using a
+ * bounded number of workers. The walk is unchanged, it finds the neighbours
+ * already loaded, so the results are the same as the sequential search. Any
+ * errors are ignored here as the walk reports them when it visits the node. */
+func (v *IndexVamana) prefetchNeighbours(candidates []DistSetElem, workers int) {
+	ids := make([]uint64, 0, workers)
+	for _, elem := range candidates {
+		if len(ids) == workers {
+			break
+		}
+		// The first candidate is the node being visited
+		if len(ids) == 0 || !elem.visited {
+			ids = append(ids, elem.Point.Id())
+		}
+	}
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			if node, err := v.nodeStore.Get(id); err == nil {
+				_ = node.LoadNeighbours(v.vecStore)
+			}
+		}(id)
+	}
+	wg.Wait()
+}
+
+/* The exact search computes the distance to every point in the index so it
+ * scales linearly with the number of points. It is used as a fallback when the
+ * graph search is deemed to have poor recall, for example if the graph has
+ * degraded after many deletes. */
+func (v *IndexVamana) exactSearch(distFn vectorstore.PointIdDistFn, k int, filter *roaring64.Bitmap) (DistSet, error) {
+	resultSet := NewDistSet(k, v.maxNodeId.Load(), distFn)
+	defer resultSet.Release()
+	err := v.vecStore.ForEach(func(point vectorstore.VectorStorePoint) error {
+		if point.Id() == STARTID {
+			return nil
+		}
+		if filter != nil && !filter.Contains(point.Id()) {
+			return nil
+		}
+		resultSet.AddWithLimit(point)
+		return nil
+	})
+	if err != nil {
+		return resultSet, fmt.Errorf("failed to scan vector store: %w", err)
+	}
+	return resultSet, nil
+}
+
+// Decides whether the graph search results look poor enough to warrant an exact
+// search according to the given criteria.
+func needsExactFallback(opts *models.SearchVectorVamanaExactFallbackOptions, limit int, searchSet, visitedSet DistSet) bool {
+	if opts == nil {
+		return false
+	}
+	minVisited := opts.MinVisited
+	if minVisited == 0 {
+		minVisited = limit
+	}
+	if visitedSet.Len() < minVisited {
+		return true
+	}
+	if opts.OnShortResults {
+		resultCount := 0
+		for _, elem := range searchSet.items {
+			if elem.Point.Id() != STARTID {
+				resultCount++
+			}
+		}
+		if resultCount < limit {
+			return true
+		}
+	}
+	return false
 }
 
 // Update the edges of the node optimistically based on the candidateSet.
 // NOTE: requires node edges to be locked.
 func (iv *IndexVamana) robustPrune(node *graphNode, candidateSet DistSet) {
+	iv.robustPruneWith(node, candidateSet, iv.parameters.Alpha, iv.parameters.DegreeBound)
+}
+
+// robustPruneWith is robustPrune with the given alpha and degree bound instead
+// of the collection parameters.
+func (iv *IndexVamana) robustPruneWith(node *graphNode, candidateSet DistSet, alpha float32, degreeBound int) {
+	/* Euclidean distances are squared to avoid the square root, which keeps
+	 * the ranking but not ratios. Comparing squared distances against alpha
+	 * would prune as if alpha were its square root, so we square alpha to keep
+	 * the pruning of the paper on the actual distances. */
+	if iv.squaredDistances {
+		alpha *= alpha
+	}
 	// ---------------------------
 	node.ClearNeighbours() // Reset edges / neighbours
 	// ---------------------------
@@ -117,7 +255,7 @@ func (iv *IndexVamana) robustPrune(node *graphNode, candidateSet DistSet) {
 			continue
 		}
 		edgeCount := node.AddNeighbour(closestElem.Point)
-		if edgeCount >= iv.parameters.DegreeBound {
+		if edgeCount >= degreeBound {
 			break
 		}
 		// ---------------------------
@@ -129,7 +267,7 @@ func (iv *IndexVamana) robustPrune(node *graphNode, candidateSet DistSet) {
 				continue
 			}
 			// ---------------------------
-			if iv.parameters.Alpha*distFn(nextElem.Point) < nextElem.Distance {
+			if alpha*distFn(nextElem.Point) < nextElem.Distance {
 				candidateSet.items[j].pruneRemoved = true
 			}
 		}
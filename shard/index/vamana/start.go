@@ -0,0 +1,52 @@
+package vamana
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+/* The start node begins as a random unit vector which, for skewed data, can be
+ * far from every point and lengthen every search. The start node is not a
+ * point of the index so instead of pointing searches at another node, we move
+ * the start node to a better location, e.g. the medoid of the points, and give
+ * it the edges a point inserted there would get. Its id stays the same so
+ * nothing else needs to change and no stale start node is left behind. */
+
+// SetStartVector moves the start node to the given vector and re-links it.
+func (v *IndexVamana) SetStartVector(vector []float32) error {
+	if len(vector) != int(v.parameters.VectorSize) {
+		return fmt.Errorf("expected start vector of size %d got %d", v.parameters.VectorSize, len(vector))
+	}
+	vector = v.normalizedVector(vector)
+	startPoint, err := v.vecStore.Set(STARTID, vector)
+	if err != nil {
+		return fmt.Errorf("could not set start point: %w", err)
+	}
+	if err := v.linkNode(context.Background(), startPoint, v.vecStore.DistanceFromFloat(vector)); err != nil {
+		return fmt.Errorf("could not link start node: %w", err)
+	}
+	v.logger.Debug().Msg("IndexVamana- SetStartVector")
+	return v.flush()
+}
+
+// Warm loads the start node, its neighbours and their edges, i.e. the nodes
+// every search visits first, and returns how many nodes it loaded.
+func (v *IndexVamana) Warm() (int, error) {
+	startNode, err := v.nodeStore.Get(STARTID)
+	if err != nil {
+		return 0, fmt.Errorf("could not get start node: %w", err)
+	}
+	if err := startNode.LoadNeighbours(v.vecStore); err != nil {
+		return 0, fmt.Errorf("could not load start node neighbours: %w", err)
+	}
+	startNode.edgesMu.RLock()
+	edges := slices.Clone(startNode.edges)
+	startNode.edgesMu.RUnlock()
+	for _, id := range edges {
+		if _, err := v.nodeStore.Get(id); err != nil {
+			return 0, fmt.Errorf("could not get node %d: %w", id, err)
+		}
+	}
+	return len(edges) + 1, nil
+}
@@ -2,10 +2,11 @@ package vamana
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math"
 	"math/rand"
-	"runtime"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/semafind/semadb/conversion"
 	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/distance"
 	"github.com/semafind/semadb/models"
 	"github.com/semafind/semadb/shard/cache"
 	"github.com/semafind/semadb/shard/vectorstore"
@@ -46,6 +48,10 @@ type IndexVamana struct {
 	 * either, bitsets can resize if we get it wrong but we try to keep it in
 	 * sync anyway. */
 	maxNodeId atomic.Uint64
+	// Whether vectors are normalised before use, see AutoNormalize
+	normalize bool
+	// Whether distances are squared euclidean ones, see robustPruneWith
+	squaredDistances bool
 	// ---------------------------
 	bucket diskstore.Bucket
 	logger zerolog.Logger
@@ -57,9 +63,12 @@ func NewIndexVamana(name string, params models.IndexVectorVamanaParameters, buck
 	index := &IndexVamana{
 		parameters: params,
 		nodeStore:  cache.NewItemCache[uint64, *graphNode](bucket),
+		normalize:  params.AutoNormalize && params.DistanceMetric == models.DistanceCosine,
 		bucket:     bucket,
 		logger:     logger,
 	}
+	// The binary quantizer compares bits instead
+	index.squaredDistances = params.DistanceMetric == models.DistanceEuclidean && (params.Quantizer == nil || params.Quantizer.Type != models.QuantizerBinary)
 	// ---------------------------
 	vstore, err := vectorstore.New(params.Quantizer, bucket, params.DistanceMetric, int(params.VectorSize))
 	if err != nil {
@@ -67,14 +76,14 @@ func NewIndexVamana(name string, params models.IndexVectorVamanaParameters, buck
 	}
 	index.vecStore = vstore
 	// ---------------------------
-	if err := index.setupStartNode(); err != nil {
-		return nil, fmt.Errorf("could not setup start node: %w", err)
-	}
-	// ---------------------------
 	// Max node id from bucket
 	if maxNodeIdVal := bucket.Get([]byte(MAXNODEIDKEY)); maxNodeIdVal != nil {
 		index.maxNodeId.Store(conversion.BytesToUint64(maxNodeIdVal))
 	}
+	// ---------------------------
+	if err := index.setupStartNode(); err != nil {
+		return nil, fmt.Errorf("could not setup start node: %w", err)
+	}
 	logger.Debug().Uint64("maxNodeId", index.maxNodeId.Load()).Msg("IndexVamana- New")
 	// ---------------------------
 	return index, nil
@@ -90,30 +99,56 @@ func (v *IndexVamana) UpdateBucket(bucket diskstore.Bucket) {
 	v.nodeStore.UpdateBucket(bucket)
 }
 
+/* Every search begins at the start node so an index whose start vector or
+ * edges have gone missing, e.g. after a partial restore, cannot be searched.
+ * The start node is recreated when the index is loaded and, if the index
+ * already has points, connected to its nearest points so searches can reach
+ * the rest of the graph again. */
 func (v *IndexVamana) setupStartNode() error {
 	// ---------------------------
-	if v.vecStore.Exists(STARTID) {
+	vectorExists := v.vecStore.Exists(STARTID)
+	_, err := v.nodeStore.Get(STARTID)
+	if err != nil && !errors.Is(err, cache.ErrNotFound) {
+		return fmt.Errorf("could not get start node: %w", err)
+	}
+	nodeExists := err == nil
+	if vectorExists && nodeExists {
 		return nil
 	}
 	// ---------------------------
-	// Create random unit vector of size n
-	randVector := make([]float32, v.parameters.VectorSize)
-	sum := float32(0)
-	for i := range randVector {
-		randVector[i] = rand.Float32()*2 - 1
-		sum += randVector[i] * randVector[i]
+	var startPoint vectorstore.VectorStorePoint
+	if vectorExists {
+		if startPoint, err = v.vecStore.Get(STARTID); err != nil {
+			return fmt.Errorf("could not get start point: %w", err)
+		}
+	} else {
+		// Create random unit vector of size n
+		randFloat := rand.Float32
+		if v.parameters.StartSeed != 0 {
+			randFloat = rand.New(rand.NewSource(v.parameters.StartSeed)).Float32
+		}
+		randVector := make([]float32, v.parameters.VectorSize)
+		for i := range randVector {
+			randVector[i] = randFloat()*2 - 1
+		}
+		distance.Normalize(randVector)
+		// Create start point
+		if startPoint, err = v.vecStore.Set(STARTID, randVector); err != nil {
+			return fmt.Errorf("could not set start point: %w", err)
+		}
 	}
-	// Normalise the vector
-	norm := 1 / float32(math.Sqrt(float64(sum)))
-	for i := range randVector {
-		randVector[i] *= norm
+	// ---------------------------
+	nearest, err := v.exactSearch(v.vecStore.DistanceFromPoint(startPoint), v.parameters.DegreeBound, nil)
+	if err != nil {
+		return fmt.Errorf("could not find start node neighbours: %w", err)
 	}
-	// Create start point
-	if _, err := v.vecStore.Set(STARTID, randVector); err != nil {
-		return fmt.Errorf("could not set start point: %w", err)
+	startNode := v.newNode(STARTID)
+	startNode.edges = make([]uint64, 0, nearest.Len())
+	for _, elem := range nearest.items {
+		startNode.edges = append(startNode.edges, elem.Point.Id())
 	}
-	startNode := &graphNode{
-		Id: STARTID,
+	if nodeExists || vectorExists || len(startNode.edges) > 0 {
+		v.logger.Warn().Bool("vectorExists", vectorExists).Bool("nodeExists", nodeExists).Int("edges", len(startNode.edges)).Msg("Recreated start node")
 	}
 	v.nodeStore.Put(STARTID, startNode)
 	return nil
@@ -124,6 +159,18 @@ type IndexVectorChange struct {
 	Vector []float32
 }
 
+// normalizedVector returns the vector to index or search with, which is a unit
+// length copy if the index normalises vectors. The given vector is not
+// modified because it belongs to the caller.
+func (v *IndexVamana) normalizedVector(vector []float32) []float32 {
+	if !v.normalize {
+		return vector
+	}
+	vector = slices.Clone(vector)
+	distance.Normalize(vector)
+	return vector
+}
+
 func (v *IndexVamana) InsertUpdateDelete(ctx context.Context, points <-chan IndexVectorChange) <-chan error {
 	errC := make(chan error, 1)
 	go func() {
@@ -155,6 +202,12 @@ func (v *IndexVamana) insertUpdateDelete(ctx context.Context, pointQueue <-chan
 			err = fmt.Errorf("invalid point id: %d", point.Id)
 			return
 		}
+		// Mismatched vectors would otherwise go out of bounds or silently
+		// compute meaningless distances
+		if point.Vector != nil && len(point.Vector) != int(v.parameters.VectorSize) {
+			err = fmt.Errorf("vector of node %d has size %d, expected %d", point.Id, len(point.Vector), v.parameters.VectorSize)
+			return
+		}
 		// What operation is this?
 		exists := v.vecStore.Exists(point.Id)
 		switch {
@@ -187,7 +240,7 @@ func (v *IndexVamana) insertUpdateDelete(ctx context.Context, pointQueue <-chan
 	 * the same cache. As opposed to multiple requests queuing to get access
 	 * to the shared cache. Internal concurrency (workers) vs external
 	 * concurrency (user requests). */
-	numWorkers := runtime.NumCPU() - 1 // We leave 1 core for the main thread
+	numWorkers := v.insertParameters(ctx).Workers
 	errCs := make([]<-chan error, numWorkers+1)
 	// ---------------------------
 	for i := 0; i < numWorkers; i++ {
@@ -241,14 +294,17 @@ func (v *IndexVamana) insertUpdateDelete(ctx context.Context, pointQueue <-chan
 	 * assumption that change the vector of a point will change its neighbours so
 	 * it has to be recalculated by re-inserting.
 	 *
-	 * We also assume there won't be to many updates in the system so this part
-	 * is single threaded for ease of implementation. One can re-use the insert
-	 * workers above by implementing an idle check, i.e. instead of waiting for
-	 * the workers to finish draining the insert channel and returning, you wait
-	 * until they have drained but are idle. */
-	for _, point := range updatedPoints {
-		if err := v.insertSinglePoint(point); err != nil {
-			return fmt.Errorf("could not re-insert updated point: %w", err)
+	 * The inbound edges of the updated nodes were removed above, so like new
+	 * nodes no other goroutine can reach them until they are linked and a fresh
+	 * set of insert workers can re-insert them in parallel. */
+	if len(updatedPoints) > 0 {
+		updateQ := utils.ProduceWithContext(ctx, updatedPoints)
+		updateErrCs := make([]<-chan error, min(numWorkers, len(updatedPoints)))
+		for i := range updateErrCs {
+			updateErrCs[i] = v.insertWorker(ctx, updateQ)
+		}
+		if err := <-utils.MergeErrorsWithContext(ctx, updateErrCs...); err != nil {
+			return fmt.Errorf("could not re-insert updated points: %w", err)
 		}
 	}
 	// ---------------------------
@@ -275,13 +331,111 @@ func (v *IndexVamana) flush() error {
 	return nil
 }
 
+// TrainQuantizer retrains the quantizer of the vector store from a sample of
+// the stored vectors, it errors if the vector store cannot be trained.
+func (v *IndexVamana) TrainQuantizer(sampleSize int) error {
+	tvs, ok := v.vecStore.(vectorstore.TrainableVectorStore)
+	if !ok {
+		return fmt.Errorf("vector store does not support training")
+	}
+	if err := tvs.Train(sampleSize); err != nil {
+		return fmt.Errorf("could not train vector store: %w", err)
+	}
+	return v.flush()
+}
+
+// SearchVisit is a graph node visited by a search with its distance to the
+// query.
+type SearchVisit struct {
+	NodeId   uint64
+	Distance float32
+}
+
+// SearchTrace records the graph nodes visited by the searches performed with
+// a context from WithSearchTrace in the order they were visited.
+type SearchTrace struct {
+	mu     sync.Mutex
+	visits []SearchVisit
+}
+
+func (t *SearchTrace) add(visit SearchVisit) {
+	t.mu.Lock()
+	t.visits = append(t.visits, visit)
+	t.mu.Unlock()
+}
+
+// Visits returns the visited nodes in order.
+func (t *SearchTrace) Visits() []SearchVisit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.visits)
+}
+
+type searchTraceKey struct{}
+
+// WithSearchTrace returns a context that records the path taken by the searches
+// performed with it. Searches without it do not materialise the visits.
+func WithSearchTrace(ctx context.Context) (context.Context, *SearchTrace) {
+	trace := &SearchTrace{}
+	return context.WithValue(ctx, searchTraceKey{}, trace), trace
+}
+
+type searchHopsKey struct{}
+
+// WithSearchHops returns a context that counts the graph nodes visited by the
+// searches performed with it. Searches may run in parallel, for example the
+// parts of a hybrid query, so the counter is atomic.
+func WithSearchHops(ctx context.Context) (context.Context, *atomic.Int64) {
+	hops := &atomic.Int64{}
+	return context.WithValue(ctx, searchHopsKey{}, hops), hops
+}
+
 func (v *IndexVamana) Search(ctx context.Context, query models.SearchVectorVamanaOptions, filter *roaring64.Bitmap) (*roaring64.Bitmap, []models.SearchResult, error) {
 	startTime := time.Now()
-	searchSet, _, err := v.greedySearch(query.Vector, query.Limit, query.SearchSize, filter)
+	/* When diversifying we keep the whole search set as candidates, this
+	 * matters for filtered searches which otherwise only keep limit results. */
+	searchSize := query.SearchSize
+	if searchSize == 0 {
+		searchSize = v.parameters.SearchSize
+	}
+	k := query.Limit
+	if query.Diversify != nil {
+		k = searchSize
+	}
+	distFn := v.queryDistFn(ctx, query.Vector)
+	if query.PrefetchWorkers > 1 {
+		ctx = withPrefetchWorkers(ctx, query.PrefetchWorkers)
+	}
+	cursor := searchCursorFrom(ctx)
+	if cursor != nil && (filter != nil || query.Diversify != nil) {
+		return nil, nil, fmt.Errorf("search cursors do not support filters or diversification")
+	}
+	var searchSet, visitedSet DistSet
+	var err error
+	resumed := cursor != nil && (len(cursor.Returned) > 0 || len(cursor.Frontier) > 0)
+	if resumed {
+		searchSet, visitedSet, err = v.resumeSearch(ctx, distFn, searchSize, cursor)
+	} else {
+		searchSet, visitedSet, err = v.greedySearch(ctx, distFn, k, searchSize, filter)
+	}
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not perform graph search: %w", err)
 	}
 	v.logger.Debug().Str("component", "shard").Str("duration", time.Since(startTime).String()).Msg("SearchPoints - GreedySearch")
+	if hops, ok := ctx.Value(searchHopsKey{}).(*atomic.Int64); ok {
+		hops.Add(int64(visitedSet.Len()))
+	}
+	// ---------------------------
+	// A resumed search is short on results by design as earlier pages took the
+	// closest points, so it does not fall back to an exact search.
+	if !resumed && needsExactFallback(query.ExactFallback, query.Limit, searchSet, visitedSet) {
+		exactStartTime := time.Now()
+		searchSet, err = v.exactSearch(distFn, k, filter)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not perform exact fallback search: %w", err)
+		}
+		v.logger.Debug().Int("visited", visitedSet.Len()).Str("duration", time.Since(exactStartTime).String()).Msg("SearchPoints - ExactFallback")
+	}
 	results := make([]models.SearchResult, 0, min(len(searchSet.items), query.Limit))
 	resultSet := roaring64.New()
 	// ---------------------------
@@ -290,7 +444,11 @@ func (v *IndexVamana) Search(ctx context.Context, query models.SearchVectorVaman
 		weight = *query.Weight
 	}
 	// ---------------------------
-	for _, elem := range searchSet.items {
+	candidates := searchSet.items
+	if query.Diversify != nil {
+		candidates = v.diversify(candidates, query.Limit, query.Diversify.Lambda)
+	}
+	for _, elem := range candidates {
 		if elem.Point.Id() == STARTID {
 			continue
 		}
@@ -306,5 +464,9 @@ func (v *IndexVamana) Search(ctx context.Context, query models.SearchVectorVaman
 		resultSet.Add(elem.Point.Id())
 	}
 	// ---------------------------
+	if cursor != nil {
+		cursor.advance(resultSet.ToArray(), searchSet, visitedSet)
+	}
+	// ---------------------------
 	return resultSet, results, err
 }
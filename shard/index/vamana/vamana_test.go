@@ -2,9 +2,12 @@ package vamana
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"fmt"
+	"math"
 	"math/rand"
+	"runtime"
 	"slices"
 	"sync"
 	"testing"
@@ -12,6 +15,7 @@ import (
 	"github.com/RoaringBitmap/roaring/roaring64"
 	"github.com/semafind/semadb/conversion"
 	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/distance"
 	"github.com/semafind/semadb/models"
 	"github.com/semafind/semadb/shard/cache"
 	"github.com/semafind/semadb/utils"
@@ -210,6 +214,47 @@ func Test_Flush(t *testing.T) {
 	require.Equal(t, 43, maxId)
 }
 
+func Test_CompressEdges(t *testing.T) {
+	params := vamanaParams
+	params.CompressEdges = true
+	bucket := diskstore.NewMemBucket(false)
+	inv, err := NewIndexVamana("test", params, bucket)
+	require.NoError(t, err)
+	ctx := context.Background()
+	rps := randPoints(200, 0)
+	require.NoError(t, <-inv.InsertUpdateDelete(ctx, utils.ProduceWithContext(ctx, rps)))
+	// ---------------------------
+	edges := make(map[uint64][]uint64)
+	require.NoError(t, inv.nodeStore.ForEach(func(id uint64, node *graphNode) error {
+		sorted := slices.Clone(node.edges)
+		slices.Sort(sorted)
+		edges[id] = sorted
+		return nil
+	}))
+	require.Len(t, edges, 201)
+	require.NoError(t, bucket.ForEach(func(key []byte, value []byte) error {
+		if key[len(key)-1] == 'e' {
+			require.True(t, conversion.IsDeltaEdgeList(value))
+		}
+		return nil
+	}))
+	// ---------------------------
+	// A fresh index reads the same edges back from the bucket
+	reopened, err := NewIndexVamana("test", params, bucket)
+	require.NoError(t, err)
+	for id, want := range edges {
+		node, err := reopened.nodeStore.Get(id)
+		require.NoError(t, err)
+		require.True(t, node.compressEdges)
+		require.Equal(t, want, node.edges)
+	}
+	checkConnectivity(t, reopened.nodeStore, 200)
+	s := models.SearchVectorVamanaOptions{Vector: rps[0].Vector, SearchSize: 75, Limit: 1}
+	_, res, err := reopened.Search(ctx, s, nil)
+	require.NoError(t, err)
+	require.Equal(t, rps[0].Id, res[0].NodeId)
+}
+
 func Test_EmptySearch(t *testing.T) {
 	inv, err := NewIndexVamana("test", vamanaParams, diskstore.NewMemBucket(false))
 	require.NoError(t, err)
@@ -251,6 +296,132 @@ func Test_Search(t *testing.T) {
 	}
 }
 
+func Test_SearchDefaultSearchSize(t *testing.T) {
+	inv, err := NewIndexVamana("test", vamanaParams, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	rps := randPoints(200, 0)
+	ctx := context.Background()
+	in := utils.ProduceWithContext(ctx, rps)
+	errC := inv.InsertUpdateDelete(ctx, in)
+	require.NoError(t, <-errC)
+	// ---------------------------
+	// A zero search size falls back to the index parameters
+	s := models.SearchVectorVamanaOptions{
+		Vector: rps[0].Vector,
+		Limit:  10,
+	}
+	_, defaultRes, err := inv.Search(context.Background(), s, nil)
+	require.NoError(t, err)
+	s.SearchSize = vamanaParams.SearchSize
+	_, res, err := inv.Search(context.Background(), s, nil)
+	require.NoError(t, err)
+	require.Equal(t, res, defaultRes)
+}
+
+func Test_SearchPrefetch(t *testing.T) {
+	bucket := diskstore.NewMemBucket(false)
+	inv, err := NewIndexVamana("test", vamanaParams, bucket)
+	require.NoError(t, err)
+	rps := randPoints(500, 0)
+	ctx := context.Background()
+	in := utils.ProduceWithContext(ctx, rps)
+	errC := inv.InsertUpdateDelete(ctx, in)
+	require.NoError(t, <-errC)
+	// ---------------------------
+	// Fresh indexes on the same bucket start with a cold cache
+	sequential, err := NewIndexVamana("test", vamanaParams, bucket)
+	require.NoError(t, err)
+	prefetched, err := NewIndexVamana("test", vamanaParams, bucket)
+	require.NoError(t, err)
+	for _, rp := range rps[:50] {
+		s := models.SearchVectorVamanaOptions{
+			Vector: rp.Vector,
+			Limit:  10,
+		}
+		_, want, err := sequential.Search(ctx, s, nil)
+		require.NoError(t, err)
+		s.PrefetchWorkers = 4
+		_, got, err := prefetched.Search(ctx, s, nil)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+}
+
+func Test_SearchCancelled(t *testing.T) {
+	inv, err := NewIndexVamana("test", vamanaParams, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	rps := randPoints(50, 0)
+	in := utils.ProduceWithContext(context.Background(), rps)
+	errC := inv.InsertUpdateDelete(context.Background(), in)
+	require.NoError(t, <-errC)
+	// ---------------------------
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := models.SearchVectorVamanaOptions{
+		Vector:     rps[0].Vector,
+		SearchSize: 75,
+		Limit:      10,
+	}
+	_, _, err = inv.Search(ctx, s, nil)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func Test_Repair(t *testing.T) {
+	inv, err := NewIndexVamana("test", vamanaParams, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	rps := randPoints(200, 0)
+	ctx := context.Background()
+	in := utils.ProduceWithContext(ctx, rps)
+	errC := inv.InsertUpdateDelete(ctx, in)
+	require.NoError(t, <-errC)
+	reachable, total, err := inv.CheckConnectivity()
+	require.NoError(t, err)
+	require.Equal(t, 200, total)
+	require.Equal(t, 200, reachable)
+	// ---------------------------
+	// Orphan a node by removing all of its inbound edges
+	orphanId := rps[0].Id
+	err = inv.nodeStore.ForEach(func(id uint64, node *graphNode) error {
+		node.edgesMu.Lock()
+		defer node.edgesMu.Unlock()
+		if err := node.LoadNeighbours(inv.vecStore); err != nil {
+			return err
+		}
+		edges := node.edges[:0]
+		neighbours := node.neighbours[:0]
+		for i, edge := range node.edges {
+			if edge != orphanId {
+				edges = append(edges, edge)
+				neighbours = append(neighbours, node.neighbours[i])
+			}
+		}
+		node.edges = edges
+		node.neighbours = neighbours
+		return nil
+	})
+	require.NoError(t, err)
+	reachable, total, err = inv.CheckConnectivity()
+	require.NoError(t, err)
+	require.Equal(t, 200, total)
+	require.Less(t, reachable, total)
+	// ---------------------------
+	repaired, err := inv.Repair()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, repaired, 1)
+	reachable, _, err = inv.CheckConnectivity()
+	require.NoError(t, err)
+	require.Equal(t, 200, reachable)
+	checkConnectivity(t, inv.nodeStore, 200)
+	s := models.SearchVectorVamanaOptions{
+		Vector:     rps[0].Vector,
+		SearchSize: 75,
+		Limit:      1,
+	}
+	_, res, err := inv.Search(context.Background(), s, nil)
+	require.NoError(t, err)
+	require.Equal(t, orphanId, res[0].NodeId)
+}
+
 func Test_FilterSearch(t *testing.T) {
 	inv, err := NewIndexVamana("test", vamanaParams, diskstore.NewMemBucket(false))
 	require.NoError(t, err)
@@ -274,3 +445,567 @@ func Test_FilterSearch(t *testing.T) {
 	require.Len(t, res, 3)
 	require.Equal(t, rp.Id, res[0].NodeId)
 }
+
+func Test_ExactFallbackSearch(t *testing.T) {
+	inv, err := NewIndexVamana("test", vamanaParams, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	rps := randPoints(200, 0)
+	ctx := context.Background()
+	in := utils.ProduceWithContext(ctx, rps)
+	errC := inv.InsertUpdateDelete(ctx, in)
+	require.NoError(t, <-errC)
+	fallback := &models.SearchVectorVamanaExactFallbackOptions{OnShortResults: true}
+	// ---------------------------
+	// Healthy graph should not need the fallback
+	searchSet, visitedSet, err := inv.greedySearch(context.Background(), inv.vecStore.DistanceFromFloat(rps[0].Vector), 10, 75, nil)
+	require.NoError(t, err)
+	require.False(t, needsExactFallback(fallback, 10, searchSet, visitedSet))
+	// ---------------------------
+	// Degrade the graph by disconnecting the start node
+	startNode, err := inv.nodeStore.Get(STARTID)
+	require.NoError(t, err)
+	startNode.edgesMu.Lock()
+	startNode.ClearNeighbours()
+	startNode.edgesMu.Unlock()
+	s := models.SearchVectorVamanaOptions{
+		Vector:     rps[0].Vector,
+		SearchSize: 75,
+		Limit:      10,
+	}
+	_, res, err := inv.Search(ctx, s, nil)
+	require.NoError(t, err)
+	require.Len(t, res, 0)
+	// ---------------------------
+	s.ExactFallback = fallback
+	_, res, err = inv.Search(ctx, s, nil)
+	require.NoError(t, err)
+	require.Len(t, res, 10)
+	require.Equal(t, rps[0].Id, res[0].NodeId)
+	// Exact results must be ordered by distance
+	for i := 1; i < len(res); i++ {
+		require.LessOrEqual(t, *res[i-1].Distance, *res[i].Distance)
+	}
+	// ---------------------------
+	// Exact search also respects the filter
+	filter := roaring64.BitmapOf(rps[5].Id, rps[6].Id)
+	_, res, err = inv.Search(ctx, s, filter)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+}
+
+func Test_Diversify(t *testing.T) {
+	inv, err := NewIndexVamana("test", vamanaParams, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	// Clusters of near duplicates around the corners of the unit square
+	centres := [][]float32{{0, 0}, {1, 0}, {0, 1}, {1, 1}}
+	clusterSize := 15
+	rps := make([]IndexVectorChange, 0, len(centres)*clusterSize)
+	for _, c := range centres {
+		for i := 0; i < clusterSize; i++ {
+			rps = append(rps, IndexVectorChange{
+				Id:     uint64(len(rps) + 2),
+				Vector: []float32{c[0] + rand.Float32()*0.001, c[1] + rand.Float32()*0.001},
+			})
+		}
+	}
+	ctx := context.Background()
+	in := utils.ProduceWithContext(ctx, rps)
+	errC := inv.InsertUpdateDelete(ctx, in)
+	require.NoError(t, <-errC)
+	clusterCount := func(res []models.SearchResult) int {
+		clusters := make(map[uint64]struct{})
+		for _, r := range res {
+			clusters[(r.NodeId-2)/uint64(clusterSize)] = struct{}{}
+		}
+		return len(clusters)
+	}
+	// ---------------------------
+	s := models.SearchVectorVamanaOptions{
+		Vector:     []float32{0, 0},
+		SearchSize: 75,
+		Limit:      4,
+	}
+	_, res, err := inv.Search(ctx, s, nil)
+	require.NoError(t, err)
+	require.Len(t, res, 4)
+	require.Equal(t, 1, clusterCount(res))
+	// ---------------------------
+	s.Diversify = &models.SearchVectorVamanaDiversifyOptions{Lambda: 0.2}
+	_, res, err = inv.Search(ctx, s, nil)
+	require.NoError(t, err)
+	require.Len(t, res, 4)
+	require.Equal(t, 4, clusterCount(res))
+	// The closest point is still picked first
+	require.Less(t, *res[0].Distance, float32(0.01))
+	// ---------------------------
+	// Lambda of 1 is plain nearest neighbour search
+	s.Diversify.Lambda = 1
+	_, res, err = inv.Search(ctx, s, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, clusterCount(res))
+}
+
+func Test_MaxHops(t *testing.T) {
+	params := vamanaParams
+	params.MaxHops = 3
+	inv, err := NewIndexVamana("test", params, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	rps := randPoints(1000, 0)
+	ctx := context.Background()
+	in := utils.ProduceWithContext(ctx, rps)
+	errC := inv.InsertUpdateDelete(ctx, in)
+	require.NoError(t, <-errC)
+	// ---------------------------
+	// searchDepths counts the points the greedy search for their own vector
+	// reaches in more than the hop bound
+	searchDepths := func() int {
+		far := 0
+		for _, rp := range rps {
+			_, visitedSet, err := inv.greedySearch(ctx, inv.vecStore.DistanceFromFloat(rp.Vector), 1, params.SearchSize, nil)
+			require.NoError(t, err)
+			depths, err := inv.visitedDepths(visitedSet)
+			require.NoError(t, err)
+			if d, ok := depths[rp.Id]; !ok || d > params.MaxHops {
+				far++
+			}
+		}
+		return far
+	}
+	// Inserts do not enforce the bound, the maintenance repair does
+	_, err = inv.Repair()
+	require.NoError(t, err)
+	require.Zero(t, searchDepths())
+	// ---------------------------
+	// Extra edges respect the degree bound
+	err = inv.nodeStore.ForEach(func(id uint64, node *graphNode) error {
+		require.LessOrEqual(t, len(node.edges), params.DegreeBound)
+		return nil
+	})
+	require.NoError(t, err)
+	// ---------------------------
+	// Searches still find the points
+	for _, rp := range rps[:100] {
+		s := models.SearchVectorVamanaOptions{
+			Vector:     rp.Vector,
+			SearchSize: 75,
+			Limit:      10,
+		}
+		_, res, err := inv.Search(ctx, s, nil)
+		require.NoError(t, err)
+		require.Len(t, res, 10)
+		require.Equal(t, rp.Id, res[0].NodeId)
+	}
+}
+
+func Test_Manhattan(t *testing.T) {
+	params := vamanaParams
+	params.DistanceMetric = models.DistanceManhattan
+	inv, err := NewIndexVamana("test", params, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	rps := randPoints(500, 0)
+	ctx := context.Background()
+	in := utils.ProduceWithContext(ctx, rps)
+	errC := inv.InsertUpdateDelete(ctx, in)
+	require.NoError(t, <-errC)
+	checkConnectivity(t, inv.nodeStore, 500)
+	// ---------------------------
+	l1 := func(x, y []float32) float32 {
+		return float32(math.Abs(float64(x[0]-y[0])) + math.Abs(float64(x[1]-y[1])))
+	}
+	query := rps[0].Vector
+	exact := slices.Clone(rps)
+	slices.SortFunc(exact, func(a, b IndexVectorChange) int {
+		return cmp.Compare(l1(query, a.Vector), l1(query, b.Vector))
+	})
+	s := models.SearchVectorVamanaOptions{
+		Vector: query,
+		Limit:  10,
+	}
+	_, res, err := inv.Search(ctx, s, nil)
+	require.NoError(t, err)
+	require.Len(t, res, 10)
+	require.Equal(t, rps[0].Id, res[0].NodeId)
+	require.Equal(t, float32(0), *res[0].Distance)
+	// The graph search should recover nearly all of the exact neighbours
+	exactIds := make(map[uint64]struct{})
+	for _, p := range exact[:10] {
+		exactIds[p.Id] = struct{}{}
+	}
+	found := 0
+	for _, r := range res {
+		if _, ok := exactIds[r.NodeId]; ok {
+			found++
+		}
+	}
+	require.GreaterOrEqual(t, found, 9)
+}
+
+func Test_VectorSizeMismatch(t *testing.T) {
+	inv, err := NewIndexVamana("test", vamanaParams, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	for _, vector := range [][]float32{{1}, {1, 2, 3}} {
+		ctx := context.Background()
+		in := utils.ProduceWithContext(ctx, []IndexVectorChange{{Id: 2, Vector: vector}})
+		errC := inv.InsertUpdateDelete(ctx, in)
+		require.ErrorContains(t, <-errC, "expected 2")
+	}
+}
+
+func Test_BinaryDistances(t *testing.T) {
+	// Binary fingerprints are sent as 0.0 and 1.0 float values
+	const dims = 64
+	rps := make([]IndexVectorChange, 300)
+	for i := range rps {
+		vector := make([]float32, dims)
+		for j := range vector {
+			vector[j] = float32(rand.Intn(2))
+		}
+		rps[i] = IndexVectorChange{Id: uint64(i + 2), Vector: vector}
+	}
+	hamming := func(x, y []float32) float32 {
+		dist := float32(0)
+		for i := range x {
+			if x[i] != y[i] {
+				dist++
+			}
+		}
+		return dist
+	}
+	for _, metric := range []string{models.DistanceHamming, models.DistanceJaccard} {
+		t.Run(metric, func(t *testing.T) {
+			params := vamanaParams
+			params.VectorSize = dims
+			params.DistanceMetric = metric
+			inv, err := NewIndexVamana("test", params, diskstore.NewMemBucket(false))
+			require.NoError(t, err)
+			ctx := context.Background()
+			in := utils.ProduceWithContext(ctx, rps)
+			errC := inv.InsertUpdateDelete(ctx, in)
+			require.NoError(t, <-errC)
+			checkConnectivity(t, inv.nodeStore, len(rps))
+			// ---------------------------
+			// Searching for a stored fingerprint finds itself at distance 0
+			// followed by its nearest neighbours in order.
+			query := rps[0].Vector
+			s := models.SearchVectorVamanaOptions{
+				Vector: query,
+				Limit:  5,
+			}
+			_, res, err := inv.Search(ctx, s, nil)
+			require.NoError(t, err)
+			require.Len(t, res, 5)
+			require.Equal(t, rps[0].Id, res[0].NodeId)
+			require.Equal(t, float32(0), *res[0].Distance)
+			for i := 1; i < len(res); i++ {
+				require.LessOrEqual(t, *res[i-1].Distance, *res[i].Distance)
+			}
+			if metric == models.DistanceHamming {
+				// The nearest other fingerprint must match the exact scan
+				nearest := float32(dims)
+				for _, p := range rps[1:] {
+					nearest = min(nearest, hamming(query, p.Vector))
+				}
+				require.Equal(t, nearest, *res[1].Distance)
+			}
+		})
+	}
+}
+
+func Test_AutoNormalize(t *testing.T) {
+	const dims = 16
+	params := vamanaParams
+	params.VectorSize = dims
+	params.DistanceMetric = models.DistanceCosine
+	normalizedIndex, err := NewIndexVamana("normalized", params, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	params.AutoNormalize = true
+	autoIndex, err := NewIndexVamana("auto", params, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	// ---------------------------
+	// The same directions are inserted scaled into the auto normalising index
+	// and already normalised into the other.
+	normalized := make([]IndexVectorChange, 100)
+	scaled := make([]IndexVectorChange, len(normalized))
+	for i := range normalized {
+		vector := make([]float32, dims)
+		for j := range vector {
+			vector[j] = rand.Float32()*2 - 1
+		}
+		scale := 1 + 10*rand.Float32()
+		scaledVector := make([]float32, dims)
+		for j := range vector {
+			scaledVector[j] = vector[j] * scale
+		}
+		distance.Normalize(vector)
+		normalized[i] = IndexVectorChange{Id: uint64(i + 2), Vector: vector}
+		scaled[i] = IndexVectorChange{Id: uint64(i + 2), Vector: scaledVector}
+	}
+	scaledVector := slices.Clone(scaled[0].Vector)
+	ctx := context.Background()
+	require.NoError(t, <-normalizedIndex.InsertUpdateDelete(ctx, utils.ProduceWithContext(ctx, normalized)))
+	require.NoError(t, <-autoIndex.InsertUpdateDelete(ctx, utils.ProduceWithContext(ctx, scaled)))
+	// The caller's vectors are left as they are
+	require.Equal(t, scaledVector, scaled[0].Vector)
+	// ---------------------------
+	_, want, err := normalizedIndex.Search(ctx, models.SearchVectorVamanaOptions{Vector: normalized[0].Vector, Limit: 10}, nil)
+	require.NoError(t, err)
+	_, got, err := autoIndex.Search(ctx, models.SearchVectorVamanaOptions{Vector: scaled[0].Vector, Limit: 10}, nil)
+	require.NoError(t, err)
+	require.Len(t, got, 10)
+	for i := range want {
+		require.Equal(t, want[i].NodeId, got[i].NodeId)
+		require.InDelta(t, *want[i].Distance, *got[i].Distance, 1e-5)
+	}
+}
+
+func BenchmarkSearchCosine(b *testing.B) {
+	const size, dims = 1_000, 128
+	params := vamanaParams
+	params.VectorSize = dims
+	params.DistanceMetric = models.DistanceCosine
+	inv, err := NewIndexVamana("bench", params, diskstore.NewMemBucket(false))
+	require.NoError(b, err)
+	rps := make([]IndexVectorChange, size)
+	for i := range rps {
+		vector := make([]float32, dims)
+		for j := range vector {
+			vector[j] = rand.Float32()*2 - 1
+		}
+		distance.Normalize(vector)
+		rps[i] = IndexVectorChange{Id: uint64(i + 2), Vector: vector}
+	}
+	ctx := context.Background()
+	require.NoError(b, <-inv.InsertUpdateDelete(ctx, utils.ProduceWithContext(ctx, rps)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := models.SearchVectorVamanaOptions{
+			Vector: rps[i%size].Vector,
+			Limit:  10,
+		}
+		if _, _, err := inv.Search(ctx, s, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Test_robustPruneSquaredEuclidean(t *testing.T) {
+	/* The second point is 1.15 times further from the node than from the first
+	 * point. That is within alpha 1.2 so it keeps its edge, but squared
+	 * distances without squaring alpha would prune it. */
+	h := float32(math.Sqrt(1 / (1.15*1.15 - 1)))
+	for _, tc := range []struct {
+		metric string
+		edges  int
+	}{
+		{models.DistanceEuclidean, 2},
+		{models.DistanceManhattan, 1},
+	} {
+		params := vamanaParams
+		params.DistanceMetric = tc.metric
+		inv, err := NewIndexVamana("test", params, diskstore.NewMemBucket(false))
+		require.NoError(t, err)
+		p1, err := inv.vecStore.Set(2, []float32{1, 0})
+		require.NoError(t, err)
+		p2, err := inv.vecStore.Set(3, []float32{1, h})
+		require.NoError(t, err)
+		candidates := NewDistSet(2, 0, inv.vecStore.DistanceFromFloat([]float32{0, 0}))
+		candidates.Add(p1, p2)
+		candidates.Sort()
+		node := &graphNode{Id: 4}
+		inv.robustPruneWith(node, candidates, 1.2, 64)
+		require.Len(t, node.edges, tc.edges, tc.metric)
+	}
+}
+
+func Test_Rebuild(t *testing.T) {
+	inv, err := NewIndexVamana("test", vamanaParams, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	rps := randPoints(200, 0)
+	ctx := context.Background()
+	require.NoError(t, <-inv.InsertUpdateDelete(ctx, utils.ProduceWithContext(ctx, rps)))
+	found := func() int {
+		count := 0
+		for _, rp := range rps {
+			s := models.SearchVectorVamanaOptions{
+				Vector:     rp.Vector,
+				SearchSize: 75,
+				Limit:      1,
+			}
+			_, res, err := inv.Search(ctx, s, nil)
+			require.NoError(t, err)
+			if len(res) > 0 && res[0].NodeId == rp.Id {
+				count++
+			}
+		}
+		return count
+	}
+	require.Equal(t, len(rps), found())
+	// ---------------------------
+	// Corrupt the graph by leaving every point with a single edge back to the
+	// start node
+	err = inv.nodeStore.ForEach(func(id uint64, node *graphNode) error {
+		if id == STARTID {
+			return nil
+		}
+		node.edgesMu.Lock()
+		defer node.edgesMu.Unlock()
+		start, err := inv.vecStore.Get(STARTID)
+		if err != nil {
+			return err
+		}
+		node.ClearNeighbours()
+		node.AddNeighbour(start)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Less(t, found(), len(rps))
+	// ---------------------------
+	linked, err := inv.Rebuild(ctx)
+	require.NoError(t, err)
+	require.Equal(t, len(rps), linked)
+	checkConnectivity(t, inv.nodeStore, len(rps))
+	require.Equal(t, len(rps), found())
+	stats, err := inv.GraphStats()
+	require.NoError(t, err)
+	require.Zero(t, stats.SelfLoops)
+	require.Zero(t, stats.DuplicateEdges)
+}
+
+func Test_InsertParameters(t *testing.T) {
+	inv, err := NewIndexVamana("test", vamanaParams, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	ctx := WithInsertParameters(context.Background(), InsertParameters{Alpha: 1.5, DegreeBound: 100})
+	// The degree bound cannot exceed that of the collection
+	require.Equal(t, InsertParameters{Alpha: 1.5, DegreeBound: 64, SearchSize: 75, Workers: max(runtime.NumCPU()-1, 1)}, inv.insertParameters(ctx))
+	// ---------------------------
+	// Half the points are inserted with a different alpha
+	rps := randPoints(200, 0)
+	errC := inv.InsertUpdateDelete(context.Background(), utils.ProduceWithContext(context.Background(), rps[:100]))
+	require.NoError(t, <-errC)
+	ctx = WithInsertParameters(context.Background(), InsertParameters{Alpha: 1.0, SearchSize: 30})
+	errC = inv.InsertUpdateDelete(ctx, utils.ProduceWithContext(ctx, rps[100:]))
+	require.NoError(t, <-errC)
+	checkConnectivity(t, inv.nodeStore, len(rps))
+	for _, rp := range rps {
+		s := models.SearchVectorVamanaOptions{
+			Vector:     rp.Vector,
+			SearchSize: 75,
+			Limit:      1,
+		}
+		_, res, err := inv.Search(context.Background(), s, nil)
+		require.NoError(t, err)
+		require.Equal(t, rp.Id, res[0].NodeId)
+	}
+}
+
+func Test_ConstructionSearchSize(t *testing.T) {
+	params := vamanaParams
+	params.SearchSize = 25
+	params.ConstructionSearchSize = 100
+	inv, err := NewIndexVamana("test", params, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	require.Equal(t, 100, inv.insertParameters(context.Background()).SearchSize)
+	// A per request search size still takes precedence
+	ctx := WithInsertParameters(context.Background(), InsertParameters{SearchSize: 30})
+	require.Equal(t, 30, inv.insertParameters(ctx).SearchSize)
+	// ---------------------------
+	rps := randPoints(200, 0)
+	require.NoError(t, <-inv.InsertUpdateDelete(context.Background(), utils.ProduceWithContext(context.Background(), rps)))
+	checkConnectivity(t, inv.nodeStore, len(rps))
+	// Queries without a search size use the smaller one of the collection
+	for _, rp := range rps[:10] {
+		s := models.SearchVectorVamanaOptions{
+			Vector: rp.Vector,
+			Limit:  1,
+		}
+		_, res, err := inv.Search(context.Background(), s, nil)
+		require.NoError(t, err)
+		require.Equal(t, rp.Id, res[0].NodeId)
+	}
+}
+
+func Test_InsertWorkers(t *testing.T) {
+	inv, err := NewIndexVamana("test", vamanaParams, diskstore.NewMemBucket(false))
+	require.NoError(t, err)
+	ctx := WithInsertParameters(context.Background(), InsertParameters{Workers: 1})
+	require.Equal(t, 1, inv.insertParameters(ctx).Workers)
+	rps := randPoints(100, 0)
+	require.NoError(t, <-inv.InsertUpdateDelete(ctx, utils.ProduceWithContext(ctx, rps)))
+	checkConnectivity(t, inv.nodeStore, len(rps))
+	// ---------------------------
+	// Updated points are re-inserted by the workers as well
+	updates := randPoints(50, 0)
+	ctx = context.Background()
+	require.NoError(t, <-inv.InsertUpdateDelete(ctx, utils.ProduceWithContext(ctx, updates)))
+	checkConnectivity(t, inv.nodeStore, len(rps))
+	for _, rp := range updates {
+		_, res, err := inv.Search(ctx, models.SearchVectorVamanaOptions{Vector: rp.Vector, SearchSize: 75, Limit: 1}, nil)
+		require.NoError(t, err)
+		require.Equal(t, rp.Id, res[0].NodeId)
+	}
+}
+
+// Compares sequential inserts against the default worker pool, the speedup
+// depends on the number of cores.
+func BenchmarkInsertWorkers(b *testing.B) {
+	const size, dims = 500, 32
+	params := vamanaParams
+	params.VectorSize = dims
+	rps := make([]IndexVectorChange, size)
+	for i := range rps {
+		vector := make([]float32, dims)
+		for j := range vector {
+			vector[j] = rand.Float32()
+		}
+		rps[i] = IndexVectorChange{Id: uint64(i + 2), Vector: vector}
+	}
+	for _, workers := range []int{1, 0} {
+		b.Run(fmt.Sprintf("Workers=%d", workers), func(b *testing.B) {
+			ctx := WithInsertParameters(context.Background(), InsertParameters{Workers: workers})
+			for i := 0; i < b.N; i++ {
+				inv, err := NewIndexVamana("bench", params, diskstore.NewMemBucket(false))
+				require.NoError(b, err)
+				require.NoError(b, <-inv.InsertUpdateDelete(ctx, utils.ProduceWithContext(ctx, rps)))
+			}
+		})
+	}
+}
+
+// Inserts into a graph whose nodes reach the degree bound, so most reverse
+// edges prune the neighbour. Profile with -cpuprofile to see where the insert
+// time goes.
+func BenchmarkInsertHighDegree(b *testing.B) {
+	const size, dims = 2000, 32
+	params := vamanaParams
+	params.VectorSize = dims
+	rps := make([]IndexVectorChange, size)
+	for i := range rps {
+		vector := make([]float32, dims)
+		for j := range vector {
+			vector[j] = rand.Float32()
+		}
+		rps[i] = IndexVectorChange{Id: uint64(i + 2), Vector: vector}
+	}
+	ctx := WithInsertParameters(context.Background(), InsertParameters{Workers: 1})
+	for i := 0; i < b.N; i++ {
+		inv, err := NewIndexVamana("bench", params, diskstore.NewMemBucket(false))
+		require.NoError(b, err)
+		require.NoError(b, <-inv.InsertUpdateDelete(ctx, utils.ProduceWithContext(ctx, rps)))
+	}
+}
+
+func Test_StartSeed(t *testing.T) {
+	params := vamanaParams
+	params.StartSeed = 42
+	startDistance := func(params models.IndexVectorVamanaParameters) float32 {
+		inv, err := NewIndexVamana("test", params, diskstore.NewMemBucket(false))
+		require.NoError(t, err)
+		start, err := inv.vecStore.Get(STARTID)
+		require.NoError(t, err)
+		return inv.vecStore.DistanceFromFloat([]float32{1, 0})(start)
+	}
+	// The same seed gives the same start vector
+	require.Equal(t, startDistance(params), startDistance(params))
+	params.StartSeed = 43
+	require.NotEqual(t, startDistance(vamanaParams), startDistance(params))
+}
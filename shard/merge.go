@@ -0,0 +1,104 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+)
+
+/* Merging consolidates two shards of the same collection into one, for example
+ * after points are deleted and the shards have become sparse. The points of the
+ * other shard are inserted into this shard batch by batch as regular inserts.
+ * This means they get new node ids from this shard and their graph edges are
+ * recomputed, the node ids and edges of the other shard are meaningless here.
+ * The other shard is left untouched so the caller decides when to drop it. */
+
+// Number of points copied per insert when merging or splitting shards
+const readPointBatchSize = 1000
+
+// readPointBatch reads the next batch of points of the shard, including their
+// payloads, after the given point.
+func (s *Shard) readPointBatch(after *uuid.UUID) ([]models.Point, error) {
+	var points []models.Point
+	err := s.db.Read(func(bm diskstore.BucketManager) error {
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		bPayloads, err := bm.Get(PAYLOADSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get payloads bucket: %w", err)
+		}
+		points, err = ScanPoints(bPoints, after, readPointBatchSize)
+		if err != nil {
+			return err
+		}
+		for i := range points {
+			points[i].Payload = getPayload(bPayloads, points[i].Id)
+		}
+		return nil
+	})
+	return points, err
+}
+
+// Merge inserts all the points of the other shard into this shard. It fails
+// without inserting anything if any point exists in both shards.
+func (s *Shard) Merge(other *Shard) error {
+	if s.collection.Id != other.collection.Id {
+		return fmt.Errorf("cannot merge shard of collection %s into %s", other.collection.Id, s.collection.Id)
+	}
+	// ---------------------------
+	// Check for conflicts first so a failed merge leaves this shard unchanged
+	var after *uuid.UUID
+	for {
+		points, err := other.readPointBatch(after)
+		if err != nil {
+			return fmt.Errorf("could not read points to merge: %w", err)
+		}
+		if len(points) == 0 {
+			break
+		}
+		err = s.db.Read(func(bm diskstore.BucketManager) error {
+			bPoints, err := bm.Get(POINTSBUCKETKEY)
+			if err != nil {
+				return fmt.Errorf("could not get points bucket: %w", err)
+			}
+			for _, point := range points {
+				exists, err := CheckPointExists(bPoints, point.Id)
+				if err != nil {
+					return fmt.Errorf("could not check point %s: %w", point.Id, err)
+				}
+				if exists {
+					return fmt.Errorf("point %s exists in both shards", point.Id)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		after = &points[len(points)-1].Id
+	}
+	// ---------------------------
+	after = nil
+	merged := 0
+	for {
+		points, err := other.readPointBatch(after)
+		if err != nil {
+			return fmt.Errorf("could not read points to merge: %w", err)
+		}
+		if len(points) == 0 {
+			break
+		}
+		if err := s.InsertPoints(context.Background(), points); err != nil {
+			return fmt.Errorf("could not insert merged points: %w", err)
+		}
+		merged += len(points)
+		after = &points[len(points)-1].Id
+	}
+	s.logger.Debug().Int("count", merged).Str("from", other.dbFile).Msg("Merge")
+	return nil
+}
@@ -0,0 +1,53 @@
+package shard
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/models"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/* Many clients only ever change the metadata of their points, e.g. tags or
+ * timestamps, and never the vectors. A metadata update carries msgpack encoded
+ * properties like an update does and is merged into the point data the same
+ * way, but it may not contain any vector property. Since unchanged properties
+ * are not dispatched to their indexes, no graph index is touched and only the
+ * indexes of the changed properties are updated. The metadata size limit of
+ * the collection applies as it does to updates. */
+
+// UpdateMetadata merges the given msgpack encoded properties into the data of
+// existing points and returns the ids of the points found.
+func (s *Shard) UpdateMetadata(ctx context.Context, updates map[uuid.UUID][]byte) ([]uuid.UUID, error) {
+	vectorProps := vectorProperties(s.collection.IndexSchema)
+	dec := msgpack.NewDecoder(nil)
+	points := make([]models.Point, 0, len(updates))
+	for id, data := range updates {
+		dec.Reset(bytes.NewReader(data))
+		n, err := dec.DecodeMapLen()
+		if err != nil {
+			return nil, fmt.Errorf("could not decode metadata of point %s: %w", id, err)
+		}
+		for i := 0; i < n; i++ {
+			key, err := dec.DecodeString()
+			if err != nil {
+				return nil, fmt.Errorf("could not decode metadata key of point %s: %w", id, err)
+			}
+			if _, ok := vectorProps[key]; ok {
+				return nil, fmt.Errorf("metadata of point %s sets vector property %s, use an update instead", id, key)
+			}
+			if err := dec.Skip(); err != nil {
+				return nil, fmt.Errorf("could not decode metadata value of point %s: %w", id, err)
+			}
+		}
+		points = append(points, models.Point{Id: id, Data: data})
+	}
+	// Sorting keeps the order of the writes independent of the map
+	slices.SortFunc(points, func(a, b models.Point) int {
+		return bytes.Compare(a.Id[:], b.Id[:])
+	})
+	return s.UpdatePoints(ctx, points)
+}
@@ -0,0 +1,24 @@
+package shard
+
+import "time"
+
+/* The shard does not depend on a particular metrics library. Instead it
+ * reports to a MetricsRecorder, for example the cluster node records them as
+ * prometheus metrics. Shards opened without a recorder use a no-op one. */
+
+type MetricsRecorder interface {
+	// The time it took to complete a search including fetching the points.
+	ObserveSearchLatency(latency time.Duration)
+	// The number of graph nodes visited by the vector searches of a query. A
+	// sharp increase often means recall is suffering, for example due to a
+	// poorly connected graph.
+	ObserveGraphHops(hops int)
+	// The number of points inserted.
+	IncInsert(count int)
+}
+
+type noopMetricsRecorder struct{}
+
+func (noopMetricsRecorder) ObserveSearchLatency(time.Duration) {}
+func (noopMetricsRecorder) ObserveGraphHops(int)               {}
+func (noopMetricsRecorder) IncInsert(int)                      {}
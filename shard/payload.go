@@ -0,0 +1,63 @@
+package shard
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+)
+
+/* Payloads are opaque bytes attached to a point, for example the full text of
+ * a document, which are returned on request but never indexed or filtered on.
+ * They are kept in their own bucket away from the point data so that searches,
+ * which decode and select point data, never read them unless asked to.
+ *
+ * Storage map:
+ * payloads:
+ * - <point_uuid>: payload */
+
+const PAYLOADSBUCKETKEY = "payloads"
+
+// putPayloads stores the payloads of the given points. Points without a
+// payload keep their existing one.
+func putPayloads(bucket diskstore.Bucket, points []models.Point) error {
+	for _, point := range points {
+		if len(point.Payload) == 0 {
+			continue
+		}
+		if err := bucket.Put(point.Id[:], point.Payload); err != nil {
+			return fmt.Errorf("could not put payload of %s: %w", point.Id, err)
+		}
+	}
+	return nil
+}
+
+func deletePayloads(bucket diskstore.Bucket, ids ...uuid.UUID) error {
+	for _, id := range ids {
+		if err := bucket.Delete(id[:]); err != nil {
+			return fmt.Errorf("could not delete payload of %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func getPayload(bucket diskstore.ReadOnlyBucket, id uuid.UUID) []byte {
+	// The value is only valid during the transaction so we copy it
+	return bytes.Clone(bucket.Get(id[:]))
+}
+
+// GetPayload returns the payload of a point, it is nil if the point has no
+// payload or does not reside in this shard.
+func (s *Shard) GetPayload(id uuid.UUID) (payload []byte, err error) {
+	err = s.db.Read(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get(PAYLOADSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get payloads bucket: %w", err)
+		}
+		payload = getPayload(b, id)
+		return nil
+	})
+	return
+}
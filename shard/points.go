@@ -4,6 +4,7 @@ package shard
  * is placed under the index package. */
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 
@@ -13,8 +14,6 @@ import (
 	"github.com/semafind/semadb/models"
 )
 
-var ErrPointDoesNotExist = errors.New("point does not exist")
-
 /* The reason we have a ShardPoint struct is because we need to store the node
  * id in the database. Having uint64 ids helps us use more efficient data
  * structures compared to raw UUIDs when traversing the graph. */
@@ -23,12 +22,16 @@ var ErrPointDoesNotExist = errors.New("point does not exist")
 type ShardPoint struct {
 	models.Point
 	NodeId uint64
+	// Set if the point was soft deleted and only its node remains
+	Tombstoned bool
 }
 
 /* Storage map:
  * points:
  * - n<node_id>i: point UUID
  * - n<node_id>d: data
+ * - n<node_id>e: expiry unix time, only for points with a TTL
+ * - n<node_id>t: tombstone of a soft deleted point, see SoftDeletePoints
  * - p<point_uuid>i: node id
  */
 
@@ -40,6 +43,41 @@ func PointKey(id uuid.UUID, suffix byte) []byte {
 	return key[:]
 }
 
+// Used to stop a range scan early once enough points are collected
+var errScanLimitReached = errors.New("scan limit reached")
+
+// ScanPoints returns up to limit points ordered by their UUID. If after is not
+// nil, only points strictly after it are returned, this allows paging through
+// the points. The returned point data is copied so it outlives the
+// transaction.
+func ScanPoints(bucket diskstore.ReadOnlyBucket, after *uuid.UUID, limit int) ([]models.Point, error) {
+	points := make([]models.Point, 0, limit)
+	// The point id keys p<uuid>i are ordered by uuid
+	start := []byte{'p'}
+	if after != nil {
+		start = PointKey(*after, 'i')
+	}
+	err := bucket.RangeScan(start, []byte{'q'}, false, func(k, v []byte) error {
+		if len(points) >= limit {
+			return errScanLimitReached
+		}
+		if len(k) != 18 || k[17] != 'i' {
+			return nil
+		}
+		pointId := uuid.UUID(k[1:17])
+		sp, err := GetPointByUUID(bucket, pointId)
+		if err != nil {
+			return fmt.Errorf("could not get point %s: %w", pointId, err)
+		}
+		points = append(points, models.Point{Id: pointId, Data: bytes.Clone(sp.Data), ExpiresAt: sp.ExpiresAt})
+		return nil
+	})
+	if err != nil && err != errScanLimitReached {
+		return nil, err
+	}
+	return points, nil
+}
+
 func SetPoint(bucket diskstore.Bucket, point ShardPoint) error {
 	// ---------------------------
 	// Set matching ids
@@ -60,9 +98,33 @@ func SetPoint(bucket diskstore.Bucket, point ShardPoint) error {
 			return fmt.Errorf("could not delete empty point data: %w", err)
 		}
 	}
+	// ---------------------------
+	if point.ExpiresAt != 0 {
+		if err := bucket.Put(conversion.NodeKey(point.NodeId, 'e'), conversion.Uint64ToBytes(uint64(point.ExpiresAt))); err != nil {
+			return fmt.Errorf("could not set point expiry: %w", err)
+		}
+	} else {
+		if err := bucket.Delete(conversion.NodeKey(point.NodeId, 'e')); err != nil {
+			return fmt.Errorf("could not delete point expiry: %w", err)
+		}
+	}
 	return nil
 }
 
+func getExpiresAt(bucket diskstore.ReadOnlyBucket, nodeId uint64) int64 {
+	expiresAt := bucket.Get(conversion.NodeKey(nodeId, 'e'))
+	if expiresAt == nil {
+		return 0
+	}
+	return int64(conversion.BytesToUint64(expiresAt))
+}
+
+// isExpired reports whether the point has a TTL that ended at or before now,
+// given in unix seconds.
+func (sp ShardPoint) isExpired(now int64) bool {
+	return sp.ExpiresAt != 0 && sp.ExpiresAt <= now
+}
+
 func CheckPointExists(bucket diskstore.ReadOnlyBucket, pointId uuid.UUID) (bool, error) {
 	v := bucket.Get(PointKey(pointId, 'i'))
 	return v != nil, nil
@@ -71,7 +133,7 @@ func CheckPointExists(bucket diskstore.ReadOnlyBucket, pointId uuid.UUID) (bool,
 func GetPointNodeIdByUUID(bucket diskstore.ReadOnlyBucket, pointId uuid.UUID) (uint64, error) {
 	nodeIdBytes := bucket.Get(PointKey(pointId, 'i'))
 	if nodeIdBytes == nil {
-		return 0, ErrPointDoesNotExist
+		return 0, ErrPointNotFound
 	}
 	nodeId := conversion.BytesToUint64(nodeIdBytes)
 	return nodeId, nil
@@ -85,8 +147,9 @@ func GetPointByUUID(bucket diskstore.ReadOnlyBucket, pointId uuid.UUID) (ShardPo
 	data := bucket.Get(conversion.NodeKey(nodeId, 'd'))
 	sp := ShardPoint{
 		Point: models.Point{
-			Id:   pointId,
-			Data: data,
+			Id:        pointId,
+			Data:      data,
+			ExpiresAt: getExpiresAt(bucket, nodeId),
 		},
 		NodeId: nodeId,
 	}
@@ -96,7 +159,7 @@ func GetPointByUUID(bucket diskstore.ReadOnlyBucket, pointId uuid.UUID) (ShardPo
 func GetPointByNodeId(bucket diskstore.ReadOnlyBucket, nodeId uint64) (ShardPoint, error) {
 	pointIdBytes := bucket.Get(conversion.NodeKey(nodeId, 'i'))
 	if pointIdBytes == nil {
-		return ShardPoint{}, ErrPointDoesNotExist
+		return ShardPoint{}, ErrPointNotFound
 	}
 	pointId, err := uuid.FromBytes(pointIdBytes)
 	if err != nil {
@@ -105,10 +168,12 @@ func GetPointByNodeId(bucket diskstore.ReadOnlyBucket, nodeId uint64) (ShardPoin
 	data := bucket.Get(conversion.NodeKey(nodeId, 'd'))
 	sp := ShardPoint{
 		Point: models.Point{
-			Id:   pointId,
-			Data: data,
+			Id:        pointId,
+			Data:      data,
+			ExpiresAt: getExpiresAt(bucket, nodeId),
 		},
-		NodeId: nodeId,
+		NodeId:     nodeId,
+		Tombstoned: bucket.Get(conversion.NodeKey(nodeId, 't')) != nil,
 	}
 	return sp, nil
 }
@@ -123,5 +188,8 @@ func DeletePoint(bucket diskstore.Bucket, pointId uuid.UUID, nodeId uint64) erro
 	if err := bucket.Delete(conversion.NodeKey(nodeId, 'd')); err != nil {
 		return fmt.Errorf("could not delete point data: %w", err)
 	}
+	if err := bucket.Delete(conversion.NodeKey(nodeId, 'e')); err != nil {
+		return fmt.Errorf("could not delete point expiry: %w", err)
+	}
 	return nil
 }
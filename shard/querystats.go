@@ -0,0 +1,246 @@
+package shard
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/* The query log records a sample of search requests so we can understand the
+ * query patterns of a shard for capacity planning. Recording happens off the
+ * search path, the search only attempts a non-blocking send to a buffered
+ * channel and a background goroutine batches the records into the query stats
+ * bucket. If the channel is full the record is dropped, we would rather lose a
+ * sample than slow down a search.
+ *
+ * Storage map:
+ * queryStats:
+ * - <unix_nano><sequence>: msgpack encoded queryRecord
+ *
+ * The keys are big endian so they are ordered by time which allows range scans
+ * over a window and pruning of old records from the front of the bucket. */
+
+const QUERYSTATSBUCKETKEY = "queryStats"
+
+// How many records can be waiting to be written before we start dropping them.
+const queryLogBufferSize = 1024
+
+type queryRecord struct {
+	QueryHash   uint64
+	Limit       int
+	Latency     time.Duration
+	ResultCount int
+	Timestamp   int64
+}
+
+type QueryStats struct {
+	// Number of recorded queries in the window
+	QueryCount int
+	// Recorded queries per second over the window, this is sampled so scale by
+	// the sample rate to estimate the actual rate.
+	QPS           float64
+	P50Latency    time.Duration
+	P99Latency    time.Duration
+	AvgResults    float64
+	AvgLimit      float64
+	UniqueQueries int
+}
+
+type queryLogger struct {
+	logger     zerolog.Logger
+	sampleRate float64
+	retention  time.Duration
+	recordC    chan queryRecord
+	// Guards sending on recordC against it being closed, searches may still
+	// be recording while the shard closes.
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+	// Used to break ties between records with the same timestamp, only
+	// accessed by the writer goroutine.
+	sequence uint64
+}
+
+func newQueryLogger(db diskstore.DiskStore, userPlan models.UserPlan, logger zerolog.Logger) *queryLogger {
+	if userPlan.QueryStatsSampleRate <= 0 {
+		return nil
+	}
+	ql := &queryLogger{
+		logger:     logger,
+		sampleRate: min(userPlan.QueryStatsSampleRate, 1),
+		retention:  time.Duration(userPlan.QueryStatsRetention) * time.Second,
+		recordC:    make(chan queryRecord, queryLogBufferSize),
+	}
+	ql.wg.Add(1)
+	go ql.run(db)
+	return ql
+}
+
+func hashQuery(q models.Query) uint64 {
+	h := fnv.New64a()
+	// The query options are plain structs so encoding should not fail, if it
+	// does we still record the query with an empty hash.
+	if b, err := msgpack.Marshal(q); err == nil {
+		h.Write(b)
+	}
+	return h.Sum64()
+}
+
+// record samples and queues a search for writing without blocking.
+func (ql *queryLogger) record(searchRequest models.SearchRequest, latency time.Duration, resultCount int) {
+	if ql == nil || rand.Float64() >= ql.sampleRate {
+		return
+	}
+	qr := queryRecord{
+		QueryHash:   hashQuery(searchRequest.Query),
+		Limit:       searchRequest.Limit,
+		Latency:     latency,
+		ResultCount: resultCount,
+		Timestamp:   time.Now().UnixNano(),
+	}
+	ql.mu.RLock()
+	defer ql.mu.RUnlock()
+	if ql.closed {
+		return
+	}
+	select {
+	case ql.recordC <- qr:
+	default:
+	}
+}
+
+func (ql *queryLogger) run(db diskstore.DiskStore) {
+	defer ql.wg.Done()
+	for qr := range ql.recordC {
+		// Drain whatever else is waiting so we write in batches
+		batch := []queryRecord{qr}
+	drain:
+		for {
+			select {
+			case next, ok := <-ql.recordC:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+		if err := ql.write(db, batch); err != nil {
+			// There is no one to return the error to, the query log is best
+			// effort.
+			ql.logger.Error().Err(err).Int("count", len(batch)).Msg("could not write query log")
+		}
+	}
+}
+
+func (ql *queryLogger) write(db diskstore.DiskStore, batch []queryRecord) error {
+	return db.Write(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get(QUERYSTATSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get query stats bucket: %w", err)
+		}
+		for _, qr := range batch {
+			value, err := msgpack.Marshal(qr)
+			if err != nil {
+				return fmt.Errorf("could not encode query record: %w", err)
+			}
+			ql.sequence++
+			if err := b.Put(queryRecordKey(qr.Timestamp, ql.sequence), value); err != nil {
+				return fmt.Errorf("could not put query record: %w", err)
+			}
+		}
+		// ---------------------------
+		// Prune records that fall outside the retention period
+		if ql.retention <= 0 {
+			return nil
+		}
+		cutoff := queryRecordKey(time.Now().Add(-ql.retention).UnixNano(), 0)
+		expiredKeys := make([][]byte, 0)
+		err = b.RangeScan(nil, cutoff, false, func(k, v []byte) error {
+			expiredKeys = append(expiredKeys, slices.Clone(k))
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not scan expired query records: %w", err)
+		}
+		for _, k := range expiredKeys {
+			if err := b.Delete(k); err != nil {
+				return fmt.Errorf("could not delete expired query record: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// close stops accepting records and waits for the pending ones to be written.
+func (ql *queryLogger) close() {
+	if ql == nil {
+		return
+	}
+	ql.mu.Lock()
+	if !ql.closed {
+		ql.closed = true
+		close(ql.recordC)
+	}
+	ql.mu.Unlock()
+	ql.wg.Wait()
+}
+
+func queryRecordKey(timestamp int64, sequence uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(timestamp))
+	binary.BigEndian.PutUint64(key[8:], sequence)
+	return key
+}
+
+// ---------------------------
+
+// QueryStats aggregates the recorded queries over the last window duration. If
+// the query log is disabled, the stats will be empty.
+func (s *Shard) QueryStats(window time.Duration) (qs QueryStats, err error) {
+	now := time.Now()
+	start := queryRecordKey(now.Add(-window).UnixNano(), 0)
+	latencies := make([]time.Duration, 0)
+	uniqueQueries := make(map[uint64]struct{})
+	var totalResults, totalLimit int
+	err = s.db.Read(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get(QUERYSTATSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get query stats bucket: %w", err)
+		}
+		return b.RangeScan(start, nil, true, func(k, v []byte) error {
+			var qr queryRecord
+			if err := msgpack.Unmarshal(v, &qr); err != nil {
+				return fmt.Errorf("could not decode query record: %w", err)
+			}
+			latencies = append(latencies, qr.Latency)
+			uniqueQueries[qr.QueryHash] = struct{}{}
+			totalResults += qr.ResultCount
+			totalLimit += qr.Limit
+			return nil
+		})
+	})
+	if err != nil || len(latencies) == 0 {
+		return
+	}
+	// ---------------------------
+	slices.Sort(latencies)
+	qs.QueryCount = len(latencies)
+	qs.QPS = float64(qs.QueryCount) / window.Seconds()
+	qs.P50Latency = latencies[(len(latencies)-1)*50/100]
+	qs.P99Latency = latencies[(len(latencies)-1)*99/100]
+	qs.AvgResults = float64(totalResults) / float64(qs.QueryCount)
+	qs.AvgLimit = float64(totalLimit) / float64(qs.QueryCount)
+	qs.UniqueQueries = len(uniqueQueries)
+	return
+}
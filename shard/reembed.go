@@ -0,0 +1,196 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/* Re-embedding replaces the vector of a property for every point in the shard,
+ * for example after the embedding model is upgraded. The pass walks the points
+ * in id order in batches: a batch of points is handed out, the caller computes
+ * new vectors and hands them back, and the vectors are written using a regular
+ * update so the indexes are updated incrementally. The id of the last
+ * re-embedded point is persisted in the internal bucket so an interrupted pass
+ * resumes where it left off rather than starting again.
+ *
+ * Storage map:
+ * internal:
+ * - reEmbedCursor/<property>: point uuid of the last re-embedded point */
+
+// Computes the new vectors of the given points, the vectors must be in the
+// same order as the points.
+type ReEmbedFunc func(ctx context.Context, points []models.Point) ([][]float32, error)
+
+type ReEmbedOptions struct {
+	// The vector property to re-embed
+	Property string
+	// Number of points handed to the re-embed function at a time
+	BatchSize int
+	// Minimum time between the start of two batches, used to rate limit the
+	// pass so it does not starve regular traffic. Zero means no limit.
+	BatchInterval time.Duration
+}
+
+func reEmbedCursorKey(property string) []byte {
+	return []byte("reEmbedCursor/" + property)
+}
+
+func (s *Shard) checkReEmbedProperty(property string) (uint, error) {
+	iparams, ok := s.collection.IndexSchema[property]
+	if !ok {
+		return 0, fmt.Errorf("property %s not found in index schema", property)
+	}
+	switch {
+	case iparams.VectorVamana != nil:
+		return iparams.VectorVamana.VectorSize, nil
+	case iparams.VectorFlat != nil:
+		return iparams.VectorFlat.VectorSize, nil
+	}
+	return 0, fmt.Errorf("property %s is not a vector index", property)
+}
+
+// ReEmbedBatch returns the next batch of points to re-embed for the given
+// property. An empty batch means the pass is complete, in that case the
+// persisted progress is cleared so the next pass starts from the beginning.
+func (s *Shard) ReEmbedBatch(property string, batchSize int) ([]models.Point, error) {
+	if _, err := s.checkReEmbedProperty(property); err != nil {
+		return nil, err
+	}
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("batch size must be positive, got %d", batchSize)
+	}
+	var points []models.Point
+	err := s.db.Read(func(bm diskstore.BucketManager) error {
+		bInternal, err := bm.Get(INTERNALBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get internal bucket: %w", err)
+		}
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		// ---------------------------
+		var after *uuid.UUID
+		if cursor := bInternal.Get(reEmbedCursorKey(property)); cursor != nil {
+			cursorId := uuid.UUID(cursor)
+			after = &cursorId
+		}
+		points, err = ScanPoints(bPoints, after, batchSize)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not get re-embed batch: %w", err)
+	}
+	// ---------------------------
+	if len(points) == 0 {
+		err = s.db.Write(func(bm diskstore.BucketManager) error {
+			bInternal, err := bm.Get(INTERNALBUCKETKEY)
+			if err != nil {
+				return fmt.Errorf("could not get internal bucket: %w", err)
+			}
+			return bInternal.Delete(reEmbedCursorKey(property))
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not clear re-embed cursor: %w", err)
+		}
+	}
+	return points, nil
+}
+
+// ApplyReEmbed writes the new vectors of the given points and advances the
+// re-embedding progress past them. Points that have been deleted in the
+// meantime are skipped.
+func (s *Shard) ApplyReEmbed(property string, pointIds []uuid.UUID, vectors [][]float32) error {
+	vectorSize, err := s.checkReEmbedProperty(property)
+	if err != nil {
+		return err
+	}
+	if len(pointIds) != len(vectors) {
+		return fmt.Errorf("got %d vectors for %d points", len(vectors), len(pointIds))
+	}
+	if len(pointIds) == 0 {
+		return nil
+	}
+	// ---------------------------
+	updatePoints := make([]models.Point, len(pointIds))
+	for i, pointId := range pointIds {
+		if len(vectors[i]) != int(vectorSize) {
+			return fmt.Errorf("vector of point %s has size %d, expected %d", pointId, len(vectors[i]), vectorSize)
+		}
+		/* Updates merge the incoming data with the existing data so we only
+		 * need to send the property we are replacing. */
+		data, err := msgpack.Marshal(models.PointAsMap{property: vectors[i]})
+		if err != nil {
+			return fmt.Errorf("could not encode vector of point %s: %w", pointId, err)
+		}
+		updatePoints[i] = models.Point{Id: pointId, Data: data}
+	}
+	if _, err := s.UpdatePoints(context.Background(), updatePoints); err != nil {
+		return fmt.Errorf("could not update re-embedded points: %w", err)
+	}
+	// ---------------------------
+	lastId := slices.MaxFunc(pointIds, func(a, b uuid.UUID) int {
+		return slices.Compare(a[:], b[:])
+	})
+	err = s.db.Write(func(bm diskstore.BucketManager) error {
+		bInternal, err := bm.Get(INTERNALBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get internal bucket: %w", err)
+		}
+		return bInternal.Put(reEmbedCursorKey(property), lastId[:])
+	})
+	if err != nil {
+		return fmt.Errorf("could not save re-embed cursor: %w", err)
+	}
+	return nil
+}
+
+// ReEmbed drives a re-embedding pass over the shard using the given function.
+// If the pass is interrupted, by an error or the context being cancelled,
+// calling it again resumes from the last completed batch. It returns the
+// number of points re-embedded in this call.
+func (s *Shard) ReEmbed(ctx context.Context, opts ReEmbedOptions, reEmbedFn ReEmbedFunc) (int, error) {
+	count := 0
+	for {
+		batchStart := time.Now()
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		points, err := s.ReEmbedBatch(opts.Property, opts.BatchSize)
+		if err != nil {
+			return count, err
+		}
+		if len(points) == 0 {
+			return count, nil
+		}
+		// ---------------------------
+		vectors, err := reEmbedFn(ctx, points)
+		if err != nil {
+			return count, fmt.Errorf("could not re-embed points: %w", err)
+		}
+		pointIds := make([]uuid.UUID, len(points))
+		for i, p := range points {
+			pointIds[i] = p.Id
+		}
+		if err := s.ApplyReEmbed(opts.Property, pointIds, vectors); err != nil {
+			return count, err
+		}
+		count += len(points)
+		s.logger.Debug().Int("count", count).Str("property", opts.Property).Msg("ReEmbed")
+		// ---------------------------
+		if wait := opts.BatchInterval - time.Since(batchStart); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return count, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package shard
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/semafind/semadb/distance"
+	"github.com/semafind/semadb/models"
+)
+
+/* Quantized vector indexes compute approximate distances, so the nearest
+ * points according to the index may be slightly out of order or miss a few of
+ * the true nearest points. Re-ranking fetches more candidates than asked for
+ * from the index and recomputes their distances exactly from the vectors in the
+ * point data, which is cheap compared to searching with full vectors. Only a
+ * top level vector query is re-ranked because nested queries only contribute
+ * a set of points. */
+
+type rerankOptions struct {
+	property string
+	vector   []float32
+	distFn   distance.FloatDistFunc
+	limit    int
+	weight   float32
+	// Point vectors are normalised like the index does before comparing
+	normalize bool
+}
+
+// normalizesVectors reports whether the graph index normalises the vectors it
+// indexes and searches with, exact distances must then use unit vectors too.
+func normalizesVectors(params *models.IndexVectorVamanaParameters) bool {
+	return params != nil && params.AutoNormalize && params.DistanceMetric == models.DistanceCosine
+}
+
+// widenRerankQuery returns the query with its limit multiplied by the rerank
+// factor along with what is needed to re-rank the results. It returns nil
+// options if the query does not ask for re-ranking.
+func widenRerankQuery(q models.Query, schema models.IndexSchema) (models.Query, *rerankOptions, error) {
+	params := schema[q.Property]
+	var rerank *models.SearchVectorRerankOptions
+	var metric string
+	ro := &rerankOptions{property: q.Property, weight: 1}
+	var weight *float32
+	switch {
+	case q.VectorVamana != nil && q.VectorVamana.Rerank != nil:
+		opts := *q.VectorVamana
+		rerank, metric = opts.Rerank, params.VectorVamana.DistanceMetric
+		ro.vector, ro.limit, weight = opts.Vector, opts.Limit, opts.Weight
+		if ro.normalize = normalizesVectors(params.VectorVamana); ro.normalize {
+			ro.vector = slices.Clone(ro.vector)
+			distance.Normalize(ro.vector)
+		}
+		if opts.SearchSize == 0 {
+			opts.SearchSize = params.VectorVamana.SearchSize
+		}
+		opts.Limit *= rerank.Factor
+		opts.SearchSize = max(opts.SearchSize, opts.Limit)
+		q.VectorVamana = &opts
+	case q.VectorFlat != nil && q.VectorFlat.Rerank != nil:
+		opts := *q.VectorFlat
+		rerank, metric = opts.Rerank, params.VectorFlat.DistanceMetric
+		ro.vector, ro.limit, weight = opts.Vector, opts.Limit, opts.Weight
+		opts.Limit *= rerank.Factor
+		q.VectorFlat = &opts
+	default:
+		return q, nil, nil
+	}
+	if weight != nil {
+		ro.weight = *weight
+	}
+	// ---------------------------
+	distFn, err := distance.GetFloatDistanceFn(metric)
+	if err != nil {
+		return q, nil, fmt.Errorf("cannot rerank property %s: %w", q.Property, err)
+	}
+	ro.distFn = distFn
+	return q, ro, nil
+}
+
+// rerankResults replaces the distances of the results with exact ones, sorts
+// them and keeps the closest limit results.
+func rerankResults(results []models.SearchResult, ro *rerankOptions) ([]models.SearchResult, error) {
+	for i := range results {
+		vector, err := pointVector(results[i].Point.Data, ro.property)
+		if err != nil {
+			return nil, fmt.Errorf("could not get vector of point %s: %w", results[i].Point.Id, err)
+		}
+		if len(vector) != len(ro.vector) {
+			return nil, fmt.Errorf("vector of point %s has size %d, expected %d", results[i].Point.Id, len(vector), len(ro.vector))
+		}
+		if ro.normalize {
+			distance.Normalize(vector)
+		}
+		dist := ro.distFn(ro.vector, vector)
+		results[i].Distance = &dist
+		results[i].HybridScore = -1 * dist * ro.weight
+	}
+	slices.SortStableFunc(results, func(a, b models.SearchResult) int {
+		return cmp.Compare(*a.Distance, *b.Distance)
+	})
+	return results[:min(len(results), ro.limit)], nil
+}
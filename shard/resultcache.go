@@ -0,0 +1,160 @@
+package shard
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+)
+
+/* Some clients such as polling dashboards issue the exact same search over
+ * and over. The result cache keeps the results of the most recent searches,
+ * keyed by a hash of the whole search request, so a repeated search is
+ * answered without touching the indexes. The request rather than just the
+ * query vector and limit is hashed because the property, offset, sort and
+ * selected fields all change the results.
+ *
+ * Any write to the shard clears the cache, there is no finer invalidation as
+ * a single insert may change the results of any vector search. Each write also
+ * bumps a version that searches read before they start, results are only
+ * cached if no write committed whilst the search ran so stale results never
+ * enter the cache. The cache is off by default because it holds on to the
+ * returned points including their data.
+ *
+ * Points with a TTL drop out of searches without a write, so an entry also
+ * keeps the earliest expiry of the candidates of the search and is stale from
+ * then on. Points outside the candidates expiring cannot change the results. */
+
+type resultCacheKey [sha256.Size]byte
+
+type resultCacheEntry struct {
+	key     resultCacheKey
+	results []models.SearchResult
+	count   int
+	// Earliest expiry of the candidates in unix seconds, zero if none expire
+	expiresAt int64
+}
+
+type resultCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[resultCacheKey]*list.Element
+	// Most recently used entries are at the front
+	order   *list.List
+	version atomic.Uint64
+}
+
+func newResultCache(size int) *resultCache {
+	return &resultCache{
+		size:    size,
+		entries: make(map[resultCacheKey]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+// requestKey hashes the search request, false means it cannot be cached.
+func requestKey(searchRequest models.SearchRequest) (resultCacheKey, bool) {
+	// Struct fields are encoded in order so equal requests hash the same
+	encoded, err := json.Marshal(searchRequest)
+	if err != nil {
+		return resultCacheKey{}, false
+	}
+	return sha256.Sum256(encoded), true
+}
+
+func (rc *resultCache) get(key resultCacheKey) ([]models.SearchResult, int, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	elem, ok := rc.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	entry := elem.Value.(*resultCacheEntry)
+	if entry.expiresAt != 0 && entry.expiresAt <= time.Now().Unix() {
+		rc.order.Remove(elem)
+		delete(rc.entries, key)
+		return nil, 0, false
+	}
+	rc.order.MoveToFront(elem)
+	return cloneResults(entry.results), entry.count, true
+}
+
+// put caches the results of a search that started at the given version,
+// expiresAt is the earliest expiry of its candidates.
+func (rc *resultCache) put(key resultCacheKey, version uint64, results []models.SearchResult, count int, expiresAt int64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.version.Load() != version {
+		return
+	}
+	if elem, ok := rc.entries[key]; ok {
+		rc.order.MoveToFront(elem)
+		return
+	}
+	entry := &resultCacheEntry{key: key, results: cloneResults(results), count: count, expiresAt: expiresAt}
+	rc.entries[key] = rc.order.PushFront(entry)
+	for rc.order.Len() > rc.size {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*resultCacheEntry).key)
+	}
+}
+
+// cloneResults copies the results so that neither the cache nor the caller
+// sees modifications of the other. Nested values of the decoded data, such as
+// vectors, are still shared and must not be modified in place.
+func cloneResults(results []models.SearchResult) []models.SearchResult {
+	cloned := make([]models.SearchResult, len(results))
+	for i, r := range results {
+		r.Data = bytes.Clone(r.Data)
+		r.Payload = bytes.Clone(r.Payload)
+		r.DecodedData = maps.Clone(r.DecodedData)
+		if r.Distance != nil {
+			distance := *r.Distance
+			r.Distance = &distance
+		}
+		if r.Score != nil {
+			score := *r.Score
+			r.Score = &score
+		}
+		cloned[i] = r
+	}
+	return cloned
+}
+
+func (rc *resultCache) invalidate() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.version.Add(1)
+	clear(rc.entries)
+	rc.order.Init()
+}
+
+// ---------------------------
+
+// versionedStore invalidates the result cache after every write transaction,
+// whether it committed or not.
+type versionedStore struct {
+	diskstore.DiskStore
+	cache *resultCache
+}
+
+func (vs versionedStore) Write(f func(diskstore.BucketManager) error) error {
+	defer vs.cache.invalidate()
+	return vs.DiskStore.Write(f)
+}
+
+// unversioned returns the store underneath the result cache, if any.
+func unversioned(db diskstore.DiskStore) diskstore.DiskStore {
+	if vs, ok := db.(versionedStore); ok {
+		return vs.DiskStore
+	}
+	return db
+}
@@ -0,0 +1,76 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// SearchByPointId returns the k points closest to the stored vector of the
+// given point, i.e. more like this, excluding the point itself. The search
+// runs on the graph index of the collection so the schema must have exactly
+// one. It returns ErrPointNotFound if the point is not in the shard.
+func (s *Shard) SearchByPointId(ctx context.Context, pointId uuid.UUID, k int) ([]models.SearchResult, error) {
+	property, params, err := vamanaProperty(s.collection.IndexSchema)
+	if err != nil {
+		return nil, fmt.Errorf("could not search by point id: %w", err)
+	}
+	// ---------------------------
+	var vector []float32
+	err = s.db.Read(func(bm diskstore.BucketManager) error {
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		sp, err := GetPointByUUID(bPoints, pointId)
+		if err != nil {
+			return err
+		}
+		var props map[string]msgpack.RawMessage
+		if err := msgpack.Unmarshal(sp.Data, &props); err != nil {
+			return fmt.Errorf("could not decode point data: %w", err)
+		}
+		raw, ok := props[property]
+		if !ok {
+			return fmt.Errorf("point %s has no vector for property %s", pointId, property)
+		}
+		if err := msgpack.Unmarshal(raw, &vector); err != nil {
+			return fmt.Errorf("could not decode vector of property %s: %w", property, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not get query point %s: %w", pointId, err)
+	}
+	// ---------------------------
+	// The query point is its own nearest neighbour so we ask for one more
+	sr := models.SearchRequest{
+		Query: models.Query{
+			Property: property,
+			VectorVamana: &models.SearchVectorVamanaOptions{
+				Vector:     vector,
+				Operator:   "near",
+				SearchSize: max(params.SearchSize, k+1),
+				Limit:      k + 1,
+			},
+		},
+		Limit: k + 1,
+	}
+	results, err := s.SearchPoints(ctx, sr)
+	if err != nil {
+		return nil, fmt.Errorf("could not search by point id: %w", err)
+	}
+	// Duplicate vectors may rank other points at distance 0 too, so the query
+	// point is not necessarily first.
+	filtered := make([]models.SearchResult, 0, k)
+	for _, r := range results {
+		if r.Point.Id != pointId && len(filtered) < k {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered, nil
+}
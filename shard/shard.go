@@ -3,7 +3,9 @@ package shard
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,6 +16,7 @@ import (
 	"github.com/semafind/semadb/models"
 	"github.com/semafind/semadb/shard/cache"
 	"github.com/semafind/semadb/shard/index"
+	"github.com/semafind/semadb/shard/index/vamana"
 	"github.com/semafind/semadb/utils"
 	"github.com/vmihailenco/msgpack/v5"
 )
@@ -24,7 +27,16 @@ type Shard struct {
 	collection models.Collection
 	// ---------------------------
 	cacheManager *cache.Manager
-	logger       zerolog.Logger
+	// Prefix of the cached indexes of this shard in the shared cache
+	cacheRoot   string
+	queryLogger *queryLogger
+	logger      zerolog.Logger
+	metrics     MetricsRecorder
+	readOnly    bool
+	// Nil unless the shard was opened with WithResultCache
+	resultCache *resultCache
+	// Encrypts the point data, payloads and vectors, nil for plain shards
+	vc *valueCipher
 }
 
 // ---------------------------
@@ -47,37 +59,234 @@ const DELETEVALUE = "_delete"
 
 // ---------------------------
 
-func NewShard(dbFile string, collection models.Collection, cacheManager *cache.Manager) (*Shard, error) {
+type shardOptions struct {
+	db        diskstore.Options
+	metrics   MetricsRecorder
+	startSeed int64
+	// Number of search results cached, 0 disables the result cache
+	resultCacheSize int
+}
+
+// ShardOption changes how the shard is opened.
+type ShardOption func(*shardOptions)
+
+// WithTimeout sets how long to wait for another process to release the shard
+// file before failing, the default is a minute.
+func WithTimeout(timeout time.Duration) ShardOption {
+	return func(o *shardOptions) {
+		o.db.Timeout = timeout
+	}
+}
+
+// WithReadOnly opens the shard read-only so multiple processes can share the
+// same file, for example read replicas. Inserts, updates and deletes then fail
+// with diskstore.ErrReadOnly.
+func WithReadOnly() ShardOption {
+	return func(o *shardOptions) {
+		o.db.ReadOnly = true
+	}
+}
+
+// WithNoFreelistSync skips syncing the free page list to disk on every write.
+func WithNoFreelistSync() ShardOption {
+	return func(o *shardOptions) {
+		o.db.NoFreelistSync = true
+	}
+}
+
+// WithNoSync skips the fsync after every write so that inserts only wait for
+// the operating system page cache. A power loss may then lose recent writes or
+// corrupt the shard, so it is only for benchmarks and ephemeral data. It is off
+// by default.
+func WithNoSync() ShardOption {
+	return func(o *shardOptions) {
+		o.db.NoSync = true
+	}
+}
+
+// WithInitialMmapSize maps the given number of bytes of the shard file up
+// front so that writes growing the file do not wait for a running backup.
+func WithInitialMmapSize(size int) ShardOption {
+	return func(o *shardOptions) {
+		o.db.InitialMmapSize = size
+	}
+}
+
+// WithMetricsRecorder reports search and insert metrics of the shard to the
+// given recorder.
+func WithMetricsRecorder(metrics MetricsRecorder) ShardOption {
+	return func(o *shardOptions) {
+		o.metrics = metrics
+	}
+}
+
+// WithStartSeed seeds the random start vectors of the graph indexes that the
+// shard creates, so that tests get the same start vectors on every run.
+func WithStartSeed(seed int64) ShardOption {
+	return func(o *shardOptions) {
+		o.startSeed = seed
+	}
+}
+
+// WithResultCache caches the results of up to size distinct searches until
+// the next write to the shard, see resultcache.go. It is off by default.
+func WithResultCache(size int) ShardOption {
+	return func(o *shardOptions) {
+		o.resultCacheSize = size
+	}
+}
+
+// seededSchema returns a copy of the schema whose graph indexes use the start
+// seed, the schema of the caller is left as is.
+func seededSchema(schema models.IndexSchema, seed int64) models.IndexSchema {
+	seeded := make(models.IndexSchema, len(schema))
+	for property, params := range schema {
+		if params.Type == models.IndexTypeVectorVamana && params.VectorVamana != nil {
+			vv := *params.VectorVamana
+			vv.StartSeed = seed
+			params.VectorVamana = &vv
+		}
+		seeded[property] = params
+	}
+	return seeded
+}
+
+func NewShard(dbFile string, collection models.Collection, cacheManager *cache.Manager, opts ...ShardOption) (*Shard, error) {
+	return newShard(dbFile, collection, cacheManager, nil, opts)
+}
+
+// NewEncryptedShard opens a shard whose point data, payloads and vectors are
+// encrypted at rest with the given key, see encryption.go. The keys of the
+// text, string and number indexes stay plaintext. A new shard adopts the key,
+// an existing shard must have been created with the same key.
+func NewEncryptedShard(dbFile string, collection models.Collection, cacheManager *cache.Manager, key []byte, opts ...ShardOption) (*Shard, error) {
+	vc, err := newValueCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create shard cipher: %w", err)
+	}
+	return newShard(dbFile, collection, cacheManager, vc, opts)
+}
+
+func applyShardOptions(opts []ShardOption) shardOptions {
+	shardOpts := shardOptions{
+		db:      diskstore.DefaultOptions,
+		metrics: noopMetricsRecorder{},
+	}
+	for _, opt := range opts {
+		opt(&shardOpts)
+	}
+	return shardOpts
+}
+
+func newShard(dbFile string, collection models.Collection, cacheManager *cache.Manager, vc *valueCipher, opts []ShardOption) (*Shard, error) {
 	// ---------------------------
-	db, err := diskstore.Open(dbFile)
+	if err := checkDistanceMetrics(collection.IndexSchema); err != nil {
+		return nil, fmt.Errorf("invalid index schema: %w", err)
+	}
+	shardOpts := applyShardOptions(opts)
+	db, err := diskstore.OpenWithOptions(dbFile, shardOpts.db)
 	if err != nil {
 		return nil, fmt.Errorf("could not open shard db: %w", err)
 	}
+	if err := checkEncryptionKey(db, vc); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !shardOpts.db.ReadOnly {
+		if err := persistCollection(db, collection); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if vc != nil {
+		db = newEncryptedStore(db, vc)
+	}
+	// The query log is written to the store underneath so that recording a
+	// search does not clear the result cache
+	queryLogDB := db
+	var rc *resultCache
+	if shardOpts.resultCacheSize > 0 {
+		rc = newResultCache(shardOpts.resultCacheSize)
+		db = versionedStore{DiskStore: db, cache: rc}
+	}
+	if shardOpts.startSeed != 0 {
+		collection.IndexSchema = seededSchema(collection.IndexSchema, shardOpts.startSeed)
+	}
 	// ---------------------------
 	if cacheManager == nil {
 		// 0 means no cache, every operation will get blank cache and discard it
 		cacheManager = cache.NewManager(0)
 	}
 	// ---------------------------
+	// In memory shards have no file name to tell them apart in the cache
+	cacheRoot := dbFile
+	if dbFile == "" {
+		cacheRoot = "memory/" + uuid.NewString()
+	}
+	// ---------------------------
+	logger := log.With().Str("component", "shard").Str("name", dbFile).Logger()
 	shard := &Shard{
 		dbFile:       dbFile, // An alternative could be db.Path()
+		cacheRoot:    cacheRoot,
 		db:           db,
 		collection:   collection,
 		cacheManager: cacheManager,
-		logger:       log.With().Str("component", "shard").Str("name", dbFile).Logger(),
+		logger:       logger,
+		metrics:      shardOpts.metrics,
+		readOnly:     shardOpts.db.ReadOnly,
+		resultCache:  rc,
+		vc:           vc,
+	}
+	// A read-only shard has nowhere to write the query log
+	if !shard.readOnly {
+		shard.queryLogger = newQueryLogger(queryLogDB, collection.UserPlan, logger)
 	}
 	return shard, nil
 }
 
 func (s *Shard) Close() error {
-	s.cacheManager.Release(s.dbFile)
+	// Pending query records must be written before the db is closed
+	s.queryLogger.close()
+	s.cacheManager.Release(s.cacheRoot)
 	return s.db.Close()
 }
 
 func (s *Shard) Backup(backupFrequency, backupCount int) error {
+	if s.dbFile == "" {
+		return fmt.Errorf("cannot backup in-memory shard: %w", diskstore.ErrInMemory)
+	}
 	return utils.BackupBBolt(s.db, backupFrequency, backupCount)
 }
 
+// BackupTo streams a consistent copy of the shard database to the writer, for
+// example to upload it straight to object storage, and returns the number of
+// bytes written. Writes to the shard are not blocked whilst the copy runs.
+func (s *Shard) BackupTo(w io.Writer) (int64, error) {
+	if s.dbFile == "" {
+		return 0, fmt.Errorf("cannot backup in-memory shard: %w", diskstore.ErrInMemory)
+	}
+	startTime := time.Now()
+	n, err := s.db.BackupTo(w)
+	if err != nil {
+		return n, fmt.Errorf("could not backup shard: %w", err)
+	}
+	s.logger.Debug().Int64("bytes", n).Str("duration", time.Since(startTime).String()).Msg("BackupTo")
+	return n, nil
+}
+
+// Vacuum rewrites the shard database to return the space freed by deleted
+// points to the operating system. Other operations on the shard wait until it
+// completes. The cached indexes are unaffected because the data does not
+// change.
+func (s *Shard) Vacuum() error {
+	startTime := time.Now()
+	if err := s.db.Vacuum(); err != nil {
+		return fmt.Errorf("could not vacuum shard: %w", err)
+	}
+	s.logger.Debug().Str("duration", time.Since(startTime).String()).Msg("Vacuum")
+	return nil
+}
+
 // ---------------------------
 
 func changePointCount(bucket diskstore.Bucket, change int) error {
@@ -103,15 +312,42 @@ func changePointCount(bucket diskstore.Bucket, change int) error {
 type shardInfo struct {
 	PointCount uint64
 	Size       int64 // Size of the shard database file
+	// Bytes of the database file held by free pages, a large fraction
+	// indicates the shard would benefit from a Vacuum.
+	FreeSize int64
+	// Unix nano time of the last applied write, replicas compare this against
+	// the primary to determine how far behind they are.
+	LastWriteTime int64
+	// Number of graph nodes by out-degree, the count at index i is the number
+	// of nodes with i edges. Only computed when requested because it scans
+	// every node of the graph indexes.
+	EdgeDegreeHistogram []int
+	// Bytes of the stored point data taken up by the values of vector
+	// properties and by everything else, including the payloads. Only
+	// computed when requested because it scans every point.
+	VectorBytes   int64
+	MetadataBytes int64
+	// Number of soft deleted points whose nodes are still in the indexes,
+	// compacting is worthwhile once this is a large fraction of the points.
+	TombstoneCount uint64
 }
 
-func (s *Shard) Info() (si shardInfo, err error) {
+// Info returns the sizes and counts of the shard. The edge degree histogram
+// requires scanning the graph indexes and is only computed if withEdgeDegrees
+// is set. Similarly the vector and metadata bytes require scanning the points
+// and are only computed if withByteSizes is set.
+func (s *Shard) Info(withEdgeDegrees, withByteSizes bool) (si shardInfo, err error) {
 	// ---------------------------
 	dbSize, err := s.db.SizeInBytes()
 	if err != nil {
 		return
 	}
 	si.Size = dbSize
+	freeSize, err := s.db.FreeSizeInBytes()
+	if err != nil {
+		return
+	}
+	si.FreeSize = freeSize
 	// ---------------------------
 	err = s.db.Read(func(bm diskstore.BucketManager) error {
 		b, err := bm.Get(INTERNALBUCKETKEY)
@@ -127,18 +363,324 @@ func (s *Shard) Info() (si shardInfo, err error) {
 		if countBytes != nil {
 			si.PointCount = conversion.BytesToUint64(countBytes)
 		}
+		if tombstoneBytes := b.Get(TOMBSTONECOUNTKEY); tombstoneBytes != nil {
+			si.TombstoneCount = conversion.BytesToUint64(tombstoneBytes)
+		}
+		// ---------------------------
+		bChanges, err := bm.Get(CHANGESBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not read changes bucket: %w", err)
+		}
+		si.LastWriteTime = getLastWriteTime(bChanges)
+		// ---------------------------
+		if withByteSizes {
+			if si.VectorBytes, si.MetadataBytes, err = s.pointByteSizes(bm); err != nil {
+				return fmt.Errorf("could not compute point byte sizes: %w", err)
+			}
+		}
 		// ---------------------------
+		if !withEdgeDegrees {
+			return nil
+		}
+		cacheTx := s.cacheManager.NewTransaction()
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+		si.EdgeDegreeHistogram, err = im.DegreeHistogram()
+		cacheTx.Commit(err != nil)
+		if err != nil {
+			return fmt.Errorf("could not compute edge degrees: %w", err)
+		}
 		return nil
 	})
 	return
 }
 
+/* The point data is a single msgpack map so we walk its keys and attribute the
+ * encoded values of vector properties to the vectors and the rest, including
+ * the keys and the payloads, to the metadata. */
+func (s *Shard) pointByteSizes(bm diskstore.BucketManager) (vectorBytes, metadataBytes int64, err error) {
+	vectorProps := vectorProperties(s.collection.IndexSchema)
+	bPoints, err := bm.Get(POINTSBUCKETKEY)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not get points bucket: %w", err)
+	}
+	dec := msgpack.NewDecoder(nil)
+	err = bPoints.PrefixScan([]byte{'n'}, func(k, v []byte) error {
+		if _, ok := conversion.NodeIdFromKey(k, 'd'); !ok || len(v) == 0 {
+			return nil
+		}
+		n, err := dataVectorBytes(dec, v, vectorProps)
+		if err != nil {
+			return err
+		}
+		vectorBytes += int64(n)
+		metadataBytes += int64(len(v))
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	metadataBytes -= vectorBytes
+	// ---------------------------
+	bPayloads, err := bm.Get(PAYLOADSBUCKETKEY)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not get payloads bucket: %w", err)
+	}
+	err = bPayloads.ForEach(func(k, v []byte) error {
+		metadataBytes += int64(len(v))
+		return nil
+	})
+	return vectorBytes, metadataBytes, err
+}
+
 // ---------------------------
 
-func (s *Shard) InsertPoints(points []models.Point) error {
+/* The point count in the internal bucket is maintained incrementally by the
+ * insert and delete operations. If it ever drifts, for example due to a bug in
+ * one of those paths, the following count the actual points. The start point
+ * of vector indices lives in the index buckets so it is never counted. */
+
+func countPoints(bucket diskstore.ReadOnlyBucket) (count int64, err error) {
+	// Every point has exactly one p<uuid>i key mapping it to its node id
+	err = bucket.PrefixScan([]byte{'p'}, func(k, v []byte) error {
+		if k[len(k)-1] == 'i' {
+			count++
+		}
+		return nil
+	})
+	return
+}
+
+// CountPoints iterates over the points bucket and returns the true number of
+// points without relying on the stored point count.
+func (s *Shard) CountPoints() (count int64, err error) {
+	err = s.db.Read(func(bm diskstore.BucketManager) error {
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		count, err = countPoints(bPoints)
+		if err != nil {
+			return fmt.Errorf("could not count points: %w", err)
+		}
+		return nil
+	})
+	return
+}
+
+// ReconcileCount overwrites the stored point count with the iterated count and
+// returns the corrected value.
+func (s *Shard) ReconcileCount() (count int64, err error) {
+	err = s.db.Write(func(bm diskstore.BucketManager) error {
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		bInternal, err := bm.Get(INTERNALBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get internal bucket: %w", err)
+		}
+		count, err = countPoints(bPoints)
+		if err != nil {
+			return fmt.Errorf("could not count points: %w", err)
+		}
+		if err := bInternal.Put(POINTCOUNTKEY, conversion.Uint64ToBytes(uint64(count))); err != nil {
+			return fmt.Errorf("could not set point count: %w", err)
+		}
+		return nil
+	})
+	if err == nil {
+		s.logger.Debug().Int64("count", count).Msg("ReconcileCount")
+	}
+	return
+}
+
+// TrainQuantizer (re)trains the product quantizers of the vector indexes from
+// a random sample of sampleSize existing points and re-encodes all points. A
+// sample size of 0 uses every point. Training normally happens once when the
+// trigger threshold of the quantizer is reached, this allows retraining after
+// the data distribution has changed.
+func (s *Shard) TrainQuantizer(sampleSize int) error {
+	trained := 0
+	cacheTx := s.cacheManager.NewTransaction()
+	err := s.db.Write(func(bm diskstore.BucketManager) error {
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+		var err error
+		trained, err = im.TrainQuantizers(sampleSize)
+		return err
+	})
+	cacheTx.Commit(err != nil)
+	if err != nil {
+		return fmt.Errorf("could not train quantizer: %w", err)
+	}
+	if trained == 0 {
+		return fmt.Errorf("no vector index with a trainable quantizer")
+	}
+	s.logger.Debug().Int("sampleSize", sampleSize).Int("indexCount", trained).Msg("TrainQuantizer")
+	return nil
+}
+
+// CheckConnectivity traverses the graph indexes from their start nodes and
+// reports how many of the indexed points can be reached. Unreachable points
+// are never returned by vector searches, see Repair.
+func (s *Shard) CheckConnectivity() (reachable int, total int, err error) {
+	cacheTx := s.cacheManager.NewTransaction()
+	err = s.db.Read(func(bm diskstore.BucketManager) error {
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+		var err error
+		reachable, total, err = im.CheckConnectivity()
+		return err
+	})
+	cacheTx.Commit(err != nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not check connectivity: %w", err)
+	}
+	s.logger.Debug().Int("reachable", reachable).Int("total", total).Msg("CheckConnectivity")
+	return reachable, total, nil
+}
+
+// Repair re-links the points of the graph indexes that are not reachable from
+// the start node and returns the number of points re-linked.
+func (s *Shard) Repair() (int, error) {
+	repaired := 0
+	cacheTx := s.cacheManager.NewTransaction()
+	err := s.db.Write(func(bm diskstore.BucketManager) error {
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+		var err error
+		repaired, err = im.RepairConnectivity()
+		return err
+	})
+	cacheTx.Commit(err != nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not repair connectivity: %w", err)
+	}
+	s.logger.Debug().Int("repaired", repaired).Msg("Repair")
+	return repaired, nil
+}
+
+// Rebuild discards the edges of the graph indexes and links every point again
+// from its stored vector, e.g. after changing the insert parameters or to
+// recover from damaged edges. Point ids, data and payloads are untouched and
+// the whole rebuild is a single transaction.
+func (s *Shard) Rebuild(ctx context.Context) error {
+	linked := 0
+	cacheTx := s.cacheManager.NewTransaction()
+	err := s.db.Write(func(bm diskstore.BucketManager) error {
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+		var err error
+		linked, err = im.RebuildGraphs(ctx)
+		return err
+	})
+	cacheTx.Commit(err != nil)
+	if err != nil {
+		return fmt.Errorf("could not rebuild graphs: %w", err)
+	}
+	s.logger.Debug().Int("linked", linked).Msg("Rebuild")
+	return nil
+}
+
+// GraphNode is a node of a graph index with its outgoing edges. The point id
+// is only set if asked for and is nil for the start node of the graph.
+type GraphNode struct {
+	NodeId  uint64
+	PointId uuid.UUID
+	Edges   []uint64
+}
+
+// ExportGraph returns up to maxNodes nodes of the graph index of the property
+// in node id order, optionally with the ids of the points they represent.
+func (s *Shard) ExportGraph(property string, maxNodes int, withPointIds bool) ([]GraphNode, error) {
+	var nodes []GraphNode
+	cacheTx := s.cacheManager.NewTransaction()
+	err := s.db.Read(func(bm diskstore.BucketManager) error {
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+		edges, err := im.ExportEdges(property, maxNodes)
+		if err != nil {
+			return err
+		}
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		nodes = make([]GraphNode, len(edges))
+		for i, e := range edges {
+			nodes[i] = GraphNode{NodeId: e.NodeId, Edges: e.Edges}
+			if !withPointIds {
+				continue
+			}
+			sp, err := GetPointByNodeId(bPoints, e.NodeId)
+			if errors.Is(err, ErrPointNotFound) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("could not get point of node %d: %w", e.NodeId, err)
+			}
+			nodes[i].PointId = sp.Id
+		}
+		return nil
+	})
+	cacheTx.Commit(err != nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not export graph: %w", err)
+	}
+	return nodes, nil
+}
+
+// ---------------------------
+
+func (s *Shard) InsertPoints(ctx context.Context, points []models.Point) error {
+	_, err := s.insertPoints(ctx, points, false)
+	return err
+}
+
+/* UpsertPoints inserts the given points, replacing the data of any points that
+ * already exist instead of failing. This makes retrying a partially failed
+ * insert safe. Unlike UpdatePoints the data of existing points is replaced
+ * rather than merged, as if the point was inserted afresh, but the point keeps
+ * its node id so the indexes treat it as an update. It returns the ids of the
+ * points that already existed. */
+func (s *Shard) UpsertPoints(ctx context.Context, points []models.Point) ([]uuid.UUID, error) {
+	return s.insertPoints(ctx, points, true)
+}
+
+func (s *Shard) insertPoints(ctx context.Context, points []models.Point, upsert bool) ([]uuid.UUID, error) {
 	// ---------------------------
-	s.logger.Debug().Int("count", len(points)).Msg("InsertPoints")
+	s.logger.Debug().Int("count", len(points)).Bool("upsert", upsert).Msg("InsertPoints")
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("could not insert points: %w", err)
+	}
+	if s.readOnly {
+		return nil, fmt.Errorf("could not insert points: %w", diskstore.ErrReadOnly)
+	}
+	if err := s.validateInsert(points); err != nil {
+		return nil, err
+	}
 	// ---------------------------
+	// Insert points
+	// Remember, Bolt allows only one read-write transaction at a time
+	var txTime time.Time
+	// Ids of points that already existed when upserting
+	var existingIds []uuid.UUID
+	cacheTx := s.cacheManager.NewTransaction()
+	err := s.db.Write(func(bm diskstore.BucketManager) error {
+		var err error
+		existingIds, err = s.insertPointsTx(ctx, bm, cacheTx, points, upsert)
+		txTime = time.Now()
+		return err
+	})
+	s.logger.Debug().Str("duration", time.Since(txTime).String()).Msg("InsertPoints - Transaction Done")
+	if err != nil {
+		cacheTx.Commit(true)
+		s.logger.Error().Err(err).Msg("could not insert points")
+		return nil, fmt.Errorf("could not insert points: %w", err)
+	}
+	cacheTx.Commit(false)
+	s.metrics.IncInsert(len(points))
+	// ---------------------------
+	return existingIds, nil
+}
+
+// validateInsert checks the points before anything is written.
+func (s *Shard) validateInsert(points []models.Point) error {
 	// Check for duplicate ids
 	ids := make(map[uuid.UUID]struct{}, len(points))
 	for _, point := range points {
@@ -147,115 +689,222 @@ func (s *Shard) InsertPoints(points []models.Point) error {
 		}
 		ids[point.Id] = struct{}{}
 	}
-	// ---------------------------
-	// Insert points
-	// Remember, Bolt allows only one read-write transaction at a time
-	var txTime time.Time
-	cacheTx := s.cacheManager.NewTransaction()
-	err := s.db.Write(func(bm diskstore.BucketManager) error {
-		bPoints, err := bm.Get(POINTSBUCKETKEY)
-		if err != nil {
-			return fmt.Errorf("could not write points bucket: %w", err)
-		}
-		bInternal, err := bm.Get(INTERNALBUCKETKEY)
-		if err != nil {
-			return fmt.Errorf("could not write internal bucket: %w", err)
+	if err := checkVectorSizes(points, s.collection.IndexSchema); err != nil {
+		return fmt.Errorf("could not insert points: %w", err)
+	}
+	if limit := s.collection.MaxMetadataBytes; limit > 0 {
+		dec := msgpack.NewDecoder(nil)
+		vectorProps := vectorProperties(s.collection.IndexSchema)
+		for _, point := range points {
+			if err := checkMetadataSize(dec, point.Id, point.Data, point.Payload, vectorProps, limit); err != nil {
+				return fmt.Errorf("could not insert points: %w", err)
+			}
 		}
+	}
+	return nil
+}
+
+// insertPointsTx inserts the validated points within the given write
+// transaction and returns the ids of the points that already existed when
+// upserting.
+func (s *Shard) insertPointsTx(ctx context.Context, bm diskstore.BucketManager, cacheTx *cache.Transaction, points []models.Point, upsert bool) ([]uuid.UUID, error) {
+	var existingIds []uuid.UUID
+	bPoints, err := bm.Get(POINTSBUCKETKEY)
+	if err != nil {
+		return nil, fmt.Errorf("could not write points bucket: %w", err)
+	}
+	bInternal, err := bm.Get(INTERNALBUCKETKEY)
+	if err != nil {
+		return nil, fmt.Errorf("could not write internal bucket: %w", err)
+	}
+	// ---------------------------
+	nodeCounter, err := NewIdCounter(bInternal, FREENODEIDSKEY, NEXTFREENODEIDKEY)
+	if err != nil {
+		return nil, fmt.Errorf("could not create id counter: %w", err)
+	}
+	// ---------------------------
+	// Kick off index dispatcher
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// ---------------------------
+	pointsQ := utils.ProduceWithContext(ctx, points)
+	indexQ, indexQErrC := utils.TransformWithContext(ctx, pointsQ, func(point models.Point) (ipc index.IndexPointChange, skip bool, err error) {
 		// ---------------------------
-		nodeCounter, err := NewIdCounter(bInternal, FREENODEIDSKEY, NEXTFREENODEIDKEY)
-		if err != nil {
-			return fmt.Errorf("could not create id counter: %w", err)
+		/* If the point exists, we can't re-insert it. This is actually an
+		 * error because the edges will be wrong in the graph. It needs to be
+		 * updated instead. We can potentially do it here (do an update
+		 * instead of insert) but the API design migh be inconsistent as it
+		 * will then depend whether a point is re-assigned to the same shard
+		 * during insertion when there are multiple shards. We are returning
+		 * an error here to force the user to update the point instead which
+		 * handles the multiple shard case. */
+		var exists bool
+		if exists, err = CheckPointExists(bPoints, point.Id); err != nil {
+			err = fmt.Errorf("could not check point existence: %w", err)
+			return
 		}
-		// ---------------------------
-		// Kick off index dispatcher
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		// ---------------------------
-		pointsQ := utils.ProduceWithContext(ctx, points)
-		indexQ, indexQErrC := utils.TransformWithContext(ctx, pointsQ, func(point models.Point) (ipc index.IndexPointChange, skip bool, err error) {
-			// ---------------------------
-			/* If the point exists, we can't re-insert it. This is actually an
-			 * error because the edges will be wrong in the graph. It needs to be
-			 * updated instead. We can potentially do it here (do an update
-			 * instead of insert) but the API design migh be inconsistent as it
-			 * will then depend whether a point is re-assigned to the same shard
-			 * during insertion when there are multiple shards. We are returning
-			 * an error here to force the user to update the point instead which
-			 * handles the multiple shard case. */
-			var exists bool
-			if exists, err = CheckPointExists(bPoints, point.Id); err != nil {
-				err = fmt.Errorf("could not check point existence: %w", err)
-				return
-			}
-			if exists {
-				err = fmt.Errorf("point already exists: %s", point.Id.String())
+		if exists && !upsert {
+			err = fmt.Errorf("%w: %s", ErrPointExists, point.Id.String())
+			return
+		}
+		if exists {
+			var existing ShardPoint
+			if existing, err = GetPointByUUID(bPoints, point.Id); err != nil {
+				err = fmt.Errorf("could not get existing point: %w", err)
 				return
 			}
-			sp := ShardPoint{Point: point, NodeId: nodeCounter.NextId()}
-			if err = SetPoint(bPoints, sp); err != nil {
-				err = fmt.Errorf("could not set point: %w", err)
+			if err = SetPoint(bPoints, ShardPoint{Point: point, NodeId: existing.NodeId}); err != nil {
+				err = fmt.Errorf("could not set upserted point: %w", err)
 				return
 			}
-			ipc.NodeId = sp.NodeId
+			existingIds = append(existingIds, point.Id)
+			ipc.NodeId = existing.NodeId
+			ipc.PreviousData = existing.Data
 			ipc.NewData = point.Data
 			return
-		})
-		im := index.NewIndexManager(bm, cacheTx, s.dbFile, s.collection.IndexSchema)
-		dispatchErrC := im.Dispatch(ctx, indexQ)
-		// ---------------------------
-		mergedErrC := utils.MergeErrorsWithContext(ctx, indexQErrC, dispatchErrC)
-		// At this point concurrent stuff is over, we can check for errors
-		if err := <-mergedErrC; err != nil {
-			return fmt.Errorf("could not complete insert: %w", err)
 		}
-		// ---------------------------
-		// Update point count accordingly
-		if err := changePointCount(bInternal, len(points)); err != nil {
-			return fmt.Errorf("could not update point count for insertion: %w", err)
-		}
-		// ---------------------------
-		if err := nodeCounter.Flush(); err != nil {
-			return fmt.Errorf("could not flush id counter: %w", err)
+		sp := ShardPoint{Point: point, NodeId: nodeCounter.NextId()}
+		if err = SetPoint(bPoints, sp); err != nil {
+			err = fmt.Errorf("could not set point: %w", err)
+			return
 		}
-		txTime = time.Now()
-		return nil
+		ipc.NodeId = sp.NodeId
+		ipc.NewData = point.Data
+		return
 	})
-	s.logger.Debug().Str("duration", time.Since(txTime).String()).Msg("InsertPoints - Transaction Done")
+	im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+	dispatchErrC := im.Dispatch(ctx, indexQ)
+	// ---------------------------
+	mergedErrC := utils.MergeErrorsWithContext(ctx, indexQErrC, dispatchErrC)
+	// At this point concurrent stuff is over, we can check for errors
+	if err := <-mergedErrC; err != nil {
+		// Stop the index workers before the transaction is closed
+		cancel()
+		<-dispatchErrC
+		return nil, fmt.Errorf("could not complete insert: %w", err)
+	}
+	// ---------------------------
+	// Update point count accordingly, only new points count
+	if err := changePointCount(bInternal, len(points)-len(existingIds)); err != nil {
+		return nil, fmt.Errorf("could not update point count for insertion: %w", err)
+	}
+	// ---------------------------
+	bChanges, err := bm.Get(CHANGESBUCKETKEY)
 	if err != nil {
-		cacheTx.Commit(true)
-		s.logger.Error().Err(err).Msg("could not insert points")
-		return fmt.Errorf("could not insert points: %w", err)
+		return nil, fmt.Errorf("could not write changes bucket: %w", err)
+	}
+	existingSet := make(map[uuid.UUID]struct{}, len(existingIds))
+	for _, id := range existingIds {
+		existingSet[id] = struct{}{}
+	}
+	insertedIds := make([]uuid.UUID, 0, len(points)-len(existingIds))
+	for _, point := range points {
+		if _, ok := existingSet[point.Id]; !ok {
+			insertedIds = append(insertedIds, point.Id)
+		}
+	}
+	changeTime := writeTime(ctx)
+	if err := recordChanges(bChanges, ChangeInsert, changeTime, insertedIds...); err != nil {
+		return nil, fmt.Errorf("could not record insert changes: %w", err)
+	}
+	if err := recordChanges(bChanges, ChangeUpdate, changeTime, existingIds...); err != nil {
+		return nil, fmt.Errorf("could not record upsert changes: %w", err)
 	}
-	cacheTx.Commit(false)
 	// ---------------------------
-	return nil
+	bPayloads, err := bm.Get(PAYLOADSBUCKETKEY)
+	if err != nil {
+		return nil, fmt.Errorf("could not get write payloads bucket: %w", err)
+	}
+	if err := putPayloads(bPayloads, points); err != nil {
+		return nil, fmt.Errorf("could not put payloads: %w", err)
+	}
+	// ---------------------------
+	if err := nodeCounter.Flush(); err != nil {
+		return nil, fmt.Errorf("could not flush id counter: %w", err)
+	}
+	return existingIds, nil
+}
+
+// ---------------------------
+
+/* InsertPointsStream inserts the points arriving on the channel in chunks of
+ * flushEvery points, each chunk is its own write transaction. This keeps the
+ * memory bounded for large bulk loads because at most a chunk of points and
+ * their index changes are held at a time, at the expense of throughput since
+ * each transaction has a fixed cost. If a chunk fails, the previous chunks
+ * remain inserted and the count of inserted points is returned along with the
+ * error. The stream ends when the channel is closed or the context is done. */
+func (s *Shard) InsertPointsStream(ctx context.Context, points <-chan models.Point, flushEvery int) (int, error) {
+	if flushEvery <= 0 {
+		return 0, fmt.Errorf("flush every must be positive, got %d", flushEvery)
+	}
+	inserted := 0
+	chunk := make([]models.Point, 0, flushEvery)
+	for {
+		select {
+		case <-ctx.Done():
+			return inserted, ctx.Err()
+		case point, ok := <-points:
+			if ok {
+				chunk = append(chunk, point)
+				if len(chunk) < flushEvery {
+					continue
+				}
+			}
+			if len(chunk) > 0 {
+				if err := s.InsertPoints(ctx, chunk); err != nil {
+					return inserted, err
+				}
+				inserted += len(chunk)
+				chunk = chunk[:0]
+			}
+			if !ok {
+				return inserted, nil
+			}
+		}
+	}
 }
 
 // ---------------------------
 
-func (s *Shard) UpdatePoints(points []models.Point) ([]uuid.UUID, error) {
+func (s *Shard) UpdatePoints(ctx context.Context, points []models.Point) ([]uuid.UUID, error) {
 	s.logger.Debug().Int("count", len(points)).Msg("UpdatePoints")
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("could not update points: %w", err)
+	}
+	if s.readOnly {
+		return nil, fmt.Errorf("could not update points: %w", diskstore.ErrReadOnly)
+	}
+	if err := checkVectorSizes(points, s.collection.IndexSchema); err != nil {
+		return nil, fmt.Errorf("could not update points: %w", err)
+	}
 	// ---------------------------
 	// Note that some points may not exist, so we need to take care of that
 	// throughout this function
 	updatedIds := make([]uuid.UUID, 0, len(points))
 	// ---------------------------
+	metadataDec := msgpack.NewDecoder(nil)
+	vectorProps := vectorProperties(s.collection.IndexSchema)
 	cacheTx := s.cacheManager.NewTransaction()
 	err := s.db.Write(func(bm diskstore.BucketManager) error {
 		pointsBucket, err := bm.Get(POINTSBUCKETKEY)
 		if err != nil {
 			return fmt.Errorf("could not get write points bucket: %w", err)
 		}
+		bPayloads, err := bm.Get(PAYLOADSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get write payloads bucket: %w", err)
+		}
 		// ---------------------------
 		// Kick off index dispatcher
-		ctx, cancel := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(ctx)
 		defer cancel()
 		// ---------------------------
 		pointsQ := utils.ProduceWithContext(ctx, points)
 		indexQ, indexQErrC := utils.TransformWithContext(ctx, pointsQ, func(point models.Point) (ipc index.IndexPointChange, skip bool, err error) {
 			// ---------------------------
 			sp, err := GetPointByUUID(pointsBucket, point.Id)
-			if err == ErrPointDoesNotExist {
+			if errors.Is(err, ErrPointNotFound) {
 				// Point does not exist, we can skip it, it may reside in
 				// another shard. Updating non-existing points is a no-op.
 				skip = true
@@ -295,8 +944,20 @@ func (s *Shard) UpdatePoints(points []models.Point) ([]uuid.UUID, error) {
 				err = fmt.Errorf("point size exceeds limit: %d", s.collection.UserPlan.MaxPointSize)
 				return
 			}
+			// The payload is kept unless a new one is given
+			payload := point.Payload
+			if payload == nil && s.collection.MaxMetadataBytes > 0 {
+				payload = bPayloads.Get(point.Id[:])
+			}
+			if err = checkMetadataSize(metadataDec, point.Id, finalNewData, payload, vectorProps, s.collection.MaxMetadataBytes); err != nil {
+				return
+			}
 			// ---------------------------
 			point.Data = finalNewData
+			// Like payloads, the expiry is kept unless a new one is given
+			if point.ExpiresAt == 0 {
+				point.ExpiresAt = sp.ExpiresAt
+			}
 			if err = SetPoint(pointsBucket, ShardPoint{Point: point, NodeId: sp.NodeId}); err != nil {
 				err = fmt.Errorf("could not set updated point: %w", err)
 				return
@@ -309,57 +970,300 @@ func (s *Shard) UpdatePoints(points []models.Point) ([]uuid.UUID, error) {
 			// ---------------------------
 			return
 		})
-		im := index.NewIndexManager(bm, cacheTx, s.dbFile, s.collection.IndexSchema)
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
 		dispatchErrC := im.Dispatch(ctx, indexQ)
 		// ---------------------------
 		mergedErrC := utils.MergeErrorsWithContext(ctx, indexQErrC, dispatchErrC)
 		// At this point concurrent stuff is over, we can check for errors
 		if err := <-mergedErrC; err != nil {
+			// Stop the index workers before the transaction is closed
+			cancel()
+			<-dispatchErrC
 			return fmt.Errorf("could not complete update: %w", err)
 		}
+		// ---------------------------
+		bChanges, err := bm.Get(CHANGESBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get write changes bucket: %w", err)
+		}
+		if err := recordChanges(bChanges, ChangeUpdate, writeTime(ctx), updatedIds...); err != nil {
+			return fmt.Errorf("could not record update changes: %w", err)
+		}
+		// ---------------------------
+		// Only replace the payloads of points that exist in this shard
+		updatedSet := make(map[uuid.UUID]struct{}, len(updatedIds))
+		for _, id := range updatedIds {
+			updatedSet[id] = struct{}{}
+		}
+		updatedPoints := make([]models.Point, 0, len(updatedIds))
+		for _, point := range points {
+			if _, ok := updatedSet[point.Id]; ok {
+				updatedPoints = append(updatedPoints, point)
+			}
+		}
+		if err := putPayloads(bPayloads, updatedPoints); err != nil {
+			return fmt.Errorf("could not put payloads: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		cacheTx.Commit(true)
+		s.logger.Debug().Err(err).Msg("could not update points")
+		return nil, fmt.Errorf("could not update points: %w", err)
+	}
+	cacheTx.Commit(false)
+	// ---------------------------
+	return updatedIds, nil
+}
+
+// ---------------------------
+
+func (s *Shard) SearchPoints(ctx context.Context, searchRequest models.SearchRequest) ([]models.SearchResult, error) {
+	results, _, err := s.searchPoints(ctx, searchRequest, nil)
+	return results, err
+}
+
+// SearchPointsWithCount is like SearchPoints but also returns the number of
+// matching points before the offset and limit are applied. This is approximate
+// for vector searches because they only consider as many candidates as the
+// limit of the vector query.
+func (s *Shard) SearchPointsWithCount(ctx context.Context, searchRequest models.SearchRequest) ([]models.SearchResult, int, error) {
+	return s.searchPoints(ctx, searchRequest, nil)
+}
+
+// SearchPointsFiltered performs a search but only returns points whose data
+// satisfies the filter predicate. The filter receives the msgpack encoded point
+// data. If the search request is a vector search and the filter rejects
+// candidates, the vector search is expanded until enough matching points are
+// found or the index is exhausted.
+func (s *Shard) SearchPointsFiltered(ctx context.Context, searchRequest models.SearchRequest, filter func(data []byte) bool) ([]models.SearchResult, error) {
+	results, _, err := s.searchPoints(ctx, searchRequest, filter)
+	return results, err
+}
+
+/* expandVectorQuery doubles the limit and search size of a top level vector
+ * query so that a filtered search can look further. It returns false if the
+ * query cannot be expanded, i.e. it is not a vector query or the previous
+ * search returned fewer results than asked for meaning there are no more
+ * points to find. */
+func expandVectorQuery(q *models.Query, resultCount int, schema models.IndexSchema) bool {
+	switch {
+	case q.VectorVamana != nil:
+		opts := *q.VectorVamana
+		if opts.SearchSize == 0 {
+			if params, ok := schema[q.Property]; ok && params.VectorVamana != nil {
+				opts.SearchSize = params.VectorVamana.SearchSize
+			}
+		}
+		/* The start node of the graph can take up one place of the search set
+		 * so a full search set may yield one fewer result than the limit. */
+		if resultCount < min(opts.Limit, opts.SearchSize-1) {
+			return false
+		}
+		opts.Limit *= 2
+		opts.SearchSize = max(opts.SearchSize*2, opts.Limit+1)
+		q.VectorVamana = &opts
+	case q.VectorFlat != nil:
+		if resultCount < q.VectorFlat.Limit {
+			return false
+		}
+		opts := *q.VectorFlat
+		opts.Limit *= 2
+		q.VectorFlat = &opts
+	default:
+		return false
+	}
+	return true
+}
+
+func (s *Shard) searchPoints(ctx context.Context, searchRequest models.SearchRequest, filter func(data []byte) bool) ([]models.SearchResult, int, error) {
+	// ---------------------------
+	// A query vector of the wrong size cannot be compared to the indexed ones
+	if err := searchRequest.Query.Validate(s.collection.IndexSchema); err != nil {
+		return nil, 0, fmt.Errorf("invalid search query: %w", err)
+	}
+	// ---------------------------
+	searchStart := time.Now()
+	// Filters are functions and cannot be part of the cache key
+	var cacheKey resultCacheKey
+	var cacheVersion uint64
+	useCache := false
+	if s.resultCache != nil && filter == nil {
+		cacheKey, useCache = requestKey(searchRequest)
+	}
+	if useCache {
+		cacheVersion = s.resultCache.version.Load()
+		if results, count, ok := s.resultCache.get(cacheKey); ok {
+			latency := time.Since(searchStart)
+			s.queryLogger.record(searchRequest, latency, len(results))
+			s.metrics.ObserveSearchLatency(latency)
+			return results, count, nil
+		}
+	}
+	// ---------------------------
+	var finalResults []models.SearchResult
+	ctx, hops := vamana.WithSearchHops(ctx)
+	// ---------------------------
+	cacheTx := s.cacheManager.NewTransaction()
+	err := s.db.Read(func(bm diskstore.BucketManager) error {
+		// ---------------------------
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		// ---------------------------
+		finalResults, err = s.searchIndexes(ctx, bm, cacheTx, bPoints, searchRequest, filter)
+		return err
+	})
+	if err != nil {
+		cacheTx.Commit(true)
+		return nil, 0, fmt.Errorf("search failed: %w", err)
+	}
+	cacheTx.Commit(false)
+	// ---------------------------
+	candidateCount := len(finalResults)
+	var expiresAt int64
+	for _, r := range finalResults {
+		if r.ExpiresAt != 0 && (expiresAt == 0 || r.ExpiresAt < expiresAt) {
+			expiresAt = r.ExpiresAt
+		}
+	}
+	finalResults, err = s.selectSortLimit(searchRequest, finalResults)
+	if err != nil {
+		return nil, 0, err
+	}
+	if useCache {
+		s.resultCache.put(cacheKey, cacheVersion, finalResults, candidateCount, expiresAt)
+	}
+	// ---------------------------
+	latency := time.Since(searchStart)
+	s.queryLogger.record(searchRequest, latency, len(finalResults))
+	s.metrics.ObserveSearchLatency(latency)
+	if h := hops.Load(); h > 0 {
+		s.metrics.ObserveGraphHops(int(h))
+	}
+	// ---------------------------
+	return finalResults, candidateCount, nil
+}
+
+// SearchPointsBatch performs multiple searches inside a single read
+// transaction. This amortises the cost of opening the transaction and loading
+// the indexes into the cache when there are many queries to run, for example
+// during bulk evaluation. The results are in the same order as the requests.
+func (s *Shard) SearchPointsBatch(ctx context.Context, searchRequests []models.SearchRequest) ([][]models.SearchResult, error) {
+	// ---------------------------
+	searchStart := time.Now()
+	batchResults := make([][]models.SearchResult, len(searchRequests))
+	batchHops := make([]int64, len(searchRequests))
+	for i, searchRequest := range searchRequests {
+		if err := searchRequest.Query.Validate(s.collection.IndexSchema); err != nil {
+			return nil, fmt.Errorf("invalid search query %d: %w", i, err)
+		}
+	}
+	// ---------------------------
+	/* The searches share the cache transaction so the indexes are loaded once.
+	 * Searching does not modify the cached indexes, so one query cannot affect
+	 * the results of another. */
+	cacheTx := s.cacheManager.NewTransaction()
+	err := s.db.Read(func(bm diskstore.BucketManager) error {
+		// ---------------------------
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		// ---------------------------
+		/* Query preprocessing such as building quantizer lookup tables is done
+		 * for the whole batch up front. */
+		queries := make([]models.Query, len(searchRequests))
+		for i, searchRequest := range searchRequests {
+			queries[i] = searchRequest.Query
+		}
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+		ctx, err := im.PrepareSearchBatch(ctx, queries)
+		if err != nil {
+			return fmt.Errorf("could not prepare search batch: %w", err)
+		}
+		// ---------------------------
+		for i, searchRequest := range searchRequests {
+			searchCtx, hops := vamana.WithSearchHops(ctx)
+			results, err := s.searchIndexes(searchCtx, bm, cacheTx, bPoints, searchRequest, nil)
+			if err != nil {
+				return fmt.Errorf("could not perform search %d: %w", i, err)
+			}
+			batchResults[i] = results
+			batchHops[i] = hops.Load()
+		}
 		return nil
 	})
 	if err != nil {
 		cacheTx.Commit(true)
-		s.logger.Debug().Err(err).Msg("could not update points")
-		return nil, fmt.Errorf("could not update points: %w", err)
+		return nil, fmt.Errorf("batch search failed: %w", err)
 	}
 	cacheTx.Commit(false)
 	// ---------------------------
-	return updatedIds, nil
+	// Each query gets an equal share of the latency in the query log
+	latency := time.Since(searchStart) / time.Duration(max(len(searchRequests), 1))
+	for i, searchRequest := range searchRequests {
+		results, err := s.selectSortLimit(searchRequest, batchResults[i])
+		if err != nil {
+			return nil, fmt.Errorf("could not process search %d: %w", i, err)
+		}
+		batchResults[i] = results
+		s.queryLogger.record(searchRequest, latency, len(results))
+		s.metrics.ObserveSearchLatency(latency)
+		if batchHops[i] > 0 {
+			s.metrics.ObserveGraphHops(int(batchHops[i]))
+		}
+	}
+	// ---------------------------
+	return batchResults, nil
 }
 
-// ---------------------------
-
-func (s *Shard) SearchPoints(searchRequest models.SearchRequest) ([]models.SearchResult, error) {
-	// ---------------------------
+// searchIndexes runs the query of a search request against the indexes and
+// backfills the matching points. If a filter is given, points that do not
+// satisfy it are skipped.
+func (s *Shard) searchIndexes(ctx context.Context, bm diskstore.BucketManager, cacheTx *cache.Transaction, bPoints diskstore.ReadOnlyBucket, searchRequest models.SearchRequest, filter func(data []byte) bool) ([]models.SearchResult, error) {
+	im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
 	/* rSet contains all the points to return, results contains any ordered
 	 * search results. For example a basic integer equals search pops up in
 	 * rSet, a vector search pops up in rSet and results. */
 	var finalResults []models.SearchResult
-	// ---------------------------
-	cacheTx := s.cacheManager.NewTransaction()
-	err := s.db.Read(func(bm diskstore.BucketManager) error {
-		// ---------------------------
-		bPoints, err := bm.Get(POINTSBUCKETKEY)
-		if err != nil {
-			return fmt.Errorf("could not get points bucket: %w", err)
+	query, rerank, err := widenRerankQuery(searchRequest.Query, s.collection.IndexSchema)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		// Expanding a filtered search may take several rounds
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
-		// ---------------------------
-		im := index.NewIndexManager(bm, cacheTx, s.dbFile, s.collection.IndexSchema)
-		rSet, results, err := im.Search(context.Background(), searchRequest.Query)
+		finalResults = finalResults[:0]
+		rSet, results, err := im.Search(ctx, query)
 		if err != nil {
-			return fmt.Errorf("could not perform search: %w", err)
+			return nil, fmt.Errorf("could not perform search: %w", err)
 		}
+		resultCount := len(results)
 		// ---------------------------
+		/* Expired and soft deleted points are skipped here rather than
+		 * removed, they stay in the indexes until PurgeExpired or Compact
+		 * deletes them. */
+		now := time.Now().Unix()
+		expired := 0
 		// Backfill point UUID and data
 		for _, r := range results {
 			sp, err := GetPointByNodeId(bPoints, r.NodeId)
 			if err != nil {
-				return fmt.Errorf("could not get point by node id %d: %w", r.NodeId, err)
+				return nil, fmt.Errorf("could not get point by node id %d: %w", r.NodeId, err)
 			}
-			r.Point = sp.Point
 			rSet.Remove(r.NodeId)
+			if sp.Tombstoned || sp.isExpired(now) {
+				expired++
+				continue
+			}
+			if filter != nil && !filter(sp.Data) {
+				continue
+			}
+			r.Point = sp.Point
 			finalResults = append(finalResults, r)
 		}
 		// If any points are missing in the results from rSet, we need to append them
@@ -368,18 +1272,50 @@ func (s *Shard) SearchPoints(searchRequest models.SearchRequest) ([]models.Searc
 			nodeId := it.Next()
 			sp, err := GetPointByNodeId(bPoints, nodeId)
 			if err != nil {
-				return fmt.Errorf("could not get point by node id %d: %w", nodeId, err)
+				return nil, fmt.Errorf("could not get point by node id %d: %w", nodeId, err)
+			}
+			if sp.Tombstoned || sp.isExpired(now) {
+				expired++
+				continue
+			}
+			if filter != nil && !filter(sp.Data) {
+				continue
 			}
 			finalResults = append(finalResults, models.SearchResult{NodeId: nodeId, Point: sp.Point})
 		}
 		// ---------------------------
-		return nil
-	})
-	if err != nil {
-		cacheTx.Commit(true)
-		return nil, fmt.Errorf("search failed: %w", err)
+		/* If the filter, expiry or tombstones rejected too many candidates we
+		 * search again looking further. A limit of 0 returns whatever the
+		 * query finds so there is nothing to expand towards. */
+		if (filter == nil && expired == 0) || searchRequest.Limit == 0 || len(finalResults) >= searchRequest.Offset+searchRequest.Limit {
+			break
+		}
+		if !expandVectorQuery(&query, resultCount, s.collection.IndexSchema) {
+			break
+		}
 	}
-	cacheTx.Commit(false)
+	// ---------------------------
+	if rerank != nil {
+		if finalResults, err = rerankResults(finalResults, rerank); err != nil {
+			return nil, fmt.Errorf("could not rerank results: %w", err)
+		}
+	}
+	// ---------------------------
+	if searchRequest.IncludePayload {
+		bPayloads, err := bm.Get(PAYLOADSBUCKETKEY)
+		if err != nil {
+			return nil, fmt.Errorf("could not get payloads bucket: %w", err)
+		}
+		for i := range finalResults {
+			finalResults[i].Payload = getPayload(bPayloads, finalResults[i].Point.Id)
+		}
+	}
+	return finalResults, nil
+}
+
+// selectSortLimit applies the select, sort, offset and limit of a search
+// request to the search results.
+func (s *Shard) selectSortLimit(searchRequest models.SearchRequest, finalResults []models.SearchResult) ([]models.SearchResult, error) {
 	// ---------------------------
 	// Select and sort
 	if len(searchRequest.Select) > 0 {
@@ -426,81 +1362,345 @@ func (s *Shard) SearchPoints(searchRequest models.SearchRequest) ([]models.Searc
 	if searchRequest.Limit == 0 {
 		searchRequest.Limit = len(finalResults)
 	}
-	finalResults = finalResults[min(searchRequest.Offset, len(finalResults)):min(searchRequest.Offset+searchRequest.Limit, len(finalResults))]
-	// ---------------------------
-	return finalResults, nil
+	return finalResults[min(searchRequest.Offset, len(finalResults)):min(searchRequest.Offset+searchRequest.Limit, len(finalResults))], nil
 }
 
 // ---------------------------
 
-func (s *Shard) DeletePoints(deleteSet map[uuid.UUID]struct{}) ([]uuid.UUID, error) {
-	// ---------------------------
-	deletedIds := make([]uuid.UUID, 0, len(deleteSet))
-	// ---------------------------
-	cacheTx := s.cacheManager.NewTransaction()
-	err := s.db.Write(func(bm diskstore.BucketManager) error {
+// GetPoint retrieves a single point by its id without performing a search. The
+// boolean is false if the point does not reside in this shard or has expired.
+// Like search, reads skip expired points that PurgeExpired has not removed
+// yet.
+func (s *Shard) GetPoint(id uuid.UUID) (point models.Point, found bool, err error) {
+	err = s.db.Read(func(bm diskstore.BucketManager) error {
 		bPoints, err := bm.Get(POINTSBUCKETKEY)
 		if err != nil {
-			return fmt.Errorf("could not get write points bucket: %w", err)
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		sp, err := GetPointByUUID(bPoints, id)
+		if errors.Is(err, ErrPointNotFound) {
+			return nil
 		}
-		bInternal, err := bm.Get(INTERNALBUCKETKEY)
 		if err != nil {
-			return fmt.Errorf("could not get write internal bucket: %w", err)
+			return fmt.Errorf("could not get point %s: %w", id, err)
 		}
-		// ---------------------------
-		nodeCounter, err := NewIdCounter(bInternal, FREENODEIDSKEY, NEXTFREENODEIDKEY)
+		if sp.isExpired(time.Now().Unix()) {
+			return nil
+		}
+		// The data slice is only valid during the transaction
+		point = models.Point{Id: sp.Id, Data: bytes.Clone(sp.Data), ExpiresAt: sp.ExpiresAt}
+		found = true
+		return nil
+	})
+	return
+}
+
+// GetPoints returns the points with the given ids, including their payloads,
+// in the order of the ids from a single consistent view of the shard. Ids that
+// do not exist in the shard or have expired are not an error, their entry is
+// the zero point whose Id is uuid.Nil so the positions still line up with the
+// ids.
+func (s *Shard) GetPoints(ids []uuid.UUID) ([]models.Point, error) {
+	points := make([]models.Point, len(ids))
+	now := time.Now().Unix()
+	err := s.db.Read(func(bm diskstore.BucketManager) error {
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
 		if err != nil {
-			return fmt.Errorf("could not create id counter: %w", err)
+			return fmt.Errorf("could not get points bucket: %w", err)
 		}
-		// ---------------------------
-		// Kick off index dispatcher
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		// ---------------------------
-		pointsQ := utils.ProduceWithContextMapKeys(ctx, deleteSet)
-		indexQ, indexQErrC := utils.TransformWithContext(ctx, pointsQ, func(pointId uuid.UUID) (ipc index.IndexPointChange, skip bool, err error) {
-			sp, err := GetPointByUUID(bPoints, pointId)
-			if err == ErrPointDoesNotExist {
-				// Deleting a non-existing point is a no-op
-				skip = true
-				return
+		bPayloads, err := bm.Get(PAYLOADSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get payloads bucket: %w", err)
+		}
+		for i, id := range ids {
+			sp, err := GetPointByUUID(bPoints, id)
+			if errors.Is(err, ErrPointNotFound) {
+				continue
 			}
 			if err != nil {
-				err = fmt.Errorf("could not get point for deletion: %w", err)
-				return
+				return fmt.Errorf("could not get point %s: %w", id, err)
 			}
-			deletedIds = append(deletedIds, pointId)
-			nodeCounter.FreeId(sp.NodeId)
-			// ---------------------------
-			if err = DeletePoint(bPoints, pointId, sp.NodeId); err != nil {
-				err = fmt.Errorf("could not delete point %s: %w", pointId, err)
-				return
+			if sp.isExpired(now) {
+				continue
 			}
-			// ---------------------------
-			ipc.NodeId = sp.NodeId
-			ipc.PreviousData = sp.Data
-			return
+			// The data slice is only valid during the transaction
+			points[i] = models.Point{
+				Id:        id,
+				Data:      bytes.Clone(sp.Data),
+				Payload:   getPayload(bPayloads, id),
+				ExpiresAt: sp.ExpiresAt,
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// IterPoints calls fn with every point of the shard that has not expired,
+// including its payload, in the order of the point ids. All points are read
+// from a single consistent view of the shard. If fn returns an error the scan
+// stops and the error is returned.
+func (s *Shard) IterPoints(fn func(models.Point) error) error {
+	now := time.Now().Unix()
+	return s.db.Read(func(bm diskstore.BucketManager) error {
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		bPayloads, err := bm.Get(PAYLOADSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get payloads bucket: %w", err)
+		}
+		// The point id keys p<uuid>i only cover user points, so index
+		// internals such as the start point of a graph are never visited.
+		return bPoints.RangeScan([]byte{'p'}, []byte{'q'}, false, func(k, v []byte) error {
+			if len(k) != 18 || k[17] != 'i' {
+				return nil
+			}
+			pointId := uuid.UUID(k[1:17])
+			sp, err := GetPointByUUID(bPoints, pointId)
+			if err != nil {
+				return fmt.Errorf("could not get point %s: %w", pointId, err)
+			}
+			if sp.isExpired(now) {
+				return nil
+			}
+			// The data slice is only valid during the transaction
+			point := models.Point{
+				Id:        pointId,
+				Data:      bytes.Clone(sp.Data),
+				Payload:   getPayload(bPayloads, pointId),
+				ExpiresAt: sp.ExpiresAt,
+			}
+			return fn(point)
 		})
-		im := index.NewIndexManager(bm, cacheTx, s.dbFile, s.collection.IndexSchema)
-		dispatchErrC := im.Dispatch(ctx, indexQ)
-		// ---------------------------
-		mergedErrC := utils.MergeErrorsWithContext(ctx, indexQErrC, dispatchErrC)
-		// At this point concurrent stuff is over, we can check for errors
-		if err := <-mergedErrC; err != nil {
-			return fmt.Errorf("could not complete insert: %w", err)
+	})
+}
+
+// ScanPoints returns up to limit points of the shard starting after the given
+// id, uuid.Nil starts from the first point, and whether more points follow.
+// Points are ordered by the bytes of their ids, so passing the id of the last
+// returned point continues the scan. Each call reads a consistent view of the
+// shard but the scan as a whole does not, points inserted or deleted between
+// calls are seen only if they come after the cursor. Index internals such as
+// the start point of a graph and expired points are never returned.
+func (s *Shard) ScanPoints(after uuid.UUID, limit int, includePayload bool) ([]models.Point, bool, error) {
+	points := make([]models.Point, 0, limit+1)
+	now := time.Now().Unix()
+	err := s.db.Read(func(bm diskstore.BucketManager) error {
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
 		}
-		// ---------------------------
-		// Update point count accordingly
-		if err := changePointCount(bInternal, -len(deletedIds)); err != nil {
-			return fmt.Errorf("could not change point count for deletion: %w", err)
+		var start *uuid.UUID
+		if after != uuid.Nil {
+			start = &after
 		}
-		// ---------------------------
-		if err := nodeCounter.Flush(); err != nil {
-			return fmt.Errorf("could not flush id counter: %w", err)
+		// One extra point tells us whether the scan is done, we keep scanning
+		// past expired points so they don't cut the page short
+		for len(points) <= limit {
+			batch, err := ScanPoints(bPoints, start, limit+1)
+			if err != nil {
+				return fmt.Errorf("could not scan points: %w", err)
+			}
+			for _, point := range batch {
+				if !(ShardPoint{Point: point}).isExpired(now) {
+					points = append(points, point)
+				}
+			}
+			if len(batch) <= limit {
+				break
+			}
+			start = &batch[len(batch)-1].Id
+		}
+		points = points[:min(len(points), limit+1)]
+		if !includePayload {
+			return nil
+		}
+		bPayloads, err := bm.Get(PAYLOADSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get payloads bucket: %w", err)
+		}
+		for i := range points {
+			points[i].Payload = getPayload(bPayloads, points[i].Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(points) > limit {
+		return points[:limit], true, nil
+	}
+	return points, false, nil
+}
+
+// Exists reports whether a point with the given id is stored in the shard
+// without reading its vector, data or payload. It follows insertion, so a point
+// that exists cannot be inserted again without an upsert. Unlike the reads of
+// points, this includes expired points until PurgeExpired removes them because
+// they still take up their ids.
+func (s *Shard) Exists(id uuid.UUID) (exists bool, err error) {
+	err = s.db.Read(func(bm diskstore.BucketManager) error {
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		exists, err = CheckPointExists(bPoints, id)
+		if err != nil {
+			return fmt.Errorf("could not check point existence: %w", err)
+		}
+		return nil
+	})
+	return
+}
+
+// ---------------------------
+
+func (s *Shard) DeletePoints(ctx context.Context, deleteSet map[uuid.UUID]struct{}) ([]uuid.UUID, error) {
+	return s.deletePoints(ctx, func(diskstore.ReadOnlyBucket) (map[uuid.UUID]struct{}, error) {
+		return deleteSet, nil
+	})
+}
+
+// DeleteImpact describes what deleting a set of points would do to the graph
+// indexes, see DeletePointsDryRun.
+type DeleteImpact struct {
+	// Number of the given points that exist and would be deleted
+	DeleteCount int
+	// Number of remaining nodes with edges to deleted nodes, these are pruned
+	// during the delete
+	PruneCount int
+	// Remaining points whose inbound edges all come from deleted nodes. The
+	// delete re-links them but a large number points to the graph becoming
+	// poorly connected.
+	Orphaned []uuid.UUID
+}
+
+// DeletePointsDryRun computes the impact of deleting the given points on the
+// graph indexes without modifying the shard.
+func (s *Shard) DeletePointsDryRun(deleteSet map[uuid.UUID]struct{}) (DeleteImpact, error) {
+	var impact DeleteImpact
+	cacheTx := s.cacheManager.NewTransaction()
+	err := s.db.Read(func(bm diskstore.BucketManager) error {
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get points bucket: %w", err)
+		}
+		nodeDeleteSet := make(map[uint64]struct{}, len(deleteSet))
+		for pointId := range deleteSet {
+			sp, err := GetPointByUUID(bPoints, pointId)
+			if errors.Is(err, ErrPointNotFound) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("could not get point %s: %w", pointId, err)
+			}
+			nodeDeleteSet[sp.NodeId] = struct{}{}
 		}
+		impact.DeleteCount = len(nodeDeleteSet)
 		// ---------------------------
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+		toPrune, orphaned, err := im.DeleteImpact(nodeDeleteSet)
+		if err != nil {
+			return fmt.Errorf("could not scan edges: %w", err)
+		}
+		impact.PruneCount = len(toPrune)
+		impact.Orphaned = make([]uuid.UUID, 0, len(orphaned))
+		for nodeId := range orphaned {
+			sp, err := GetPointByNodeId(bPoints, nodeId)
+			if err != nil {
+				return fmt.Errorf("could not get orphaned point %d: %w", nodeId, err)
+			}
+			impact.Orphaned = append(impact.Orphaned, sp.Id)
+		}
 		return nil
 	})
+	cacheTx.Commit(err != nil)
+	if err != nil {
+		return impact, fmt.Errorf("could not compute delete impact: %w", err)
+	}
+	s.logger.Debug().Int("deleteCount", impact.DeleteCount).Int("pruneCount", impact.PruneCount).Int("orphanedCount", len(impact.Orphaned)).Msg("DeletePointsDryRun")
+	return impact, nil
+}
+
+// DeletePointsByFilter deletes every point whose data satisfies the filter,
+// for example all the points of a tenant. The points are selected and deleted
+// in the same transaction so concurrent updates cannot change the outcome. It
+// returns the ids of the deleted points.
+func (s *Shard) DeletePointsByFilter(ctx context.Context, filter func(data []byte) bool) ([]uuid.UUID, error) {
+	return s.deletePoints(ctx, func(bPoints diskstore.ReadOnlyBucket) (map[uuid.UUID]struct{}, error) {
+		deleteSet := make(map[uuid.UUID]struct{})
+		// The point id keys p<uuid>i only cover user points
+		err := bPoints.RangeScan([]byte{'p'}, []byte{'q'}, false, func(k, v []byte) error {
+			if len(k) != 18 || k[17] != 'i' {
+				return nil
+			}
+			pointId := uuid.UUID(k[1:17])
+			sp, err := GetPointByUUID(bPoints, pointId)
+			if err != nil {
+				return fmt.Errorf("could not get point %s: %w", pointId, err)
+			}
+			if filter(sp.Data) {
+				deleteSet[pointId] = struct{}{}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not scan points: %w", err)
+		}
+		return deleteSet, nil
+	})
+}
+
+// PurgeExpired deletes the points whose TTL has ended and returns their ids.
+// Searches already skip expired points but they occupy the indexes, e.g. graph
+// edges, until purged.
+func (s *Shard) PurgeExpired(ctx context.Context) ([]uuid.UUID, error) {
+	now := time.Now().Unix()
+	return s.deletePoints(ctx, func(bPoints diskstore.ReadOnlyBucket) (map[uuid.UUID]struct{}, error) {
+		deleteSet := make(map[uuid.UUID]struct{})
+		// Only points with a TTL have an n<node_id>e key
+		err := bPoints.RangeScan([]byte{'n'}, []byte{'o'}, false, func(k, v []byte) error {
+			nodeId, ok := conversion.NodeIdFromKey(k, 'e')
+			if !ok || int64(conversion.BytesToUint64(v)) > now {
+				return nil
+			}
+			sp, err := GetPointByNodeId(bPoints, nodeId)
+			if err != nil {
+				return fmt.Errorf("could not get point by node id %d: %w", nodeId, err)
+			}
+			deleteSet[sp.Id] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not scan point expiries: %w", err)
+		}
+		return deleteSet, nil
+	})
+}
+
+// deletePoints deletes the points selected by the given function inside the
+// write transaction.
+func (s *Shard) deletePoints(ctx context.Context, selectFn func(bPoints diskstore.ReadOnlyBucket) (map[uuid.UUID]struct{}, error)) ([]uuid.UUID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("could not delete points: %w", err)
+	}
+	if s.readOnly {
+		return nil, fmt.Errorf("could not delete points: %w", diskstore.ErrReadOnly)
+	}
+	// ---------------------------
+	var deletedIds []uuid.UUID
+	// ---------------------------
+	cacheTx := s.cacheManager.NewTransaction()
+	err := s.db.Write(func(bm diskstore.BucketManager) error {
+		var err error
+		deletedIds, err = s.deletePointsTx(ctx, bm, cacheTx, selectFn)
+		return err
+	})
 	if err != nil {
 		cacheTx.Commit(true)
 		return nil, fmt.Errorf("could not delete points: %w", err)
@@ -509,4 +1709,105 @@ func (s *Shard) DeletePoints(deleteSet map[uuid.UUID]struct{}) ([]uuid.UUID, err
 	return deletedIds, nil
 }
 
+// deletePointsTx deletes the points selected by the given function within the
+// given write transaction and returns the ids of the points that existed.
+func (s *Shard) deletePointsTx(ctx context.Context, bm diskstore.BucketManager, cacheTx *cache.Transaction, selectFn func(bPoints diskstore.ReadOnlyBucket) (map[uuid.UUID]struct{}, error)) ([]uuid.UUID, error) {
+	bPoints, err := bm.Get(POINTSBUCKETKEY)
+	if err != nil {
+		return nil, fmt.Errorf("could not get write points bucket: %w", err)
+	}
+	// ---------------------------
+	deleteSet, err := selectFn(bPoints)
+	if err != nil {
+		return nil, err
+	}
+	deletedIds := make([]uuid.UUID, 0, len(deleteSet))
+	// ---------------------------
+	bInternal, err := bm.Get(INTERNALBUCKETKEY)
+	if err != nil {
+		return nil, fmt.Errorf("could not get write internal bucket: %w", err)
+	}
+	// ---------------------------
+	nodeCounter, err := NewIdCounter(bInternal, FREENODEIDSKEY, NEXTFREENODEIDKEY)
+	if err != nil {
+		return nil, fmt.Errorf("could not create id counter: %w", err)
+	}
+	// ---------------------------
+	// Kick off index dispatcher
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// ---------------------------
+	pointsQ := utils.ProduceWithContextMapKeys(ctx, deleteSet)
+	indexQ, indexQErrC := utils.TransformWithContext(ctx, pointsQ, func(pointId uuid.UUID) (ipc index.IndexPointChange, skip bool, err error) {
+		sp, err := GetPointByUUID(bPoints, pointId)
+		if errors.Is(err, ErrPointNotFound) {
+			// Deleting a non-existing point is a no-op
+			skip = true
+			return
+		}
+		if err != nil {
+			err = fmt.Errorf("could not get point for deletion: %w", err)
+			return
+		}
+		/* Node ids of points start after the start node of the graph
+		 * indexes so this only happens if the point mapping is corrupt.
+		 * Deleting it would take the start node of every graph index
+		 * with it, so we leave the point out of the deleted ids. */
+		if sp.NodeId == vamana.STARTID {
+			s.logger.Warn().Str("pointId", pointId.String()).Msg("Refusing to delete point mapped to the start node")
+			skip = true
+			return
+		}
+		deletedIds = append(deletedIds, pointId)
+		nodeCounter.FreeId(sp.NodeId)
+		// ---------------------------
+		if err = DeletePoint(bPoints, pointId, sp.NodeId); err != nil {
+			err = fmt.Errorf("could not delete point %s: %w", pointId, err)
+			return
+		}
+		// ---------------------------
+		ipc.NodeId = sp.NodeId
+		ipc.PreviousData = sp.Data
+		return
+	})
+	im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+	dispatchErrC := im.Dispatch(ctx, indexQ)
+	// ---------------------------
+	mergedErrC := utils.MergeErrorsWithContext(ctx, indexQErrC, dispatchErrC)
+	// At this point concurrent stuff is over, we can check for errors
+	if err := <-mergedErrC; err != nil {
+		// Stop the index workers before the transaction is closed
+		cancel()
+		<-dispatchErrC
+		return nil, fmt.Errorf("could not complete insert: %w", err)
+	}
+	// ---------------------------
+	// Update point count accordingly
+	if err := changePointCount(bInternal, -len(deletedIds)); err != nil {
+		return nil, fmt.Errorf("could not change point count for deletion: %w", err)
+	}
+	// ---------------------------
+	bChanges, err := bm.Get(CHANGESBUCKETKEY)
+	if err != nil {
+		return nil, fmt.Errorf("could not get write changes bucket: %w", err)
+	}
+	if err := recordChanges(bChanges, ChangeDelete, writeTime(ctx), deletedIds...); err != nil {
+		return nil, fmt.Errorf("could not record delete changes: %w", err)
+	}
+	// ---------------------------
+	bPayloads, err := bm.Get(PAYLOADSBUCKETKEY)
+	if err != nil {
+		return nil, fmt.Errorf("could not get write payloads bucket: %w", err)
+	}
+	if err := deletePayloads(bPayloads, deletedIds...); err != nil {
+		return nil, fmt.Errorf("could not delete payloads: %w", err)
+	}
+	// ---------------------------
+	if err := nodeCounter.Flush(); err != nil {
+		return nil, fmt.Errorf("could not flush id counter: %w", err)
+	}
+	// ---------------------------
+	return deletedIds, nil
+}
+
 // ---------------------------
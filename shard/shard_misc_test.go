@@ -1,17 +1,35 @@
 package shard
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/conversion"
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/distance"
 	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard/cache"
+	"github.com/semafind/semadb/shard/index/vamana"
 	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 func Test_UpdateMerge(t *testing.T) {
 	s := tempShard(t)
 	pmaps := randPointsAsMap(10)
 	points := pointsAsMapToPoints(pmaps)
-	err := s.InsertPoints(points)
+	err := s.InsertPoints(context.Background(), points)
 	require.NoError(t, err)
 	// Update a point
 	p := pmaps[0]
@@ -20,7 +38,7 @@ func Test_UpdateMerge(t *testing.T) {
 	updatePoints := pointsAsMapToPoints(pmaps[:1])
 	updatePoints[0].Id = points[0].Id
 	// ---------------------------
-	updatedIds, err := s.UpdatePoints(updatePoints)
+	updatedIds, err := s.UpdatePoints(context.Background(), updatePoints)
 	require.NoError(t, err)
 	require.Len(t, updatedIds, 1)
 	require.Equal(t, points[0].Id, updatedIds[0])
@@ -36,7 +54,7 @@ func Test_UpdateMerge(t *testing.T) {
 		},
 		Select: []string{"size", "price"},
 	}
-	res, err := s.SearchPoints(sr)
+	res, err := s.SearchPoints(context.Background(), sr)
 	require.NoError(t, err)
 	require.Len(t, res, 1)
 	require.Equal(t, int64(100), res[0].DecodedData["size"])
@@ -47,7 +65,7 @@ func Test_UpdateExceedsUserPlan(t *testing.T) {
 	s := tempShard(t)
 	pmaps := randPointsAsMap(10)
 	points := pointsAsMapToPoints(pmaps)
-	err := s.InsertPoints(points)
+	err := s.InsertPoints(context.Background(), points)
 	require.NoError(t, err)
 	// Update a point
 	p := pmaps[0]
@@ -56,6 +74,2066 @@ func Test_UpdateExceedsUserPlan(t *testing.T) {
 	updatePoints := pointsAsMapToPoints(pmaps[:1])
 	updatePoints[0].Id = points[0].Id
 	// ---------------------------
-	_, err = s.UpdatePoints(updatePoints)
+	_, err = s.UpdatePoints(context.Background(), updatePoints)
 	require.Error(t, err)
 }
+
+func Test_MaxMetadataBytes(t *testing.T) {
+	col := sampleCol
+	col.MaxMetadataBytes = 1000
+	s, err := NewShard(filepath.Join(t.TempDir(), "sharddb.bbolt"), col, cache.NewManager(-1))
+	require.NoError(t, err)
+	vectorProps := vectorProperties(col.IndexSchema)
+	metadataSize := func(p models.Point) int {
+		vectorBytes, err := dataVectorBytes(msgpack.NewDecoder(nil), p.Data, vectorProps)
+		require.NoError(t, err)
+		return len(p.Data) - vectorBytes
+	}
+	// Fill the metadata of every point up to exactly the limit
+	points := randPoints(5)
+	for i := range points {
+		points[i].Payload = bytes.Repeat([]byte("x"), col.MaxMetadataBytes-metadataSize(points[i]))
+	}
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// ---------------------------
+	over := randPoints(1)
+	over[0].Payload = bytes.Repeat([]byte("x"), col.MaxMetadataBytes-metadataSize(over[0])+1)
+	err = s.InsertPoints(context.Background(), over)
+	require.ErrorContains(t, err, over[0].Id.String())
+	require.ErrorContains(t, err, fmt.Sprint(col.MaxMetadataBytes+1))
+	// ---------------------------
+	// Updates count the kept payload and reject growing past the limit
+	update := []models.Point{{Id: points[0].Id, Data: points[0].Data}}
+	_, err = s.UpdatePoints(context.Background(), update)
+	require.NoError(t, err)
+	update[0].Payload = append(points[0].Payload, 'x')
+	_, err = s.UpdatePoints(context.Background(), update)
+	require.ErrorContains(t, err, points[0].Id.String())
+	stored, err := s.GetPayload(points[0].Id)
+	require.NoError(t, err)
+	require.Equal(t, points[0].Payload, stored)
+	// Metadata updates are held to the same limit
+	longer, err := msgpack.Marshal(models.PointAsMap{"description": "a longer description than before"})
+	require.NoError(t, err)
+	_, err = s.UpdateMetadata(context.Background(), map[uuid.UUID][]byte{points[0].Id: longer})
+	require.ErrorContains(t, err, points[0].Id.String())
+	// ---------------------------
+	// Zero is unlimited
+	s.collection.MaxMetadataBytes = 0
+	require.NoError(t, s.InsertPoints(context.Background(), over))
+	require.NoError(t, s.Close())
+}
+
+func queryStatsShard(t *testing.T, dbFile string, sampleRate float64) *Shard {
+	col := sampleCol
+	col.UserPlan.QueryStatsSampleRate = sampleRate
+	col.UserPlan.QueryStatsRetention = 60
+	s, err := NewShard(dbFile, col, cache.NewManager(-1))
+	require.NoError(t, err)
+	return s
+}
+
+func Test_QueryStats(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	s := queryStatsShard(t, dbFile, 1)
+	points := randPoints(10)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	for i := 0; i < 20; i++ {
+		_, err := s.SearchPoints(context.Background(), searchRequest(points[i%2], 3))
+		require.NoError(t, err)
+	}
+	// Closing waits for the query log to be written
+	require.NoError(t, s.Close())
+	s = queryStatsShard(t, dbFile, 1)
+	qs, err := s.QueryStats(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 20, qs.QueryCount)
+	require.Equal(t, 2, qs.UniqueQueries)
+	require.Equal(t, 3.0, qs.AvgResults)
+	require.Equal(t, 3.0, qs.AvgLimit)
+	require.Greater(t, qs.QPS, 0.0)
+	require.Greater(t, qs.P50Latency, time.Duration(0))
+	require.LessOrEqual(t, qs.P50Latency, qs.P99Latency)
+	require.NoError(t, s.Close())
+}
+
+func Test_QueryStatsSampling(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	s := queryStatsShard(t, dbFile, 0.5)
+	points := randPoints(10)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	for i := 0; i < 400; i++ {
+		_, err := s.SearchPoints(context.Background(), searchRequest(points[0], 1))
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+	s = queryStatsShard(t, dbFile, 0.5)
+	qs, err := s.QueryStats(time.Minute)
+	require.NoError(t, err)
+	require.InDelta(t, 200, qs.QueryCount, 60)
+	require.NoError(t, s.Close())
+}
+
+func Test_QueryStatsRecordWhileClosing(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	s := queryStatsShard(t, dbFile, 1)
+	sr := searchRequest(randPoints(1)[0], 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.queryLogger.record(sr, time.Millisecond, 1)
+			}
+		}()
+	}
+	// Searches finishing after the query log closes are dropped, not sent
+	s.queryLogger.close()
+	wg.Wait()
+	s.queryLogger.record(sr, time.Millisecond, 1)
+	require.NoError(t, s.Close())
+}
+
+func Test_QueryStatsDisabled(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(2)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	_, err := s.SearchPoints(context.Background(), searchRequest(points[0], 1))
+	require.NoError(t, err)
+	qs, err := s.QueryStats(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 0, qs.QueryCount)
+	require.NoError(t, s.Close())
+}
+
+func Test_GetPoint(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(5)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	p, found, err := s.GetPoint(points[2].Id)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, points[2].Id, p.Id)
+	require.Equal(t, points[2].Data, p.Data)
+	// ---------------------------
+	_, found, err = s.GetPoint(uuid.New())
+	require.NoError(t, err)
+	require.False(t, found)
+	require.NoError(t, s.Close())
+}
+
+func Test_GetPoints(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(5)
+	points[1].Payload = []byte("hydrated payload")
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	missing := uuid.New()
+	got, err := s.GetPoints([]uuid.UUID{points[3].Id, missing, points[1].Id})
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	require.Equal(t, points[3].Id, got[0].Id)
+	require.Equal(t, points[3].Data, got[0].Data)
+	// Missing ids keep their position with the zero point
+	require.Equal(t, uuid.Nil, got[1].Id)
+	require.Equal(t, points[1].Id, got[2].Id)
+	require.Equal(t, points[1].Payload, got[2].Payload)
+	require.NoError(t, s.Close())
+}
+
+func Test_IterPoints(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(20)
+	points[3].Payload = []byte("exported payload")
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// ---------------------------
+	seen := make(map[uuid.UUID]models.Point)
+	err := s.IterPoints(func(p models.Point) error {
+		seen[p.Id] = p
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, seen, 20)
+	for _, p := range points {
+		require.Equal(t, p.Data, seen[p.Id].Data)
+	}
+	require.Equal(t, points[3].Payload, seen[points[3].Id].Payload)
+	// ---------------------------
+	// Returning an error stops the scan
+	errStop := errors.New("stop")
+	visited := 0
+	err = s.IterPoints(func(p models.Point) error {
+		visited++
+		if visited == 5 {
+			return errStop
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, errStop)
+	require.Equal(t, 5, visited)
+	require.NoError(t, s.Close())
+}
+
+func Test_ScanPoints(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(25)
+	points[3].Payload = []byte("scanned payload")
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	slices.SortFunc(points, func(a, b models.Point) int {
+		return bytes.Compare(a.Id[:], b.Id[:])
+	})
+	// ---------------------------
+	// Pages follow each other in id order
+	scanned := make([]models.Point, 0, len(points))
+	after := uuid.Nil
+	for {
+		page, more, err := s.ScanPoints(after, 10, true)
+		require.NoError(t, err)
+		scanned = append(scanned, page...)
+		if !more {
+			require.Len(t, page, 5)
+			break
+		}
+		require.Len(t, page, 10)
+		after = page[len(page)-1].Id
+	}
+	require.Len(t, scanned, len(points))
+	for i, p := range points {
+		require.Equal(t, p.Id, scanned[i].Id)
+		require.Equal(t, p.Data, scanned[i].Data)
+		require.Equal(t, p.Payload, scanned[i].Payload)
+	}
+	// ---------------------------
+	// Payloads are only read if asked for
+	page, more, err := s.ScanPoints(uuid.Nil, len(points), false)
+	require.NoError(t, err)
+	require.False(t, more)
+	require.Len(t, page, len(points))
+	for _, p := range page {
+		require.Nil(t, p.Payload)
+	}
+	require.NoError(t, s.Close())
+}
+
+func Test_CountPoints(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(10)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	count, err := s.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 10, count)
+	// ---------------------------
+	// Make the stored count drift
+	err = s.db.Write(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get(INTERNALBUCKETKEY)
+		require.NoError(t, err)
+		return changePointCount(b, 5)
+	})
+	require.NoError(t, err)
+	si, err := s.Info(false, false)
+	require.NoError(t, err)
+	require.EqualValues(t, 15, si.PointCount)
+	// ---------------------------
+	count, err = s.ReconcileCount()
+	require.NoError(t, err)
+	require.EqualValues(t, 10, count)
+	si, err = s.Info(false, false)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, si.PointCount)
+	require.NoError(t, s.Close())
+}
+
+func Test_InfoByteSizes(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(100)
+	points[0].Payload = []byte("metadata payload")
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// ---------------------------
+	si, err := s.Info(false, false)
+	require.NoError(t, err)
+	require.Zero(t, si.VectorBytes)
+	require.Zero(t, si.MetadataBytes)
+	// ---------------------------
+	si, err = s.Info(false, true)
+	require.NoError(t, err)
+	// The vector and flat properties each encode 2 float32 values in 11 bytes
+	require.EqualValues(t, 100*2*11, si.VectorBytes)
+	total := int64(len(points[0].Payload))
+	for _, p := range points {
+		total += int64(len(p.Data))
+	}
+	require.Equal(t, total, si.VectorBytes+si.MetadataBytes)
+	require.NoError(t, s.Close())
+}
+
+func Test_InfoEdgeDegrees(t *testing.T) {
+	s := tempShard(t)
+	require.NoError(t, s.InsertPoints(context.Background(), randPoints(100)))
+	// ---------------------------
+	si, err := s.Info(false, false)
+	require.NoError(t, err)
+	require.Nil(t, si.EdgeDegreeHistogram)
+	// ---------------------------
+	si, err = s.Info(true, false)
+	require.NoError(t, err)
+	require.Len(t, si.EdgeDegreeHistogram, 65)
+	total := 0
+	for _, count := range si.EdgeDegreeHistogram {
+		total += count
+	}
+	require.Equal(t, 100, total)
+	require.Zero(t, si.EdgeDegreeHistogram[0])
+	require.NoError(t, s.Close())
+}
+
+func Test_Analyze(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(100)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// ---------------------------
+	report, err := s.Analyze(context.Background(), nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 100, report.NodeCount)
+	require.Zero(t, report.SelfLoops)
+	require.Zero(t, report.DuplicateEdges)
+	require.Greater(t, report.AverageDegree, 0.0)
+	require.Zero(t, report.QueryCount)
+	// ---------------------------
+	// Every point is its own nearest neighbour
+	queries := make([][]float32, 10)
+	groundTruth := make([][]uuid.UUID, 10)
+	for i, p := range points[:10] {
+		queries[i] = getVector(p)
+		groundTruth[i] = []uuid.UUID{p.Id}
+	}
+	report, err = s.Analyze(context.Background(), queries, groundTruth)
+	require.NoError(t, err)
+	require.Equal(t, 10, report.QueryCount)
+	require.Equal(t, 1.0, report.Recall)
+	// ---------------------------
+	_, err = s.Analyze(context.Background(), queries, groundTruth[:5])
+	require.Error(t, err)
+	require.NoError(t, s.Close())
+}
+
+func Test_CalibrateSearchSize(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(100)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	queries := make([][]float32, 10)
+	groundTruth := make([][]uuid.UUID, 10)
+	for i, p := range points[:10] {
+		queries[i] = getVector(p)
+		groundTruth[i] = []uuid.UUID{p.Id}
+	}
+	// The smallest allowed search size already finds every point itself
+	searchSize, err := s.CalibrateSearchSize(context.Background(), queries, groundTruth, 1)
+	require.NoError(t, err)
+	require.Equal(t, 25, searchSize)
+	// ---------------------------
+	_, err = s.CalibrateSearchSize(context.Background(), queries, groundTruth, 1.5)
+	require.Error(t, err)
+	groundTruth[0] = []uuid.UUID{uuid.New()}
+	_, err = s.CalibrateSearchSize(context.Background(), queries, groundTruth, 0.9)
+	require.ErrorIs(t, err, ErrPointNotFound)
+	require.NoError(t, s.Close())
+}
+
+func Test_SetStartPoint(t *testing.T) {
+	dbpath := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	recorder := &testMetricsRecorder{}
+	s, err := NewShard(dbpath, sampleCol, cache.NewManager(-1), WithMetricsRecorder(recorder))
+	require.NoError(t, err)
+	points := randPoints(200)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	searchHops := func() int {
+		recorder.hops = 0
+		for _, p := range points[:50] {
+			_, err := s.SearchPoints(context.Background(), searchRequest(p, 1))
+			require.NoError(t, err)
+		}
+		return recorder.hops
+	}
+	hopsBefore := searchHops()
+	// ---------------------------
+	medoidId, err := s.ComputeMedoid(100)
+	require.NoError(t, err)
+	medoid, found, err := s.GetPoint(medoidId)
+	require.NoError(t, err)
+	require.True(t, found)
+	// The points are uniform over the unit square so the medoid is central
+	vector := getVector(medoid)
+	require.InDelta(t, 0.5, vector[0], 0.25)
+	require.InDelta(t, 0.5, vector[1], 0.25)
+	require.NoError(t, s.SetStartPoint(medoidId))
+	require.ErrorIs(t, s.SetStartPoint(uuid.New()), ErrPointNotFound)
+	// Searches start closer to the points so visit no more nodes
+	require.LessOrEqual(t, searchHops(), hopsBefore)
+	// Re-linking the start node does not duplicate the edges pointing to it
+	err = s.db.Read(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get(GRAPHINDEXBUCKETKEY)
+		require.NoError(t, err)
+		return b.ForEach(func(k, v []byte) error {
+			if k[len(k)-1] != 'e' {
+				return nil
+			}
+			edges, err := conversion.DecodeEdgeList(v)
+			require.NoError(t, err)
+			edgeSet := make(map[uint64]struct{}, len(edges))
+			for _, e := range edges {
+				edgeSet[e] = struct{}{}
+			}
+			require.Len(t, edgeSet, len(edges))
+			return nil
+		})
+	})
+	require.NoError(t, err)
+	// ---------------------------
+	// Deleting the point the start was moved to leaves the graph intact
+	_, err = s.DeletePoints(context.Background(), map[uuid.UUID]struct{}{medoidId: {}})
+	require.NoError(t, err)
+	reachable, total, err := s.CheckConnectivity()
+	require.NoError(t, err)
+	require.Equal(t, 199, total)
+	require.Equal(t, total, reachable)
+	for _, p := range points[:10] {
+		if p.Id == medoidId {
+			continue
+		}
+		res, err := s.SearchPoints(context.Background(), searchRequest(p, 1))
+		require.NoError(t, err)
+		require.Equal(t, p.Id, res[0].Point.Id)
+	}
+	require.NoError(t, s.Close())
+}
+
+func Test_DeletePointsDryRun(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(100)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	deleteSet := map[uuid.UUID]struct{}{uuid.New(): {}}
+	for _, p := range points[:50] {
+		deleteSet[p.Id] = struct{}{}
+	}
+	// ---------------------------
+	impact, err := s.DeletePointsDryRun(deleteSet)
+	require.NoError(t, err)
+	require.Equal(t, 50, impact.DeleteCount)
+	require.Greater(t, impact.PruneCount, 0)
+	// The remaining points and the start node of the graph
+	require.LessOrEqual(t, impact.PruneCount, 51)
+	for _, id := range impact.Orphaned {
+		require.NotContains(t, deleteSet, id)
+	}
+	// Nothing is deleted
+	si, err := s.Info(false, false)
+	require.NoError(t, err)
+	require.EqualValues(t, 100, si.PointCount)
+	_, found, err := s.GetPoint(points[0].Id)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.NoError(t, s.Close())
+}
+
+func Test_Vacuum(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(2000)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	deleteSet := make(map[uuid.UUID]struct{})
+	for _, p := range points[100:] {
+		deleteSet[p.Id] = struct{}{}
+	}
+	_, err := s.DeletePoints(context.Background(), deleteSet)
+	require.NoError(t, err)
+	// ---------------------------
+	si, err := s.Info(false, false)
+	require.NoError(t, err)
+	require.Greater(t, si.FreeSize, int64(0))
+	require.NoError(t, s.Vacuum())
+	vsi, err := s.Info(false, false)
+	require.NoError(t, err)
+	require.Less(t, vsi.Size, si.Size)
+	require.EqualValues(t, 100, vsi.PointCount)
+	// ---------------------------
+	// The shard keeps working after the database is swapped
+	res, err := s.SearchPoints(context.Background(), searchRequest(points[0], 1))
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, points[0].Id, res[0].Point.Id)
+	require.NoError(t, s.InsertPoints(context.Background(), randPoints(10)))
+	require.NoError(t, s.Close())
+}
+
+func Test_ReadOnly(t *testing.T) {
+	dbpath := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	s, err := NewShard(dbpath, sampleCol, cache.NewManager(-1))
+	require.NoError(t, err)
+	points := randPoints(50)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// Opening the shard again while it is in use times out
+	_, err = NewShard(dbpath, sampleCol, cache.NewManager(-1), WithTimeout(50*time.Millisecond))
+	require.Error(t, err)
+	require.NoError(t, s.Close())
+	// ---------------------------
+	rs, err := NewShard(dbpath, sampleCol, cache.NewManager(-1), WithReadOnly(), WithTimeout(time.Second))
+	require.NoError(t, err)
+	res, err := rs.SearchPoints(context.Background(), searchRequest(points[0], 1))
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, points[0].Id, res[0].Point.Id)
+	// ---------------------------
+	err = rs.InsertPoints(context.Background(), randPoints(1))
+	require.ErrorIs(t, err, diskstore.ErrReadOnly)
+	_, err = rs.UpdatePoints(context.Background(), points[:1])
+	require.ErrorIs(t, err, diskstore.ErrReadOnly)
+	_, err = rs.DeletePoints(context.Background(), map[uuid.UUID]struct{}{points[0].Id: {}})
+	require.ErrorIs(t, err, diskstore.ErrReadOnly)
+	require.NoError(t, rs.Close())
+}
+
+type testMetricsRecorder struct {
+	searches int
+	hops     int
+	inserted int
+}
+
+func (r *testMetricsRecorder) ObserveSearchLatency(time.Duration) { r.searches++ }
+func (r *testMetricsRecorder) ObserveGraphHops(hops int)          { r.hops += hops }
+func (r *testMetricsRecorder) IncInsert(count int)                { r.inserted += count }
+
+func Test_MetricsRecorder(t *testing.T) {
+	dbpath := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	recorder := &testMetricsRecorder{}
+	s, err := NewShard(dbpath, sampleCol, cache.NewManager(-1), WithMetricsRecorder(recorder))
+	require.NoError(t, err)
+	points := randPoints(50)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	require.Equal(t, 50, recorder.inserted)
+	// ---------------------------
+	_, err = s.SearchPoints(context.Background(), searchRequest(points[0], 5))
+	require.NoError(t, err)
+	require.Equal(t, 1, recorder.searches)
+	require.Greater(t, recorder.hops, 0)
+	require.NoError(t, s.Close())
+}
+
+func Test_NoSync(t *testing.T) {
+	dbpath := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	s, err := NewShard(dbpath, sampleCol, cache.NewManager(-1), WithNoSync())
+	require.NoError(t, err)
+	points := randPoints(20)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	require.NoError(t, s.Close())
+	// ---------------------------
+	s, err = NewShard(dbpath, sampleCol, cache.NewManager(-1))
+	require.NoError(t, err)
+	count, err := s.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 20, count)
+	require.NoError(t, s.Close())
+}
+
+func BenchmarkInsertSync(b *testing.B) {
+	for _, noSync := range []bool{false, true} {
+		b.Run(fmt.Sprintf("noSync=%v", noSync), func(b *testing.B) {
+			var opts []ShardOption
+			if noSync {
+				opts = append(opts, WithNoSync())
+			}
+			s, err := NewShard(filepath.Join(b.TempDir(), "sharddb.bbolt"), sampleCol, cache.NewManager(-1), opts...)
+			require.NoError(b, err)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, s.InsertPoints(context.Background(), randPoints(10)))
+			}
+			b.StopTimer()
+			require.NoError(b, s.Close())
+		})
+	}
+}
+
+func Test_OpenShard(t *testing.T) {
+	dbpath := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	s, err := NewShard(dbpath, sampleCol, cache.NewManager(-1))
+	require.NoError(t, err)
+	points := randPoints(20)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	require.NoError(t, s.Close())
+	// ---------------------------
+	opened, err := OpenShard(dbpath)
+	require.NoError(t, err)
+	require.Equal(t, sampleCol.Id, opened.collection.Id)
+	require.Equal(t, sampleCol.IndexSchema, opened.collection.IndexSchema)
+	res, err := opened.SearchPoints(context.Background(), searchRequest(points[0], 1))
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, points[0].Id, res[0].Point.Id)
+	require.NoError(t, opened.Close())
+	// ---------------------------
+	_, err = OpenShard(filepath.Join(t.TempDir(), "missing.bbolt"))
+	require.Error(t, err)
+}
+
+func Test_InMemory(t *testing.T) {
+	// In memory shards sharing a cache must not see each other's indexes
+	cm := cache.NewManager(-1)
+	sA, err := NewShard("", sampleCol, cm)
+	require.NoError(t, err)
+	sB, err := NewShard("", sampleCol, cm)
+	require.NoError(t, err)
+	pointsA := randPoints(20)
+	require.NoError(t, sA.InsertPoints(context.Background(), pointsA))
+	require.NoError(t, sB.InsertPoints(context.Background(), randPoints(20)))
+	res, err := sA.SearchPoints(context.Background(), searchRequest(pointsA[0], 20))
+	require.NoError(t, err)
+	require.Len(t, res, 20)
+	for _, r := range res {
+		_, found, err := sA.GetPoint(r.Point.Id)
+		require.NoError(t, err)
+		require.True(t, found)
+	}
+	// ---------------------------
+	require.ErrorIs(t, sA.Backup(1, 1), diskstore.ErrInMemory)
+	require.NoError(t, sA.Close())
+	require.NoError(t, sB.Close())
+}
+
+func Test_CancelledContext(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(100)
+	require.NoError(t, s.InsertPoints(context.Background(), points[:50]))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// ---------------------------
+	err := s.InsertPoints(ctx, points[50:])
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = s.UpdatePoints(ctx, points[:10])
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = s.DeletePoints(ctx, map[uuid.UUID]struct{}{points[0].Id: {}})
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = s.SearchPoints(ctx, searchRequest(points[0], 10))
+	require.ErrorIs(t, err, context.Canceled)
+	// ---------------------------
+	// Nothing was applied
+	count, err := s.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 50, count)
+	require.NoError(t, s.Close())
+}
+
+func Test_ChangedSince(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(10)
+	t0 := time.Now()
+	require.NoError(t, s.InsertPoints(context.Background(), points[:5]))
+	t1 := time.Now()
+	require.NoError(t, s.InsertPoints(context.Background(), points[5:]))
+	t2 := time.Now()
+	// ---------------------------
+	changes, err := s.ChangedSince(t0)
+	require.NoError(t, err)
+	require.Len(t, changes, 10)
+	changes, err = s.ChangedSince(t1)
+	require.NoError(t, err)
+	require.Len(t, changes, 5)
+	// Changes of the same write are ordered by point id
+	expected := make(map[uuid.UUID][]byte)
+	for _, p := range points[5:] {
+		expected[p.Id] = p.Data
+	}
+	for _, c := range changes {
+		require.Equal(t, ChangeInsert, c.Operation)
+		require.Equal(t, expected[c.Point.Id], c.Point.Data)
+	}
+	// ---------------------------
+	// Update one point and delete another
+	updatePoints := randPoints(1)
+	updatePoints[0].Id = points[0].Id
+	_, err = s.UpdatePoints(context.Background(), updatePoints)
+	require.NoError(t, err)
+	_, err = s.DeletePoints(context.Background(), map[uuid.UUID]struct{}{points[1].Id: {}})
+	require.NoError(t, err)
+	changes, err = s.ChangedSince(t2)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	require.Equal(t, ChangeUpdate, changes[0].Operation)
+	require.Equal(t, points[0].Id, changes[0].Point.Id)
+	require.Equal(t, ChangeDelete, changes[1].Operation)
+	require.Equal(t, points[1].Id, changes[1].Point.Id)
+	require.Nil(t, changes[1].Point.Data)
+	// Only the latest change of a point is kept
+	changes, err = s.ChangedSince(t0)
+	require.NoError(t, err)
+	require.Len(t, changes, 10)
+	// ---------------------------
+	// Page through the changes with a cursor
+	cursor := ChangeCursor{Timestamp: t0.UnixNano()}
+	paged := make([]PointChange, 0)
+	for {
+		page, next, err := s.ChangesAfter(cursor, 3)
+		require.NoError(t, err)
+		if len(page) == 0 {
+			require.Equal(t, cursor, next)
+			break
+		}
+		require.LessOrEqual(t, len(page), 3)
+		paged = append(paged, page...)
+		cursor = next
+	}
+	require.Equal(t, changes, paged)
+	require.NoError(t, s.Close())
+}
+
+func Test_SearchPointsFiltered(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(100)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// Only every tenth point passes the filter
+	filter := func(data []byte) bool {
+		var p models.PointAsMap
+		require.NoError(t, msgpack.Unmarshal(data, &p))
+		return p["size"].(int64)%10 == 0
+	}
+	sr := searchRequest(points[1], 5)
+	sr.Query.VectorVamana.SearchSize = 5
+	res, err := s.SearchPointsFiltered(context.Background(), sr, filter)
+	require.NoError(t, err)
+	require.Len(t, res, 5)
+	for _, r := range res {
+		require.True(t, filter(r.Point.Data))
+	}
+	// ---------------------------
+	// Asking for more than there are matches returns all of them
+	sr = searchRequest(points[1], 20)
+	res, err = s.SearchPointsFiltered(context.Background(), sr, filter)
+	require.NoError(t, err)
+	require.Len(t, res, 10)
+	// ---------------------------
+	// The unfiltered search is unaffected
+	res, err = s.SearchPoints(context.Background(), searchRequest(points[1], 5))
+	require.NoError(t, err)
+	require.Len(t, res, 5)
+	require.NoError(t, s.Close())
+}
+
+func Test_SearchPointsBatch(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(50)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	searchRequests := make([]models.SearchRequest, 10)
+	for i := range searchRequests {
+		searchRequests[i] = searchRequest(points[i], 5)
+	}
+	// One of the searches selects properties which must not affect the others
+	searchRequests[3].Select = []string{"size"}
+	batchResults, err := s.SearchPointsBatch(context.Background(), searchRequests)
+	require.NoError(t, err)
+	require.Len(t, batchResults, len(searchRequests))
+	// ---------------------------
+	// The batch should give the same results as individual searches
+	for i, sr := range searchRequests {
+		res, err := s.SearchPoints(context.Background(), sr)
+		require.NoError(t, err)
+		require.Equal(t, res, batchResults[i])
+		require.Equal(t, points[i].Id, batchResults[i][0].Point.Id)
+	}
+	require.NoError(t, s.Close())
+}
+
+func Test_ReEmbed(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(20)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// The new embedding swaps the vector components
+	swap := func(v []float32) []float32 {
+		return []float32{v[1], v[0]}
+	}
+	seen := make(map[uuid.UUID]int)
+	calls := 0
+	reEmbedFn := func(ctx context.Context, batch []models.Point) ([][]float32, error) {
+		calls++
+		if calls == 3 {
+			return nil, errors.New("embedding service unavailable")
+		}
+		vectors := make([][]float32, len(batch))
+		for i, p := range batch {
+			seen[p.Id]++
+			vectors[i] = swap(getVector(p))
+		}
+		return vectors, nil
+	}
+	opts := ReEmbedOptions{Property: "vector", BatchSize: 3}
+	// ---------------------------
+	// The third batch fails, the pass is resumed from where it stopped
+	count, err := s.ReEmbed(context.Background(), opts, reEmbedFn)
+	require.Error(t, err)
+	require.Equal(t, 6, count)
+	count, err = s.ReEmbed(context.Background(), opts, reEmbedFn)
+	require.NoError(t, err)
+	require.Equal(t, 14, count)
+	require.Len(t, seen, 20)
+	for _, c := range seen {
+		require.Equal(t, 1, c)
+	}
+	// ---------------------------
+	for _, p := range points {
+		newP, found, err := s.GetPoint(p.Id)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, swap(getVector(p)), getVector(newP))
+		// Searching with the new vector finds the point
+		res, err := s.SearchPoints(context.Background(), searchRequest(newP, 1))
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.Equal(t, p.Id, res[0].Point.Id)
+	}
+	// ---------------------------
+	// A completed pass starts again from the beginning
+	batch, err := s.ReEmbedBatch("vector", 50)
+	require.NoError(t, err)
+	require.Len(t, batch, 20)
+	require.Error(t, s.ApplyReEmbed("vector", []uuid.UUID{points[0].Id}, [][]float32{{1, 2, 3}}))
+	require.NoError(t, s.Close())
+}
+
+func Test_ApplyChanges(t *testing.T) {
+	primary := tempShard(t)
+	replica := tempShard(t)
+	points := randPoints(10)
+	require.NoError(t, primary.InsertPoints(context.Background(), points[:5]))
+	// ---------------------------
+	// The replica catches up with the primary
+	changes, cursor, err := primary.ChangesAfter(ChangeCursor{}, 0)
+	require.NoError(t, err)
+	require.NoError(t, replica.ApplyChanges(changes))
+	psi, err := primary.Info(false, false)
+	require.NoError(t, err)
+	rsi, err := replica.Info(false, false)
+	require.NoError(t, err)
+	require.Greater(t, psi.LastWriteTime, int64(0))
+	require.Equal(t, psi.LastWriteTime, rsi.LastWriteTime)
+	require.Equal(t, psi.PointCount, rsi.PointCount)
+	// ---------------------------
+	// The primary moves on and the replica lags behind
+	require.NoError(t, primary.InsertPoints(context.Background(), points[5:]))
+	updatePoints := randPoints(1)
+	updatePoints[0].Id = points[0].Id
+	_, err = primary.UpdatePoints(context.Background(), updatePoints)
+	require.NoError(t, err)
+	_, err = primary.DeletePoints(context.Background(), map[uuid.UUID]struct{}{points[1].Id: {}})
+	require.NoError(t, err)
+	psi, err = primary.Info(false, false)
+	require.NoError(t, err)
+	require.Greater(t, psi.LastWriteTime, rsi.LastWriteTime)
+	// ---------------------------
+	changes, _, err = primary.ChangesAfter(cursor, 0)
+	require.NoError(t, err)
+	require.NoError(t, replica.ApplyChanges(changes))
+	rsi, err = replica.Info(false, false)
+	require.NoError(t, err)
+	require.Equal(t, psi.LastWriteTime, rsi.LastWriteTime)
+	require.EqualValues(t, 9, rsi.PointCount)
+	p, found, err := replica.GetPoint(points[0].Id)
+	require.NoError(t, err)
+	require.True(t, found)
+	pp, _, err := primary.GetPoint(points[0].Id)
+	require.NoError(t, err)
+	require.Equal(t, pp.Data, p.Data)
+	_, found, err = replica.GetPoint(points[1].Id)
+	require.NoError(t, err)
+	require.False(t, found)
+	// The replica records the changes at the times of the primary
+	pchanges, _, err := primary.ChangesAfter(ChangeCursor{}, 0)
+	require.NoError(t, err)
+	rchanges, _, err := replica.ChangesAfter(ChangeCursor{}, 0)
+	require.NoError(t, err)
+	require.Len(t, rchanges, len(pchanges))
+	for i := range pchanges {
+		require.Equal(t, pchanges[i].Point.Id, rchanges[i].Point.Id)
+		require.Equal(t, pchanges[i].Operation, rchanges[i].Operation)
+		require.Equal(t, pchanges[i].Timestamp, rchanges[i].Timestamp)
+	}
+	// ---------------------------
+	// A failing apply leaves the replica as it was
+	badPoint := randPoints(1)[0]
+	badPoint.Data, err = msgpack.Marshal(models.PointAsMap{"vector": []float32{1, 2, 3}})
+	require.NoError(t, err)
+	require.Error(t, replica.ApplyChanges([]PointChange{
+		{Point: models.Point{Id: points[2].Id}, Operation: ChangeDelete, Timestamp: psi.LastWriteTime + 1},
+		{Point: badPoint, Operation: ChangeInsert, Timestamp: psi.LastWriteTime + 2},
+	}))
+	_, found, err = replica.GetPoint(points[2].Id)
+	require.NoError(t, err)
+	require.True(t, found)
+	rsi, err = replica.Info(false, false)
+	require.NoError(t, err)
+	require.Equal(t, psi.LastWriteTime, rsi.LastWriteTime)
+	require.NoError(t, primary.Close())
+	require.NoError(t, replica.Close())
+}
+
+// quantizedCol is the sample collection with a product quantized vector index
+func quantizedCol() models.Collection {
+	col := sampleCol
+	col.IndexSchema = models.IndexSchema{
+		"vector": models.IndexSchemaValue{
+			Type: models.IndexTypeVectorVamana,
+			VectorVamana: &models.IndexVectorVamanaParameters{
+				VectorSize:     2,
+				DistanceMetric: models.DistanceEuclidean,
+				SearchSize:     75,
+				DegreeBound:    64,
+				Alpha:          1.2,
+				Quantizer: &models.Quantizer{
+					Type: models.QuantizerProduct,
+					Product: &models.ProductQuantizerParameters{
+						NumCentroids:     16,
+						NumSubVectors:    2,
+						TriggerThreshold: 1000,
+					},
+				},
+			},
+		},
+	}
+	return col
+}
+
+func Test_TrainQuantizer(t *testing.T) {
+	// The sample collection has no quantizers to train
+	s := tempShard(t)
+	require.Error(t, s.TrainQuantizer(10))
+	require.NoError(t, s.Close())
+	// ---------------------------
+	col := quantizedCol()
+	dbFile := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	s, err := NewShard(dbFile, col, cache.NewManager(-1))
+	require.NoError(t, err)
+	points := randPoints(50)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	require.NoError(t, s.TrainQuantizer(20))
+	// Points are now searched using the codes
+	res, err := s.SearchPoints(context.Background(), searchRequest(points[0], 5))
+	require.NoError(t, err)
+	require.Len(t, res, 5)
+	// Retraining works on already encoded points
+	require.NoError(t, s.TrainQuantizer(0))
+	require.NoError(t, s.Close())
+}
+
+func Test_SearchPointsWithCount(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(20)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// Every point has a size below 100
+	sr := models.SearchRequest{
+		Query: models.Query{
+			Property: "size",
+			Integer: &models.SearchIntegerOptions{
+				Value:    100,
+				Operator: models.OperatorLessThan,
+			},
+		},
+		Limit: 5,
+	}
+	res, count, err := s.SearchPointsWithCount(context.Background(), sr)
+	require.NoError(t, err)
+	require.Len(t, res, 5)
+	require.Equal(t, 20, count)
+	// ---------------------------
+	// Vector searches are bounded by the vector query limit
+	sr = searchRequest(points[0], 5)
+	sr.Query.VectorVamana.Limit = 10
+	res, count, err = s.SearchPointsWithCount(context.Background(), sr)
+	require.NoError(t, err)
+	require.Len(t, res, 5)
+	require.Equal(t, 10, count)
+	require.NoError(t, s.Close())
+}
+
+func Test_Payload(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(5)
+	// The payload is larger than the maximum point size of the user plan
+	payload := bytes.Repeat([]byte("unindexed "), 2000)
+	points[0].Payload = payload
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// ---------------------------
+	// Payloads are not returned unless asked for
+	res, err := s.SearchPoints(context.Background(), searchRequest(points[0], 1))
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Nil(t, res[0].Payload)
+	sr := searchRequest(points[0], 1)
+	sr.IncludePayload = true
+	res, err = s.SearchPoints(context.Background(), sr)
+	require.NoError(t, err)
+	require.Equal(t, payload, res[0].Payload)
+	p, found, err := s.GetPoint(points[0].Id)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Nil(t, p.Payload)
+	require.Equal(t, points[0].Data, p.Data)
+	stored, err := s.GetPayload(points[0].Id)
+	require.NoError(t, err)
+	require.Equal(t, payload, stored)
+	// ---------------------------
+	// The payload is not indexed
+	sr = models.SearchRequest{
+		Query: models.Query{
+			Property: "description",
+			Text: &models.SearchTextOptions{
+				Value:    "unindexed",
+				Operator: models.OperatorContainsAny,
+				Limit:    10,
+			},
+		},
+		Limit: 10,
+	}
+	res, err = s.SearchPoints(context.Background(), sr)
+	require.NoError(t, err)
+	require.Len(t, res, 0)
+	// ---------------------------
+	// Updating without a payload keeps it, deleting removes it
+	updatePoints := randPoints(1)
+	updatePoints[0].Id = points[0].Id
+	_, err = s.UpdatePoints(context.Background(), updatePoints)
+	require.NoError(t, err)
+	stored, err = s.GetPayload(points[0].Id)
+	require.NoError(t, err)
+	require.Equal(t, payload, stored)
+	updatePoints[0].Payload = []byte("new payload")
+	_, err = s.UpdatePoints(context.Background(), updatePoints)
+	require.NoError(t, err)
+	stored, err = s.GetPayload(points[0].Id)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new payload"), stored)
+	_, err = s.DeletePoints(context.Background(), map[uuid.UUID]struct{}{points[0].Id: {}})
+	require.NoError(t, err)
+	stored, err = s.GetPayload(points[0].Id)
+	require.NoError(t, err)
+	require.Nil(t, stored)
+	require.NoError(t, s.Close())
+}
+
+func Test_Merge(t *testing.T) {
+	s := tempShard(t)
+	other := tempShard(t)
+	points := randPoints(60)
+	points[50].Payload = []byte("merged payload")
+	require.NoError(t, s.InsertPoints(context.Background(), points[:40]))
+	require.NoError(t, other.InsertPoints(context.Background(), points[40:]))
+	// ---------------------------
+	require.NoError(t, s.Merge(other))
+	count, err := s.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 60, count)
+	// The merged points are searchable in the receiving shard
+	for _, p := range points[40:] {
+		res, err := s.SearchPoints(context.Background(), searchRequest(p, 1))
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.Equal(t, p.Id, res[0].Point.Id)
+	}
+	payload, err := s.GetPayload(points[50].Id)
+	require.NoError(t, err)
+	require.Equal(t, points[50].Payload, payload)
+	// The other shard is left untouched
+	count, err = other.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 20, count)
+	// ---------------------------
+	// Merging again conflicts on every point and inserts nothing
+	require.Error(t, s.Merge(other))
+	count, err = s.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 60, count)
+}
+
+func Test_Split(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(200)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	dir := t.TempDir()
+	left, right, err := s.Split(filepath.Join(dir, "left.bbolt"), filepath.Join(dir, "right.bbolt"))
+	require.NoError(t, err)
+	defer left.Close()
+	defer right.Close()
+	// ---------------------------
+	leftCount, err := left.CountPoints()
+	require.NoError(t, err)
+	rightCount, err := right.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 200, leftCount+rightCount)
+	// The median split gives roughly equal halves
+	require.InDelta(t, 100, leftCount, 20)
+	// ---------------------------
+	// Each point is in exactly one half and searching that half finds it
+	for _, p := range points {
+		_, inLeft, err := left.GetPoint(p.Id)
+		require.NoError(t, err)
+		_, inRight, err := right.GetPoint(p.Id)
+		require.NoError(t, err)
+		require.NotEqual(t, inLeft, inRight)
+		half := right
+		if inLeft {
+			half = left
+		}
+		res, err := half.SearchPoints(context.Background(), searchRequest(p, 1))
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.Equal(t, p.Id, res[0].Point.Id)
+	}
+	// The original shard is left untouched
+	count, err := s.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 200, count)
+}
+
+func Test_SplitEncrypted(t *testing.T) {
+	key := bytes.Repeat([]byte{42}, 32)
+	s, err := NewEncryptedShard(filepath.Join(t.TempDir(), "sharddb.bbolt"), sampleCol, cache.NewManager(-1), key)
+	require.NoError(t, err)
+	points := randPoints(50)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	dir := t.TempDir()
+	leftDbFile, rightDbFile := filepath.Join(dir, "left.bbolt"), filepath.Join(dir, "right.bbolt")
+	left, right, err := s.Split(leftDbFile, rightDbFile)
+	require.NoError(t, err)
+	leftCount, err := left.CountPoints()
+	require.NoError(t, err)
+	rightCount, err := right.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 50, leftCount+rightCount)
+	require.NoError(t, left.Close())
+	require.NoError(t, right.Close())
+	require.NoError(t, s.Close())
+	// ---------------------------
+	// Both halves need the key of the original shard
+	for _, dbFile := range []string{leftDbFile, rightDbFile} {
+		raw, err := os.ReadFile(dbFile)
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(raw, []byte("This is a description")))
+		_, err = NewShard(dbFile, sampleCol, cache.NewManager(-1))
+		require.ErrorIs(t, err, ErrEncryptionKey)
+		half, err := NewEncryptedShard(dbFile, sampleCol, cache.NewManager(-1), key)
+		require.NoError(t, err)
+		require.NoError(t, half.Close())
+	}
+}
+
+func Test_SplitFailure(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(20)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// The split vector of the point with the largest id is too long, sampling
+	// still works but inserting it into a new shard fails
+	last := points[0]
+	for _, p := range points {
+		if bytes.Compare(p.Id[:], last.Id[:]) > 0 {
+			last = p
+		}
+	}
+	property, err := s.splitProperty()
+	require.NoError(t, err)
+	badData, err := msgpack.Marshal(models.PointAsMap{property: []float32{1, 2, 3}})
+	require.NoError(t, err)
+	err = s.db.Write(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get(POINTSBUCKETKEY)
+		require.NoError(t, err)
+		nodeId, err := GetPointNodeIdByUUID(b, last.Id)
+		require.NoError(t, err)
+		return b.Put(conversion.NodeKey(nodeId, 'd'), badData)
+	})
+	require.NoError(t, err)
+	// ---------------------------
+	dir := t.TempDir()
+	leftFile, rightFile := filepath.Join(dir, "left.bbolt"), filepath.Join(dir, "right.bbolt")
+	left, right, err := s.Split(leftFile, rightFile)
+	require.ErrorIs(t, err, ErrDimMismatch)
+	require.Nil(t, left)
+	require.Nil(t, right)
+	require.NoFileExists(t, leftFile)
+	require.NoFileExists(t, rightFile)
+}
+
+func Test_InsertPointsStream(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(25)
+	pointsC := make(chan models.Point)
+	go func() {
+		for _, p := range points {
+			pointsC <- p
+		}
+		close(pointsC)
+	}()
+	count, err := s.InsertPointsStream(context.Background(), pointsC, 10)
+	require.NoError(t, err)
+	require.Equal(t, 25, count)
+	pointCount, err := s.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 25, pointCount)
+	res, err := s.SearchPoints(context.Background(), searchRequest(points[24], 1))
+	require.NoError(t, err)
+	require.Equal(t, points[24].Id, res[0].Point.Id)
+	// ---------------------------
+	// A failing chunk keeps the earlier chunks
+	pointsC = make(chan models.Point, 20)
+	for _, p := range randPoints(10) {
+		pointsC <- p
+	}
+	for _, p := range points[:10] {
+		pointsC <- p
+	}
+	close(pointsC)
+	count, err = s.InsertPointsStream(context.Background(), pointsC, 10)
+	require.Error(t, err)
+	require.Equal(t, 10, count)
+	pointCount, err = s.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 35, pointCount)
+}
+
+func Test_InsertPointsCrashAtomic(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(40)
+	require.NoError(t, s.InsertPoints(context.Background(), points[:20]))
+	// The batch fails on the last point after the others have been indexed
+	batch := append(slices.Clone(points[20:]), points[0])
+	require.Error(t, s.InsertPoints(context.Background(), batch))
+	// ---------------------------
+	// A copy of the file is what a crash at this point would leave on disk
+	crashed := filepath.Join(t.TempDir(), "crashed.bbolt")
+	require.NoError(t, s.db.BackupToFile(crashed))
+	require.NoError(t, s.Close())
+	recovered, err := OpenShard(crashed)
+	require.NoError(t, err)
+	pointCount, err := recovered.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 20, pointCount)
+	reachable, total, err := recovered.CheckConnectivity()
+	require.NoError(t, err)
+	require.Equal(t, 20, total)
+	require.Equal(t, 20, reachable)
+	_, found, err := recovered.GetPoint(points[20].Id)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.NoError(t, recovered.Close())
+}
+
+func Test_DeleteStartPoint(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(50)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// A corrupt mapping points a user point at the start node
+	corrupt := uuid.New()
+	err := s.db.Write(func(bm diskstore.BucketManager) error {
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return err
+		}
+		return bPoints.Put(PointKey(corrupt, 'i'), conversion.Uint64ToBytes(vamana.STARTID))
+	})
+	require.NoError(t, err)
+	deleteSet := map[uuid.UUID]struct{}{corrupt: {}, points[0].Id: {}}
+	deletedIds, err := s.DeletePoints(context.Background(), deleteSet)
+	require.NoError(t, err)
+	require.Equal(t, []uuid.UUID{points[0].Id}, deletedIds)
+	res, err := s.SearchPoints(context.Background(), searchRequest(points[1], 5))
+	require.NoError(t, err)
+	require.Equal(t, points[1].Id, res[0].Point.Id)
+	require.NoError(t, s.Close())
+}
+
+func Test_StartNodeRecovery(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	s, err := NewShard(dbFile, sampleCol, cache.NewManager(-1))
+	require.NoError(t, err)
+	points := randPoints(50)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// Lose the edges of the start node
+	err = s.db.Write(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get(fmt.Sprintf("index/%s/vector", models.IndexTypeVectorVamana))
+		if err != nil {
+			return err
+		}
+		return b.Delete(conversion.NodeKey(vamana.STARTID, 'e'))
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	// ---------------------------
+	s, err = NewShard(dbFile, sampleCol, cache.NewManager(-1))
+	require.NoError(t, err)
+	res, err := s.SearchPoints(context.Background(), searchRequest(points[1], 5))
+	require.NoError(t, err)
+	require.Len(t, res, 5)
+	require.Equal(t, points[1].Id, res[0].Point.Id)
+	require.NoError(t, s.Close())
+}
+
+func Test_SearchPointsBatchQuantized(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	s, err := NewShard(dbFile, quantizedCol(), cache.NewManager(-1))
+	require.NoError(t, err)
+	points := randPoints(100)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	require.NoError(t, s.TrainQuantizer(0))
+	// ---------------------------
+	// Batched query lookup tables give the same results as per query ones
+	searchRequests := make([]models.SearchRequest, 20)
+	for i := range searchRequests {
+		searchRequests[i] = searchRequest(points[i], 10)
+	}
+	batchResults, err := s.SearchPointsBatch(context.Background(), searchRequests)
+	require.NoError(t, err)
+	for i, sr := range searchRequests {
+		res, err := s.SearchPoints(context.Background(), sr)
+		require.NoError(t, err)
+		require.Equal(t, res, batchResults[i])
+	}
+	require.NoError(t, s.Close())
+}
+
+func Test_UpsertPoints(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(20)
+	require.NoError(t, s.InsertPoints(context.Background(), points[:10]))
+	require.Error(t, s.InsertPoints(context.Background(), points[5:15]))
+	// ---------------------------
+	// Retrying with an upsert replaces the existing points and inserts the rest
+	retried := slices.Clone(points[5:15])
+	retried[0].Data = points[19].Data
+	existingIds, err := s.UpsertPoints(context.Background(), retried)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []uuid.UUID{points[5].Id, points[6].Id, points[7].Id, points[8].Id, points[9].Id}, existingIds)
+	count, err := s.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 15, count)
+	reconciled, err := s.ReconcileCount()
+	require.NoError(t, err)
+	require.EqualValues(t, 15, reconciled)
+	// ---------------------------
+	// The replaced data is indexed under the same point
+	p, found, err := s.GetPoint(points[5].Id)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, points[19].Data, p.Data)
+	res, err := s.SearchPoints(context.Background(), searchRequest(points[19], 1))
+	require.NoError(t, err)
+	require.Equal(t, points[5].Id, res[0].Point.Id)
+	require.Equal(t, 15, getVectorCount(s))
+	require.NoError(t, s.Close())
+}
+
+func Test_EncryptedShard(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	key := bytes.Repeat([]byte{42}, 32)
+	s, err := NewEncryptedShard(dbFile, sampleCol, cache.NewManager(-1), key)
+	require.NoError(t, err)
+	points := randPoints(20)
+	points[0].Payload = []byte("secret payload")
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// ---------------------------
+	// Search and reads are transparent with the key
+	res, err := s.SearchPoints(context.Background(), searchRequest(points[0], 1))
+	require.NoError(t, err)
+	require.Equal(t, points[0].Id, res[0].Point.Id)
+	require.Equal(t, points[0].Data, res[0].Point.Data)
+	payload, err := s.GetPayload(points[0].Id)
+	require.NoError(t, err)
+	require.Equal(t, points[0].Payload, payload)
+	require.NoError(t, s.Close())
+	// ---------------------------
+	// The plaintext is not on disk
+	raw, err := os.ReadFile(dbFile)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(raw, []byte("This is a description")))
+	require.False(t, bytes.Contains(raw, points[0].Payload))
+	var rawVector []byte
+	for _, f := range getVector(points[0]) {
+		rawVector = append(rawVector, conversion.SingleFloat32ToBytes(f)...)
+	}
+	require.False(t, bytes.Contains(raw, rawVector))
+	// ---------------------------
+	// The shard can't be opened without the right key
+	_, err = NewShard(dbFile, sampleCol, cache.NewManager(-1))
+	require.ErrorIs(t, err, ErrEncryptionKey)
+	_, err = NewEncryptedShard(dbFile, sampleCol, cache.NewManager(-1), bytes.Repeat([]byte{7}, 32))
+	require.ErrorIs(t, err, ErrEncryptionKey)
+	// ---------------------------
+	// Rotating the key keeps the data readable with the new key only
+	s, err = NewEncryptedShard(dbFile, sampleCol, cache.NewManager(-1), key)
+	require.NoError(t, err)
+	newKey := bytes.Repeat([]byte{7}, 32)
+	require.NoError(t, s.RotateEncryptionKey(newKey))
+	p, found, err := s.GetPoint(points[1].Id)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, points[1].Data, p.Data)
+	require.NoError(t, s.Close())
+	_, err = NewEncryptedShard(dbFile, sampleCol, cache.NewManager(-1), key)
+	require.ErrorIs(t, err, ErrEncryptionKey)
+	s, err = NewEncryptedShard(dbFile, sampleCol, cache.NewManager(-1), newKey)
+	require.NoError(t, err)
+	payload, err = s.GetPayload(points[0].Id)
+	require.NoError(t, err)
+	require.Equal(t, points[0].Payload, payload)
+	require.NoError(t, s.Close())
+}
+
+func Test_EncryptedShardCorruption(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	key := bytes.Repeat([]byte{42}, 32)
+	s, err := NewEncryptedShard(dbFile, sampleCol, cache.NewManager(-1), key)
+	require.NoError(t, err)
+	points := randPoints(20)
+	points[0].Payload = []byte("secret payload")
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// ---------------------------
+	// Flip a byte of the sealed payload underneath the encryption
+	raw := unversioned(s.db).(*encryptedStore).DiskStore
+	err = raw.Write(func(bm diskstore.BucketManager) error {
+		b, err := bm.Get(PAYLOADSBUCKETKEY)
+		require.NoError(t, err)
+		var payloadKey, sealed []byte
+		b.ForEach(func(k, v []byte) error {
+			payloadKey, sealed = k, bytes.Clone(v)
+			return nil
+		})
+		sealed[len(sealed)-1] ^= 0xff
+		return b.Put(payloadKey, sealed)
+	})
+	require.NoError(t, err)
+	// ---------------------------
+	// The payload is not reported as missing
+	_, err = s.GetPayload(points[0].Id)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "could not decrypt")
+	require.NoError(t, s.Close())
+}
+
+func Test_SearchPointsReranked(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	s, err := NewShard(dbFile, quantizedCol(), cache.NewManager(-1))
+	require.NoError(t, err)
+	points := randPoints(200)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	require.NoError(t, s.TrainQuantizer(0))
+	// ---------------------------
+	sr := searchRequest(points[0], 10)
+	sr.Query.VectorVamana.Rerank = &models.SearchVectorRerankOptions{Factor: 4}
+	res, err := s.SearchPoints(context.Background(), sr)
+	require.NoError(t, err)
+	require.Len(t, res, 10)
+	require.Equal(t, points[0].Id, res[0].Point.Id)
+	// The distances are exact and in order
+	query := getVector(points[0])
+	for i, r := range res {
+		vector := getVector(r.Point)
+		dx, dy := vector[0]-query[0], vector[1]-query[1]
+		require.InDelta(t, dx*dx+dy*dy, *r.Distance, 1e-6)
+		if i > 0 {
+			require.LessOrEqual(t, *res[i-1].Distance, *r.Distance)
+		}
+	}
+	require.NoError(t, s.Close())
+}
+
+func Test_SearchPointsRerankedNormalized(t *testing.T) {
+	col := sampleCol
+	col.IndexSchema = models.IndexSchema{
+		"vector": models.IndexSchemaValue{
+			Type: models.IndexTypeVectorVamana,
+			VectorVamana: &models.IndexVectorVamanaParameters{
+				VectorSize:     2,
+				DistanceMetric: models.DistanceCosine,
+				SearchSize:     75,
+				DegreeBound:    64,
+				Alpha:          1.2,
+				AutoNormalize:  true,
+			},
+		},
+	}
+	dbFile := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	s, err := NewShard(dbFile, col, cache.NewManager(-1))
+	require.NoError(t, err)
+	// Vectors far from unit length
+	pointsAsMap := randPointsAsMap(100)
+	for _, p := range pointsAsMap {
+		vector := p["vector"].([]float32)
+		vector[0], vector[1] = vector[0]*10+1, vector[1]*10+1
+	}
+	points := pointsAsMapToPoints(pointsAsMap)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// ---------------------------
+	sr := searchRequest(points[0], 10)
+	sr.Query.VectorVamana.Rerank = &models.SearchVectorRerankOptions{Factor: 4}
+	res, err := s.SearchPoints(context.Background(), sr)
+	require.NoError(t, err)
+	require.Len(t, res, 10)
+	// The exact distances are cosine distances of the unit vectors
+	query := getVector(points[0])
+	distance.Normalize(query)
+	for i, r := range res {
+		vector := getVector(r.Point)
+		distance.Normalize(vector)
+		require.InDelta(t, 1-(vector[0]*query[0]+vector[1]*query[1]), *r.Distance, 1e-5)
+		require.GreaterOrEqual(t, *r.Distance, float32(-1e-5))
+		if i > 0 {
+			require.LessOrEqual(t, *res[i-1].Distance, *r.Distance)
+		}
+	}
+	require.InDelta(t, 0, *res[0].Distance, 1e-5)
+	require.NoError(t, s.Close())
+}
+
+func Test_BackupIncremental(t *testing.T) {
+	dir := t.TempDir()
+	s := tempShard(t)
+	points := randPoints(200)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	base := filepath.Join(dir, "base.bbolt")
+	require.NoError(t, s.db.BackupToFile(base))
+	// ---------------------------
+	// A delta per round of changes, each against the previous restored state
+	prev := filepath.Join(dir, "prev.bbolt")
+	require.NoError(t, s.db.BackupToFile(prev))
+	deleteSet := map[uuid.UUID]struct{}{points[0].Id: {}, points[1].Id: {}}
+	_, err := s.DeletePoints(context.Background(), deleteSet)
+	require.NoError(t, err)
+	newPoints := randPoints(5)
+	require.NoError(t, s.InsertPoints(context.Background(), newPoints))
+	delta1 := filepath.Join(dir, "delta1")
+	require.NoError(t, s.BackupIncremental(prev, delta1))
+	require.NoError(t, RestoreFromDeltas(prev, []string{delta1}))
+	require.NoError(t, s.InsertPoints(context.Background(), randPoints(3)))
+	delta2 := filepath.Join(dir, "delta2")
+	require.NoError(t, s.BackupIncremental(prev, delta2))
+	// The deltas only hold the changes
+	baseInfo, err := os.Stat(base)
+	require.NoError(t, err)
+	deltaInfo, err := os.Stat(delta1)
+	require.NoError(t, err)
+	require.Less(t, deltaInfo.Size(), baseInfo.Size()/2)
+	// ---------------------------
+	require.NoError(t, RestoreFromDeltas(base, []string{delta1, delta2}))
+	restored, err := OpenShard(base)
+	require.NoError(t, err)
+	si, err := restored.Info(false, false)
+	require.NoError(t, err)
+	require.EqualValues(t, 206, si.PointCount)
+	ids := make(map[uuid.UUID]struct{})
+	require.NoError(t, restored.IterPoints(func(p models.Point) error {
+		ids[p.Id] = struct{}{}
+		return nil
+	}))
+	require.Len(t, ids, 206)
+	require.NotContains(t, ids, points[0].Id)
+	require.Contains(t, ids, newPoints[0].Id)
+	res, err := restored.SearchPoints(context.Background(), searchRequest(newPoints[0], 1))
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, newPoints[0].Id, res[0].Point.Id)
+	require.NoError(t, restored.Close())
+	// ---------------------------
+	// Truncated deltas are rejected without changing the base
+	data, err := os.ReadFile(delta1)
+	require.NoError(t, err)
+	truncated := filepath.Join(dir, "truncated")
+	require.NoError(t, os.WriteFile(truncated, data[:len(data)-1], 0644))
+	require.Error(t, RestoreFromDeltas(base, []string{truncated}))
+	// So are deltas with a corrupt field length, without allocating it
+	corrupt := append(append([]byte{}, deltaMagic...), deltaVersion, deltaOpPut)
+	corrupt = binary.AppendUvarint(corrupt, 1<<62)
+	corruptPath := filepath.Join(dir, "corrupt")
+	require.NoError(t, os.WriteFile(corruptPath, corrupt, 0644))
+	require.ErrorContains(t, RestoreFromDeltas(base, []string{corruptPath}), "exceeds delta file size")
+	require.NoError(t, s.Close())
+}
+
+func Test_BackupTo(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(100)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	var buf bytes.Buffer
+	n, err := s.BackupTo(&buf)
+	require.NoError(t, err)
+	require.EqualValues(t, buf.Len(), n)
+	require.NoError(t, s.Close())
+	// ---------------------------
+	backupPath := filepath.Join(t.TempDir(), "backup.bbolt")
+	require.NoError(t, os.WriteFile(backupPath, buf.Bytes(), 0644))
+	restored, err := OpenShard(backupPath)
+	require.NoError(t, err)
+	si, err := restored.Info(false, false)
+	require.NoError(t, err)
+	require.EqualValues(t, 100, si.PointCount)
+	res, err := restored.SearchPoints(context.Background(), searchRequest(points[0], 1))
+	require.NoError(t, err)
+	require.Equal(t, points[0].Id, res[0].Point.Id)
+	require.NoError(t, restored.Close())
+	// ---------------------------
+	inMemory, err := NewShard("", sampleCol, cache.NewManager(-1))
+	require.NoError(t, err)
+	_, err = inMemory.BackupTo(&buf)
+	require.ErrorIs(t, err, diskstore.ErrInMemory)
+}
+
+func Test_Snapshot(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(100)
+	require.NoError(t, s.InsertPoints(context.Background(), points[:50]))
+	snap, err := s.Snapshot()
+	require.NoError(t, err)
+	require.FileExists(t, snap.file)
+	// Later writes to the shard are not seen by the snapshot
+	require.NoError(t, s.InsertPoints(context.Background(), points[50:]))
+	count, err := snap.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 50, count)
+	seen := 0
+	require.NoError(t, snap.IterPoints(func(p models.Point) error {
+		seen++
+		return nil
+	}))
+	require.Equal(t, 50, seen)
+	res, err := snap.SearchPoints(context.Background(), searchRequest(points[0], 1))
+	require.NoError(t, err)
+	require.Equal(t, points[0].Id, res[0].Point.Id)
+	res, err = snap.SearchPoints(context.Background(), searchRequest(points[99], 1))
+	require.NoError(t, err)
+	require.NotEqual(t, points[99].Id, res[0].Point.Id)
+	// ---------------------------
+	require.NoError(t, snap.Close())
+	require.NoFileExists(t, snap.file)
+	count, err = s.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 100, count)
+	require.NoError(t, s.Close())
+	// ---------------------------
+	inMemory, err := NewShard("", sampleCol, cache.NewManager(-1))
+	require.NoError(t, err)
+	_, err = inMemory.Snapshot()
+	require.ErrorIs(t, err, diskstore.ErrInMemory)
+}
+
+func Test_ResultCache(t *testing.T) {
+	dbpath := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	s, err := NewShard(dbpath, sampleCol, cache.NewManager(-1), WithResultCache(2))
+	require.NoError(t, err)
+	points := randPoints(100)
+	require.NoError(t, s.InsertPoints(context.Background(), points[:50]))
+	// ---------------------------
+	res, err := s.SearchPoints(context.Background(), searchRequest(points[99], 1))
+	require.NoError(t, err)
+	require.Equal(t, 1, s.resultCache.order.Len())
+	cached, err := s.SearchPoints(context.Background(), searchRequest(points[99], 1))
+	require.NoError(t, err)
+	require.Equal(t, res, cached)
+	require.Equal(t, 1, s.resultCache.order.Len())
+	// Modifying returned results leaves the cached ones intact
+	*cached[0].Distance = -1
+	cached[0].Data[0] ^= 0xff
+	cached, err = s.SearchPoints(context.Background(), searchRequest(points[99], 1))
+	require.NoError(t, err)
+	require.Equal(t, res, cached)
+	// Least recently used searches are evicted
+	for _, p := range points[:3] {
+		_, err := s.SearchPoints(context.Background(), searchRequest(p, 1))
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, s.resultCache.order.Len())
+	// ---------------------------
+	// Writes clear the cache so the newly inserted point is found
+	require.NoError(t, s.InsertPoints(context.Background(), points[99:]))
+	require.Equal(t, 0, s.resultCache.order.Len())
+	res, err = s.SearchPoints(context.Background(), searchRequest(points[99], 1))
+	require.NoError(t, err)
+	require.Equal(t, points[99].Id, res[0].Point.Id)
+	// Results of a search that overlapped a write are not cached
+	key, ok := requestKey(searchRequest(points[0], 1))
+	require.True(t, ok)
+	version := s.resultCache.version.Load()
+	s.resultCache.invalidate()
+	s.resultCache.put(key, version, res, 1, 0)
+	_, _, found := s.resultCache.get(key)
+	require.False(t, found)
+	// Entries are stale once a candidate expires
+	s.resultCache.put(key, s.resultCache.version.Load(), res, 1, time.Now().Unix()-1)
+	_, _, found = s.resultCache.get(key)
+	require.False(t, found)
+	require.Equal(t, 0, s.resultCache.order.Len())
+	// The earliest expiry of the candidates is kept with the entry
+	expiring := randPoints(1)
+	expiring[0].ExpiresAt = time.Now().Unix() + 60
+	require.NoError(t, s.InsertPoints(context.Background(), expiring))
+	res, err = s.SearchPoints(context.Background(), searchRequest(expiring[0], 1))
+	require.NoError(t, err)
+	require.Equal(t, expiring[0].Id, res[0].Point.Id)
+	key, ok = requestKey(searchRequest(expiring[0], 1))
+	require.True(t, ok)
+	require.Equal(t, expiring[0].ExpiresAt, s.resultCache.entries[key].Value.(*resultCacheEntry).expiresAt)
+	s.resultCache.invalidate()
+	// Filtered searches bypass the cache
+	_, err = s.SearchPointsFiltered(context.Background(), searchRequest(points[1], 1), func([]byte) bool { return true })
+	require.NoError(t, err)
+	require.Equal(t, 0, s.resultCache.order.Len())
+	require.NoError(t, s.Close())
+}
+
+func Test_SentinelErrors(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(2)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	err := s.InsertPoints(context.Background(), points[:1])
+	require.ErrorIs(t, err, ErrPointExists)
+	require.ErrorContains(t, err, points[0].Id.String())
+	_, err = s.SearchByPointId(context.Background(), uuid.New(), 1)
+	require.ErrorIs(t, err, ErrPointNotFound)
+	// The deprecated name still matches
+	require.ErrorIs(t, err, ErrPointDoesNotExist)
+	// ---------------------------
+	require.NoError(t, s.Close())
+	_, err = s.SearchPoints(context.Background(), searchRequest(points[0], 1))
+	require.ErrorIs(t, err, ErrShardClosed)
+	err = s.InsertPoints(context.Background(), randPoints(1))
+	require.ErrorIs(t, err, ErrShardClosed)
+	// ---------------------------
+	inMemory, err := NewShard("", sampleCol, cache.NewManager(-1))
+	require.NoError(t, err)
+	require.NoError(t, inMemory.Close())
+	_, err = inMemory.CountPoints()
+	require.ErrorIs(t, err, ErrShardClosed)
+}
+
+func Test_CustomDistanceMetric(t *testing.T) {
+	vv := *sampleIndexSchema["vector"].VectorVamana
+	vv.DistanceMetric = "test-manhattan"
+	col := sampleCol
+	col.IndexSchema = maps.Clone(sampleIndexSchema)
+	col.IndexSchema["vector"] = models.IndexSchemaValue{Type: models.IndexTypeVectorVamana, VectorVamana: &vv}
+	dbpath := filepath.Join(t.TempDir(), "sharddb.bbolt")
+	_, err := NewShard(dbpath, col, nil)
+	require.ErrorContains(t, err, "unknown distance metric")
+	// ---------------------------
+	if !distance.IsKnownMetric("test-manhattan") {
+		require.NoError(t, distance.Register("test-manhattan", func(x, y []float32) float32 {
+			var sum float32
+			for i := range x {
+				sum += max(x[i]-y[i], y[i]-x[i])
+			}
+			return sum
+		}))
+	}
+	s, err := NewShard(dbpath, col, nil)
+	require.NoError(t, err)
+	points := randPoints(50)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	res, err := s.SearchPoints(context.Background(), searchRequest(points[0], 1))
+	require.NoError(t, err)
+	require.Equal(t, points[0].Id, res[0].Point.Id)
+	require.NoError(t, s.Close())
+}
+
+func Test_NamedVectors(t *testing.T) {
+	vamanaParams := func(size uint) *models.IndexVectorVamanaParameters {
+		return &models.IndexVectorVamanaParameters{
+			VectorSize:     size,
+			DistanceMetric: models.DistanceEuclidean,
+			SearchSize:     75,
+			DegreeBound:    64,
+			Alpha:          1.2,
+		}
+	}
+	col := models.Collection{
+		UserId: "test",
+		Id:     "named",
+		IndexSchema: models.IndexSchema{
+			"title": {Type: models.IndexTypeVectorVamana, VectorVamana: vamanaParams(2)},
+			"body":  {Type: models.IndexTypeVectorVamana, VectorVamana: vamanaParams(3)},
+		},
+	}
+	s, err := NewShard(filepath.Join(t.TempDir(), "sharddb.bbolt"), col, cache.NewManager(-1))
+	require.NoError(t, err)
+	// Every other point has no body vector
+	points := make([]models.Point, 20)
+	for i := range points {
+		fi := float32(i)
+		pointData := models.PointAsMap{"title": []float32{fi, 0}}
+		if i%2 == 0 {
+			pointData["body"] = []float32{0, 0, fi}
+		}
+		data, err := msgpack.Marshal(pointData)
+		require.NoError(t, err)
+		points[i] = models.Point{Id: uuid.New(), Data: data}
+	}
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	// ---------------------------
+	search := func(property string, vector []float32) []models.SearchResult {
+		sr := models.SearchRequest{
+			Query: models.Query{
+				Property: property,
+				VectorVamana: &models.SearchVectorVamanaOptions{
+					Vector:   vector,
+					Operator: "near",
+					Limit:    20,
+				},
+			},
+			Limit: 20,
+		}
+		res, err := s.SearchPoints(context.Background(), sr)
+		require.NoError(t, err)
+		return res
+	}
+	res := search("title", []float32{5, 0})
+	require.Len(t, res, 20)
+	require.Equal(t, points[5].Id, res[0].Point.Id)
+	res = search("body", []float32{0, 0, 7})
+	require.Len(t, res, 10)
+	require.Contains(t, []uuid.UUID{points[6].Id, points[8].Id}, res[0].Point.Id)
+	require.NoError(t, s.Close())
+}
+
+func Test_BulkLoad(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(60)
+	b, err := s.BeginBulkLoad()
+	require.NoError(t, err)
+	for i := 0; i < 60; i += 20 {
+		require.NoError(t, b.InsertPoints(context.Background(), points[i:i+20]))
+	}
+	// Nothing is visible until the bulk load ends
+	count, err := s.CountPoints()
+	require.NoError(t, err)
+	require.Zero(t, count)
+	inserted, err := b.End()
+	require.NoError(t, err)
+	require.Equal(t, 60, inserted)
+	// ---------------------------
+	count, err = s.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 60, count)
+	reachable, total, err := s.CheckConnectivity()
+	require.NoError(t, err)
+	require.Equal(t, 60, total)
+	require.Equal(t, 60, reachable)
+	res, err := s.SearchPoints(context.Background(), searchRequest(points[42], 5))
+	require.NoError(t, err)
+	require.Equal(t, points[42].Id, res[0].Point.Id)
+	_, err = b.End()
+	require.ErrorIs(t, err, ErrBulkLoadClosed)
+	require.NoError(t, s.Close())
+}
+
+func Test_BulkLoadAllOrNothing(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(40)
+	b, err := s.BeginBulkLoad()
+	require.NoError(t, err)
+	require.NoError(t, b.InsertPoints(context.Background(), points[:20]))
+	// Re-inserting a point of the bulk load fails and discards all of it
+	batch := append(slices.Clone(points[20:]), points[0])
+	require.Error(t, b.InsertPoints(context.Background(), batch))
+	require.ErrorIs(t, b.InsertPoints(context.Background(), points[20:]), ErrBulkLoadClosed)
+	count, err := s.CountPoints()
+	require.NoError(t, err)
+	require.Zero(t, count)
+	// ---------------------------
+	b, err = s.BeginBulkLoad()
+	require.NoError(t, err)
+	require.NoError(t, b.InsertPoints(context.Background(), points[:20]))
+	b.Abort()
+	count, err = s.CountPoints()
+	require.NoError(t, err)
+	require.Zero(t, count)
+	// The shard takes regular writes again
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	require.NoError(t, s.Close())
+}
+
+func Test_BulkLoadClosedShard(t *testing.T) {
+	s := tempShard(t)
+	require.NoError(t, s.Close())
+	// The write transaction never starts so the bulk load fails instead of
+	// waiting for it
+	b, err := s.BeginBulkLoad()
+	require.NoError(t, err)
+	require.ErrorIs(t, b.InsertPoints(context.Background(), randPoints(5)), ErrShardClosed)
+	require.ErrorIs(t, b.InsertPoints(context.Background(), randPoints(5)), ErrBulkLoadClosed)
+	_, err = b.End()
+	require.ErrorIs(t, err, ErrBulkLoadClosed)
+	// ---------------------------
+	b, err = s.BeginBulkLoad()
+	require.NoError(t, err)
+	_, err = b.End()
+	require.ErrorIs(t, err, ErrShardClosed)
+}
+
+func Test_SoftDeleteCompact(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(50)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	deleteSet := make(map[uuid.UUID]struct{})
+	for _, p := range points[:10] {
+		deleteSet[p.Id] = struct{}{}
+	}
+	deletedIds, err := s.SoftDeletePoints(context.Background(), deleteSet)
+	require.NoError(t, err)
+	require.Len(t, deletedIds, 10)
+	si, err := s.Info(false, false)
+	require.NoError(t, err)
+	require.EqualValues(t, 40, si.PointCount)
+	require.EqualValues(t, 10, si.TombstoneCount)
+	// ---------------------------
+	// Soft deleted points are gone but their nodes are still searched
+	_, found, err := s.GetPoint(points[0].Id)
+	require.NoError(t, err)
+	require.False(t, found)
+	res, err := s.SearchPoints(context.Background(), searchRequest(points[0], 5))
+	require.NoError(t, err)
+	require.Len(t, res, 5)
+	for _, r := range res {
+		require.NotContains(t, deleteSet, r.Point.Id)
+	}
+	// The id can be reused before compaction
+	require.NoError(t, s.InsertPoints(context.Background(), points[:1]))
+	// ---------------------------
+	compacted, err := s.Compact(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 10, compacted)
+	si, err = s.Info(false, false)
+	require.NoError(t, err)
+	require.EqualValues(t, 41, si.PointCount)
+	require.EqualValues(t, 0, si.TombstoneCount)
+	res, err = s.SearchPoints(context.Background(), searchRequest(points[0], 1))
+	require.NoError(t, err)
+	require.Equal(t, points[0].Id, res[0].Point.Id)
+	res, err = s.SearchPoints(context.Background(), searchRequest(points[20], 1))
+	require.NoError(t, err)
+	require.Equal(t, points[20].Id, res[0].Point.Id)
+	// Nothing left to compact
+	compacted, err = s.Compact(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, compacted)
+	require.NoError(t, s.Close())
+}
+
+func Test_WithStartSeed(t *testing.T) {
+	s, err := NewShard("", sampleCol, nil, WithStartSeed(42))
+	require.NoError(t, err)
+	require.EqualValues(t, 42, s.collection.IndexSchema["vector"].VectorVamana.StartSeed)
+	// The collection of the caller is not modified
+	require.Zero(t, sampleCol.IndexSchema["vector"].VectorVamana.StartSeed)
+	require.NoError(t, s.InsertPoints(context.Background(), randPoints(10)))
+	require.NoError(t, s.Close())
+}
+
+func Test_Exists(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(5)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	for _, p := range points {
+		exists, err := s.Exists(p.Id)
+		require.NoError(t, err)
+		require.True(t, exists)
+	}
+	exists, err := s.Exists(uuid.New())
+	require.NoError(t, err)
+	require.False(t, exists)
+	// ---------------------------
+	_, err = s.DeletePoints(context.Background(), map[uuid.UUID]struct{}{points[0].Id: {}})
+	require.NoError(t, err)
+	exists, err = s.Exists(points[0].Id)
+	require.NoError(t, err)
+	require.False(t, exists)
+	require.NoError(t, s.Close())
+}
+
+func Test_Rebuild(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(100)
+	points[0].Payload = []byte("kept payload")
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	require.NoError(t, s.Rebuild(context.Background()))
+	reachable, total, err := s.CheckConnectivity()
+	require.NoError(t, err)
+	require.Equal(t, len(points), total)
+	require.Equal(t, total, reachable)
+	for _, p := range points {
+		res, err := s.SearchPoints(context.Background(), searchRequest(p, 1))
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.Equal(t, p.Id, res[0].Point.Id)
+	}
+	payload, err := s.GetPayload(points[0].Id)
+	require.NoError(t, err)
+	require.Equal(t, points[0].Payload, payload)
+	require.NoError(t, s.Close())
+}
+
+func Test_UpdateUnchangedVector(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(50)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	before, err := s.ExportGraph("vector", len(points)+1, false)
+	require.NoError(t, err)
+	// ---------------------------
+	// Only the category changes, the vector is sent again unchanged
+	updates := make([]models.Point, 10)
+	for i := range updates {
+		data, err := msgpack.Marshal(models.PointAsMap{
+			"vector":   getVector(points[i]),
+			"category": fmt.Sprintf("updated %d", i),
+		})
+		require.NoError(t, err)
+		updates[i] = models.Point{Id: points[i].Id, Data: data}
+	}
+	updatedIds, err := s.UpdatePoints(context.Background(), updates)
+	require.NoError(t, err)
+	require.Len(t, updatedIds, len(updates))
+	after, err := s.ExportGraph("vector", len(points)+1, false)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	// ---------------------------
+	point, found, err := s.GetPoint(updates[0].Id)
+	require.NoError(t, err)
+	require.True(t, found)
+	var data models.PointAsMap
+	require.NoError(t, msgpack.Unmarshal(point.Data, &data))
+	require.Equal(t, "updated 0", data["category"])
+	require.NoError(t, s.Close())
+}
+
+func Test_UpdateMetadata(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(20)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	before, err := s.ExportGraph("vector", len(points)+1, false)
+	require.NoError(t, err)
+	// ---------------------------
+	tags, err := msgpack.Marshal(models.PointAsMap{"category": "tagged"})
+	require.NoError(t, err)
+	missingId := uuid.New()
+	updatedIds, err := s.UpdateMetadata(context.Background(), map[uuid.UUID][]byte{
+		points[0].Id: tags,
+		missingId:    tags,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uuid.UUID{points[0].Id}, updatedIds)
+	after, err := s.ExportGraph("vector", len(points)+1, false)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	point, found, err := s.GetPoint(points[0].Id)
+	require.NoError(t, err)
+	require.True(t, found)
+	var data models.PointAsMap
+	require.NoError(t, msgpack.Unmarshal(point.Data, &data))
+	require.Equal(t, "tagged", data["category"])
+	require.Equal(t, getVector(points[0]), getVector(point))
+	// ---------------------------
+	// Vectors can only be changed by updates
+	vector, err := msgpack.Marshal(models.PointAsMap{"vector": []float32{1, 2}})
+	require.NoError(t, err)
+	_, err = s.UpdateMetadata(context.Background(), map[uuid.UUID][]byte{points[0].Id: vector})
+	require.ErrorContains(t, err, "vector property")
+	require.NoError(t, s.Close())
+}
@@ -1,10 +1,13 @@
 package shard
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
+	"github.com/google/uuid"
 	"github.com/semafind/semadb/models"
+	"github.com/semafind/semadb/shard/index/vamana"
 	"github.com/stretchr/testify/require"
 )
 
@@ -28,7 +31,7 @@ func TestSearch_Select(t *testing.T) {
 	// ---------------------------
 	s := tempShard(t)
 	points := randPoints(100)
-	err := s.InsertPoints(points)
+	err := s.InsertPoints(context.Background(), points)
 	require.NoError(t, err)
 	// ---------------------------
 	sr := models.SearchRequest{
@@ -41,7 +44,7 @@ func TestSearch_Select(t *testing.T) {
 		},
 		Select: []string{"size", "category", "nonExistent"},
 	}
-	res, err := s.SearchPoints(sr)
+	res, err := s.SearchPoints(context.Background(), sr)
 	require.NoError(t, err)
 	require.Len(t, res, 11)
 	for i := 0; i < 11; i++ {
@@ -58,7 +61,7 @@ func TestSearch_Sort(t *testing.T) {
 	// ---------------------------
 	s := tempShard(t)
 	points := randPoints(100)
-	err := s.InsertPoints(points)
+	err := s.InsertPoints(context.Background(), points)
 	require.NoError(t, err)
 	// ---------------------------
 	sr := models.SearchRequest{
@@ -74,7 +77,7 @@ func TestSearch_Sort(t *testing.T) {
 			{Property: "size", Descending: true},
 		},
 	}
-	res, err := s.SearchPoints(sr)
+	res, err := s.SearchPoints(context.Background(), sr)
 	require.NoError(t, err)
 	require.Len(t, res, 11)
 	for i := 0; i < 11; i++ {
@@ -86,7 +89,7 @@ func TestSearch_SortPartial(t *testing.T) {
 	// ---------------------------
 	s := tempShard(t)
 	points := randPoints(100)
-	err := s.InsertPoints(points)
+	err := s.InsertPoints(context.Background(), points)
 	require.NoError(t, err)
 	// ---------------------------
 	sr := models.SearchRequest{
@@ -104,7 +107,7 @@ func TestSearch_SortPartial(t *testing.T) {
 			{Property: "size", Descending: true},
 		},
 	}
-	res, err := s.SearchPoints(sr)
+	res, err := s.SearchPoints(context.Background(), sr)
 	require.NoError(t, err)
 	require.Len(t, res, 11)
 	/* We expect points "extra" property to come first and sorted in descending
@@ -143,3 +146,43 @@ func TestSearch_SortPartial(t *testing.T) {
 		}
 	}
 }
+
+func Test_SearchByPointId(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(50)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	res, err := s.SearchByPointId(context.Background(), points[0].Id, 5)
+	require.NoError(t, err)
+	require.Len(t, res, 5)
+	// The same as searching with the vector, without the query point itself
+	want, err := s.SearchPoints(context.Background(), searchRequest(points[0], 6))
+	require.NoError(t, err)
+	require.Equal(t, points[0].Id, want[0].Point.Id)
+	require.Equal(t, want[1:], res)
+	// ---------------------------
+	_, err = s.SearchByPointId(context.Background(), uuid.New(), 5)
+	require.ErrorIs(t, err, ErrPointNotFound)
+	require.NoError(t, s.Close())
+}
+
+func Test_SearchPointsExplain(t *testing.T) {
+	s := tempShard(t)
+	points := randPoints(50)
+	require.NoError(t, s.InsertPoints(context.Background(), points))
+	vector := getVector(points[0])
+	res, explain, err := s.SearchPointsExplain(context.Background(), vector, 5)
+	require.NoError(t, err)
+	want, err := s.SearchPoints(context.Background(), searchRequest(points[0], 5))
+	require.NoError(t, err)
+	require.Equal(t, want, res)
+	// ---------------------------
+	// The search starts at the start node and visits the closest point
+	require.Equal(t, len(explain.Visits), explain.Hops)
+	require.EqualValues(t, vamana.STARTID, explain.Visits[0].NodeId)
+	nodeIds := make([]uint64, len(explain.Visits))
+	for i, v := range explain.Visits {
+		nodeIds[i] = v.NodeId
+	}
+	require.Contains(t, nodeIds, res[0].NodeId)
+	require.NoError(t, s.Close())
+}
@@ -1,11 +1,13 @@
 package shard
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/semafind/semadb/conversion"
@@ -178,7 +180,7 @@ func checkNodeIdPointIdMapping(t *testing.T, shard *Shard, expectedCount int) {
 func checkPointCount(t *testing.T, shard *Shard, expected int) {
 	require.Equal(t, expected, getVectorCount(shard))
 	checkNodeIdPointIdMapping(t, shard, expected)
-	si, err := shard.Info()
+	si, err := shard.Info(false, false)
 	require.NoError(t, err)
 	require.EqualValues(t, expected, si.PointCount)
 	checkConnectivity(t, shard, int(expected))
@@ -348,7 +350,7 @@ func searchRequest(p models.Point, limit int) models.SearchRequest {
 func TestShard_CreatePoint(t *testing.T) {
 	shard := tempShard(t)
 	points := randPoints(42)
-	err := shard.InsertPoints(points)
+	err := shard.InsertPoints(context.Background(), points)
 	require.NoError(t, err)
 	// Check that the shard has two points
 	checkPointCount(t, shard, 42)
@@ -358,7 +360,7 @@ func TestShard_CreatePoint(t *testing.T) {
 func TestShard_CreateMorePoints(t *testing.T) {
 	shard := tempShard(t)
 	points := randPoints(4242)
-	err := shard.InsertPoints(points)
+	err := shard.InsertPoints(context.Background(), points)
 	require.NoError(t, err)
 	checkPointCount(t, shard, 4242)
 	require.NoError(t, shard.Close())
@@ -369,7 +371,7 @@ func TestShard_Persistence(t *testing.T) {
 	dbfile := filepath.Join(shardDir, "sharddb.bbolt")
 	shard, _ := NewShard(dbfile, sampleCol, cache.NewManager(-1))
 	points := randPoints(7)
-	err := shard.InsertPoints(points)
+	err := shard.InsertPoints(context.Background(), points)
 	require.NoError(t, err)
 	require.NoError(t, shard.Close())
 	shard, err = NewShard(dbfile, sampleCol, cache.NewManager(-1))
@@ -383,17 +385,58 @@ func TestShard_DuplicatePointId(t *testing.T) {
 	shard := tempShard(t)
 	points := randPoints(2)
 	points[0].Id = points[1].Id
-	err := shard.InsertPoints(points)
+	err := shard.InsertPoints(context.Background(), points)
 	// Insert expects unique ids and should fail
 	require.Error(t, err)
 	require.NoError(t, shard.Close())
 }
 
+func TestShard_VectorSizeMismatch(t *testing.T) {
+	shard := tempShard(t)
+	points := randPoints(10)
+	require.NoError(t, shard.InsertPoints(context.Background(), points))
+	for _, vector := range [][]float32{{1}, {1, 2, 3}} {
+		// ---------------------------
+		bad := randPointsAsMap(1)[0]
+		bad["vector"] = vector
+		err := shard.InsertPoints(context.Background(), pointsAsMapToPoints([]models.PointAsMap{bad}))
+		require.ErrorContains(t, err, "expected 2")
+		require.ErrorIs(t, err, ErrDimMismatch)
+		// ---------------------------
+		data, err := msgpack.Marshal(models.PointAsMap{"vector": vector})
+		require.NoError(t, err)
+		_, err = shard.UpdatePoints(context.Background(), []models.Point{{Id: points[0].Id, Data: data}})
+		require.ErrorContains(t, err, points[0].Id.String())
+		require.ErrorIs(t, err, ErrDimMismatch)
+		// ---------------------------
+		sr := searchRequest(points[0], 5)
+		sr.Query.VectorVamana.Vector = vector
+		_, err = shard.SearchPoints(context.Background(), sr)
+		require.ErrorContains(t, err, "length mismatch")
+		require.ErrorIs(t, err, ErrDimMismatch)
+	}
+	// Points without data have no vectors to check
+	require.NoError(t, checkVectorSizes([]models.Point{{Id: points[1].Id}}, sampleCol.IndexSchema))
+	// Only the vector properties are looked at
+	data, err := msgpack.Marshal(models.PointAsMap{"description": []any{1, "two"}, "vector": []float32{1, 2}, "nested": map[string]any{"vector": []float32{1}}})
+	require.NoError(t, err)
+	require.NoError(t, checkVectorSizes([]models.Point{{Id: points[1].Id, Data: data}}, sampleCol.IndexSchema))
+	// The graph is unaffected by the rejected vectors
+	res, err := shard.SearchPoints(context.Background(), searchRequest(points[0], 1))
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, points[0].Id, res[0].Point.Id)
+	count, err := shard.CountPoints()
+	require.NoError(t, err)
+	require.EqualValues(t, 10, count)
+	require.NoError(t, shard.Close())
+}
+
 func TestShard_BasicSearch(t *testing.T) {
 	shard := tempShard(t)
 	points := randPoints(2)
-	shard.InsertPoints(points)
-	res, err := shard.SearchPoints(searchRequest(points[0], 1))
+	shard.InsertPoints(context.Background(), points)
+	res, err := shard.SearchPoints(context.Background(), searchRequest(points[0], 1))
 	require.NoError(t, err)
 	require.Equal(t, 1, len(res))
 	require.Equal(t, points[0].Id, res[0].Point.Id)
@@ -407,7 +450,7 @@ func TestShard_CacheReuse(t *testing.T) {
 	cm := cache.NewManager(-1)
 	shard, _ := NewShard("", sampleCol, cm)
 	points := randPoints(7)
-	err := shard.InsertPoints(points)
+	err := shard.InsertPoints(context.Background(), points)
 	require.NoError(t, err)
 	// Purge the disk storage layer
 	err = shard.db.Write(func(bm diskstore.BucketManager) error {
@@ -415,7 +458,7 @@ func TestShard_CacheReuse(t *testing.T) {
 	})
 	require.NoError(t, err)
 	// The shared cache should allow us to search
-	res, err := shard.SearchPoints(searchRequest(points[0], 1))
+	res, err := shard.SearchPoints(context.Background(), searchRequest(points[0], 1))
 	require.NoError(t, err)
 	require.Equal(t, 1, len(res))
 	require.Equal(t, points[0].Id, res[0].Point.Id)
@@ -428,11 +471,11 @@ func TestShard_CacheReuse(t *testing.T) {
 func TestShard_BucketSearch(t *testing.T) {
 	shard := tempShard(t)
 	points := randPoints(2)
-	require.NoError(t, shard.InsertPoints(points))
+	require.NoError(t, shard.InsertPoints(context.Background(), points))
 	// Clear the cache
 	shard.cacheManager.Release(shard.dbFile + "/index/vectorVamana/vector")
 	// Search from the bucket directly
-	res, err := shard.SearchPoints(searchRequest(points[0], 1))
+	res, err := shard.SearchPoints(context.Background(), searchRequest(points[0], 1))
 	require.NoError(t, err)
 	require.Equal(t, 1, len(res))
 	require.Equal(t, points[0].Id, res[0].Point.Id)
@@ -445,8 +488,8 @@ func TestShard_BucketSearch(t *testing.T) {
 func TestShard_SearchMaxLimit(t *testing.T) {
 	shard := tempShard(t)
 	points := randPoints(2)
-	shard.InsertPoints(points)
-	res, err := shard.SearchPoints(searchRequest(points[0], 7))
+	shard.InsertPoints(context.Background(), points)
+	res, err := shard.SearchPoints(context.Background(), searchRequest(points[0], 7))
 	require.NoError(t, err)
 	require.Equal(t, 2, len(res))
 	require.NoError(t, shard.Close())
@@ -455,9 +498,9 @@ func TestShard_SearchMaxLimit(t *testing.T) {
 func TestShard_UpdatePoint(t *testing.T) {
 	shard := tempShard(t)
 	points := randPoints(2)
-	err := shard.InsertPoints(points[:1])
+	err := shard.InsertPoints(context.Background(), points[:1])
 	require.NoError(t, err)
-	updateRes, err := shard.UpdatePoints(points)
+	updateRes, err := shard.UpdatePoints(context.Background(), points)
 	require.NoError(t, err)
 	require.Equal(t, 1, len(updateRes))
 	require.Contains(t, updateRes, points[0].Id)
@@ -468,11 +511,11 @@ func TestShard_UpdatePoint(t *testing.T) {
 func TestShard_DeletePoint(t *testing.T) {
 	shard := tempShard(t)
 	points := randPoints(2)
-	shard.InsertPoints(points)
+	shard.InsertPoints(context.Background(), points)
 	deleteSet := make(map[uuid.UUID]struct{})
 	deleteSet[points[0].Id] = struct{}{}
 	// delete one point
-	delIds, err := shard.DeletePoints(deleteSet)
+	delIds, err := shard.DeletePoints(context.Background(), deleteSet)
 	require.NoError(t, err)
 	require.Len(t, delIds, 1)
 	require.Equal(t, points[0].Id, delIds[0])
@@ -480,14 +523,14 @@ func TestShard_DeletePoint(t *testing.T) {
 	checkMaxNodeId(t, shard, 2)
 	checkNoReferences(t, shard, points[0].Id)
 	// Try deleting the same point again
-	delIds, err = shard.DeletePoints(deleteSet)
+	delIds, err = shard.DeletePoints(context.Background(), deleteSet)
 	require.NoError(t, err)
 	require.Len(t, delIds, 0)
 	checkPointCount(t, shard, 1)
 	checkNoReferences(t, shard, points[0].Id)
 	// Delete other point too
 	deleteSet[points[1].Id] = struct{}{}
-	delIds, err = shard.DeletePoints(deleteSet)
+	delIds, err = shard.DeletePoints(context.Background(), deleteSet)
 	require.Len(t, delIds, 1)
 	require.Equal(t, points[1].Id, delIds[0])
 	require.NoError(t, err)
@@ -496,15 +539,47 @@ func TestShard_DeletePoint(t *testing.T) {
 	require.NoError(t, shard.Close())
 }
 
+func TestShard_DeletePointsByFilter(t *testing.T) {
+	shard := tempShard(t)
+	points := randPoints(50)
+	require.NoError(t, shard.InsertPoints(context.Background(), points))
+	// Delete the points with an even size
+	filter := func(data []byte) bool {
+		var pointData models.PointAsMap
+		require.NoError(t, msgpack.Unmarshal(data, &pointData))
+		return pointData["size"].(int64)%2 == 0
+	}
+	delIds, err := shard.DeletePointsByFilter(context.Background(), filter)
+	require.NoError(t, err)
+	require.Len(t, delIds, 25)
+	checkPointCount(t, shard, 25)
+	for i, p := range points {
+		if i%2 == 0 {
+			checkNoReferences(t, shard, p.Id)
+			continue
+		}
+		res, err := shard.SearchPoints(context.Background(), searchRequest(p, 1))
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.Equal(t, p.Id, res[0].Point.Id)
+	}
+	// Nothing matches anymore
+	delIds, err = shard.DeletePointsByFilter(context.Background(), filter)
+	require.NoError(t, err)
+	require.Len(t, delIds, 0)
+	checkPointCount(t, shard, 25)
+	require.NoError(t, shard.Close())
+}
+
 func TestShard_InsertDeleteSearchInsertPoint(t *testing.T) {
 	shard := tempShard(t)
 	points := randPoints(2)
-	shard.InsertPoints(points)
+	shard.InsertPoints(context.Background(), points)
 	deleteSet := make(map[uuid.UUID]struct{})
 	deleteSet[points[0].Id] = struct{}{}
 	deleteSet[points[1].Id] = struct{}{}
 	// delete all points
-	delIds, err := shard.DeletePoints(deleteSet)
+	delIds, err := shard.DeletePoints(context.Background(), deleteSet)
 	require.NoError(t, err)
 	require.Len(t, delIds, 2)
 	checkPointCount(t, shard, 0)
@@ -512,11 +587,11 @@ func TestShard_InsertDeleteSearchInsertPoint(t *testing.T) {
 	checkNoReferences(t, shard, delIds...)
 	checkMaxNodeId(t, shard, 0)
 	// Try searching for the deleted point
-	res, err := shard.SearchPoints(searchRequest(points[0], 1))
+	res, err := shard.SearchPoints(context.Background(), searchRequest(points[0], 1))
 	require.NoError(t, err)
 	require.Len(t, res, 0)
 	// Try inserting the deleted points
-	err = shard.InsertPoints(points)
+	err = shard.InsertPoints(context.Background(), points)
 	require.NoError(t, err)
 	checkPointCount(t, shard, 2)
 	checkMaxNodeId(t, shard, 2)
@@ -527,20 +602,20 @@ func TestShard_SearchWhileInsert(t *testing.T) {
 	shard := tempShard(t)
 	points := randPoints(100)
 	// Insert points
-	err := shard.InsertPoints(points)
+	err := shard.InsertPoints(context.Background(), points)
 	require.NoError(t, err)
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		newPoints := randPoints(100)
-		err := shard.InsertPoints(newPoints)
+		err := shard.InsertPoints(context.Background(), newPoints)
 		assert.NoError(t, err)
 		wg.Done()
 	}()
 	// Search points
 	go func() {
 		for _, point := range points {
-			res, err := shard.SearchPoints(searchRequest(point, 1))
+			res, err := shard.SearchPoints(context.Background(), searchRequest(point, 1))
 			assert.NoError(t, err)
 			assert.Len(t, res, 1)
 			assert.Equal(t, point.Id, res[0].Point.Id)
@@ -556,13 +631,13 @@ func TestShard_DeleteWhileInsert(t *testing.T) {
 	shard := tempShard(t)
 	points := randPoints(3)
 	// Insert points
-	err := shard.InsertPoints(points)
+	err := shard.InsertPoints(context.Background(), points)
 	require.NoError(t, err)
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		newPoints := randPoints(3)
-		err := shard.InsertPoints(newPoints)
+		err := shard.InsertPoints(context.Background(), newPoints)
 		assert.NoError(t, err)
 		wg.Done()
 	}()
@@ -572,7 +647,7 @@ func TestShard_DeleteWhileInsert(t *testing.T) {
 		for i := 0; i < 2; i++ {
 			deleteSet[points[i].Id] = struct{}{}
 		}
-		delIds, err := shard.DeletePoints(deleteSet)
+		delIds, err := shard.DeletePoints(context.Background(), deleteSet)
 		assert.NoError(t, err)
 		assert.Len(t, delIds, 2)
 		wg.Done()
@@ -587,7 +662,7 @@ func TestShard_ConcurrentCRUD(t *testing.T) {
 	shard := tempShard(t)
 	points := randPoints(150)
 	// Initial points
-	require.NoError(t, shard.InsertPoints(points))
+	require.NoError(t, shard.InsertPoints(context.Background(), points))
 	var wg sync.WaitGroup
 	wg.Add(5)
 	// ---------------------------
@@ -595,20 +670,20 @@ func TestShard_ConcurrentCRUD(t *testing.T) {
 	go func() {
 		// Insert points
 		newPoints := randPoints(50)
-		assert.NoError(t, shard.InsertPoints(newPoints))
+		assert.NoError(t, shard.InsertPoints(context.Background(), newPoints))
 		wg.Done()
 	}()
 	go func() {
 		// Insert points
 		newPoints := randPoints(50)
-		assert.NoError(t, shard.InsertPoints(newPoints))
+		assert.NoError(t, shard.InsertPoints(context.Background(), newPoints))
 		wg.Done()
 	}()
 	// ---------------------------
 	// Search points
 	go func() {
 		for i := 0; i < 50; i++ {
-			res, err := shard.SearchPoints(searchRequest(points[i], 1))
+			res, err := shard.SearchPoints(context.Background(), searchRequest(points[i], 1))
 			assert.NoError(t, err)
 			assert.Len(t, res, 1)
 			assert.Equal(t, points[i].Id, res[0].Point.Id)
@@ -622,7 +697,7 @@ func TestShard_ConcurrentCRUD(t *testing.T) {
 		for i := 50; i < 100; i++ {
 			updatePoints[i-50].Id = points[i].Id
 		}
-		updateRes, err := shard.UpdatePoints(updatePoints)
+		updateRes, err := shard.UpdatePoints(context.Background(), updatePoints)
 		assert.NoError(t, err)
 		assert.Len(t, updateRes, 50)
 		wg.Done()
@@ -634,7 +709,7 @@ func TestShard_ConcurrentCRUD(t *testing.T) {
 		for i := 100; i < 150; i++ {
 			deleteSet[points[i].Id] = struct{}{}
 		}
-		delIds, err := shard.DeletePoints(deleteSet)
+		delIds, err := shard.DeletePoints(context.Background(), deleteSet)
 		assert.NoError(t, err)
 		assert.Len(t, delIds, 50)
 		wg.Done()
@@ -654,7 +729,7 @@ func TestShard_LargeInsertDeleteInsertSearch(t *testing.T) {
 	initSize := 10000
 	points := randPoints(initSize)
 	// Insert points
-	shard.InsertPoints(points)
+	shard.InsertPoints(context.Background(), points)
 	// dumpEdgesToCSV(t, shard, "../dump/edgesBeforeDelete.csv")
 	deleteSet := make(map[uuid.UUID]struct{})
 	delSize := 500
@@ -662,7 +737,7 @@ func TestShard_LargeInsertDeleteInsertSearch(t *testing.T) {
 		deleteSet[points[i].Id] = struct{}{}
 	}
 	// delete all points
-	delIds, err := shard.DeletePoints(deleteSet)
+	delIds, err := shard.DeletePoints(context.Background(), deleteSet)
 	// dumpEdgesToCSV(t, shard, "../dump/edgesAfterDelete.csv")
 	require.NoError(t, err)
 	require.Len(t, delIds, delSize)
@@ -670,13 +745,13 @@ func TestShard_LargeInsertDeleteInsertSearch(t *testing.T) {
 	checkNoReferences(t, shard, delIds...)
 	checkMaxNodeId(t, shard, initSize)
 	// Try inserting the deleted points
-	err = shard.InsertPoints(points[:delSize])
+	err = shard.InsertPoints(context.Background(), points[:delSize])
 	require.NoError(t, err)
 	checkPointCount(t, shard, initSize)
 	checkMaxNodeId(t, shard, initSize)
 	// Try searching for the deleted point
 	sp := points[0]
-	res, err := shard.SearchPoints(searchRequest(sp, 1))
+	res, err := shard.SearchPoints(context.Background(), searchRequest(sp, 1))
 	require.NoError(t, err)
 	require.Len(t, res, 1)
 	require.Equal(t, sp.Id, res[0].Point.Id)
@@ -687,20 +762,20 @@ func TestShard_LargeInsertUpdateSearch(t *testing.T) {
 	shard := tempShard(t)
 	initSize := 10000
 	points := randPoints(initSize)
-	shard.InsertPoints(points)
+	shard.InsertPoints(context.Background(), points)
 	// Update some of the points
 	updateSize := 100
 	updatePoints := randPoints(updateSize)
 	for i := 0; i < updateSize; i++ {
 		updatePoints[i].Id = points[i].Id
 	}
-	updateRes, err := shard.UpdatePoints(updatePoints)
+	updateRes, err := shard.UpdatePoints(context.Background(), updatePoints)
 	require.NoError(t, err)
 	require.Len(t, updateRes, updateSize)
 	checkPointCount(t, shard, initSize)
 	checkMaxNodeId(t, shard, initSize)
 	// Try searching for the updated point
-	res, err := shard.SearchPoints(searchRequest(updatePoints[0], 1))
+	res, err := shard.SearchPoints(context.Background(), searchRequest(updatePoints[0], 1))
 	require.NoError(t, err)
 	require.Len(t, res, 1)
 	require.Equal(t, points[0].Id, res[0].Point.Id)
@@ -806,3 +881,124 @@ func TestShard_LargeInsertUpdateSearch(t *testing.T) {
 // 	}
 // 	// ---------------------------
 // }
+
+func TestShard_SearchCursor(t *testing.T) {
+	shard := tempShard(t)
+	points := randPoints(500)
+	require.NoError(t, shard.InsertPoints(context.Background(), points))
+	// ---------------------------
+	// Paging in tens returns distinct points, nearest first
+	res, cursor, err := shard.SearchPointsWithCursor(context.Background(), searchRequest(points[0], 10))
+	require.NoError(t, err)
+	require.Len(t, res, 10)
+	require.Equal(t, points[0].Id, res[0].Point.Id)
+	seen := make(map[uuid.UUID]struct{})
+	lastDistance := float32(0)
+	for page := 0; page < 3; page++ {
+		for _, r := range res {
+			require.NotContains(t, seen, r.Point.Id)
+			seen[r.Point.Id] = struct{}{}
+			lastDistance = max(lastDistance, *r.Distance)
+		}
+		res, cursor, err = shard.SearchPointsFrom(context.Background(), cursor, 10)
+		require.NoError(t, err)
+		require.Len(t, res, 10)
+		require.GreaterOrEqual(t, *res[len(res)-1].Distance, lastDistance)
+	}
+	// ---------------------------
+	// Points deleted between pages are skipped by the resumed walk
+	deleteSet := make(map[uuid.UUID]struct{})
+	for _, r := range res {
+		deleteSet[r.Point.Id] = struct{}{}
+	}
+	_, err = shard.DeletePoints(context.Background(), deleteSet)
+	require.NoError(t, err)
+	res, _, err = shard.SearchPointsFrom(context.Background(), cursor, 10)
+	require.NoError(t, err)
+	require.NotEmpty(t, res)
+	for _, r := range res {
+		require.NotContains(t, deleteSet, r.Point.Id)
+		require.NotContains(t, seen, r.Point.Id)
+	}
+	// ---------------------------
+	_, _, err = shard.SearchPointsFrom(context.Background(), []byte("garbage"), 10)
+	require.Error(t, err)
+	require.NoError(t, shard.Close())
+}
+
+func TestShard_PointExpiry(t *testing.T) {
+	shard := tempShard(t)
+	points := randPoints(30)
+	now := time.Now().Unix()
+	expiredIds := make(map[uuid.UUID]struct{})
+	for i := range points[:10] {
+		points[i].ExpiresAt = now - 10
+		expiredIds[points[i].Id] = struct{}{}
+	}
+	for i := range points[10:15] {
+		points[10+i].ExpiresAt = now + 3600
+	}
+	require.NoError(t, shard.InsertPoints(context.Background(), points))
+	// ---------------------------
+	// Expired points are skipped even though they are the closest
+	res, err := shard.SearchPoints(context.Background(), searchRequest(points[0], 20))
+	require.NoError(t, err)
+	require.Len(t, res, 20)
+	for _, r := range res {
+		require.NotContains(t, expiredIds, r.Point.Id)
+	}
+	// Updates without an expiry keep the existing one
+	_, err = shard.UpdatePoints(context.Background(), []models.Point{{Id: points[10].Id, Data: points[10].Data}})
+	require.NoError(t, err)
+	point, found, err := shard.GetPoint(points[10].Id)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, now+3600, point.ExpiresAt)
+	// Reads skip expired points too but they still exist until purged
+	_, found, err = shard.GetPoint(points[0].Id)
+	require.NoError(t, err)
+	require.False(t, found)
+	got, err := shard.GetPoints([]uuid.UUID{points[0].Id, points[10].Id})
+	require.NoError(t, err)
+	require.Equal(t, uuid.Nil, got[0].Id)
+	require.Equal(t, points[10].Id, got[1].Id)
+	iterated := 0
+	require.NoError(t, shard.IterPoints(func(p models.Point) error {
+		require.NotContains(t, expiredIds, p.Id)
+		iterated++
+		return nil
+	}))
+	require.Equal(t, 20, iterated)
+	var scanned []models.Point
+	after := uuid.Nil
+	for {
+		page, more, err := shard.ScanPoints(after, 3, false)
+		require.NoError(t, err)
+		scanned = append(scanned, page...)
+		if !more {
+			break
+		}
+		require.Len(t, page, 3)
+		after = page[len(page)-1].Id
+	}
+	require.Len(t, scanned, 20)
+	for _, p := range scanned {
+		require.NotContains(t, expiredIds, p.Id)
+	}
+	exists, err := shard.Exists(points[0].Id)
+	require.NoError(t, err)
+	require.True(t, exists)
+	// ---------------------------
+	purged, err := shard.PurgeExpired(context.Background())
+	require.NoError(t, err)
+	require.Len(t, purged, 10)
+	for _, id := range purged {
+		require.Contains(t, expiredIds, id)
+	}
+	checkPointCount(t, shard, 20)
+	checkNoReferences(t, shard, purged...)
+	purged, err = shard.PurgeExpired(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, purged)
+	require.NoError(t, shard.Close())
+}
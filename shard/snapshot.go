@@ -0,0 +1,86 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/models"
+)
+
+/* A snapshot freezes the shard at a point in time so that long running reads,
+ * for example an export paging through millions of points, see one consistent
+ * view without holding a database transaction open for the whole duration. A
+ * long lived read transaction would stop the database from reusing freed pages
+ * and the file would keep growing under concurrent writes.
+ *
+ * The snapshot is a full copy of the database file in the temporary directory,
+ * taken with BackupTo, which is then opened read-only. So it costs as much disk
+ * as the shard itself, including its graph indexes and free pages, and takes
+ * as long to create as a backup. The copy is deleted on Close, snapshots should
+ * be closed as soon as they are no longer needed. The indexes of the snapshot
+ * are cached separately from the shard under the name of the copy. */
+
+// ShardSnapshot is a read-only copy of a shard taken at a point in time. It is
+// not affected by later writes to the shard.
+type ShardSnapshot struct {
+	shard *Shard
+	file  string
+}
+
+// Snapshot copies the shard database to a temporary file and opens it
+// read-only. In-memory shards cannot be snapshotted.
+func (s *Shard) Snapshot() (*ShardSnapshot, error) {
+	if s.dbFile == "" {
+		return nil, fmt.Errorf("cannot snapshot in-memory shard: %w", diskstore.ErrInMemory)
+	}
+	f, err := os.CreateTemp("", "semadb-snapshot-*.bbolt")
+	if err != nil {
+		return nil, fmt.Errorf("could not create snapshot file: %w", err)
+	}
+	if _, err := s.BackupTo(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("could not copy shard to snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("could not close snapshot file: %w", err)
+	}
+	// ---------------------------
+	snapShard, err := newShard(f.Name(), s.collection, s.cacheManager, s.vc, []ShardOption{WithReadOnly()})
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("could not open snapshot: %w", err)
+	}
+	s.logger.Debug().Str("file", f.Name()).Msg("Snapshot")
+	return &ShardSnapshot{shard: snapShard, file: f.Name()}, nil
+}
+
+// SearchPoints searches the snapshot like Shard.SearchPoints.
+func (ss *ShardSnapshot) SearchPoints(ctx context.Context, searchRequest models.SearchRequest) ([]models.SearchResult, error) {
+	return ss.shard.SearchPoints(ctx, searchRequest)
+}
+
+// IterPoints calls fn with every point of the snapshot like Shard.IterPoints.
+func (ss *ShardSnapshot) IterPoints(fn func(models.Point) error) error {
+	return ss.shard.IterPoints(fn)
+}
+
+// CountPoints returns the number of points in the snapshot.
+func (ss *ShardSnapshot) CountPoints() (int64, error) {
+	return ss.shard.CountPoints()
+}
+
+// Close releases the snapshot and deletes its copy of the database.
+func (ss *ShardSnapshot) Close() error {
+	closeErr := ss.shard.Close()
+	if err := os.Remove(ss.file); err != nil && closeErr == nil {
+		return fmt.Errorf("could not remove snapshot file: %w", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("could not close snapshot: %w", closeErr)
+	}
+	return nil
+}
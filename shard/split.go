@@ -0,0 +1,197 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/models"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/* Splitting partitions the points of a shard into two new shards when it grows
+ * too large. We pick the dimension of a vector property with the highest
+ * variance over a sample of points and split at the median of that dimension,
+ * a hyperplane that gives two roughly equal halves which are also compact in
+ * vector space. The points are inserted into the new shards as regular inserts
+ * so each new shard builds its own graph from its own start point. The shard
+ * being split is left untouched. */
+
+// Maximum number of vectors sampled to pick the splitting hyperplane
+const splitSampleSize = 1000
+
+// splitProperty returns the vector property used to partition the points, the
+// first vector index in name order.
+func (s *Shard) splitProperty() (string, error) {
+	properties := make([]string, 0, len(s.collection.IndexSchema))
+	for propName, params := range s.collection.IndexSchema {
+		if params.VectorVamana != nil || params.VectorFlat != nil {
+			properties = append(properties, propName)
+		}
+	}
+	if len(properties) == 0 {
+		return "", fmt.Errorf("collection %s has no vector index to split on", s.collection.Id)
+	}
+	slices.Sort(properties)
+	return properties[0], nil
+}
+
+// pointVector extracts the vector of a property from the point data, it is nil
+// if the point does not have the property.
+func pointVector(data []byte, property string) ([]float32, error) {
+	var pointData models.PointAsMap
+	if err := msgpack.Unmarshal(data, &pointData); err != nil {
+		return nil, fmt.Errorf("could not decode point data: %w", err)
+	}
+	value, ok := pointData[property]
+	if !ok {
+		return nil, nil
+	}
+	anyArr, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("expected vector for %s got %T", property, value)
+	}
+	vector := make([]float32, len(anyArr))
+	for i, v := range anyArr {
+		if vector[i], ok = v.(float32); !ok {
+			return nil, fmt.Errorf("expected float32 in vector %s got %T", property, v)
+		}
+	}
+	return vector, nil
+}
+
+// splitHyperplane samples the vectors of the property and returns the
+// dimension with the highest variance along with its median value.
+func (s *Shard) splitHyperplane(property string) (int, float32, error) {
+	// Reservoir sampling so the sample is uniform over all the points
+	sample := make([][]float32, 0, splitSampleSize)
+	seen := 0
+	var after *uuid.UUID
+	for {
+		points, err := s.readPointBatch(after)
+		if err != nil {
+			return 0, 0, fmt.Errorf("could not read points to sample: %w", err)
+		}
+		if len(points) == 0 {
+			break
+		}
+		for _, point := range points {
+			vector, err := pointVector(point.Data, property)
+			if err != nil {
+				return 0, 0, fmt.Errorf("could not get vector of %s: %w", point.Id, err)
+			}
+			if vector == nil {
+				continue
+			}
+			seen++
+			if len(sample) < splitSampleSize {
+				sample = append(sample, vector)
+			} else if j := rand.Intn(seen); j < splitSampleSize {
+				sample[j] = vector
+			}
+		}
+		after = &points[len(points)-1].Id
+	}
+	if len(sample) < 2 {
+		return 0, 0, fmt.Errorf("not enough points with %s to split, got %d", property, len(sample))
+	}
+	// ---------------------------
+	bestDim := 0
+	bestVariance := float32(-1)
+	for dim := range sample[0] {
+		var sum, sumSq float32
+		for _, vector := range sample {
+			sum += vector[dim]
+			sumSq += vector[dim] * vector[dim]
+		}
+		mean := sum / float32(len(sample))
+		if variance := sumSq/float32(len(sample)) - mean*mean; variance > bestVariance {
+			bestDim = dim
+			bestVariance = variance
+		}
+	}
+	// ---------------------------
+	values := make([]float32, len(sample))
+	for i, vector := range sample {
+		values[i] = vector[bestDim]
+	}
+	slices.Sort(values)
+	return bestDim, values[len(values)/2], nil
+}
+
+// Split partitions the points of the shard into two new shards stored at the
+// given paths. Points on the lower side of the splitting hyperplane go to the
+// left shard, the rest and any points without the split vector go to the
+// right shard.
+func (s *Shard) Split(leftDbFile, rightDbFile string) (left *Shard, right *Shard, err error) {
+	property, err := s.splitProperty()
+	if err != nil {
+		return nil, nil, err
+	}
+	dim, median, err := s.splitHyperplane(property)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.logger.Debug().Str("property", property).Int("dim", dim).Float32("median", median).Msg("Split")
+	// ---------------------------
+	// The halves are encrypted with the key of the shard if it has one
+	leftShard, err := newShard(leftDbFile, s.collection, s.cacheManager, s.vc, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create left shard: %w", err)
+	}
+	rightShard, err := newShard(rightDbFile, s.collection, s.cacheManager, s.vc, nil)
+	if err != nil {
+		leftShard.Close()
+		os.Remove(leftDbFile)
+		return nil, nil, fmt.Errorf("could not create right shard: %w", err)
+	}
+	// A failed split must not leave half populated shards behind, the new
+	// shards are held locally because failures return nil for them
+	defer func() {
+		if err != nil {
+			leftShard.Close()
+			rightShard.Close()
+			os.Remove(leftDbFile)
+			os.Remove(rightDbFile)
+		}
+	}()
+	// ---------------------------
+	var after *uuid.UUID
+	for {
+		points, err := s.readPointBatch(after)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read points to split: %w", err)
+		}
+		if len(points) == 0 {
+			break
+		}
+		leftPoints := make([]models.Point, 0, len(points))
+		rightPoints := make([]models.Point, 0, len(points))
+		for _, point := range points {
+			vector, err := pointVector(point.Data, property)
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not get vector of %s: %w", point.Id, err)
+			}
+			if vector != nil && vector[dim] < median {
+				leftPoints = append(leftPoints, point)
+			} else {
+				rightPoints = append(rightPoints, point)
+			}
+		}
+		if len(leftPoints) > 0 {
+			if err := leftShard.InsertPoints(context.Background(), leftPoints); err != nil {
+				return nil, nil, fmt.Errorf("could not insert into left shard: %w", err)
+			}
+		}
+		if len(rightPoints) > 0 {
+			if err := rightShard.InsertPoints(context.Background(), rightPoints); err != nil {
+				return nil, nil, fmt.Errorf("could not insert into right shard: %w", err)
+			}
+		}
+		after = &points[len(points)-1].Id
+	}
+	return leftShard, rightShard, nil
+}
@@ -0,0 +1,139 @@
+package shard
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/distance"
+	"github.com/semafind/semadb/shard/index"
+)
+
+/* Searches start from a random unit vector which, for skewed data, can be far
+ * from every point and lengthen every search. The medoid of the points, the
+ * point with the smallest average distance to the others, is a better start.
+ * It is estimated from a sample because the exact medoid compares every pair
+ * of points. */
+
+// ComputeMedoid samples up to sampleSize points and returns the one with the
+// smallest average distance to the sample according to the graph index.
+func (s *Shard) ComputeMedoid(sampleSize int) (uuid.UUID, error) {
+	property, params, err := vamanaProperty(s.collection.IndexSchema)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("could not find property to compute medoid: %w", err)
+	}
+	distFn, err := distance.GetFloatDistanceFn(params.DistanceMetric)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("could not compute medoid: %w", err)
+	}
+	// ---------------------------
+	// Reservoir sampling so the sample is uniform over all the points
+	sampleIds := make([]uuid.UUID, 0, sampleSize)
+	sample := make([][]float32, 0, sampleSize)
+	seen := 0
+	var after *uuid.UUID
+	for {
+		points, err := s.readPointBatch(after)
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("could not read points to sample: %w", err)
+		}
+		if len(points) == 0 {
+			break
+		}
+		for _, point := range points {
+			vector, err := pointVector(point.Data, property)
+			if err != nil {
+				return uuid.Nil, fmt.Errorf("could not get vector of %s: %w", point.Id, err)
+			}
+			if vector == nil {
+				continue
+			}
+			if normalizesVectors(params) {
+				distance.Normalize(vector)
+			}
+			seen++
+			if len(sample) < sampleSize {
+				sampleIds = append(sampleIds, point.Id)
+				sample = append(sample, vector)
+			} else if j := rand.Intn(seen); j < sampleSize {
+				sampleIds[j] = point.Id
+				sample[j] = vector
+			}
+		}
+		after = &points[len(points)-1].Id
+	}
+	if len(sample) == 0 {
+		return uuid.Nil, fmt.Errorf("no points with %s to compute medoid", property)
+	}
+	// ---------------------------
+	medoid := 0
+	bestSum := float32(-1)
+	for i, x := range sample {
+		var sum float32
+		for _, y := range sample {
+			sum += distFn(x, y)
+		}
+		if bestSum < 0 || sum < bestSum {
+			medoid = i
+			bestSum = sum
+		}
+	}
+	return sampleIds[medoid], nil
+}
+
+// SetStartPoint moves the start of the graph index searches to the vector of
+// the given point, e.g. the one returned by ComputeMedoid. The point itself is
+// unaffected and can be deleted later like any other point.
+func (s *Shard) SetStartPoint(id uuid.UUID) error {
+	property, _, err := vamanaProperty(s.collection.IndexSchema)
+	if err != nil {
+		return fmt.Errorf("could not find property to set start point: %w", err)
+	}
+	point, found, err := s.GetPoint(id)
+	if err != nil {
+		return fmt.Errorf("could not get point %s: %w", id, err)
+	}
+	if !found {
+		return ErrPointNotFound
+	}
+	vector, err := pointVector(point.Data, property)
+	if err != nil {
+		return fmt.Errorf("could not get vector of %s: %w", id, err)
+	}
+	if vector == nil {
+		return fmt.Errorf("point %s has no %s vector", id, property)
+	}
+	// ---------------------------
+	cacheTx := s.cacheManager.NewTransaction()
+	err = s.db.Write(func(bm diskstore.BucketManager) error {
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+		return im.SetStartVector(property, vector)
+	})
+	cacheTx.Commit(err != nil)
+	if err != nil {
+		return fmt.Errorf("could not set start point: %w", err)
+	}
+	s.logger.Debug().Str("id", id.String()).Msg("SetStartPoint")
+	return nil
+}
+
+// Warm pulls the start node of the graph indexes and its neighbours into
+// memory so the first search after opening the shard does not pay for
+// reading them from disk. It returns the number of nodes loaded.
+func (s *Shard) Warm() (int, error) {
+	cacheTx := s.cacheManager.NewTransaction()
+	var loaded int
+	err := s.db.Read(func(bm diskstore.BucketManager) error {
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+		var err error
+		loaded, err = im.Warm()
+		return err
+	})
+	cacheTx.Commit(err != nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not warm shard: %w", err)
+	}
+	s.logger.Debug().Int("loaded", loaded).Msg("Warm")
+	return loaded, nil
+}
@@ -0,0 +1,197 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/conversion"
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/shard/index"
+	"github.com/semafind/semadb/shard/index/vamana"
+	"github.com/semafind/semadb/utils"
+)
+
+/* Deleting points repairs the graph indexes inline, every remaining node that
+ * pointed to a deleted one is pruned again, which makes deletes expensive under
+ * high churn. A soft delete instead only removes the point id mapping and
+ * leaves a tombstone on the node so the point is gone for gets, updates and
+ * scans but its node stays in the indexes. Searches skip tombstoned nodes like
+ * expired ones and Compact later removes all of them from the indexes in one
+ * batch. The point id is free again right away, inserting it creates a new node
+ * that is unrelated to the tombstone. */
+
+var TOMBSTONECOUNTKEY = []byte("tombstoneCount")
+
+func changeTombstoneCount(bucket diskstore.Bucket, change int) error {
+	var count uint64
+	if countBytes := bucket.Get(TOMBSTONECOUNTKEY); countBytes != nil {
+		count = conversion.BytesToUint64(countBytes)
+	}
+	newCount := int(count) + change
+	if newCount < 0 {
+		return fmt.Errorf("tombstone count cannot be negative")
+	}
+	if err := bucket.Put(TOMBSTONECOUNTKEY, conversion.Uint64ToBytes(uint64(newCount))); err != nil {
+		return fmt.Errorf("could not change tombstone count: %w", err)
+	}
+	return nil
+}
+
+// SoftDeletePoints deletes the points without repairing the graph indexes, see
+// Compact. It returns the ids of the deleted points.
+func (s *Shard) SoftDeletePoints(ctx context.Context, deleteSet map[uuid.UUID]struct{}) ([]uuid.UUID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("could not soft delete points: %w", err)
+	}
+	if s.readOnly {
+		return nil, fmt.Errorf("could not soft delete points: %w", diskstore.ErrReadOnly)
+	}
+	// ---------------------------
+	deletedIds := make([]uuid.UUID, 0, len(deleteSet))
+	err := s.db.Write(func(bm diskstore.BucketManager) error {
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get write points bucket: %w", err)
+		}
+		for pointId := range deleteSet {
+			nodeId, err := GetPointNodeIdByUUID(bPoints, pointId)
+			if errors.Is(err, ErrPointNotFound) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("could not get point %s: %w", pointId, err)
+			}
+			if nodeId == vamana.STARTID {
+				s.logger.Warn().Str("pointId", pointId.String()).Msg("Refusing to delete point mapped to the start node")
+				continue
+			}
+			if err := bPoints.Delete(PointKey(pointId, 'i')); err != nil {
+				return fmt.Errorf("could not delete point id: %w", err)
+			}
+			// The expiry would otherwise have PurgeExpired look for the point
+			if err := bPoints.Delete(conversion.NodeKey(nodeId, 'e')); err != nil {
+				return fmt.Errorf("could not delete point expiry: %w", err)
+			}
+			if err := bPoints.Put(conversion.NodeKey(nodeId, 't'), []byte{1}); err != nil {
+				return fmt.Errorf("could not set tombstone: %w", err)
+			}
+			deletedIds = append(deletedIds, pointId)
+		}
+		// ---------------------------
+		bInternal, err := bm.Get(INTERNALBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get write internal bucket: %w", err)
+		}
+		if err := changePointCount(bInternal, -len(deletedIds)); err != nil {
+			return fmt.Errorf("could not change point count for soft deletion: %w", err)
+		}
+		if err := changeTombstoneCount(bInternal, len(deletedIds)); err != nil {
+			return err
+		}
+		// ---------------------------
+		bChanges, err := bm.Get(CHANGESBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get write changes bucket: %w", err)
+		}
+		if err := recordChanges(bChanges, ChangeDelete, writeTime(ctx), deletedIds...); err != nil {
+			return fmt.Errorf("could not record delete changes: %w", err)
+		}
+		// A reinsert of the id must not find the old payload
+		bPayloads, err := bm.Get(PAYLOADSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get write payloads bucket: %w", err)
+		}
+		if err := deletePayloads(bPayloads, deletedIds...); err != nil {
+			return fmt.Errorf("could not delete payloads: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not soft delete points: %w", err)
+	}
+	s.logger.Debug().Int("deleted", len(deletedIds)).Msg("SoftDeletePoints")
+	return deletedIds, nil
+}
+
+// Compact removes the tombstoned nodes of soft deleted points from the indexes,
+// repairing the graph indexes in one batch. It returns the number of nodes
+// removed.
+func (s *Shard) Compact(ctx context.Context) (int, error) {
+	if s.readOnly {
+		return 0, fmt.Errorf("could not compact: %w", diskstore.ErrReadOnly)
+	}
+	// ---------------------------
+	compacted := 0
+	cacheTx := s.cacheManager.NewTransaction()
+	err := s.db.Write(func(bm diskstore.BucketManager) error {
+		bPoints, err := bm.Get(POINTSBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get write points bucket: %w", err)
+		}
+		nodeIds := make([]uint64, 0)
+		err = bPoints.RangeScan([]byte{'n'}, []byte{'o'}, false, func(k, v []byte) error {
+			if nodeId, ok := conversion.NodeIdFromKey(k, 't'); ok {
+				nodeIds = append(nodeIds, nodeId)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not scan tombstones: %w", err)
+		}
+		if len(nodeIds) == 0 {
+			return nil
+		}
+		// ---------------------------
+		bInternal, err := bm.Get(INTERNALBUCKETKEY)
+		if err != nil {
+			return fmt.Errorf("could not get write internal bucket: %w", err)
+		}
+		nodeCounter, err := NewIdCounter(bInternal, FREENODEIDSKEY, NEXTFREENODEIDKEY)
+		if err != nil {
+			return fmt.Errorf("could not create id counter: %w", err)
+		}
+		// ---------------------------
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		nodesQ := utils.ProduceWithContext(ctx, nodeIds)
+		indexQ, indexQErrC := utils.TransformWithContext(ctx, nodesQ, func(nodeId uint64) (ipc index.IndexPointChange, skip bool, err error) {
+			ipc.NodeId = nodeId
+			ipc.PreviousData = bPoints.Get(conversion.NodeKey(nodeId, 'd'))
+			/* The point id key is not ours to delete, it was removed by the
+			 * soft delete and may since belong to a reinserted point. */
+			for _, suffix := range []byte{'i', 'd', 't'} {
+				if err = bPoints.Delete(conversion.NodeKey(nodeId, suffix)); err != nil {
+					err = fmt.Errorf("could not delete tombstoned node %d: %w", nodeId, err)
+					return
+				}
+			}
+			nodeCounter.FreeId(nodeId)
+			return
+		})
+		im := index.NewIndexManager(bm, cacheTx, s.cacheRoot, s.collection.IndexSchema)
+		dispatchErrC := im.Dispatch(ctx, indexQ)
+		if err := <-utils.MergeErrorsWithContext(ctx, indexQErrC, dispatchErrC); err != nil {
+			// Stop the index workers before the transaction is closed
+			cancel()
+			<-dispatchErrC
+			return fmt.Errorf("could not remove tombstoned nodes: %w", err)
+		}
+		// ---------------------------
+		if err := changeTombstoneCount(bInternal, -len(nodeIds)); err != nil {
+			return err
+		}
+		if err := nodeCounter.Flush(); err != nil {
+			return fmt.Errorf("could not flush id counter: %w", err)
+		}
+		compacted = len(nodeIds)
+		return nil
+	})
+	cacheTx.Commit(err != nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not compact: %w", err)
+	}
+	s.logger.Debug().Int("compacted", compacted).Msg("Compact")
+	return compacted, nil
+}
@@ -0,0 +1,184 @@
+package shard
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/semafind/semadb/distance"
+	"github.com/semafind/semadb/models"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// vectorSizes returns the expected vector size of every vector property in
+// the index schema.
+func vectorSizes(schema models.IndexSchema) map[string]int {
+	sizes := make(map[string]int)
+	for property, params := range schema {
+		switch {
+		case params.Type == models.IndexTypeVectorVamana && params.VectorVamana != nil:
+			sizes[property] = int(params.VectorVamana.VectorSize)
+		case params.Type == models.IndexTypeVectorFlat && params.VectorFlat != nil:
+			sizes[property] = int(params.VectorFlat.VectorSize)
+		}
+	}
+	return sizes
+}
+
+// checkDistanceMetrics rejects vector indexes whose distance metric is not
+// registered, otherwise the shard would only fail once the index is used.
+func checkDistanceMetrics(schema models.IndexSchema) error {
+	for property, params := range schema {
+		var metric string
+		switch {
+		case params.Type == models.IndexTypeVectorVamana && params.VectorVamana != nil:
+			metric = params.VectorVamana.DistanceMetric
+		case params.Type == models.IndexTypeVectorFlat && params.VectorFlat != nil:
+			metric = params.VectorFlat.DistanceMetric
+		default:
+			continue
+		}
+		if !distance.IsKnownMetric(metric) {
+			return fmt.Errorf("unknown distance metric %q for property %s", metric, property)
+		}
+	}
+	return nil
+}
+
+/* checkVectorSizes rejects points with vectors that do not match the size of
+ * their index. The indexes assume every vector has the same size, a mismatched
+ * vector would make the distance functions read out of bounds or compare
+ * partial vectors, corrupting the graph when its edges are pruned. Points
+ * without a vector property, such as partial updates, are not checked. */
+func checkVectorSizes(points []models.Point, schema models.IndexSchema) error {
+	sizes := vectorSizes(schema)
+	if len(sizes) == 0 {
+		return nil
+	}
+	dec := msgpack.NewDecoder(nil)
+	for _, point := range points {
+		if err := checkDataVectorSizes(dec, point, sizes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDataVectorSizes only decodes the lengths of the vector properties of
+// the point, everything else is skipped. Points without data are not checked
+// like the indexes do not index them.
+func checkDataVectorSizes(dec *msgpack.Decoder, point models.Point, sizes map[string]int) error {
+	if len(point.Data) == 0 {
+		return nil
+	}
+	dec.Reset(bytes.NewReader(point.Data))
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return fmt.Errorf("could not decode data of point %s: %w", point.Id, err)
+	}
+	for i := 0; i < n; i++ {
+		key, err := dec.DecodeString()
+		if err != nil {
+			return fmt.Errorf("could not decode data key of point %s: %w", point.Id, err)
+		}
+		size, isVector := sizes[key]
+		if isVector {
+			// Other types are not vectors and are rejected by the index
+			isVector, err = isArrayNext(dec)
+			if err != nil {
+				return fmt.Errorf("could not decode vector %s of point %s: %w", key, point.Id, err)
+			}
+		}
+		if !isVector {
+			if err := dec.Skip(); err != nil {
+				return fmt.Errorf("could not skip data value of point %s: %w", point.Id, err)
+			}
+			continue
+		}
+		length, err := dec.DecodeArrayLen()
+		if err != nil {
+			return fmt.Errorf("could not decode vector %s of point %s: %w", key, point.Id, err)
+		}
+		if length != size {
+			return fmt.Errorf("%w: point %s has vector of size %d for property %s, expected %d", ErrDimMismatch, point.Id, length, key, size)
+		}
+		for j := 0; j < length; j++ {
+			if err := dec.Skip(); err != nil {
+				return fmt.Errorf("could not skip vector %s of point %s: %w", key, point.Id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isArrayNext reports whether the next value of the decoder is an array.
+func isArrayNext(dec *msgpack.Decoder) (bool, error) {
+	c, err := dec.PeekCode()
+	if err != nil {
+		return false, err
+	}
+	return msgpcode.IsFixedArray(c) || c == msgpcode.Array16 || c == msgpcode.Array32, nil
+}
+
+// ---------------------------
+
+// vectorProperties returns the vector properties of the index schema.
+func vectorProperties(schema models.IndexSchema) map[string]struct{} {
+	props := make(map[string]struct{})
+	for property := range vectorSizes(schema) {
+		props[property] = struct{}{}
+	}
+	return props
+}
+
+// dataVectorBytes returns the encoded size of the values of the vector
+// properties in the point data.
+func dataVectorBytes(dec *msgpack.Decoder, data []byte, vectorProps map[string]struct{}) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	dec.Reset(bytes.NewReader(data))
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return 0, fmt.Errorf("could not decode point data: %w", err)
+	}
+	vectorBytes := 0
+	for i := 0; i < n; i++ {
+		key, err := dec.DecodeString()
+		if err != nil {
+			return 0, fmt.Errorf("could not decode point data key: %w", err)
+		}
+		if _, ok := vectorProps[key]; !ok {
+			if err := dec.Skip(); err != nil {
+				return 0, fmt.Errorf("could not skip point data value: %w", err)
+			}
+			continue
+		}
+		raw, err := dec.DecodeRaw()
+		if err != nil {
+			return 0, fmt.Errorf("could not decode vector %s: %w", key, err)
+		}
+		vectorBytes += len(raw)
+	}
+	return vectorBytes, nil
+}
+
+/* checkMetadataSize rejects a point whose metadata, i.e. everything but the
+ * vectors including the payload, exceeds the limit of the collection. Vectors
+ * are bounded by the index schema already, the rest is unbounded otherwise and
+ * a single tenant could fill a shared shard with large blobs. A limit of zero
+ * means unlimited. */
+func checkMetadataSize(dec *msgpack.Decoder, id uuid.UUID, data, payload []byte, vectorProps map[string]struct{}, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+	vectorBytes, err := dataVectorBytes(dec, data, vectorProps)
+	if err != nil {
+		return fmt.Errorf("could not measure metadata of point %s: %w", id, err)
+	}
+	if size := len(data) - vectorBytes + len(payload); size > limit {
+		return fmt.Errorf("point %s has %d bytes of metadata, exceeding the limit of %d", id, size, limit)
+	}
+	return nil
+}
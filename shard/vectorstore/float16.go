@@ -0,0 +1,271 @@
+package vectorstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/semafind/semadb/conversion"
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/distance"
+	"github.com/semafind/semadb/shard/cache"
+)
+
+/* Stores vectors as IEEE 754 half precision floats which halves the memory and
+ * disk footprint of the plain store. Most embedding models tolerate the loss of
+ * precision, half floats keep about 3 significant decimal digits which changes
+ * distances far less than the gaps between neighbours in practice, so recall
+ * drops by well under a percent unlike the lossier binary and product
+ * quantizers. Values beyond the half range of about 65504 become infinity, so
+ * it suits normalised or small magnitude vectors. Distances are computed on the
+ * vectors converted back to float32, that costs some speed over the plain store
+ * in exchange for the memory. */
+type float16Store struct {
+	items  *cache.ItemCache[uint64, float16Point]
+	distFn distance.FloatDistFunc
+	// Scratch vectors for converting stored points back to float32, distance
+	// functions may be called from multiple goroutines.
+	buffers *sync.Pool
+}
+
+func newFloat16Store(bucket diskstore.Bucket, distFn distance.FloatDistFunc, vectorLength int) float16Store {
+	return float16Store{
+		items:  cache.NewItemCache[uint64, float16Point](bucket),
+		distFn: distFn,
+		buffers: &sync.Pool{
+			New: func() any {
+				buf := make([]float32, vectorLength)
+				return &buf
+			},
+		},
+	}
+}
+
+func (fs float16Store) Exists(id uint64) bool {
+	_, err := fs.items.Get(id)
+	return err == nil
+}
+
+func (fs float16Store) Get(id uint64) (VectorStorePoint, error) {
+	return fs.items.Get(id)
+}
+
+func (fs float16Store) GetMany(ids ...uint64) ([]VectorStorePoint, error) {
+	points, err := fs.items.GetMany(ids...)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]VectorStorePoint, len(points))
+	for i, p := range points {
+		ret[i] = p
+	}
+	return ret, nil
+}
+
+func (fs float16Store) ForEach(fn func(VectorStorePoint) error) error {
+	return fs.items.ForEach(func(id uint64, point float16Point) error {
+		return fn(point)
+	})
+}
+
+func (fs float16Store) SizeInMemory() int64 {
+	return fs.items.SizeInMemory()
+}
+
+func (fs float16Store) UpdateBucket(bucket diskstore.Bucket) {
+	fs.items.UpdateBucket(bucket)
+}
+
+func (fs float16Store) Set(id uint64, vector []float32) (VectorStorePoint, error) {
+	point := float16Point{
+		id:     id,
+		Vector: toFloat16s(vector),
+	}
+	fs.items.Put(id, point)
+	return point, nil
+}
+
+func (fs float16Store) Delete(ids ...uint64) error {
+	return fs.items.Delete(ids...)
+}
+
+func (fs float16Store) Fit() error {
+	return nil
+}
+
+func (fs float16Store) DistanceFromFloat(x []float32) PointIdDistFn {
+	return func(y VectorStorePoint) float32 {
+		point, ok := y.(float16Point)
+		if !ok {
+			log.Warn().Uint64("id", y.Id()).Msg("point not found for distance calculation")
+			return math.MaxFloat32
+		}
+		buf := fs.buffers.Get().(*[]float32)
+		defer fs.buffers.Put(buf)
+		return fs.distFn(x, fromFloat16s(*buf, point.Vector))
+	}
+}
+
+func (fs float16Store) DistanceFromPoint(x VectorStorePoint) PointIdDistFn {
+	pointX, okX := x.(float16Point)
+	var vectorX []float32
+	if okX {
+		vectorX = fromFloat16s(make([]float32, len(pointX.Vector)), pointX.Vector)
+	}
+	return func(y VectorStorePoint) float32 {
+		pointY, okY := y.(float16Point)
+		if !okX || !okY {
+			log.Warn().Uint64("idX", x.Id()).Uint64("idY", y.Id()).Msg("point not found for distance calculation")
+			return math.MaxFloat32
+		}
+		buf := fs.buffers.Get().(*[]float32)
+		defer fs.buffers.Put(buf)
+		return fs.distFn(vectorX, fromFloat16s(*buf, pointY.Vector))
+	}
+}
+
+func (fs float16Store) Flush() error {
+	return fs.items.Flush()
+}
+
+// ---------------------------
+
+type float16Point struct {
+	id     uint64
+	Vector []uint16
+}
+
+func (fp float16Point) Id() uint64 {
+	return fp.id
+}
+
+func (fp float16Point) IdFromKey(key []byte) (uint64, bool) {
+	return conversion.NodeIdFromKey(key, 'h')
+}
+
+func (fp float16Point) SizeInMemory() int64 {
+	return int64(8 + 2*len(fp.Vector))
+}
+
+// Always returns false as we don't track dirty state.
+func (fp float16Point) CheckAndClearDirty() bool {
+	return false
+}
+
+func (fp float16Point) ReadFrom(id uint64, bucket diskstore.Bucket) (point float16Point, err error) {
+	point.id = id
+	vectorBytes := bucket.Get(conversion.NodeKey(id, 'h'))
+	if vectorBytes == nil {
+		err = cache.ErrNotFound
+		return
+	}
+	point.Vector = make([]uint16, len(vectorBytes)/2)
+	for i := range point.Vector {
+		point.Vector[i] = binary.LittleEndian.Uint16(vectorBytes[i*2:])
+	}
+	return
+}
+
+func (fp float16Point) WriteTo(id uint64, bucket diskstore.Bucket) error {
+	vectorBytes := make([]byte, 2*len(fp.Vector))
+	for i, h := range fp.Vector {
+		binary.LittleEndian.PutUint16(vectorBytes[i*2:], h)
+	}
+	if err := bucket.Put(conversion.NodeKey(id, 'h'), vectorBytes); err != nil {
+		return fmt.Errorf("could not write float16 point vector: %w", err)
+	}
+	return nil
+}
+
+func (fp float16Point) DeleteFrom(id uint64, bucket diskstore.Bucket) error {
+	if err := bucket.Delete(conversion.NodeKey(id, 'h')); err != nil {
+		return fmt.Errorf("could not delete float16 point vector: %w", err)
+	}
+	return nil
+}
+
+// ---------------------------
+
+func toFloat16s(vector []float32) []uint16 {
+	halves := make([]uint16, len(vector))
+	for i, f := range vector {
+		halves[i] = toFloat16(f)
+	}
+	return halves
+}
+
+// fromFloat16s converts the halves into dst which must be at least as long.
+func fromFloat16s(dst []float32, halves []uint16) []float32 {
+	dst = dst[:len(halves)]
+	for i, h := range halves {
+		dst[i] = fromFloat16(h)
+	}
+	return dst
+}
+
+// toFloat16 converts to the nearest half precision float, ties to even.
+// Values too large for a half become infinity and too small become zero.
+func toFloat16(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int((bits>>23)&0xff) - 127 + 15
+	mant := bits & 0x7fffff
+	// ---------------------------
+	switch {
+	case (bits>>23)&0xff == 0xff:
+		// Infinity stays infinity, NaN stays NaN
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp >= 0x1f:
+		return sign | 0x7c00
+	case exp <= 0:
+		// Subnormal half, the implicit leading bit becomes explicit
+		if exp < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint(14 - exp)
+		half := uint16(mant >> shift)
+		rem := mant & (1<<shift - 1)
+		halfway := uint32(1) << (shift - 1)
+		if rem > halfway || (rem == halfway && half&1 == 1) {
+			half++
+		}
+		return sign | half
+	}
+	// ---------------------------
+	half := sign | uint16(exp<<10) | uint16(mant>>13)
+	// Rounding may carry into the exponent which is still correct, the largest
+	// half rounds up to infinity.
+	rem := mant & 0x1fff
+	if rem > 0x1000 || (rem == 0x1000 && half&1 == 1) {
+		half++
+	}
+	return half
+}
+
+func fromFloat16(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := int((h >> 10) & 0x1f)
+	mant := uint32(h & 0x3ff)
+	switch exp {
+	case 0:
+		if mant == 0 {
+			return math.Float32frombits(sign)
+		}
+		// Normalise the subnormal half
+		exp = 1
+		for mant&0x400 == 0 {
+			mant <<= 1
+			exp--
+		}
+		mant &= 0x3ff
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	}
+	return math.Float32frombits(sign | uint32(exp+127-15)<<23 | mant<<13)
+}
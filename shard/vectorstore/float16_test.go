@@ -0,0 +1,85 @@
+package vectorstore
+
+import (
+	"cmp"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/distance"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_float16Conversion(t *testing.T) {
+	// Exactly representable values survive the round trip
+	for _, f := range []float32{0, 1, -2, 0.5, 0.333251953125, 65504, -65504, 6.1035156e-05, 5.9604645e-08} {
+		require.Equal(t, f, fromFloat16(toFloat16(f)), "%v", f)
+	}
+	require.Equal(t, uint16(0x3c00), toFloat16(1))
+	// Out of range values saturate to infinity or flush to zero
+	require.True(t, math.IsInf(float64(fromFloat16(toFloat16(70000))), 1))
+	require.True(t, math.IsInf(float64(fromFloat16(toFloat16(-70000))), -1))
+	require.Equal(t, float32(0), fromFloat16(toFloat16(1e-10)))
+	require.True(t, math.IsNaN(float64(fromFloat16(toFloat16(float32(math.NaN()))))))
+	// Ties round to even, 1 + 2^-11 is halfway between 1 and the next half
+	require.Equal(t, uint16(0x3c00), toFloat16(1+1.0/2048))
+	require.Equal(t, uint16(0x3c02), toFloat16(1+3.0/2048))
+	// ---------------------------
+	// Otherwise the relative error is at most half a unit in the last place
+	for i := 0; i < 10000; i++ {
+		f := (rand.Float32()*2 - 1) * 1000
+		got := fromFloat16(toFloat16(f))
+		require.InEpsilon(t, f, got, 1.0/2048+1e-7)
+	}
+}
+
+/* Compares exact nearest neighbours computed on float16 vectors to those on
+ * float32 vectors. Normalised embedding like vectors lose well under a percent
+ * of recall at 10. */
+func Test_float16Recall(t *testing.T) {
+	const size, dims, queries, k = 5000, 64, 50, 10
+	distFn, err := distance.GetFloatDistanceFn("euclidean")
+	require.NoError(t, err)
+	fs := newFloat16Store(diskstore.NewMemBucket(false), distFn, dims)
+	vectors := make([][]float32, size)
+	points := make([]VectorStorePoint, size)
+	for i := range vectors {
+		vectors[i] = make([]float32, dims)
+		for j := range vectors[i] {
+			vectors[i][j] = float32(rand.NormFloat64())
+		}
+		distance.Normalize(vectors[i])
+		points[i], err = fs.Set(uint64(i+1), vectors[i])
+		require.NoError(t, err)
+	}
+	topK := func(dist func(i int) float32) []int {
+		ids := make([]int, size)
+		for i := range ids {
+			ids[i] = i
+		}
+		dists := make([]float32, size)
+		for i := range dists {
+			dists[i] = dist(i)
+		}
+		slices.SortFunc(ids, func(a, b int) int {
+			return cmp.Compare(dists[a], dists[b])
+		})
+		return ids[:k]
+	}
+	found := 0
+	for q := 0; q < queries; q++ {
+		query := vectors[rand.Intn(size)]
+		want := topK(func(i int) float32 { return distFn(query, vectors[i]) })
+		halfDistFn := fs.DistanceFromFloat(query)
+		got := topK(func(i int) float32 { return halfDistFn(points[i]) })
+		for _, id := range got {
+			if slices.Contains(want, id) {
+				found++
+			}
+		}
+	}
+	recall := float32(found) / float32(queries*k)
+	require.GreaterOrEqual(t, recall, float32(0.99))
+}
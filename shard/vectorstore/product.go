@@ -3,6 +3,8 @@ package vectorstore
 import (
 	"fmt"
 	"math"
+	"math/rand"
+	"runtime"
 	"sync"
 
 	"github.com/rs/zerolog/log"
@@ -16,6 +18,11 @@ import (
 
 const productQuantizerCentroidDistsKey = "_productQuantizerCentroidDists"
 const productQuantizerFlatCentroidsKey = "_productQuantizerFlatCentroids"
+const productQuantizerDriftKey = "_productQuantizerDrift"
+
+// Minimum number of points inserted since the last training before we decide
+// whether the data has drifted
+const productQuantizerDriftMinSamples = 100
 
 /* Product Quantization is a technique to quantize high-dimensional vectors into
  * a low-memory usage representation. The original vector is divided up to m
@@ -36,6 +43,12 @@ type productQuantizer struct {
 	centroidDists []float32 // shape (num_subvectors * num_centroids * num_centroids)
 	flatCentroids []float32 // shape (num_subvectors* num_centroids * subvector_len)
 	// ---------------------------
+	// Drift tracking, see checkDrift
+	driftMu        sync.Mutex
+	trainError     float32
+	recentErrorSum float32
+	recentCount    int
+	// ---------------------------
 	bucket diskstore.Bucket
 }
 
@@ -84,14 +97,18 @@ func newProductQuantizer(bucket diskstore.Bucket, distFnName string, params mode
 	if buff := bucket.Get([]byte(productQuantizerFlatCentroidsKey)); buff != nil {
 		pq.flatCentroids = conversion.BytesToFloat32(buff)
 	}
+	if buff := bucket.Get([]byte(productQuantizerDriftKey)); buff != nil {
+		drift := conversion.BytesToFloat32(buff)
+		pq.trainError, pq.recentErrorSum, pq.recentCount = drift[0], drift[1], int(drift[2])
+	}
 	return pq, nil
 }
 
-func (pq productQuantizer) centroidDistIdx(subvector, centroidX, centroidY int) int {
+func (pq *productQuantizer) centroidDistIdx(subvector, centroidX, centroidY int) int {
 	return subvector*pq.params.NumCentroids*pq.params.NumCentroids + centroidX*pq.params.NumCentroids + centroidY
 }
 
-func (pq productQuantizer) flatCentroidSlice(subvector, centroid int) (start, end int) {
+func (pq *productQuantizer) flatCentroidSlice(subvector, centroid int) (start, end int) {
 	start = subvector*pq.params.NumCentroids*pq.subVectorLen + centroid*pq.subVectorLen
 	end = start + pq.subVectorLen
 	return
@@ -133,7 +150,7 @@ func (pq *productQuantizer) UpdateBucket(bucket diskstore.Bucket) {
 	pq.bucket = bucket
 }
 
-func (pq productQuantizer) encode(vector []float32) []uint8 {
+func (pq *productQuantizer) encode(vector []float32) []uint8 {
 	if len(pq.flatCentroids) == 0 {
 		return nil
 	}
@@ -158,6 +175,28 @@ func (pq productQuantizer) encode(vector []float32) []uint8 {
 	return encoded
 }
 
+// quantizationError is the squared euclidean distance between the vector and
+// its reconstruction from the centroids.
+func (pq *productQuantizer) quantizationError(vector []float32, centroidIds []uint8) float32 {
+	var qErr float32
+	for i, centroidId := range centroidIds {
+		start, end := pq.flatCentroidSlice(i, int(centroidId))
+		for j, c := range pq.flatCentroids[start:end] {
+			diff := vector[i*pq.subVectorLen+j] - c
+			qErr += diff * diff
+		}
+	}
+	return qErr
+}
+
+func (pq *productQuantizer) meanQuantizationError(vectors [][]float32, centroidIds [][]uint8) float32 {
+	var sum float32
+	for i, vector := range vectors {
+		sum += pq.quantizationError(vector, centroidIds[i])
+	}
+	return sum / float32(len(vectors))
+}
+
 func (pq *productQuantizer) Set(id uint64, vector []float32) (VectorStorePoint, error) {
 	point := &productQuantizedPoint{
 		id:          id,
@@ -165,6 +204,13 @@ func (pq *productQuantizer) Set(id uint64, vector []float32) (VectorStorePoint,
 		CentroidIds: pq.encode(vector),
 	}
 	pq.items.Put(id, point)
+	if point.CentroidIds != nil && pq.params.RetrainDriftThreshold > 0 {
+		qErr := pq.quantizationError(vector, point.CentroidIds)
+		pq.driftMu.Lock()
+		pq.recentErrorSum += qErr
+		pq.recentCount++
+		pq.driftMu.Unlock()
+	}
 	return point, nil
 }
 
@@ -172,9 +218,39 @@ func (pq *productQuantizer) Delete(ids ...uint64) error {
 	return pq.items.Delete(ids...)
 }
 
+/* As the data distribution shifts, the codebook trained on the earlier points
+ * represents the new points poorly which degrades recall. We compare the
+ * average quantization error of the points inserted since the last training to
+ * the error of the training points, a large increase means the data has
+ * drifted and we retrain the codebook on all the points. */
+func (pq *productQuantizer) checkDrift() bool {
+	if pq.params.RetrainDriftThreshold <= 0 || pq.trainError == 0 {
+		return false
+	}
+	pq.driftMu.Lock()
+	defer pq.driftMu.Unlock()
+	if pq.recentCount < productQuantizerDriftMinSamples {
+		return false
+	}
+	return pq.recentErrorSum/float32(pq.recentCount) > pq.params.RetrainDriftThreshold*pq.trainError
+}
+
+// resetDrift records the error of a new codebook and clears the recent errors.
+func (pq *productQuantizer) resetDrift(trainError float32) {
+	pq.driftMu.Lock()
+	defer pq.driftMu.Unlock()
+	pq.trainError = trainError
+	pq.recentErrorSum = 0
+	pq.recentCount = 0
+}
+
 func (pq *productQuantizer) Fit() error {
 	// Have we already optimised?
 	if len(pq.flatCentroids) != 0 {
+		if pq.checkDrift() {
+			log.Debug().Float32("trainError", pq.trainError).Int("recentCount", pq.recentCount).Msg("product quantizer drift detected, retraining")
+			return pq.Train(0)
+		}
 		return nil
 	}
 	itemCount := pq.items.Count()
@@ -196,6 +272,72 @@ func (pq *productQuantizer) Fit() error {
 		return fmt.Errorf("could not collect vectors for kmeans: %w", err)
 	}
 	// ---------------------------
+	labels := pq.trainCodebook(allVectors)
+	allCentroidIds := make([][]uint8, len(allPoints))
+	for j := 0; j < len(allPoints); j++ {
+		for i := 0; i < pq.params.NumSubVectors; i++ {
+			allPoints[j].CentroidIds[i] = labels[i][j]
+		}
+		allCentroidIds[j] = allPoints[j].CentroidIds
+	}
+	pq.resetDrift(pq.meanQuantizationError(allVectors, allCentroidIds))
+	// ---------------------------
+	return nil
+}
+
+/* Train (re)trains the codebook from a random sample of the stored vectors and
+ * re-encodes every point with it. Unlike Fit, this works after the quantizer
+ * has been fitted because the full vectors are kept on disk alongside the
+ * codes. A sample size of 0 or larger than the number of points uses every
+ * point. */
+func (pq *productQuantizer) Train(sampleSize int) error {
+	allVectors := make([][]float32, 0, pq.items.Count())
+	allPoints := make([]*productQuantizedPoint, 0, pq.items.Count())
+	err := pq.items.ForEach(func(id uint64, point *productQuantizedPoint) error {
+		vector := point.Vector
+		if len(vector) == 0 {
+			// Encoded points are loaded without their full vector
+			fullVecBytes := pq.bucket.Get(conversion.NodeKey(id, 'v'))
+			if fullVecBytes == nil {
+				return fmt.Errorf("full vector not found for point %d", id)
+			}
+			vector = conversion.BytesToFloat32(fullVecBytes)
+		}
+		allVectors = append(allVectors, vector)
+		allPoints = append(allPoints, point)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not collect vectors for training: %w", err)
+	}
+	// ---------------------------
+	sample := allVectors
+	if sampleSize > 0 && sampleSize < len(allVectors) {
+		sample = make([][]float32, sampleSize)
+		for i, j := range rand.Perm(len(allVectors))[:sampleSize] {
+			sample[i] = allVectors[j]
+		}
+	}
+	if len(sample) == 0 {
+		return fmt.Errorf("no vectors to train on")
+	}
+	pq.trainCodebook(sample)
+	// ---------------------------
+	allCentroidIds := make([][]uint8, len(allPoints))
+	for i, point := range allPoints {
+		point.CentroidIds = pq.encode(allVectors[i])
+		point.isDirty = true
+		allCentroidIds[i] = point.CentroidIds
+	}
+	pq.resetDrift(pq.meanQuantizationError(allVectors, allCentroidIds))
+	return nil
+}
+
+// trainCodebook runs kmeans on each subvector of the given vectors to compute
+// the centroids. It returns the centroid labels of the vectors for each
+// subvector.
+func (pq *productQuantizer) trainCodebook(vectors [][]float32) [][]uint8 {
+	labels := make([][]uint8, pq.params.NumSubVectors)
 	pq.flatCentroids = make([]float32, pq.params.NumSubVectors*pq.params.NumCentroids*pq.subVectorLen)
 	pq.centroidDists = make([]float32, pq.params.NumSubVectors*pq.params.NumCentroids*pq.params.NumCentroids)
 	var wg sync.WaitGroup
@@ -210,12 +352,10 @@ func (pq *productQuantizer) Fit() error {
 				Offset:    i * pq.subVectorLen,
 				VectorLen: pq.subVectorLen,
 			}
-			kmeans.Fit(allVectors)
-			// Update encoded vectors, direct access from this go routine should
-			// be safe because we only access our offset / subvector.
-			for j := 0; j < len(allPoints); j++ {
-				allPoints[j].CentroidIds[i] = kmeans.Labels[j]
-			}
+			kmeans.Fit(vectors)
+			// Direct access from this go routine should be safe because we
+			// only access our offset / subvector.
+			labels[i] = kmeans.Labels
 			// Update the flat centroids
 			for j := 0; j < pq.params.NumCentroids; j++ {
 				start, end := pq.flatCentroidSlice(i, j)
@@ -231,8 +371,7 @@ func (pq *productQuantizer) Fit() error {
 		}(i)
 	}
 	wg.Wait()
-	// ---------------------------
-	return nil
+	return labels
 }
 
 func (pq *productQuantizer) DistanceFromFloat(x []float32) PointIdDistFn {
@@ -253,6 +392,13 @@ func (pq *productQuantizer) DistanceFromFloat(x []float32) PointIdDistFn {
 	 * vector and the centroid. We do this by computing all centroid distances in
 	 * advance and performing lookups after. */
 	dists := make([]float32, pq.params.NumSubVectors*pq.params.NumCentroids)
+	pq.queryTable(x, dists)
+	return pq.tableDistFn(dists)
+}
+
+// queryTable fills in the distances of each subvector of the query to each
+// centroid of that subvector.
+func (pq *productQuantizer) queryTable(x []float32, dists []float32) {
 	for i := 0; i < pq.params.NumSubVectors; i++ {
 		subvector := x[i*pq.subVectorLen : (i+1)*pq.subVectorLen]
 		for j := 0; j < pq.params.NumCentroids; j++ {
@@ -261,7 +407,9 @@ func (pq *productQuantizer) DistanceFromFloat(x []float32) PointIdDistFn {
 			dists[i*pq.params.NumCentroids+j] = pq.distFn(subvector, centroid)
 		}
 	}
-	// ---------------------------
+}
+
+func (pq *productQuantizer) tableDistFn(dists []float32) PointIdDistFn {
 	return func(y VectorStorePoint) float32 {
 		pointY, ok := y.(*productQuantizedPoint)
 		if !ok {
@@ -276,6 +424,38 @@ func (pq *productQuantizer) DistanceFromFloat(x []float32) PointIdDistFn {
 	}
 }
 
+/* DistancesFromFloats builds the lookup tables of a batch of queries in one
+ * go. The tables are carved out of a single allocation and built in parallel
+ * across the queries, each table is computed exactly as in DistanceFromFloat
+ * so the distances are identical. */
+func (pq *productQuantizer) DistancesFromFloats(xs [][]float32) []PointIdDistFn {
+	distFns := make([]PointIdDistFn, len(xs))
+	if len(pq.flatCentroids) == 0 {
+		for i, x := range xs {
+			distFns[i] = pq.DistanceFromFloat(x)
+		}
+		return distFns
+	}
+	// ---------------------------
+	tableSize := pq.params.NumSubVectors * pq.params.NumCentroids
+	tables := make([]float32, len(xs)*tableSize)
+	workers := min(runtime.NumCPU(), len(xs))
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(xs); i += workers {
+				dists := tables[i*tableSize : (i+1)*tableSize]
+				pq.queryTable(xs[i], dists)
+				distFns[i] = pq.tableDistFn(dists)
+			}
+		}(w)
+	}
+	wg.Wait()
+	return distFns
+}
+
 func (pq *productQuantizer) DistanceFromPoint(x VectorStorePoint) PointIdDistFn {
 	pointX, okX := x.(*productQuantizedPoint)
 	if len(pq.flatCentroids) == 0 {
@@ -315,6 +495,12 @@ func (pq *productQuantizer) Flush() error {
 		if err := pq.bucket.Put([]byte(productQuantizerFlatCentroidsKey), conversion.Float32ToBytes(pq.flatCentroids)); err != nil {
 			return err
 		}
+		pq.driftMu.Lock()
+		drift := []float32{pq.trainError, pq.recentErrorSum, float32(pq.recentCount)}
+		pq.driftMu.Unlock()
+		if err := pq.bucket.Put([]byte(productQuantizerDriftKey), conversion.Float32ToBytes(drift)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,176 @@
+package vectorstore
+
+import (
+	"cmp"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/semafind/semadb/diskstore"
+	"github.com/semafind/semadb/distance"
+	"github.com/semafind/semadb/models"
+	"github.com/stretchr/testify/require"
+)
+
+func randVectors(n int, offset float32) [][]float32 {
+	vectors := make([][]float32, n)
+	for i := range vectors {
+		vectors[i] = []float32{offset + rand.Float32(), offset + rand.Float32(), offset + rand.Float32(), offset + rand.Float32()}
+	}
+	return vectors
+}
+
+// quantizedRecall is the average fraction of the exact k nearest vectors that
+// the quantized distances also rank in the top k.
+func quantizedRecall(t *testing.T, pq *productQuantizer, vectors, queries [][]float32, k int) float32 {
+	t.Helper()
+	distFn, err := distance.GetFloatDistanceFn(models.DistanceEuclidean)
+	require.NoError(t, err)
+	var recall float32
+	for _, query := range queries {
+		ids := make([]uint64, len(vectors))
+		for i := range ids {
+			ids[i] = uint64(i + 1)
+		}
+		slices.SortFunc(ids, func(a, b uint64) int {
+			return cmp.Compare(distFn(query, vectors[a-1]), distFn(query, vectors[b-1]))
+		})
+		exact := slices.Clone(ids[:k])
+		// ---------------------------
+		qDistFn := pq.DistanceFromFloat(query)
+		// Sorting fresh ids so ties are not broken in the exact order
+		qIds := make([]uint64, len(vectors))
+		qDists := make(map[uint64]float32, len(qIds))
+		for i := range qIds {
+			id := uint64(i + 1)
+			qIds[i] = id
+			point, err := pq.Get(id)
+			require.NoError(t, err)
+			qDists[id] = qDistFn(point)
+		}
+		slices.SortStableFunc(qIds, func(a, b uint64) int {
+			return cmp.Compare(qDists[a], qDists[b])
+		})
+		for _, id := range qIds[:k] {
+			if slices.Contains(exact, id) {
+				recall++
+			}
+		}
+	}
+	return recall / float32(len(queries)*k)
+}
+
+func Test_ProductDrift(t *testing.T) {
+	params := models.ProductQuantizerParameters{
+		NumCentroids:          16,
+		NumSubVectors:         2,
+		TriggerThreshold:      200,
+		RetrainDriftThreshold: 2,
+	}
+	pq, err := newProductQuantizer(diskstore.NewMemBucket(false), models.DistanceEuclidean, params, 4)
+	require.NoError(t, err)
+	vectors := randVectors(200, 0)
+	for i, v := range vectors {
+		_, err := pq.Set(uint64(i+1), v)
+		require.NoError(t, err)
+	}
+	require.NoError(t, pq.Fit())
+	require.Greater(t, pq.trainError, float32(0))
+	baseline := quantizedRecall(t, pq, vectors, vectors[:20], 10)
+	// ---------------------------
+	// Points from the same distribution do not drift
+	for i, v := range randVectors(100, 0) {
+		_, err := pq.Set(uint64(len(vectors)+i+1), v)
+		require.NoError(t, err)
+		require.NoError(t, pq.Delete(uint64(len(vectors)+i+1)))
+	}
+	require.False(t, pq.checkDrift())
+	pq.resetDrift(pq.trainError)
+	// ---------------------------
+	// A shifted batch is quantized poorly by the stale codebook
+	shifted := randVectors(200, 5)
+	for i, v := range shifted {
+		_, err := pq.Set(uint64(len(vectors)+i+1), v)
+		require.NoError(t, err)
+	}
+	vectors = append(vectors, shifted...)
+	require.True(t, pq.checkDrift())
+	staleRecall := quantizedRecall(t, pq, vectors, shifted[:20], 10)
+	require.Less(t, staleRecall, baseline)
+	// ---------------------------
+	// Fit retrains which brings the recall back up
+	require.NoError(t, pq.Fit())
+	require.False(t, pq.checkDrift())
+	require.Equal(t, 0, pq.recentCount)
+	retrainedRecall := quantizedRecall(t, pq, vectors, shifted[:20], 10)
+	require.Greater(t, retrainedRecall, staleRecall)
+	// ---------------------------
+	// Drift statistics survive a reload
+	require.NoError(t, pq.Flush())
+	reloaded, err := newProductQuantizer(pq.bucket, models.DistanceEuclidean, params, 4)
+	require.NoError(t, err)
+	require.Equal(t, pq.trainError, reloaded.trainError)
+}
+
+func fittedProductQuantizer(t testing.TB, vectorLen int) *productQuantizer {
+	params := models.ProductQuantizerParameters{
+		NumCentroids:     256,
+		NumSubVectors:    8,
+		TriggerThreshold: 1000,
+	}
+	pq, err := newProductQuantizer(diskstore.NewMemBucket(false), models.DistanceEuclidean, params, vectorLen)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		vector := make([]float32, vectorLen)
+		for j := range vector {
+			vector[j] = rand.Float32()
+		}
+		_, err := pq.Set(uint64(i+1), vector)
+		require.NoError(t, err)
+	}
+	require.NoError(t, pq.Fit())
+	return pq
+}
+
+func randQueries(n, vectorLen int) [][]float32 {
+	queries := make([][]float32, n)
+	for i := range queries {
+		queries[i] = make([]float32, vectorLen)
+		for j := range queries[i] {
+			queries[i][j] = rand.Float32()
+		}
+	}
+	return queries
+}
+
+func Test_ProductDistancesFromFloats(t *testing.T) {
+	pq := fittedProductQuantizer(t, 32)
+	queries := randQueries(50, 32)
+	distFns := pq.DistancesFromFloats(queries)
+	require.Len(t, distFns, len(queries))
+	for i, query := range queries {
+		distFn := pq.DistanceFromFloat(query)
+		for _, id := range []uint64{1, 42, 1000} {
+			point, err := pq.Get(id)
+			require.NoError(t, err)
+			require.Equal(t, distFn(point), distFns[i](point))
+		}
+	}
+}
+
+func BenchmarkProductQueryTables(b *testing.B) {
+	pq := fittedProductQuantizer(b, 128)
+	queries := randQueries(256, 128)
+	b.Run("PerQuery", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, query := range queries {
+				pq.DistanceFromFloat(query)
+			}
+		}
+	})
+	b.Run("Batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			pq.DistancesFromFloats(queries)
+		}
+	})
+}
@@ -15,6 +15,7 @@ var storeTypes = []*models.Quantizer{
 	{Type: models.QuantizerNone},
 	{Type: models.QuantizerBinary, Binary: &models.BinaryQuantizerParamaters{Threshold: nil, TriggerThreshold: 5, DistanceMetric: models.DistanceHamming}},
 	{Type: models.QuantizerProduct, Product: &models.ProductQuantizerParameters{NumCentroids: 256, NumSubVectors: 2, TriggerThreshold: 5}},
+	{Type: models.QuantizerFloat16},
 }
 
 func checkBucketIsEmpty(t *testing.T, bucket diskstore.Bucket, empty bool) {
@@ -152,3 +153,30 @@ func Test_DistanceFromPoint(t *testing.T) {
 		}
 	}
 }
+
+func Test_ProductTrain(t *testing.T) {
+	bucket := diskstore.NewMemBucket(false)
+	s := setupVectorStore(t, storeTypes[2], bucket)
+	triggerFit(t, s)
+	require.NoError(t, s.Flush())
+	// ---------------------------
+	// A fresh store only loads the codes, training has to use the full vectors
+	s = setupVectorStore(t, storeTypes[2], bucket)
+	ts, ok := s.(vectorstore.TrainableVectorStore)
+	require.True(t, ok)
+	require.NoError(t, ts.Train(3))
+	// Training on every point should keep the nearest point nearest
+	require.NoError(t, ts.Train(0))
+	require.NoError(t, s.Flush())
+	// ---------------------------
+	s = setupVectorStore(t, storeTypes[2], bucket)
+	distFn := s.DistanceFromFloat([]float32{1, 2, 3, 4})
+	pointA, err := s.Get(1)
+	require.NoError(t, err)
+	pointB, err := s.Get(4)
+	require.NoError(t, err)
+	require.Less(t, distFn(pointA), distFn(pointB))
+	// The plain store has nothing to train
+	_, ok = setupVectorStore(t, storeTypes[0], bucket).(vectorstore.TrainableVectorStore)
+	require.False(t, ok)
+}
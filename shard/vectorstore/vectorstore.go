@@ -42,6 +42,32 @@ type VectorStore interface {
 	Flush() error
 }
 
+// A vector store that learns from the data, such as a quantizer, may also
+// support being retrained on demand from a sample of the stored vectors.
+type TrainableVectorStore interface {
+	Train(sampleSize int) error
+}
+
+// A vector store that preprocesses queries, such as building the lookup table
+// of a quantizer, may do so for a batch of queries at once which amortises the
+// cost across the batch.
+type BatchDistanceVectorStore interface {
+	DistancesFromFloats(xs [][]float32) []PointIdDistFn
+}
+
+// DistancesFromFloats returns the distance functions of the given queries in
+// order, using the batched path of the vector store if it has one.
+func DistancesFromFloats(vs VectorStore, xs [][]float32) []PointIdDistFn {
+	if bvs, ok := vs.(BatchDistanceVectorStore); ok {
+		return bvs.DistancesFromFloats(xs)
+	}
+	distFns := make([]PointIdDistFn, len(xs))
+	for i, x := range xs {
+		distFns[i] = vs.DistanceFromFloat(x)
+	}
+	return distFns
+}
+
 // ---------------------------
 
 func New(params *models.Quantizer, bucket diskstore.Bucket, distFnName string, vectorLength int) (VectorStore, error) {
@@ -91,6 +117,8 @@ func New(params *models.Quantizer, bucket diskstore.Bucket, distFnName string, v
 			return nil, fmt.Errorf("product quantizer parameters are nil")
 		}
 		return newProductQuantizer(bucket, distFnName, *params.Product, vectorLength)
+	case models.QuantizerFloat16:
+		return newFloat16Store(bucket, distFn, vectorLength), nil
 	}
 	return nil, fmt.Errorf("unknown vector store type %T", params.Type)
 }
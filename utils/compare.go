@@ -2,6 +2,7 @@ package utils
 
 import (
 	"cmp"
+	"container/heap"
 	"reflect"
 	"slices"
 
@@ -33,11 +34,12 @@ func CompareAny(a, b any) int {
 	return 0
 }
 
-// Attemps to sort search results by the given properties.
-func SortSearchResults(results []models.SearchResult, sortOpts []models.SortOption) {
+// CompareSearchResults returns the comparison function that orders search
+// results by the given properties.
+func CompareSearchResults(sortOpts []models.SortOption) func(a, b models.SearchResult) int {
 	/* Because we don't know the type of the values, this may be a costly
 	 * operation to undertake. We should monitor how this performs. */
-	slices.SortFunc(results, func(a, b models.SearchResult) int {
+	return func(a, b models.SearchResult) int {
 		for _, s := range sortOpts {
 			// E.g. s = "age"
 			av, aok := a.DecodedData[s.Property]
@@ -66,5 +68,77 @@ func SortSearchResults(results []models.SearchResult, sortOpts []models.SortOpti
 			}
 		}
 		return 0
-	})
+	}
+}
+
+// Attemps to sort search results by the given properties.
+func SortSearchResults(results []models.SearchResult, sortOpts []models.SortOption) {
+	slices.SortFunc(results, CompareSearchResults(sortOpts))
+}
+
+// CompareHybridScore orders search results by descending hybrid score.
+func CompareHybridScore(a, b models.SearchResult) int {
+	return cmp.Compare(b.HybridScore, a.HybridScore)
+}
+
+// ---------------------------
+
+/* Merging the results of many shards by sorting all of them costs O(n log n)
+ * over every result whereas each shard already returns its results in order.
+ * The k-way merge below keeps a heap of the next result of each shard and pops
+ * the best one until it has k results, which only touches O(k) results and
+ * holds one entry per shard on top of the output. */
+
+type mergeHead struct {
+	list  []models.SearchResult
+	index int
+}
+
+type mergeHeap struct {
+	heads   []mergeHead
+	compare func(a, b models.SearchResult) int
+}
+
+func (h *mergeHeap) Len() int { return len(h.heads) }
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.heads[i], h.heads[j]
+	return h.compare(a.list[a.index], b.list[b.index]) < 0
+}
+func (h *mergeHeap) Swap(i, j int) { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+func (h *mergeHeap) Push(x any)    { h.heads = append(h.heads, x.(mergeHead)) }
+func (h *mergeHeap) Pop() any {
+	last := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return last
+}
+
+// MergeSearchResults merges the lists of search results, each ordered by the
+// comparison function, and returns the first k results of the merged order. A
+// list that is not in order is sorted first.
+func MergeSearchResults(lists [][]models.SearchResult, k int, compare func(a, b models.SearchResult) int) []models.SearchResult {
+	h := &mergeHeap{heads: make([]mergeHead, 0, len(lists)), compare: compare}
+	total := 0
+	for _, list := range lists {
+		if len(list) == 0 {
+			continue
+		}
+		if !slices.IsSortedFunc(list, compare) {
+			slices.SortFunc(list, compare)
+		}
+		h.heads = append(h.heads, mergeHead{list: list})
+		total += len(list)
+	}
+	heap.Init(h)
+	merged := make([]models.SearchResult, 0, min(k, total))
+	for len(merged) < k && h.Len() > 0 {
+		head := &h.heads[0]
+		merged = append(merged, head.list[head.index])
+		head.index++
+		if head.index == len(head.list) {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return merged
 }
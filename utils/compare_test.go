@@ -1,6 +1,8 @@
 package utils_test
 
 import (
+	"math/rand"
+	"slices"
 	"testing"
 
 	"github.com/semafind/semadb/models"
@@ -149,3 +151,60 @@ func Test_SortSearchResults(t *testing.T) {
 		})
 	}
 }
+
+func sortedShardResults(shardCount, size int) [][]models.SearchResult {
+	lists := make([][]models.SearchResult, shardCount)
+	for i := range lists {
+		lists[i] = make([]models.SearchResult, size)
+		for j := range lists[i] {
+			lists[i][j] = models.SearchResult{
+				NodeId:      uint64(i*size + j),
+				HybridScore: rand.Float32(),
+			}
+		}
+		slices.SortFunc(lists[i], utils.CompareHybridScore)
+	}
+	return lists
+}
+
+func Test_MergeSearchResults(t *testing.T) {
+	lists := sortedShardResults(5, 10)
+	lists = append(lists, nil)
+	// One list out of order is sorted before merging
+	slices.Reverse(lists[0])
+	all := make([]models.SearchResult, 0, 50)
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+	slices.SortFunc(all, utils.CompareHybridScore)
+	for _, k := range []int{0, 1, 7, 50, 100} {
+		merged := utils.MergeSearchResults(lists, k, utils.CompareHybridScore)
+		require.Equal(t, all[:min(k, len(all))], merged)
+	}
+	// ---------------------------
+	sortOpts := []models.SortOption{{Property: "age"}}
+	a := []models.SearchResult{{NodeId: 1, DecodedData: map[string]any{"age": 1}}, {NodeId: 3, DecodedData: map[string]any{"age": 3}}}
+	b := []models.SearchResult{{NodeId: 2, DecodedData: map[string]any{"age": 2}}}
+	merged := utils.MergeSearchResults([][]models.SearchResult{a, b}, 3, utils.CompareSearchResults(sortOpts))
+	require.Equal(t, []uint64{1, 2, 3}, []uint64{merged[0].NodeId, merged[1].NodeId, merged[2].NodeId})
+}
+
+func BenchmarkMergeSearchResults(b *testing.B) {
+	const shardCount, limit = 50, 75
+	lists := sortedShardResults(shardCount, limit)
+	b.Run("heap", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			utils.MergeSearchResults(lists, limit, utils.CompareHybridScore)
+		}
+	})
+	b.Run("sortAll", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			all := make([]models.SearchResult, 0, shardCount*limit)
+			for _, list := range lists {
+				all = append(all, list...)
+			}
+			slices.SortFunc(all, utils.CompareHybridScore)
+			_ = all[:limit]
+		}
+	})
+}
@@ -157,13 +157,21 @@ func MergeWithContext[T any](ctx context.Context, cs ...<-chan T) <-chan T {
 func MergeErrorsWithContext(ctx context.Context, cs ...<-chan error) <-chan error {
 	errC := make(chan error, 1)
 	var wg sync.WaitGroup
-	ctx, cancel := context.WithCancelCause(ctx)
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(parent)
 	wg.Add(len(cs))
 	for _, c := range cs {
 		go func(c <-chan error) {
 			select {
 			case <-ctx.Done():
 				cancel(ctx.Err())
+				/* If the parent context is done the producers are stopping
+				 * as well, so we wait for them instead of returning while they
+				 * may still be using, for example, a transaction the caller is
+				 * about to close. */
+				if parent.Err() != nil {
+					<-c
+				}
 			case err := <-c:
 				if err != nil {
 					cancel(err)
@@ -174,7 +182,9 @@ func MergeErrorsWithContext(ctx context.Context, cs ...<-chan error) <-chan erro
 	}
 	go func() {
 		wg.Wait()
-		errC <- context.Cause(ctx)
+		err := context.Cause(ctx)
+		cancel(nil)
+		errC <- err
 		close(errC)
 	}()
 	return errC